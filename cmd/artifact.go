@@ -0,0 +1,79 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+func runArtifactDownload(args []string) int {
+	var (
+		cf     clientFlags
+		taskID int64
+		format string
+		output string
+	)
+	fs := newFlagSet("artifact download", &cf)
+	fs.Int64Var(&taskID, "task", 0, "ID of the succeeded task")
+	fs.StringVar(&format, "format", "", "only download artifact in given format, e.g. zip")
+	fs.StringVar(&output, "output", ".", "directory to save artifacts")
+	if _, err := parseArgs(fs, args); err != nil {
+		return parseExitCode(err)
+	} else if taskID <= 0 {
+		return failUsage(fs, "--task is required")
+	}
+
+	c, err := cf.newClient(false)
+	if err != nil {
+		return failUsage(fs, "%v", err)
+	}
+
+	artifacts, err := c.TaskArtifacts(taskID)
+	if err != nil {
+		return fail("Fail to list artifacts: %v", err)
+	}
+
+	if err = os.MkdirAll(output, os.ModePerm); err != nil {
+		return fail("Fail to create output directory: %v", err)
+	}
+	downloaded := 0
+	for _, a := range artifacts {
+		if len(format) > 0 && a.Format != format {
+			continue
+		}
+
+		savePath := filepath.Join(output, a.Name)
+		f, err := os.Create(savePath)
+		if err != nil {
+			return fail("Fail to create file: %v", err)
+		}
+		err = c.Download(a, f)
+		f.Close()
+		if err != nil {
+			os.Remove(savePath)
+			return fail("Fail to download %s: %v", a.Name, err)
+		}
+
+		fmt.Fprintln(stdout, savePath)
+		downloaded++
+	}
+
+	if downloaded == 0 {
+		return fail("Task %d has no artifact to download", taskID)
+	}
+	return EXIT_OK
+}
@@ -0,0 +1,68 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cmd
+
+import "fmt"
+
+func runBatchRun(args []string) int {
+	var (
+		cf clientFlags
+		rf refFlags
+		wf waitFlags
+	)
+	fs := newFlagSet("batch run", &cf)
+	addRefFlags(fs, &rf)
+	addWaitFlags(fs, &wf, true)
+	positionals, err := parseArgs(fs, args)
+	if err != nil {
+		return parseExitCode(err)
+	} else if len(positionals) != 1 {
+		return failUsage(fs, "exactly one batch profile name is required")
+	}
+
+	ref, err := rf.Ref()
+	if err != nil {
+		return failUsage(fs, "%v", err)
+	}
+	c, err := cf.newClient(true)
+	if err != nil {
+		return failUsage(fs, "%v", err)
+	}
+
+	result, err := c.CreateBatchTasks(cf.project, positionals[0], ref)
+	if err != nil {
+		return fail("Fail to create batch tasks: %v", err)
+	}
+	fmt.Fprintf(stderr, "Batch '%s' of %s (%s): %d created, %d skipped, %d rejected\n",
+		result.Profile, result.Ref, result.Commit, len(result.Created), len(result.Skipped), len(result.Rejected))
+
+	ids := make([]int64, 0, len(result.Created)+len(result.Skipped))
+	for _, t := range append(result.Created, result.Skipped...) {
+		fmt.Fprintln(stdout, t.ID)
+		ids = append(ids, t.ID)
+	}
+	for _, entry := range result.Rejected {
+		fmt.Fprintf(stderr, "Rejected, no builder can take: %s\n", entry)
+	}
+
+	code := EXIT_OK
+	if wf.wait {
+		code = waitTasks(c, ids, &wf)
+	}
+	if code == EXIT_OK && len(result.Rejected) > 0 {
+		code = EXIT_FAILED
+	}
+	return code
+}
@@ -0,0 +1,253 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package cmd implements command-line client of Luban for scripting builds,
+// which calls REST API of the server with a personal access token.
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/lubanstudio/luban/pkg/client"
+)
+
+// Exit codes of commands.
+const (
+	EXIT_OK      = 0
+	EXIT_ERROR   = 1 // Request failed or other errors
+	EXIT_USAGE   = 2 // Invalid command or flags
+	EXIT_FAILED  = 3 // Tasks failed, were canceled or batch entries were rejected
+	EXIT_TIMEOUT = 4 // Tasks did not finish within timeout
+)
+
+const usage = `Usage: luban <command> [arguments]
+
+Commands:
+  web                       Start Luban server (default when no command is given)
+  task create [flags]       Create a task, and wait for it to finish with --wait
+  task wait <id>            Wait for a task to finish
+  task logs <id>            Print build log of a task
+  artifact download [flags] Download artifacts of a succeeded task
+  batch run <profile>       Create tasks of a batch profile, and wait for them with --wait
+
+Server URL, access token and project are read from environment variables
+LUBAN_URL, LUBAN_TOKEN and LUBAN_PROJECT, or from flags --url, --token and --project.
+
+Exit codes:
+  0  Success
+  1  Request failed or other errors
+  2  Invalid command or flags
+  3  Tasks failed, were canceled or batch entries were rejected
+  4  Tasks did not finish within timeout
+
+Run "luban <command> <subcommand> -h" for flags of a command.
+`
+
+var (
+	stdout io.Writer = os.Stdout
+	stderr io.Writer = os.Stderr
+)
+
+// Run runs the client command with given arguments without program name,
+// and returns the exit code.
+func Run(args []string) int {
+	if len(args) > 0 && (args[0] == "help" || args[0] == "-h" || args[0] == "--help") {
+		fmt.Fprint(stdout, usage)
+		return EXIT_OK
+	} else if len(args) < 2 {
+		fmt.Fprint(stderr, usage)
+		return EXIT_USAGE
+	}
+
+	var run func([]string) int
+	switch args[0] + " " + args[1] {
+	case "task create":
+		run = runTaskCreate
+	case "task wait":
+		run = runTaskWait
+	case "task logs":
+		run = runTaskLogs
+	case "artifact download":
+		run = runArtifactDownload
+	case "batch run":
+		run = runBatchRun
+	default:
+		fmt.Fprint(stderr, usage)
+		return EXIT_USAGE
+	}
+	return run(args[2:])
+}
+
+// IsCommand returns true if given argument is a client command.
+func IsCommand(name string) bool {
+	switch name {
+	case "task", "artifact", "batch", "help", "-h", "--help":
+		return true
+	}
+	return false
+}
+
+// clientFlags are flags shared by all commands.
+type clientFlags struct {
+	url     string
+	token   string
+	project string
+}
+
+func newFlagSet(name string, cf *clientFlags) *flag.FlagSet {
+	fs := flag.NewFlagSet("luban "+name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&cf.url, "url", os.Getenv("LUBAN_URL"), "URL of Luban server")
+	fs.StringVar(&cf.token, "token", os.Getenv("LUBAN_TOKEN"), "personal access token, prefer environment variable LUBAN_TOKEN")
+	fs.StringVar(&cf.project, "project", os.Getenv("LUBAN_PROJECT"), "name of project")
+	return fs
+}
+
+// parseArgs parses flags that may be given before or after positional
+// arguments, and returns positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positionals []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		} else if fs.NArg() == 0 {
+			return positionals, nil
+		}
+		positionals = append(positionals, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// parseExitCode returns the exit code for error returned by parsing flags,
+// which has been printed with usage.
+func parseExitCode(err error) int {
+	if err == flag.ErrHelp {
+		return EXIT_OK
+	}
+	return EXIT_USAGE
+}
+
+func (cf *clientFlags) newClient(requireProject bool) (*client.Client, error) {
+	if len(cf.url) == 0 {
+		return nil, fmt.Errorf("server URL is required")
+	} else if len(cf.token) == 0 {
+		return nil, fmt.Errorf("access token is required")
+	} else if requireProject && len(cf.project) == 0 {
+		return nil, fmt.Errorf("project is required")
+	}
+	return client.New(cf.url, cf.token), nil
+}
+
+// refFlags are flags to specify the reference to build.
+type refFlags struct {
+	branch string
+	tag    string
+	ref    string
+}
+
+func addRefFlags(fs *flag.FlagSet, rf *refFlags) {
+	fs.StringVar(&rf.branch, "branch", "", "branch to build")
+	fs.StringVar(&rf.tag, "tag", "", "tag to build")
+	fs.StringVar(&rf.ref, "ref", "", "full reference name, pull request (e.g. pull/123) or commit ID to build")
+}
+
+// Ref returns the reference given by one of the flags.
+func (rf *refFlags) Ref() (string, error) {
+	refs := make([]string, 0, 1)
+	if len(rf.branch) > 0 {
+		refs = append(refs, "refs/heads/"+rf.branch)
+	}
+	if len(rf.tag) > 0 {
+		refs = append(refs, "refs/tags/"+rf.tag)
+	}
+	if len(rf.ref) > 0 {
+		refs = append(refs, rf.ref)
+	}
+	if len(refs) > 1 {
+		return "", fmt.Errorf("only one of --branch, --tag and --ref can be given")
+	} else if len(refs) == 0 {
+		return "", nil
+	}
+	return refs[0], nil
+}
+
+// waitFlags are flags to wait for tasks to finish.
+type waitFlags struct {
+	wait     bool
+	timeout  time.Duration
+	interval time.Duration
+}
+
+func addWaitFlags(fs *flag.FlagSet, wf *waitFlags, withSwitch bool) {
+	if withSwitch {
+		fs.BoolVar(&wf.wait, "wait", false, "wait for tasks to finish")
+	}
+	fs.DurationVar(&wf.timeout, "timeout", 0, "maximum time to wait, 0 means no limit")
+	fs.DurationVar(&wf.interval, "interval", 10*time.Second, "interval to poll status of tasks")
+}
+
+// waitTasks waits for all given tasks to finish within timeout, and returns
+// the exit code by their final status.
+func waitTasks(c *client.Client, ids []int64, wf *waitFlags) int {
+	var deadline time.Time
+	if wf.timeout > 0 {
+		deadline = time.Now().Add(wf.timeout)
+	}
+
+	code := EXIT_OK
+	for _, id := range ids {
+		var timeout time.Duration
+		if !deadline.IsZero() {
+			timeout = deadline.Sub(time.Now())
+			if timeout <= 0 {
+				timeout = time.Nanosecond
+			}
+		}
+
+		fmt.Fprintf(stderr, "Waiting for task %d...\n", id)
+		task, err := c.WaitTask(id, wf.interval, timeout)
+		if err == client.ErrTimeout {
+			fmt.Fprintf(stderr, "Task %d is still %s: %s\n", id, task.Status, task.URL)
+			return EXIT_TIMEOUT
+		} else if err != nil {
+			fmt.Fprintf(stderr, "Fail to wait for task %d: %v\n", id, err)
+			return EXIT_ERROR
+		}
+
+		fmt.Fprintf(stderr, "Task %d %s: %s\n", id, task.Status, task.URL)
+		switch task.Status {
+		case client.TASK_STATUS_SUCCEED, client.TASK_STATUS_ARCHIVED:
+		default:
+			code = EXIT_FAILED
+		}
+	}
+	return code
+}
+
+// fail prints the error and returns the exit code for it.
+func fail(format string, args ...interface{}) int {
+	fmt.Fprintf(stderr, format+"\n", args...)
+	return EXIT_ERROR
+}
+
+// failUsage prints the error with usage of flags, and returns the exit code for it.
+func failUsage(fs *flag.FlagSet, format string, args ...interface{}) int {
+	fmt.Fprintf(stderr, format+"\n", args...)
+	fs.Usage()
+	return EXIT_USAGE
+}
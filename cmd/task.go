@@ -0,0 +1,136 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lubanstudio/luban/pkg/client"
+)
+
+func runTaskCreate(args []string) int {
+	var (
+		cf   clientFlags
+		rf   refFlags
+		wf   waitFlags
+		opt  client.CreateTaskOption
+		tags string
+	)
+	fs := newFlagSet("task create", &cf)
+	addRefFlags(fs, &rf)
+	addWaitFlags(fs, &wf, true)
+	fs.StringVar(&opt.OS, "os", "", "target OS, e.g. linux")
+	fs.StringVar(&opt.Arch, "arch", "", "target architecture, e.g. arm64")
+	fs.StringVar(&tags, "tags", "", "comma-separated build tags")
+	fs.StringVar(&opt.TagExpr, "tag-expr", "", "extra expression that supported tags of builder must satisfy")
+	fs.StringVar(&opt.GoVersion, "go-version", "", "Go version constraint, e.g. >=1.21")
+	fs.StringVar(&opt.CC, "cc", "", "required C compiler")
+	fs.StringVar(&opt.Libc, "libc", "", "required C library")
+	fs.StringVar(&opt.BuildFlags, "build-flags", "", "extra flags passed to go build")
+	fs.StringVar(&opt.LDFlags, "ldflags", "", "template of -ldflags value")
+	if _, err := parseArgs(fs, args); err != nil {
+		return parseExitCode(err)
+	}
+
+	var err error
+	opt.Ref, err = rf.Ref()
+	if err != nil {
+		return failUsage(fs, "%v", err)
+	} else if len(opt.OS) == 0 || len(opt.Arch) == 0 || len(opt.Ref) == 0 {
+		return failUsage(fs, "--os, --arch and one of --branch, --tag and --ref are required")
+	}
+	if len(tags) > 0 {
+		opt.Tags = strings.Split(tags, ",")
+	}
+
+	c, err := cf.newClient(true)
+	if err != nil {
+		return failUsage(fs, "%v", err)
+	}
+
+	task, err := c.CreateTask(cf.project, &opt)
+	if err != nil {
+		return fail("Fail to create task: %v", err)
+	}
+	fmt.Fprintln(stdout, task.ID)
+	fmt.Fprintf(stderr, "Task %d is %s: %s\n", task.ID, task.Status, task.URL)
+
+	if !wf.wait {
+		return EXIT_OK
+	}
+	return waitTasks(c, []int64{task.ID}, &wf)
+}
+
+// parseTaskID returns the task ID which must be the only positional argument.
+func parseTaskID(positionals []string) (int64, error) {
+	if len(positionals) != 1 {
+		return 0, fmt.Errorf("exactly one task ID is required")
+	}
+	id, err := strconv.ParseInt(positionals[0], 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid task ID: %s", positionals[0])
+	}
+	return id, nil
+}
+
+func runTaskWait(args []string) int {
+	var (
+		cf clientFlags
+		wf waitFlags
+	)
+	fs := newFlagSet("task wait", &cf)
+	addWaitFlags(fs, &wf, false)
+	positionals, err := parseArgs(fs, args)
+	if err != nil {
+		return parseExitCode(err)
+	}
+
+	id, err := parseTaskID(positionals)
+	if err != nil {
+		return failUsage(fs, "%v", err)
+	}
+	c, err := cf.newClient(false)
+	if err != nil {
+		return failUsage(fs, "%v", err)
+	}
+	return waitTasks(c, []int64{id}, &wf)
+}
+
+func runTaskLogs(args []string) int {
+	var cf clientFlags
+	fs := newFlagSet("task logs", &cf)
+	positionals, err := parseArgs(fs, args)
+	if err != nil {
+		return parseExitCode(err)
+	}
+
+	id, err := parseTaskID(positionals)
+	if err != nil {
+		return failUsage(fs, "%v", err)
+	}
+	c, err := cf.newClient(false)
+	if err != nil {
+		return failUsage(fs, "%v", err)
+	}
+
+	data, err := c.TaskBuildLog(id)
+	if err != nil {
+		return fail("Fail to get build log: %v", err)
+	}
+	stdout.Write(data)
+	return EXIT_OK
+}
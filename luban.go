@@ -15,22 +15,29 @@
 package main
 
 import (
+	gocontext "context"
+	"crypto/tls"
 	"fmt"
+	"io/ioutil"
 	"net/http"
-	"path"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/go-macaron/binding"
-	"github.com/go-macaron/oauth2"
 	"github.com/go-macaron/session"
-	goauth2 "golang.org/x/oauth2"
 	log "gopkg.in/clog.v1"
 	"gopkg.in/macaron.v1"
 
+	"github.com/lubanstudio/luban/cmd"
 	"github.com/lubanstudio/luban/models"
+	"github.com/lubanstudio/luban/pkg/auth"
 	"github.com/lubanstudio/luban/pkg/context"
 	"github.com/lubanstudio/luban/pkg/form"
 	"github.com/lubanstudio/luban/pkg/setting"
 	"github.com/lubanstudio/luban/pkg/template"
+	"github.com/lubanstudio/luban/pkg/tool"
 	"github.com/lubanstudio/luban/routes"
 )
 
@@ -41,8 +48,31 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && cmd.IsCommand(os.Args[1]) {
+		os.Exit(cmd.Run(os.Args[1:]))
+	} else if len(os.Args) > 1 && os.Args[1] != "web" {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", os.Args[1])
+		os.Exit(cmd.Run(nil))
+	}
+	runWeb()
+}
+
+// runWeb starts the server and blocks until it is shut down by signal.
+func runWeb() {
+	setting.Init()
+	models.Init()
 	log.Info("Luban %s", APP_VER)
 
+	if err := auth.Init(); err != nil {
+		log.Fatal(4, "Fail to init authentication providers: %v", err)
+	}
+	if setting.Auth.EnableLocal {
+		auth.SetPasswordProvider(models.LocalProvider{})
+	}
+	if len(auth.Providers()) == 0 && auth.GetPasswordProvider() == nil {
+		log.Warn("No authentication source is configured, no one is able to sign in")
+	}
+
 	m := macaron.New()
 	if !setting.ProdMode {
 		m.Use(macaron.Logger())
@@ -58,31 +88,51 @@ func main() {
 	m.Use(session.Sessioner(session.Options{
 		Provider:       "file",
 		ProviderConfig: "data/sessions",
+		Secure:         setting.Server.Protocol == "https",
 	}))
-	m.Use(oauth2.Github(
-		&goauth2.Config{
-			ClientID:     setting.OAuth2.ClientID,
-			ClientSecret: setting.OAuth2.ClientSecret,
-		},
-	))
 	m.Use(context.Contexter())
 
 	bindIgnErr := binding.BindIgnErr
 
 	m.Get("/", func(ctx *macaron.Context) { ctx.Redirect("/dashboard") })
+
+	m.Group("/login", func() {
+		m.Combo("").Get(routes.Login).Post(bindIgnErr(form.SignIn{}), routes.LoginPost)
+		m.Get("/:provider", routes.OAuthLogin)
+		m.Get("/:provider/callback", routes.OAuthCallback)
+	}, context.ReqCSRFToken())
+	m.Post("/logout", context.ReqCSRFToken(), routes.Logout)
+
 	m.Group("", func() {
 		m.Get("/dashboard", routes.Dashboard)
 
-		m.Group("/tasks", func() {
-			m.Get("", routes.Tasks)
+		m.Get("/tasks", func(ctx *context.Context) { ctx.Redirect("/projects") })
+		m.Get("/tasks/:id", routes.RedirectTask)
 
-			m.Group("", func() {
-				m.Combo("/new").Get(routes.NewTask).Post(bindIgnErr(form.NewTask{}), routes.NewTaskPost)
-				m.Combo("/new_batch", context.ReqAdmin()).Get(routes.NewBatchTasks).Post(routes.NewBatchTasksPost)
+		m.Group("/projects", func() {
+			m.Get("", routes.Projects)
+			m.Combo("/new", context.ReqRole(models.ROLE_ADMIN)).Get(routes.NewProject).Post(bindIgnErr(form.Project{}), routes.NewProjectPost)
+		}, func(ctx *context.Context) {
+			ctx.Data["PageIsProject"] = true
+		})
+
+		m.Group("/projects/:project", func() {
+			m.Get("", func(ctx *context.Context) { ctx.Redirect(ctx.Project.Link() + "/tasks") })
+
+			m.Group("/tasks", func() {
+				m.Get("", routes.Tasks)
+				m.Group("", func() {
+					m.Combo("/new").Get(routes.NewTask).Post(bindIgnErr(form.NewTask{}), routes.NewTaskPost)
+					m.Get("/preview", routes.PreviewTaskBuilders)
+				}, context.ReqRole(models.ROLE_TASK_CREATOR), context.ReqProjectAccess(models.ACCESS_MODE_WRITE))
+				m.Combo("/new_batch", context.ReqRole(models.ROLE_RELEASE_MANAGER), context.ReqProjectAccess(models.ACCESS_MODE_ADMIN)).
+					Get(routes.NewBatchTasks).Post(bindIgnErr(form.NewBatchTasks{}), routes.NewBatchTasksPost)
 
 				m.Group("/:id", func() {
 					m.Get("", routes.ViewTask)
-					m.Get("/archive", context.ReqAdmin(), routes.ArchiveTask)
+					m.Get("/log", routes.ViewTaskBuildLog)
+					m.Post("/archive", context.ReqRole(models.ROLE_RELEASE_MANAGER), context.ReqProjectAccess(models.ACCESS_MODE_ADMIN), routes.ArchiveTask)
+					m.Post("/cancel", context.ReqRole(models.ROLE_TASK_CREATOR), context.ReqProjectAccess(models.ACCESS_MODE_WRITE), routes.CancelTask)
 				}, func(ctx *context.Context) {
 					task, err := models.GetTaskByID(ctx.ParamsInt64(":id"))
 					if err != nil {
@@ -92,54 +142,261 @@ func main() {
 							ctx.Handle(500, "GetTaskByID", err)
 						}
 						return
+					} else if task.ProjectID != ctx.Project.ID {
+						ctx.NotFound()
+						return
 					}
 					ctx.Task = task
 					ctx.Data["Task"] = ctx.Task
 				})
+			}, func(ctx *context.Context) {
+				ctx.Data["PageIsTask"] = true
+			})
+
+			m.Group("/batches", func() {
+				m.Get("", routes.BatchProfiles)
+				m.Combo("/new").Get(routes.NewBatchProfile).Post(bindIgnErr(form.BatchProfile{}), routes.NewBatchProfilePost)
+
+				m.Group("/:id", func() {
+					m.Combo("/edit").Get(routes.EditBatchProfile).Post(bindIgnErr(form.BatchProfile{}), routes.EditBatchProfilePost)
+					m.Post("/delete", routes.DeleteBatchProfile)
+				})
+			}, context.ReqRole(models.ROLE_RELEASE_MANAGER), context.ReqProjectAccess(models.ACCESS_MODE_ADMIN), func(ctx *context.Context) {
+				ctx.Data["PageIsBatch"] = true
+			})
+
+			m.Group("/secrets", func() {
+				m.Combo("").Get(routes.Secrets).Post(bindIgnErr(form.Secret{}), routes.SetSecretPost)
+				m.Post("/:id/delete", routes.DeleteSecret)
+			}, context.ReqRole(models.ROLE_RELEASE_MANAGER), context.ReqProjectAccess(models.ACCESS_MODE_ADMIN), func(ctx *context.Context) {
+				ctx.Data["PageIsSecret"] = true
 			})
-		}, func(ctx *context.Context) {
-			ctx.Data["PageIsTask"] = true
-			ctx.Data["AllowedOSs"] = setting.AllowedOSs
-			ctx.Data["AllowedArchs"] = setting.AllowedArchs
-			ctx.Data["AllowedTags"] = setting.AllowedTags
-			ctx.Data["AllowedBranches"] = setting.Project.Branches
-		})
+
+			m.Group("/settings", func() {
+				m.Combo("").Get(routes.ProjectSettings).Post(bindIgnErr(form.Project{}), routes.ProjectSettingsPost)
+				m.Post("/collaborators", bindIgnErr(form.Collaborator{}), routes.ProjectCollaboratorPost)
+				m.Post("/webhook_secret", routes.RegenerateWebhookSecret)
+			}, context.ReqRole(models.ROLE_RELEASE_MANAGER), context.ReqProjectAccess(models.ACCESS_MODE_ADMIN), func(ctx *context.Context) {
+				ctx.Data["PageIsProjectSettings"] = true
+			})
+		}, context.ProjectAssignment())
 
 		m.Group("/builders", func() {
 			m.Get("", routes.Builders)
+			m.Combo("/new", context.ReqRole(models.ROLE_BUILDER_OWNER)).
+				Get(routes.NewBuilder).Post(bindIgnErr(form.NewBuilder{}), routes.NewBuilderPost)
+			m.Get("/pending", context.ReqRole(models.ROLE_ADMIN), routes.PendingBuilders)
 
-			m.Group("", func() {
-				m.Combo("/new").Get(routes.NewBuilder).Post(bindIgnErr(form.NewBuilder{}), routes.NewBuilderPost)
+			m.Group("/:id", func() {
+				m.Get("", routes.ViewBuilder)
 
-				m.Group("/:id", func() {
+				m.Group("", func() {
 					m.Combo("/edit").Get(routes.EditBuilder).Post(bindIgnErr(form.NewBuilder{}), routes.EditBuilderPost)
-					m.Post("/regenerate_token", routes.RegenerateBuilderToken)
+					m.Post("/maintenance", bindIgnErr(form.BuilderMaintenance{}), routes.UpdateBuilderMaintenance)
+					m.Group("/tokens", func() {
+						m.Post("/new", bindIgnErr(form.BuilderToken{}), routes.NewBuilderTokenPost)
+						m.Post("/:tid/rotate", bindIgnErr(form.RotateBuilderToken{}), routes.RotateBuilderToken)
+						m.Post("/:tid/delete", routes.DeleteBuilderToken)
+					})
 					m.Post("/delete", routes.DeleteBuilder)
-				})
-			}, context.ReqAdmin())
+				}, context.ReqRole(models.ROLE_BUILDER_OWNER), context.ReqBuilderOwner())
+				m.Post("/approve", context.ReqRole(models.ROLE_ADMIN), routes.ApproveBuilder)
+			}, context.BuilderAssignment())
 		}, func(ctx *context.Context) {
 			ctx.Data["PageIsBuilder"] = true
 		})
 
-	}, oauth2.LoginRequired)
+		m.Group("/schedules", func() {
+			m.Get("", routes.Schedules)
+			m.Combo("/new").Get(routes.NewSchedule).Post(bindIgnErr(form.Schedule{}), routes.NewSchedulePost)
 
-	m.Get("/artifacts/:name", func(ctx *context.Context) {
-		http.ServeFile(ctx.Resp, ctx.Req.Request, path.Join(setting.ArtifactsPath, ctx.Params(":name")))
-	})
+			m.Group("/:id", func() {
+				m.Combo("/edit").Get(routes.EditSchedule).Post(bindIgnErr(form.Schedule{}), routes.EditSchedulePost)
+				m.Post("/run", routes.RunSchedule)
+				m.Post("/delete", routes.DeleteSchedule)
+			})
+		}, context.ReqRole(models.ROLE_ADMIN), func(ctx *context.Context) {
+			ctx.Data["PageIsSchedule"] = true
+		})
+
+		m.Group("/user/settings/tokens", func() {
+			m.Combo("").Get(routes.AccessTokens).Post(bindIgnErr(form.AccessToken{}), routes.NewAccessTokenPost)
+			m.Post("/:id/delete", routes.DeleteAccessToken)
+		})
+
+		m.Group("/admin/users", func() {
+			m.Get("", routes.AdminUsers)
+			m.Combo("/new").Get(routes.NewLocalUser).Post(bindIgnErr(form.NewLocalUser{}), routes.NewLocalUserPost)
+			m.Post("/:id/role", bindIgnErr(form.UserRole{}), routes.UpdateUserRole)
+		}, context.ReqRole(models.ROLE_ADMIN), func(ctx *context.Context) {
+			ctx.Data["PageIsAdminUsers"] = true
+		})
+
+		m.Group("/admin/audit", func() {
+			m.Get("", routes.AdminAuditLogs)
+			m.Get("/export", routes.ExportAuditLogs)
+		}, context.ReqRole(models.ROLE_ADMIN), func(ctx *context.Context) {
+			ctx.Data["PageIsAdminAudit"] = true
+		})
+
+	}, context.ReqSignIn(), context.ReqCSRFToken())
+
+	m.Get("/artifacts/:project/:name", routes.ReqSignInOrAccessToken, context.ProjectAssignment(), routes.DownloadArtifact)
 
 	m.Group("/api/v1", func() {
 		m.Group("/builder", func() {
-			m.Post("/matrix", routes.UpdateMatrix)
-			m.Post("/heartbeat", routes.HeartBeat)
-			m.Post("/upload/artifact", routes.UploadArtifact)
+			m.Group("", func() {
+				m.Post("/matrix", routes.UpdateMatrix)
+				m.Post("/heartbeat", routes.HeartBeat)
+			}, routes.RequireBuilderScope(models.BUILDER_SCOPE_HEARTBEAT), routes.LimitBodySize(setting.Server.MaxBodySize))
+			m.Group("/upload", func() {
+				m.Post("/artifact", routes.LimitBodySize(setting.Server.MaxUploadSize), routes.UploadArtifact)
+				m.Post("/log", routes.LimitBodySize(setting.Server.MaxBuildLogSize), routes.UploadBuildLog)
+			}, routes.RequireBuilderScope(models.BUILDER_SCOPE_UPLOAD))
 		}, routes.RequireBuilderToken)
+
+		// REST API authenticated by personal access tokens.
+		m.Group("", func() {
+			m.Get("/tasks", routes.APIListTasks)
+			m.Group("/tasks/:id", func() {
+				m.Get("", routes.APIGetTask)
+				m.Get("/artifacts", routes.APITaskArtifacts)
+				m.Get("/log", routes.APITaskBuildLog)
+				m.Post("/cancel", routes.APICancelTask)
+				m.Post("/archive", routes.APIArchiveTask)
+			}, routes.APITaskAssignment)
+			m.Group("/projects/:project", func() {
+				m.Post("/tasks", routes.APICreateTask)
+				m.Post("/batches/:name/tasks", routes.APICreateBatchTasks)
+			}, routes.APIProjectAssignment)
+			m.Get("/builders", routes.APIListBuilders)
+			m.Get("/builders/:id", routes.APIGetBuilder)
+			m.Get("/artifacts", routes.APIListArtifacts)
+		}, routes.RequireAccessToken, routes.LimitBodySize(setting.Server.MaxBodySize))
+
+		if setting.Webhook.Enabled {
+			m.Post("/projects/:project/webhook/:kind", routes.Webhook)
+		}
 	})
 
 	m.NotFound(context.NotFound)
 
+	if err := models.SyncSchedules(); err != nil {
+		log.Fatal(4, "Fail to sync schedules: %v", err)
+	}
+
 	go models.AssignTasks()
+	go models.RunSchedules()
+	go models.RefreshUsers()
+
+	servers := []*http.Server{newServer(m)}
+	if setting.BuilderTLS.Enabled {
+		servers = append(servers, newBuilderTLSServer(m))
+	}
+
+	// Wait for termination signal, then stop accepting new requests and let in-flight
+	// ones (e.g. uploading artifacts) and scheduler finish within shutdown timeout.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigs
+	log.Info("Received signal %v, shutting down...", sig)
+
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), setting.Server.ShutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Error(4, "Fail to shutdown server on %s: %v", server.Addr, err)
+		}
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		models.StopScheduler()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		log.Error(4, "Scheduler did not stop within shutdown timeout")
+	}
+	log.Info("Luban stopped")
+	log.Shutdown()
+}
+
+// newServer starts and returns the main server with HTTP or HTTPS.
+func newServer(handler http.Handler) *http.Server {
+	server := &http.Server{
+		Addr:              fmt.Sprintf("%s:%d", setting.Server.ListenAddr, setting.HTTPPort),
+		Handler:           handler,
+		ReadHeaderTimeout: setting.Server.ReadHeaderTimeout,
+		ReadTimeout:       setting.Server.ReadTimeout,
+		WriteTimeout:      setting.Server.WriteTimeout,
+		IdleTimeout:       setting.Server.IdleTimeout,
+	}
+
+	var certFile, keyFile string
+	if setting.Server.Protocol == "https" {
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		if len(setting.Server.CertFile) > 0 && len(setting.Server.KeyFile) > 0 {
+			certFile, keyFile = setting.Server.CertFile, setting.Server.KeyFile
+		} else {
+			log.Warn("Using self-signed certificate, it should only be used for development")
+			cert, err := tool.NewSelfSignedCert([]string{"localhost", "127.0.0.1"})
+			if err != nil {
+				log.Fatal(4, "Fail to generate self-signed certificate: %v", err)
+			}
+			server.TLSConfig.Certificates = []tls.Certificate{cert}
+		}
+	}
+
+	go func() {
+		log.Info("Listening on %s://%s", setting.Server.Protocol, server.Addr)
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(4, "Fail to start server: %v", err)
+		}
+	}()
+	return server
+}
+
+// newBuilderTLSServer starts and returns the server of builder API with client
+// certificate verification, other routes are not available on this server.
+func newBuilderTLSServer(handler http.Handler) *http.Server {
+	data, err := ioutil.ReadFile(setting.BuilderTLS.ClientCAFile)
+	if err != nil {
+		log.Fatal(4, "Fail to read client CA file: %v", err)
+	}
+	tlsConfig, err := tool.NewClientCertConfig(data)
+	if err != nil {
+		log.Fatal(4, "Fail to load client CA file '%s': %v", setting.BuilderTLS.ClientCAFile, err)
+	}
+
+	server := &http.Server{
+		Addr:              setting.BuilderTLS.ListenAddr,
+		ReadHeaderTimeout: setting.Server.ReadHeaderTimeout,
+		ReadTimeout:       setting.Server.ReadTimeout,
+		WriteTimeout:      setting.Server.WriteTimeout,
+		IdleTimeout:       setting.Server.IdleTimeout,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasPrefix(r.URL.Path, "/api/v1/builder/") {
+				http.NotFound(w, r)
+				return
+			}
+			handler.ServeHTTP(w, r)
+		}),
+		TLSConfig: tlsConfig,
+	}
 
-	listenAddr := fmt.Sprintf("0.0.0.0:%d", setting.HTTPPort)
-	log.Info("Listening on %s", listenAddr)
-	log.Fatal(4, "Fail to start server: %v", http.ListenAndServe(listenAddr, m))
+	go func() {
+		log.Info("Listening builder TLS on %s", server.Addr)
+		if err := server.ListenAndServeTLS(setting.BuilderTLS.CertFile, setting.BuilderTLS.KeyFile); err != http.ErrServerClosed {
+			log.Fatal(4, "Fail to start builder TLS server: %v", err)
+		}
+	}()
+	return server
 }
@@ -0,0 +1,118 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package models
+
+import (
+	"crypto/subtle"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/lubanstudio/luban/pkg/tool"
+)
+
+// AccessToken is a personal token used by a user to call REST API with
+// permissions of the user. Only a salted hash of the token is stored,
+// the plain token is shown once.
+type AccessToken struct {
+	ID         int64
+	UserID     int64 `gorm:"INDEX"`
+	Name       string
+	Prefix     string `gorm:"INDEX"`
+	Salt       string `json:"-"`
+	Hash       string `json:"-"`
+	LastUsed   int64
+	LastUsedIP string `gorm:"column:last_used_ip"`
+	Created    int64
+}
+
+func (t *AccessToken) BeforeCreate() {
+	t.Created = time.Now().Unix()
+}
+
+func (t *AccessToken) CreatedTime() time.Time {
+	return time.Unix(t.Created, 0)
+}
+
+func (t *AccessToken) LastUsedTime() time.Time {
+	return time.Unix(t.LastUsed, 0)
+}
+
+// NewAccessToken creates a new token for the user with given name,
+// and returns the plain token which is not stored anywhere.
+func NewAccessToken(userID int64, name string) (*AccessToken, string, error) {
+	err := x.Where("user_id = ? AND name = ?", userID, name).First(new(AccessToken)).Error
+	if err == nil {
+		return nil, "", ErrAccessTokenExists{name}
+	} else if !IsErrRecordNotFound(err) {
+		return nil, "", err
+	}
+
+	plain := tool.NewSecretToekn()
+	salt := tool.NewSecretToekn()[:10]
+	t := &AccessToken{
+		UserID: userID,
+		Name:   name,
+		Prefix: plain[:tokenPrefixLength],
+		Salt:   salt,
+		Hash:   hashToken(salt, plain),
+	}
+	if err = x.Create(t).Error; err != nil {
+		return nil, "", err
+	}
+	return t, plain, nil
+}
+
+// GetAccessTokenByToken returns the token matches given plain token.
+func GetAccessTokenByToken(plain string) (*AccessToken, error) {
+	if len(plain) < tokenPrefixLength {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	candidates := make([]*AccessToken, 0, 1)
+	if err := x.Where("prefix = ?", plain[:tokenPrefixLength]).Find(&candidates).Error; err != nil {
+		return nil, err
+	}
+	for _, t := range candidates {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hashToken(t.Salt, plain))) == 1 {
+			return t, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+// UpdateLastUsed records when and where the token is used.
+func (t *AccessToken) UpdateLastUsed(ip string) error {
+	t.LastUsed = time.Now().Unix()
+	t.LastUsedIP = ip
+	return x.Model(t).Updates(map[string]interface{}{
+		"last_used":    t.LastUsed,
+		"last_used_ip": t.LastUsedIP,
+	}).Error
+}
+
+func GetAccessTokenByID(userID, id int64) (*AccessToken, error) {
+	t := new(AccessToken)
+	return t, x.Where("id = ? AND user_id = ?", id, userID).First(t).Error
+}
+
+func ListAccessTokens(userID int64) ([]*AccessToken, error) {
+	tokens := make([]*AccessToken, 0, 5)
+	return tokens, x.Where("user_id = ?", userID).Order("id").Find(&tokens).Error
+}
+
+func DeleteAccessToken(userID, id int64) error {
+	return x.Where("id = ? AND user_id = ?", id, userID).Delete(new(AccessToken)).Error
+}
@@ -0,0 +1,341 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Actions recorded in audit log, named as "<target type>.<verb>".
+const (
+	AUDIT_USER_SIGN_IN        = "user.sign_in"
+	AUDIT_USER_SIGN_IN_FAILED = "user.sign_in_failed"
+	AUDIT_USER_SIGN_OUT       = "user.sign_out"
+	AUDIT_USER_CREATE         = "user.create"
+	AUDIT_USER_UPDATE_ROLE    = "user.update_role"
+
+	AUDIT_ACCESS_TOKEN_CREATE = "access_token.create"
+	AUDIT_ACCESS_TOKEN_DELETE = "access_token.delete"
+
+	AUDIT_PROJECT_CREATE           = "project.create"
+	AUDIT_PROJECT_UPDATE           = "project.update"
+	AUDIT_PROJECT_SET_COLLABORATOR = "project.set_collaborator"
+
+	AUDIT_PROJECT_REGENERATE_WEBHOOK_SECRET = "project.regenerate_webhook_secret"
+
+	AUDIT_TASK_CREATE  = "task.create"
+	AUDIT_TASK_CANCEL  = "task.cancel"
+	AUDIT_TASK_ARCHIVE = "task.archive"
+
+	AUDIT_BATCH_PROFILE_CREATE = "batch_profile.create"
+	AUDIT_BATCH_PROFILE_UPDATE = "batch_profile.update"
+	AUDIT_BATCH_PROFILE_DELETE = "batch_profile.delete"
+	AUDIT_BATCH_PROFILE_RUN    = "batch_profile.run"
+
+	AUDIT_SECRET_SET    = "secret.set"
+	AUDIT_SECRET_DELETE = "secret.delete"
+
+	AUDIT_BUILDER_CREATE             = "builder.create"
+	AUDIT_BUILDER_UPDATE             = "builder.update"
+	AUDIT_BUILDER_UPDATE_MAINTENANCE = "builder.update_maintenance"
+	AUDIT_BUILDER_APPROVE            = "builder.approve"
+	AUDIT_BUILDER_DELETE             = "builder.delete"
+
+	AUDIT_BUILDER_TOKEN_CREATE = "builder_token.create"
+	AUDIT_BUILDER_TOKEN_ROTATE = "builder_token.rotate"
+	AUDIT_BUILDER_TOKEN_DELETE = "builder_token.delete"
+
+	AUDIT_SCHEDULE_CREATE = "schedule.create"
+	AUDIT_SCHEDULE_UPDATE = "schedule.update"
+	AUDIT_SCHEDULE_DELETE = "schedule.delete"
+	AUDIT_SCHEDULE_RUN    = "schedule.run"
+)
+
+var AuditActions = []string{
+	AUDIT_USER_SIGN_IN, AUDIT_USER_SIGN_IN_FAILED, AUDIT_USER_SIGN_OUT, AUDIT_USER_CREATE, AUDIT_USER_UPDATE_ROLE,
+	AUDIT_ACCESS_TOKEN_CREATE, AUDIT_ACCESS_TOKEN_DELETE,
+	AUDIT_PROJECT_CREATE, AUDIT_PROJECT_UPDATE, AUDIT_PROJECT_SET_COLLABORATOR, AUDIT_PROJECT_REGENERATE_WEBHOOK_SECRET,
+	AUDIT_TASK_CREATE, AUDIT_TASK_CANCEL, AUDIT_TASK_ARCHIVE,
+	AUDIT_BATCH_PROFILE_CREATE, AUDIT_BATCH_PROFILE_UPDATE, AUDIT_BATCH_PROFILE_DELETE, AUDIT_BATCH_PROFILE_RUN,
+	AUDIT_SECRET_SET, AUDIT_SECRET_DELETE,
+	AUDIT_BUILDER_CREATE, AUDIT_BUILDER_UPDATE, AUDIT_BUILDER_UPDATE_MAINTENANCE, AUDIT_BUILDER_APPROVE, AUDIT_BUILDER_DELETE,
+	AUDIT_BUILDER_TOKEN_CREATE, AUDIT_BUILDER_TOKEN_ROTATE, AUDIT_BUILDER_TOKEN_DELETE,
+	AUDIT_SCHEDULE_CREATE, AUDIT_SCHEDULE_UPDATE, AUDIT_SCHEDULE_DELETE, AUDIT_SCHEDULE_RUN,
+}
+
+// AuditTarget identifies the resource that an action is done on.
+type AuditTarget struct {
+	Type string
+	ID   int64
+	Name string
+}
+
+func (u *User) AuditTarget() AuditTarget {
+	return AuditTarget{"user", u.ID, u.LoginName()}
+}
+
+func (t *AccessToken) AuditTarget() AuditTarget {
+	return AuditTarget{"access_token", t.ID, t.Name}
+}
+
+func (p *Project) AuditTarget() AuditTarget {
+	return AuditTarget{"project", p.ID, p.Name}
+}
+
+func (t *Task) AuditTarget() AuditTarget {
+	target := AuditTarget{Type: "task", ID: t.ID}
+	if t.Project != nil {
+		target.Name = t.Project.Name
+	}
+	return target
+}
+
+func (p *BatchProfile) AuditTarget() AuditTarget {
+	return AuditTarget{"batch_profile", p.ID, p.Name}
+}
+
+func (s *Secret) AuditTarget() AuditTarget {
+	return AuditTarget{"secret", s.ID, s.Name}
+}
+
+func (b *Builder) AuditTarget() AuditTarget {
+	return AuditTarget{"builder", b.ID, b.Name}
+}
+
+func (t *BuilderToken) AuditTarget() AuditTarget {
+	return AuditTarget{"builder_token", t.ID, t.Prefix}
+}
+
+func (s *Schedule) AuditTarget() AuditTarget {
+	return AuditTarget{"schedule", s.ID, s.Name}
+}
+
+// AuditLog records an administrative or security-relevant action. Records are
+// append-only: updating or deleting them through models fails, but it is not
+// enforced by the database, use a database user without UPDATE and DELETE
+// privileges on table "audit_log" or ship logs elsewhere to make them tamper-proof.
+//
+// Values of the target before and after the action are encoded as JSON, fields
+// with sensitive values (e.g. password hashes, tokens, secret values) are tagged
+// with `json:"-"` and never recorded.
+type AuditLog struct {
+	ID         int64
+	ActorID    int64  `gorm:"INDEX"` // 0 for anonymous or system actions, e.g. webhooks
+	ActorName  string `gorm:"INDEX"`
+	Action     string `gorm:"INDEX"`
+	TargetType string `gorm:"INDEX:audit_log_target"`
+	TargetID   int64  `gorm:"INDEX:audit_log_target"`
+	TargetName string
+	Before     string `gorm:"TYPE:TEXT"`
+	After      string `gorm:"TYPE:TEXT"`
+	IP         string `gorm:"column:ip"`
+	Created    int64  `gorm:"INDEX"`
+}
+
+var errAuditLogAppendOnly = errors.New("audit logs are append-only")
+
+func (l *AuditLog) BeforeCreate() {
+	l.Created = time.Now().Unix()
+}
+
+func (l *AuditLog) BeforeUpdate() error {
+	return errAuditLogAppendOnly
+}
+
+func (l *AuditLog) BeforeDelete() error {
+	return errAuditLogAppendOnly
+}
+
+func (l *AuditLog) CreatedTime() time.Time {
+	return time.Unix(l.Created, 0)
+}
+
+func encodeAuditValue(v interface{}) (string, error) {
+	if v == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// NewAuditLog appends a record of the action done by given actor, which is nil
+// for anonymous or system actions. Before and after are values of the target,
+// nil means the target did not exist before or after the action.
+func NewAuditLog(actor *User, ip, action string, target AuditTarget, before, after interface{}) (err error) {
+	l := &AuditLog{
+		Action:     action,
+		TargetType: target.Type,
+		TargetID:   target.ID,
+		TargetName: target.Name,
+		IP:         ip,
+	}
+	if actor != nil {
+		l.ActorID = actor.ID
+		l.ActorName = actor.LoginName()
+	}
+
+	if l.Before, err = encodeAuditValue(before); err != nil {
+		return fmt.Errorf("encode before: %v", err)
+	} else if l.After, err = encodeAuditValue(after); err != nil {
+		return fmt.Errorf("encode after: %v", err)
+	}
+	return x.Create(l).Error
+}
+
+const (
+	signInFailedInterval = 10 * time.Minute
+	signInFailedMaxKeys  = 10000
+)
+
+// auditLimiter limits how often records with the same key are written,
+// records in between are counted and reported by the next written record.
+type auditLimiter struct {
+	lock     sync.Mutex
+	interval time.Duration
+	maxKeys  int
+	limits   map[string]*auditLimit
+}
+
+type auditLimit struct {
+	last       time.Time
+	suppressed int
+}
+
+// allow returns true if a record with given key is allowed to be written now,
+// and the number of records suppressed since last written one. Keys are merged
+// into a single one when there are too many distinct keys (e.g. guessing names),
+// so that memory and number of records are still bounded.
+func (l *auditLimiter) allow(key string, now time.Time) (bool, int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.limits == nil {
+		l.limits = make(map[string]*auditLimit)
+	}
+	if _, ok := l.limits[key]; !ok && len(l.limits) >= l.maxKeys {
+		for k, limit := range l.limits {
+			if now.Sub(limit.last) >= l.interval && limit.suppressed == 0 {
+				delete(l.limits, k)
+			}
+		}
+		if len(l.limits) >= l.maxKeys {
+			key = "*"
+		}
+	}
+
+	limit, ok := l.limits[key]
+	if ok && now.Sub(limit.last) < l.interval {
+		limit.suppressed++
+		return false, 0
+	} else if !ok {
+		limit = new(auditLimit)
+		l.limits[key] = limit
+	}
+	suppressed := limit.suppressed
+	limit.last = now
+	limit.suppressed = 0
+	return true, suppressed
+}
+
+var signInFailedLimiter = &auditLimiter{
+	interval: signInFailedInterval,
+	maxKeys:  signInFailedMaxKeys,
+}
+
+// NewSignInFailedAuditLog records a failed sign in of the user from given IP.
+// At most one record is written for the same user and IP every 10 minutes,
+// which has the number of failures not recorded since the previous record,
+// so that guessing passwords does not flood audit log.
+func NewSignInFailedAuditLog(ip string, target AuditTarget, reason string) error {
+	ok, suppressed := signInFailedLimiter.allow(target.Name+"@"+ip, time.Now())
+	if !ok {
+		return nil
+	}
+
+	after := map[string]interface{}{"reason": reason}
+	if suppressed > 0 {
+		after["suppressed"] = suppressed
+	}
+	return NewAuditLog(nil, ip, AUDIT_USER_SIGN_IN_FAILED, target, nil, after)
+}
+
+// AuditLogSearchOptions filters audit logs, zero values are not used as filters.
+type AuditLogSearchOptions struct {
+	ActorName  string // "<source>:<username>"
+	Action     string
+	TargetType string
+	TargetID   int64
+	Since      int64 // Unix time, inclusive
+	Until      int64 // Unix time, exclusive
+	// Pages are located by ID instead of offset so that they are cheap to reach
+	// and not shifted by new logs. Logs older than BeforeID are returned when
+	// it is set, otherwise logs newer than AfterID when it is set.
+	BeforeID int64
+	AfterID  int64
+	PageSize int
+}
+
+// SearchAuditLogs returns a page of audit logs match given options in reverse
+// order, and total number of matched logs of all pages.
+func SearchAuditLogs(opts *AuditLogSearchOptions) ([]*AuditLog, int64, error) {
+	sess := x.Model(new(AuditLog))
+	if len(opts.ActorName) > 0 {
+		sess = sess.Where("actor_name = ?", opts.ActorName)
+	}
+	if len(opts.Action) > 0 {
+		sess = sess.Where("action = ?", opts.Action)
+	}
+	if len(opts.TargetType) > 0 {
+		sess = sess.Where("target_type = ?", opts.TargetType)
+	}
+	if opts.TargetID > 0 {
+		sess = sess.Where("target_id = ?", opts.TargetID)
+	}
+	if opts.Since > 0 {
+		sess = sess.Where("created >= ?", opts.Since)
+	}
+	if opts.Until > 0 {
+		sess = sess.Where("created < ?", opts.Until)
+	}
+
+	var total int64
+	if err := sess.Count(&total).Error; err != nil {
+		return nil, 0, fmt.Errorf("count: %v", err)
+	}
+
+	logs := make([]*AuditLog, 0, opts.PageSize)
+	if opts.BeforeID > 0 || opts.AfterID <= 0 {
+		if opts.BeforeID > 0 {
+			sess = sess.Where("id < ?", opts.BeforeID)
+		}
+		return logs, total, sess.Limit(opts.PageSize).Order("id DESC").Find(&logs).Error
+	}
+
+	// Logs right after the ID are the oldest ones newer than it.
+	if err := sess.Where("id > ?", opts.AfterID).Limit(opts.PageSize).Order("id ASC").Find(&logs).Error; err != nil {
+		return nil, 0, err
+	}
+	for i, j := 0, len(logs)-1; i < j; i, j = i+1, j-1 {
+		logs[i], logs[j] = logs[j], logs[i]
+	}
+	return logs, total, nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package models
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAuditLimiter(t *testing.T) {
+	l := &auditLimiter{interval: 10 * time.Minute, maxKeys: 3}
+	now := time.Now()
+
+	type step struct {
+		key            string
+		after          time.Duration
+		wantOK         bool
+		wantSuppressed int
+	}
+	steps := []step{
+		{"alice@1.1.1.1", 0, true, 0},
+		{"alice@1.1.1.1", time.Minute, false, 0},
+		{"alice@1.1.1.1", 2 * time.Minute, false, 0},
+		{"alice@2.2.2.2", 2 * time.Minute, true, 0},
+		{"alice@1.1.1.1", 11 * time.Minute, true, 2},
+		{"alice@1.1.1.1", 12 * time.Minute, false, 0},
+		{"alice@1.1.1.1", 30 * time.Minute, true, 1},
+	}
+	for i, s := range steps {
+		ok, suppressed := l.allow(s.key, now.Add(s.after))
+		if ok != s.wantOK || suppressed != s.wantSuppressed {
+			t.Errorf("step %d: got (%v, %d), want (%v, %d)", i, ok, suppressed, s.wantOK, s.wantSuppressed)
+		}
+	}
+}
+
+func TestAuditLimiter_MaxKeys(t *testing.T) {
+	l := &auditLimiter{interval: 10 * time.Minute, maxKeys: 3}
+	now := time.Now()
+
+	// Distinct keys beyond the limit share a single key.
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow(fmt.Sprintf("user%d@1.1.1.1", i), now); !ok {
+			t.Fatalf("key %d is not allowed", i)
+		}
+	}
+	if ok, _ := l.allow("user3@1.1.1.1", now); !ok {
+		t.Fatal("shared bucket did not allow the first record")
+	}
+	for _, key := range []string{"user4@1.1.1.1", "user5@2.2.2.2"} {
+		if ok, _ := l.allow(key, now); ok {
+			t.Fatalf("shared bucket allowed another record of %q within interval", key)
+		}
+	}
+	if len(l.limits) > 4 {
+		t.Fatalf("got %d keys, want at most 4", len(l.limits))
+	}
+
+	// Expired keys without suppressed records are dropped for new keys.
+	later := now.Add(time.Hour)
+	if ok, _ := l.allow("user6@1.1.1.1", later); !ok {
+		t.Fatal("new key is not allowed after old keys expired")
+	}
+	if _, ok := l.limits["user6@1.1.1.1"]; !ok {
+		t.Fatal("new key does not have its own bucket after old keys expired")
+	}
+}
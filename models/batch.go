@@ -0,0 +1,396 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/lubanstudio/luban/pkg/setting"
+	"github.com/lubanstudio/luban/pkg/tagexpr"
+	"github.com/lubanstudio/luban/pkg/webhook"
+)
+
+// BatchProfile is a named list of build entries to be created as tasks at once.
+type BatchProfile struct {
+	ID          int64
+	ProjectID   int64    `gorm:"UNIQUE_INDEX:batch_profile_project_name"`
+	Project     *Project `gorm:"-" json:"-"`
+	Name        string   `gorm:"UNIQUE_INDEX:batch_profile_project_name"`
+	DefaultRef  string
+	Priority    int
+	WebhookRefs string // Comma-separated glob patterns of references
+	BuildOptions
+	Created int64
+
+	Entries []*BatchEntry `gorm:"-"`
+}
+
+func (p *BatchProfile) BeforeCreate() {
+	p.Created = time.Now().Unix()
+}
+
+func (p *BatchProfile) AfterFind() (err error) {
+	p.Project, err = GetProjectByID(p.ProjectID)
+	if err != nil && !IsErrRecordNotFound(err) {
+		return fmt.Errorf("GetProjectByID [%d]: %v", p.ProjectID, err)
+	}
+
+	p.Entries = make([]*BatchEntry, 0, 10)
+	if err = x.Where("profile_id = ?", p.ID).Order("id").Find(&p.Entries).Error; err != nil {
+		return fmt.Errorf("find entries: %v", err)
+	}
+	return nil
+}
+
+// MatchWebhookRef returns true if given reference should trigger the profile.
+func (p *BatchProfile) MatchWebhookRef(ref string) bool {
+	if len(p.WebhookRefs) == 0 {
+		return false
+	}
+	return webhook.MatchRef(strings.Split(p.WebhookRefs, ","), ref)
+}
+
+// EntriesText returns entries in the text format accepted by ParseBatchEntries.
+func (p *BatchProfile) EntriesText() string {
+	lines := make([]string, len(p.Entries))
+	for i := range p.Entries {
+		lines[i] = p.Entries[i].String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// BatchEntry is a build entry of batch profile.
+type BatchEntry struct {
+	ID        int64
+	ProfileID int64 `gorm:"INDEX"`
+	OS        string
+	Arch      string
+	Tags      string
+	TagExpr   string
+	Toolchain
+}
+
+func (e *BatchEntry) TagsList() []string {
+	if len(e.Tags) == 0 {
+		return nil
+	}
+	return strings.Split(e.Tags, ",")
+}
+
+func (e *BatchEntry) String() string {
+	s := strings.TrimSpace(e.OS + " " + e.Arch + " " + e.Tags)
+	if len(e.TagExpr) > 0 {
+		s += " match=" + e.TagExpr
+	}
+	return strings.TrimSpace(s + " " + e.Toolchain.String())
+}
+
+// ParseBatchEntries parses entries from text, each line is in format of
+// "<os> <arch> [tag1,tag2] [match=<tag expr>] [go=<constraint>] [cc=<cc>] [libc=<libc>]",
+// tag expression must not contain spaces. Empty lines and lines start with '#' are ignored.
+func ParseBatchEntries(text string) ([]*BatchEntry, error) {
+	entries := make([]*BatchEntry, 0, 10)
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, ErrInvalidBatchEntry{i + 1, line}
+		}
+
+		entry := &BatchEntry{
+			OS:   fields[0],
+			Arch: fields[1],
+		}
+		for j, field := range fields[2:] {
+			idx := strings.Index(field, "=")
+			if idx == -1 {
+				// Tags can only be the first optional field.
+				if j > 0 {
+					return nil, ErrInvalidBatchEntry{i + 1, line}
+				}
+				tags := strings.Split(field, ",")
+				sort.Strings(tags)
+				entry.Tags = strings.Join(tags, ",")
+				continue
+			}
+
+			switch field[:idx] {
+			case "match":
+				entry.TagExpr = field[idx+1:]
+			case "go":
+				entry.GoVersion = field[idx+1:]
+			case "cc":
+				entry.CC = field[idx+1:]
+			case "libc":
+				entry.Libc = field[idx+1:]
+			default:
+				return nil, ErrInvalidBatchEntry{i + 1, line}
+			}
+		}
+		if _, err := ParseTagConstraint(entry.TagsList(), entry.TagExpr); err != nil {
+			return nil, ErrInvalidBatchEntry{i + 1, line}
+		} else if entry.Toolchain.Validate() != nil {
+			return nil, ErrInvalidBatchEntry{i + 1, line}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// saveBatchEntries replaces entries of the profile within given transaction.
+func saveBatchEntries(tx *gorm.DB, profileID int64, entries []*BatchEntry) (err error) {
+	if err = tx.Delete(new(BatchEntry), "profile_id = ?", profileID).Error; err != nil {
+		return fmt.Errorf("delete old entries: %v", err)
+	}
+	for _, entry := range entries {
+		entry.ID = 0
+		entry.ProfileID = profileID
+		if err = tx.Create(entry).Error; err != nil {
+			return fmt.Errorf("create entry: %v", err)
+		}
+	}
+	return nil
+}
+
+func (p *BatchProfile) Save() (err error) {
+	if !IsErrRecordNotFound(x.Where("project_id = ? AND name = ? AND id != ?", p.ProjectID, p.Name, p.ID).First(new(BatchProfile)).Error) {
+		return ErrBatchProfileExists{p.Name}
+	} else if err = p.BuildOptions.Validate(); err != nil {
+		return err
+	} else if err = checkSecrets(p.ProjectID, p.SecretList()); err != nil {
+		return err
+	}
+
+	tx := x.Begin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if err = tx.Save(p).Error; err != nil {
+		return err
+	} else if err = saveBatchEntries(tx, p.ID, p.Entries); err != nil {
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func NewBatchProfile(profile *BatchProfile) (err error) {
+	if !IsErrRecordNotFound(x.Where("project_id = ? AND name = ?", profile.ProjectID, profile.Name).First(new(BatchProfile)).Error) {
+		return ErrBatchProfileExists{profile.Name}
+	} else if err = profile.BuildOptions.Validate(); err != nil {
+		return err
+	} else if err = checkSecrets(profile.ProjectID, profile.SecretList()); err != nil {
+		return err
+	}
+
+	tx := x.Begin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if err = tx.Create(profile).Error; err != nil {
+		return err
+	} else if err = saveBatchEntries(tx, profile.ID, profile.Entries); err != nil {
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func GetBatchProfileByID(id int64) (*BatchProfile, error) {
+	profile := new(BatchProfile)
+	return profile, x.First(profile, id).Error
+}
+
+func GetBatchProfileByName(projectID int64, name string) (*BatchProfile, error) {
+	profile := new(BatchProfile)
+	return profile, x.Where("project_id = ? AND name = ?", projectID, name).First(profile).Error
+}
+
+// ListBatchProfiles returns batch profiles of given project, or of all projects when projectID is 0.
+func ListBatchProfiles(projectID int64) ([]*BatchProfile, error) {
+	profiles := make([]*BatchProfile, 0, 5)
+	sess := x.Order("project_id, name")
+	if projectID > 0 {
+		sess = sess.Where("project_id = ?", projectID)
+	}
+	return profiles, sess.Find(&profiles).Error
+}
+
+func DeleteBatchProfileByID(id int64) (err error) {
+	var numSchedules int64
+	if err = x.Model(new(Schedule)).Where("profile_id = ?", id).Count(&numSchedules).Error; err != nil {
+		return fmt.Errorf("count schedules: %v", err)
+	} else if numSchedules > 0 {
+		return ErrBatchProfileInUse{id}
+	}
+
+	tx := x.Begin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if err = tx.Delete(new(BatchEntry), "profile_id = ?", id).Error; err != nil {
+		return fmt.Errorf("delete entries: %v", err)
+	} else if err = tx.Delete(new(BatchProfile), id).Error; err != nil {
+		return fmt.Errorf("delete profile: %v", err)
+	}
+
+	return tx.Commit().Error
+}
+
+// migrateBatchProfiles imports legacy "custom/batch.json" as the default profile.
+func migrateBatchProfiles() error {
+	if len(setting.BatchTasks) == 0 || Count(new(BatchProfile)) > 0 {
+		return nil
+	}
+
+	profile := &BatchProfile{
+		Name:       "default",
+		DefaultRef: "master",
+	}
+	// Webhooks used to trigger batch tasks for references in settings when enabled.
+	if setting.Webhook.Enabled {
+		profile.WebhookRefs = strings.Join(setting.Webhook.Refs, ",")
+	}
+	for _, t := range setting.BatchTasks {
+		profile.Entries = append(profile.Entries, &BatchEntry{
+			OS:   t.OS,
+			Arch: t.Arch,
+			Tags: strings.Join(t.Tags, ","),
+		})
+	}
+	if err := NewBatchProfile(profile); err != nil {
+		return fmt.Errorf("NewBatchProfile: %v", err)
+	}
+
+	return x.Model(new(Schedule)).Where("profile_id = 0").Update("profile_id", profile.ID).Error
+}
+
+// BatchResult describes what happened to each entry when creating batch tasks.
+type BatchResult struct {
+	Profile *BatchProfile
+	Ref     string
+	Commit  string
+
+	Created  []*Task
+	Skipped  []*Task // Tasks already exist for the commit
+	Rejected []*BatchEntry
+}
+
+func (r *BatchResult) RefName() string {
+	return ShortRefName(r.Ref)
+}
+
+// NewBatchTasks creates tasks of the profile for given reference,
+// default reference of the profile is used when it is empty.
+func NewBatchTasks(doerID int64, profile *BatchProfile, ref string) (*BatchResult, error) {
+	if len(ref) == 0 {
+		ref = profile.DefaultRef
+	}
+
+	ref, commit, err := profile.Project.ResolveRef(ref)
+	if err != nil {
+		if IsErrRefNotExist(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("ResolveRef: %v", err)
+	}
+	return NewBatchTasksOfCommit(doerID, profile, ref, commit)
+}
+
+// NewBatchTasksOfCommit creates tasks of the profile for given reference which has
+// already been resolved to the commit, e.g. received from a webhook. Entries that
+// already have a task for the commit are skipped, and entries that no builder matrix
+// can take are rejected. All tasks are created in a single transaction.
+func NewBatchTasksOfCommit(doerID int64, profile *BatchProfile, ref, commit string) (_ *BatchResult, err error) {
+	result := &BatchResult{
+		Profile: profile,
+		Ref:     ref,
+		Commit:  commit,
+	}
+
+	tx := x.Begin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	for _, e := range profile.Entries {
+		task := &Task{
+			ProjectID:    profile.ProjectID,
+			Project:      profile.Project,
+			OS:           e.OS,
+			Arch:         e.Arch,
+			Tags:         e.Tags,
+			TagExpr:      e.TagExpr,
+			Toolchain:    e.Toolchain,
+			Ref:          ref,
+			Commit:       commit,
+			Priority:     profile.Priority,
+			BuildOptions: profile.BuildOptions,
+			PosterID:     doerID,
+		}
+
+		// Check to prevent duplicated tasks
+		var existing *Task
+		if existing, err = findDuplicatedTask(tx, task); err == nil {
+			result.Skipped = append(result.Skipped, existing)
+			continue
+		} else if !IsErrRecordNotFound(err) {
+			return nil, fmt.Errorf("check existing task: %v", err)
+		}
+
+		// Make sure there is a matrix can take the job.
+		var builderIDs []int64
+		var constraint *tagexpr.Expr
+		constraint, err = ParseTagConstraint(e.TagsList(), e.TagExpr)
+		if err != nil {
+			return nil, err
+		}
+		builderIDs, err = MatchBuilders(e.OS, e.Arch, constraint, e.Toolchain)
+		if err != nil && !IsErrNoSuitableMatrix(err) {
+			return nil, fmt.Errorf("MatchBuilders: %v", err)
+		} else if len(builderIDs) == 0 {
+			result.Rejected = append(result.Rejected, e)
+			continue
+		}
+
+		if err = tx.Create(task).Error; err != nil {
+			return nil, fmt.Errorf("create new task: %v", err)
+		}
+		result.Created = append(result.Created, task)
+	}
+
+	if err = tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,286 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package models
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Unknwon/com"
+)
+
+// BuildOptions are extra options to build a task, they are set by the poster
+// or copied from the batch profile that creates the task. Secrets and options
+// that make builders run arbitrary commands can only be set by batch profiles,
+// see BuildOptions.ProfileOnlyOption.
+type BuildOptions struct {
+	BuildFlags   string // Extra flags passed to "go build", e.g. "-race -trimpath"
+	LDFlags      string // Template of "-ldflags" value, e.g. "-X main.Version={ref_name}"
+	Envs         string // Environment variables in format of "KEY=VALUE", one per line
+	PreBuildCmds string // Commands to run before build, one per line
+	Secrets      string // Comma-separated names of project secrets the task may receive
+}
+
+var envKeyPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Validate returns error if any environment variable is malformed.
+func (opts BuildOptions) Validate() error {
+	for i, line := range strings.Split(opts.Envs, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		idx := strings.Index(line, "=")
+		if idx == -1 || !envKeyPattern.MatchString(line[:idx]) {
+			return ErrInvalidBuildEnv{i + 1, line}
+		}
+	}
+	return nil
+}
+
+// flagSpec describes a flag that is known to be safe, i.e. it cannot make
+// builders run programs other than the Go toolchain (e.g. "-toolexec",
+// "-extld", "-overlay" or "-compiler") nor write outside the build directory.
+type flagSpec struct {
+	// isBool is true if the flag takes no value unless given as "-flag=value".
+	isBool bool
+	// valid returns true if the value is allowed, nil means any value is allowed.
+	valid func(value string) bool
+}
+
+func oneOf(values ...string) func(string) bool {
+	return func(value string) bool {
+		return com.IsSliceContainsStr(values, value)
+	}
+}
+
+var (
+	boolValue    = oneOf("true", "false")
+	numberValue  = regexp.MustCompile(`^[0-9]+$`).MatchString
+	boolFlag     = flagSpec{isBool: true, valid: boolValue}
+	anyValueFlag = flagSpec{}
+
+	// Flags of "go tool link".
+	safeLinkerFlags = map[string]flagSpec{
+		"X":             anyValueFlag,
+		"s":             boolFlag,
+		"w":             boolFlag,
+		"buildid":       anyValueFlag,
+		"compressdwarf": boolFlag,
+	}
+	// Flags of "go tool compile".
+	safeCompilerFlags = map[string]flagSpec{
+		"N":     boolFlag,
+		"l":     boolFlag,
+		"m":     boolFlag,
+		"B":     boolFlag,
+		"S":     boolFlag,
+		"dwarf": boolFlag,
+	}
+	// Flags of "go build", flags of other tools are checked by safeToolFlags.
+	safeBuildFlags = map[string]flagSpec{
+		"a":         boolFlag,
+		"race":      boolFlag,
+		"msan":      boolFlag,
+		"asan":      boolFlag,
+		"trimpath":  boolFlag,
+		"v":         boolFlag,
+		"x":         boolFlag,
+		"buildvcs":  {isBool: true, valid: oneOf("true", "false", "auto")},
+		"p":         {valid: numberValue},
+		"mod":       {valid: oneOf("readonly", "vendor", "mod")},
+		"buildmode": {valid: oneOf("default", "exe", "pie")},
+		"ldflags":   {valid: safeToolFlags(safeLinkerFlags)},
+		"gcflags":   {valid: safeToolFlags(safeCompilerFlags)},
+	}
+)
+
+// splitQuoted splits s into fields separated by spaces, and fields can be quoted
+// by single or double quotes, which is how Go commands split values of flags
+// like "-ldflags". It returns false if a quote is not closed.
+func splitQuoted(s string) ([]string, bool) {
+	var (
+		fields []string
+		field  []byte
+		quote  byte
+		inside bool
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				field = append(field, c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inside = true
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if inside {
+				fields = append(fields, string(field))
+				field = field[:0]
+				inside = false
+			}
+		default:
+			field = append(field, c)
+			inside = true
+		}
+	}
+	if quote != 0 {
+		return nil, false
+	}
+	if inside {
+		fields = append(fields, string(field))
+	}
+	return fields, true
+}
+
+// isSafeFlags returns true if every field is a flag in given specs with
+// an allowed value. Values are given as "-flag=value" or "-flag value".
+func isSafeFlags(fields []string, specs map[string]flagSpec) bool {
+	for i := 0; i < len(fields); i++ {
+		if !strings.HasPrefix(fields[i], "-") {
+			return false
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(fields[i], "-"), "-")
+		value, hasValue := "", false
+		if idx := strings.Index(name, "="); idx > -1 {
+			name, value, hasValue = name[:idx], name[idx+1:], true
+		}
+
+		spec, ok := specs[name]
+		if !ok {
+			return false
+		} else if spec.isBool && !hasValue {
+			continue
+		} else if !hasValue {
+			if i+1 >= len(fields) {
+				return false
+			}
+			i++
+			value = fields[i]
+		}
+		if spec.valid != nil && !spec.valid(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// safeToolFlags returns a validator of values of "-ldflags" or "-gcflags",
+// which may have a package pattern prefix, e.g. "all=-N -l".
+func safeToolFlags(specs map[string]flagSpec) func(string) bool {
+	return func(value string) bool {
+		if idx := strings.Index(value, "="); idx > -1 && !strings.HasPrefix(value, "-") {
+			value = value[idx+1:]
+		}
+		fields, ok := splitQuoted(value)
+		return ok && isSafeFlags(fields, specs)
+	}
+}
+
+// isSafeBuildFlags returns true if all flags are known to be safe, fields are
+// split by spaces without quoting in the same way as builders do.
+func isSafeBuildFlags(flags string) bool {
+	return isSafeFlags(strings.Fields(flags), safeBuildFlags)
+}
+
+// isSafeLDFlags returns true if all linker flags of the "-ldflags" template
+// are known to be safe.
+func isSafeLDFlags(ldflags string) bool {
+	fields, ok := splitQuoted(ldflags)
+	return ok && isSafeFlags(fields, safeLinkerFlags)
+}
+
+// ScriptOption returns name of the first option that may make builders run
+// commands other than "go build", or empty string if there is none. Build flags
+// and linker flags are only allowed when all of them are known to be safe.
+// Such options can only be set in batch profiles, which are managed by project
+// admins.
+func (opts BuildOptions) ScriptOption() string {
+	switch {
+	case len(opts.EnvList()) > 0:
+		return "envs"
+	case len(opts.PreBuildCmdList()) > 0:
+		return "pre_build_cmds"
+	case !isSafeBuildFlags(opts.BuildFlags):
+		return "build_flags"
+	case !isSafeLDFlags(opts.LDFlags):
+		return "ldflags"
+	}
+	return ""
+}
+
+// ProfileOnlyOption returns name of the first option that can only be set in
+// batch profiles, or empty string if there is none.
+func (opts BuildOptions) ProfileOnlyOption() string {
+	if option := opts.ScriptOption(); len(option) > 0 {
+		return option
+	} else if len(opts.SecretList()) > 0 {
+		return "secrets"
+	}
+	return ""
+}
+
+func (opts BuildOptions) BuildFlagList() []string {
+	return strings.Fields(opts.BuildFlags)
+}
+
+func (opts BuildOptions) EnvList() []string {
+	return splitLines(opts.Envs)
+}
+
+func (opts BuildOptions) PreBuildCmdList() []string {
+	return splitLines(opts.PreBuildCmds)
+}
+
+func (opts BuildOptions) SecretList() []string {
+	return splitList(opts.Secrets)
+}
+
+func splitLines(s string) []string {
+	list := make([]string, 0, 5)
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			list = append(list, line)
+		}
+	}
+	return list
+}
+
+// ExpandLDFlags returns the ldflags template of the task with variables replaced.
+// Available variables are {commit}, {short_commit}, {ref}, {ref_name}, {build_time},
+// {os}, {arch}, {tags} and {task_id}.
+func (t *Task) ExpandLDFlags(buildTime time.Time) string {
+	if len(t.LDFlags) == 0 {
+		return ""
+	}
+
+	return com.Expand(t.LDFlags, map[string]string{
+		"commit":       t.Commit,
+		"short_commit": t.Commit[:10],
+		"ref":          t.Ref,
+		"ref_name":     t.RefName(),
+		"build_time":   buildTime.UTC().Format(time.RFC3339),
+		"os":           t.OS,
+		"arch":         t.Arch,
+		"tags":         t.Tags,
+		"task_id":      com.ToStr(t.ID),
+	})
+}
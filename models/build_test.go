@@ -0,0 +1,74 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package models
+
+import (
+	"testing"
+)
+
+func TestBuildOptions_ScriptOption(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   BuildOptions
+		option string
+	}{
+		{"no option", BuildOptions{}, ""},
+		{"safe build flags", BuildOptions{BuildFlags: "-race -trimpath -v -p 4 -mod=readonly -buildmode=pie"}, ""},
+		{"safe compiler flags", BuildOptions{BuildFlags: "-gcflags=all=-N -gcflags=-l"}, ""},
+		{"safe linker flags in build flags", BuildOptions{BuildFlags: "-ldflags=-s"}, ""},
+		{"safe linker flags", BuildOptions{LDFlags: "-s -w -X main.Version={ref_name} -X 'main.Name=Luban CI'"}, ""},
+		{"linker flags with values", BuildOptions{LDFlags: "-X=main.Commit={short_commit} -buildid= -compressdwarf=false"}, ""},
+		{"environment variables", BuildOptions{Envs: "CGO_ENABLED=0"}, "envs"},
+		{"pre-build commands", BuildOptions{PreBuildCmds: "make"}, "pre_build_cmds"},
+
+		{"toolexec", BuildOptions{BuildFlags: "-toolexec=/tmp/evil"}, "build_flags"},
+		{"toolexec with double dash", BuildOptions{BuildFlags: "--toolexec /tmp/evil"}, "build_flags"},
+		{"extld inside ldflags", BuildOptions{BuildFlags: "-ldflags=-extld=/tmp/evil"}, "build_flags"},
+		{"quoted extld inside ldflags", BuildOptions{BuildFlags: `-ldflags "-extld /tmp/evil"`}, "build_flags"},
+		{"quoted extld with pattern", BuildOptions{BuildFlags: `-ldflags=all=-extld=/tmp/evil`}, "build_flags"},
+		{"extldflags inside ldflags", BuildOptions{BuildFlags: "-ldflags=-extldflags=-fuse-ld=/tmp/evil"}, "build_flags"},
+		{"gccgo compiler", BuildOptions{BuildFlags: "-compiler=gccgo -gccgoflags=-wrapper=/tmp/evil"}, "build_flags"},
+		{"overlay", BuildOptions{BuildFlags: "-overlay=/tmp/overlay.json"}, "build_flags"},
+		{"pkgdir", BuildOptions{BuildFlags: "-pkgdir /tmp/pkg"}, "build_flags"},
+		{"output path", BuildOptions{BuildFlags: "-o /etc/passwd"}, "build_flags"},
+		{"package argument", BuildOptions{BuildFlags: "-v ./cmd/evil"}, "build_flags"},
+		{"missing value", BuildOptions{BuildFlags: "-p"}, "build_flags"},
+		{"invalid value", BuildOptions{BuildFlags: "-mod=/tmp/go.mod"}, "build_flags"},
+		{"extld", BuildOptions{LDFlags: "-extld=/tmp/evil"}, "ldflags"},
+		{"extld as separate value", BuildOptions{LDFlags: "-X main.Version=1 -extld /tmp/evil"}, "ldflags"},
+		{"extldflags", BuildOptions{LDFlags: "-s -extldflags '-fuse-ld=/tmp/evil'"}, "ldflags"},
+		{"quoted extld", BuildOptions{LDFlags: `"-extld=/tmp/evil"`}, "ldflags"},
+		{"unclosed quote", BuildOptions{LDFlags: `-X 'main.Version=1`}, "ldflags"},
+		{"linkmode", BuildOptions{LDFlags: "-linkmode=external"}, "ldflags"},
+	}
+	for _, test := range tests {
+		if option := test.opts.ScriptOption(); option != test.option {
+			t.Errorf("%s: got %q, want %q", test.name, option, test.option)
+		}
+	}
+}
+
+func TestSplitQuoted(t *testing.T) {
+	fields, ok := splitQuoted(`-X 'main.Name=Luban CI' -X "main.Version=1" -s`)
+	want := []string{"-X", "main.Name=Luban CI", "-X", "main.Version=1", "-s"}
+	if !ok || len(fields) != len(want) {
+		t.Fatalf("got %q, %v", fields, ok)
+	}
+	for i := range want {
+		if fields[i] != want[i] {
+			t.Errorf("field %d: got %q, want %q", i, fields[i], want[i])
+		}
+	}
+}
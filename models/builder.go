@@ -15,12 +15,14 @@
 package models
 
 import (
+	"crypto/x509"
 	"fmt"
 	"strings"
 	"time"
 
-	"github.com/Unknwon/com"
+	"github.com/jinzhu/gorm"
 
+	"github.com/lubanstudio/luban/pkg/tagexpr"
 	"github.com/lubanstudio/luban/pkg/tool"
 )
 
@@ -53,15 +55,64 @@ func ParseTrustLevel(n int) TrustLevel {
 	}
 }
 
+// BuilderMode indicates whether a builder takes new tasks.
+type BuilderMode int
+
+const (
+	BUILDER_MODE_ACTIVE   BuilderMode = iota
+	BUILDER_MODE_DRAINING             // Finishes current task but takes no new ones
+	BUILDER_MODE_DISABLED             // Current task is requeued and takes no new ones
+)
+
+func (m BuilderMode) ToString() string {
+	switch m {
+	case BUILDER_MODE_DRAINING:
+		return "Draining"
+	case BUILDER_MODE_DISABLED:
+		return "Disabled"
+	}
+	return "Active"
+}
+
+func ParseBuilderMode(n int) BuilderMode {
+	switch n {
+	case 1:
+		return BUILDER_MODE_DRAINING
+	case 2:
+		return BUILDER_MODE_DISABLED
+	default:
+		return BUILDER_MODE_ACTIVE
+	}
+}
+
 type Builder struct {
 	ID         int64
+	OwnerID    int64 `gorm:"INDEX"`
+	Owner      *User `gorm:"-" json:"-"`
 	Name       string
-	Token      string `gorm:"UNIQUE"`
 	TrustLevel TrustLevel
 
+	// Client certificate used to authenticate over builder TLS listener,
+	// fingerprint takes precedence over subject common name.
+	CertSubject     string `gorm:"INDEX"`
+	CertFingerprint string `gorm:"INDEX"` // Lower case hex of SHA256 without colons
+
+	// Admin-approved values that matrices of the builder can have, empty means no limit.
+	AllowedOSs   string `gorm:"column:allowed_oss"`
+	AllowedArchs string
+	AllowedTags  string
+
+	Mode BuilderMode
+	// Scheduled maintenance window, builder takes no new tasks during the period.
+	MaintenanceStart int64
+	MaintenanceEnd   int64
+
 	IsIdle        bool `gorm:"NOT NULL"`
 	LastHeartBeat int64
+	LastStatus    string // Status reported by last heartbeat
+	Version       string // Version of builder agent
 	Created       int64
+	Deleted       int64 `gorm:"INDEX"` // Builders are soft deleted to keep attribution of tasks
 
 	TaskID int64
 }
@@ -70,9 +121,27 @@ func (b *Builder) BeforeCreate() {
 	b.Created = time.Now().Unix()
 }
 
+// BUILDER_OFFLINE_TIMEOUT is the duration without heartbeat after which a builder is offline.
+const BUILDER_OFFLINE_TIMEOUT = time.Minute
+
+func (b *Builder) IsOnline() bool {
+	return b.LastHeartBeat >= time.Now().Add(-BUILDER_OFFLINE_TIMEOUT).Unix()
+}
+
 func (b *Builder) Status() string {
-	if b.LastHeartBeat < time.Now().Add(-1*time.Minute).Unix() {
+	if b.IsDeleted() {
+		return "Deleted"
+	} else if !b.IsOnline() {
 		return "Offline"
+	} else if b.Mode == BUILDER_MODE_DISABLED {
+		return "Disabled"
+	} else if b.Mode == BUILDER_MODE_DRAINING || b.InMaintenance() {
+		if !b.IsIdle {
+			return "Draining"
+		} else if b.InMaintenance() {
+			return "Maintenance"
+		}
+		return "Drained"
 	}
 	if b.IsIdle {
 		return "Idle"
@@ -80,35 +149,280 @@ func (b *Builder) Status() string {
 	return "Busy"
 }
 
+func (b *Builder) MaintenanceStartTime() time.Time {
+	return time.Unix(b.MaintenanceStart, 0)
+}
+
+func (b *Builder) MaintenanceEndTime() time.Time {
+	return time.Unix(b.MaintenanceEnd, 0)
+}
+
+func (b *Builder) HasMaintenance() bool {
+	return b.MaintenanceEnd > time.Now().Unix()
+}
+
+// InMaintenance returns true if current time is in the maintenance window.
+func (b *Builder) InMaintenance() bool {
+	now := time.Now().Unix()
+	return b.MaintenanceStart <= now && now < b.MaintenanceEnd
+}
+
+// AcceptsTasks returns true if the builder is able to take new tasks.
+func (b *Builder) AcceptsTasks() bool {
+	return b.IsApproved() && b.Mode == BUILDER_MODE_ACTIVE && !b.InMaintenance()
+}
+
+// acceptingBuilders is the query scope of builders that are able to take new tasks,
+// see Builder.AcceptsTasks.
+func acceptingBuilders(db *gorm.DB) *gorm.DB {
+	now := time.Now().Unix()
+	return db.Where("deleted = 0 AND trust_level > ? AND mode = ? AND NOT (maintenance_start <= ? AND maintenance_end > ?)",
+		TRUST_LEVEL_UNAPPROVED, BUILDER_MODE_ACTIVE, now, now)
+}
+
+// idleBuilders is the query scope of online builders that are waiting for new tasks.
+func idleBuilders(db *gorm.DB) *gorm.DB {
+	return acceptingBuilders(db).Where("is_idle = ? AND last_heart_beat >= ?",
+		true, time.Now().Add(-BUILDER_OFFLINE_TIMEOUT).Unix())
+}
+
+// SetMode changes mode of the builder, current task is requeued when the builder is disabled.
+func (b *Builder) SetMode(mode BuilderMode) (err error) {
+	tx := x.Begin()
+	defer releaseTransaction(tx)
+
+	b.Mode = mode
+	cols := map[string]interface{}{
+		"mode": b.Mode,
+	}
+	if mode == BUILDER_MODE_DISABLED {
+		if err = b.requeueTask(tx); err != nil {
+			return fmt.Errorf("requeueTask: %v", err)
+		}
+		cols["task_id"] = b.TaskID
+		cols["is_idle"] = b.IsIdle
+	}
+	// Heartbeat may update the same row concurrently, only write columns changed here.
+	if err = tx.Model(b).Where("deleted = 0").Updates(cols).Error; err != nil {
+		return fmt.Errorf("update builder: %v", err)
+	}
+
+	return tx.Commit().Error
+}
+
+// requeueTask puts current task of the builder back to the queue.
+func (b *Builder) requeueTask(tx *gorm.DB) error {
+	if b.TaskID == 0 {
+		return nil
+	}
+
+	if err := tx.Model(new(Task)).Where("id = ?", b.TaskID).Updates(map[string]interface{}{
+		"status":     TASK_STATUS_PENDING,
+		"builder_id": 0,
+		"started":    0,
+		"updated":    time.Now().Unix(),
+	}).Error; err != nil {
+		return err
+	}
+	b.TaskID = 0
+	b.IsIdle = true
+	return nil
+}
+
+// SetMaintenance schedules maintenance window of the builder, zero values clear the window.
+func (b *Builder) SetMaintenance(start, end time.Time) error {
+	if start.IsZero() || end.IsZero() {
+		b.MaintenanceStart, b.MaintenanceEnd = 0, 0
+	} else if !end.After(start) {
+		return ErrInvalidMaintenanceWindow{start, end}
+	} else {
+		b.MaintenanceStart, b.MaintenanceEnd = start.Unix(), end.Unix()
+	}
+	return x.Model(b).Where("deleted = 0").Updates(map[string]interface{}{
+		"maintenance_start": b.MaintenanceStart,
+		"maintenance_end":   b.MaintenanceEnd,
+	}).Error
+}
+
 func (b *Builder) CreatedTime() time.Time {
 	return time.Unix(b.Created, 0)
 }
 
-// HeartBeat updates last active and status.
-func (b *Builder) HeartBeat(isIdle bool) error {
+func (b *Builder) IsDeleted() bool {
+	return b.Deleted > 0
+}
+
+func (b *Builder) DeletedTime() time.Time {
+	return time.Unix(b.Deleted, 0)
+}
+
+func (b *Builder) IsApproved() bool {
+	return b.TrustLevel > TRUST_LEVEL_UNAPPROVED
+}
+
+// IsOwnedBy returns true if given user is able to manage the builder,
+// which are the owner and admins.
+func (b *Builder) IsOwnedBy(u *User) bool {
+	if b.IsDeleted() {
+		return false
+	}
+	return u.IsAdmin() || (b.OwnerID > 0 && b.OwnerID == u.ID)
+}
+
+// GetOwner loads owner of the builder, builders created before ownership
+// was introduced have no owner.
+func (b *Builder) GetOwner() (err error) {
+	if b.OwnerID == 0 || b.Owner != nil {
+		return nil
+	}
+	b.Owner, err = GetUserByID(b.OwnerID)
+	if IsErrRecordNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (b *Builder) AllowedOSList() []string {
+	return splitList(b.AllowedOSs)
+}
+
+func (b *Builder) AllowedArchList() []string {
+	return splitList(b.AllowedArchs)
+}
+
+func (b *Builder) AllowedTagList() []string {
+	return splitList(b.AllowedTags)
+}
+
+func (b *Builder) LastHeartBeatTime() time.Time {
+	return time.Unix(b.LastHeartBeat, 0)
+}
+
+// HeartBeat updates last active and status. It records a history when the builder
+// comes back online, reports a different status or runs another agent version.
+func (b *Builder) HeartBeat(isIdle bool, status, version string) error {
+	if b.Status() == "Offline" || status != b.LastStatus || version != b.Version {
+		history := &HeartBeatHistory{
+			BuilderID: b.ID,
+			Status:    status,
+			Version:   version,
+		}
+		if err := x.Create(history).Error; err != nil {
+			return fmt.Errorf("create heartbeat history: %v", err)
+		}
+	}
+
+	// Only update columns owned by heartbeat, saving whole row would bring back
+	// a builder deleted meanwhile and overwrite changes made by scheduler, or
+	// mode and maintenance window set by admin.
 	b.LastHeartBeat = time.Now().Unix()
+	b.LastStatus = status
+	b.Version = version
 	b.IsIdle = isIdle
-	return b.Save()
+	return x.Model(b).Where("deleted = 0").Updates(map[string]interface{}{
+		"last_heart_beat": b.LastHeartBeat,
+		"last_status":     b.LastStatus,
+		"version":         b.Version,
+		"is_idle":         b.IsIdle,
+	}).Error
+}
+
+// HeartBeatHistory is a record of status change of a builder.
+type HeartBeatHistory struct {
+	ID        int64
+	BuilderID int64 `gorm:"INDEX"`
+	Status    string
+	Version   string
+	Created   int64
+}
+
+func (h *HeartBeatHistory) BeforeCreate() {
+	h.Created = time.Now().Unix()
+}
+
+func (h *HeartBeatHistory) CreatedTime() time.Time {
+	return time.Unix(h.Created, 0)
+}
+
+// ListHeartBeatHistories returns latest heartbeat histories of the builder.
+func ListHeartBeatHistories(builderID int64, limit int) ([]*HeartBeatHistory, error) {
+	histories := make([]*HeartBeatHistory, 0, limit)
+	return histories, x.Where("builder_id = ?", builderID).Order("id DESC").Limit(limit).Find(&histories).Error
+}
+
+// BuilderStats is the statistics of tasks finished by a builder.
+type BuilderStats struct {
+	NumSucceed int64
+	NumFailed  int64
+}
+
+func (s *BuilderStats) NumFinished() int64 {
+	return s.NumSucceed + s.NumFailed
+}
+
+// SuccessRate returns percentage of succeed tasks in finished ones.
+func (s *BuilderStats) SuccessRate() float64 {
+	if s.NumFinished() == 0 {
+		return 0
+	}
+	return float64(s.NumSucceed) * 100 / float64(s.NumFinished())
+}
+
+func GetBuilderStats(builderID int64) (*BuilderStats, error) {
+	stats := new(BuilderStats)
+	// Only succeed tasks can be archived.
+	if err := x.Model(new(Task)).Where("builder_id = ? AND status IN (?)", builderID,
+		[]TaskStatus{TASK_STATUS_SUCCEED, TASK_STATUS_ARCHIVED}).Count(&stats.NumSucceed).Error; err != nil {
+		return nil, fmt.Errorf("count succeed tasks: %v", err)
+	} else if err = x.Model(new(Task)).Where("builder_id = ? AND status = ?", builderID,
+		TASK_STATUS_FAILED).Count(&stats.NumFailed).Error; err != nil {
+		return nil, fmt.Errorf("count failed tasks: %v", err)
+	}
+	return stats, nil
 }
 
 func (b *Builder) Save() error {
-	if !IsErrRecordNotFound(x.Where("name = ? AND id != ?", b.Name, b.ID).First(new(Builder)).Error) {
+	if !IsErrRecordNotFound(x.Where("name = ? AND id != ? AND deleted = 0", b.Name, b.ID).First(new(Builder)).Error) {
 		return ErrBuilderExists{b.Name}
+	} else if len(b.CertFingerprint) > 0 &&
+		!IsErrRecordNotFound(x.Where("cert_fingerprint = ? AND id != ? AND deleted = 0", b.CertFingerprint, b.ID).First(new(Builder)).Error) {
+		return ErrBuilderCertExists{b.CertFingerprint}
+	} else if len(b.CertSubject) > 0 &&
+		!IsErrRecordNotFound(x.Where("cert_subject = ? AND id != ? AND deleted = 0", b.CertSubject, b.ID).First(new(Builder)).Error) {
+		return ErrBuilderCertSubjectExists{b.CertSubject}
 	}
 	return x.Save(b).Error
 }
 
-func NewBuilder(name string) (*Builder, error) {
-	if !IsErrRecordNotFound(x.Where("name = ?", name).First(new(Builder)).Error) {
-		return nil, ErrBuilderExists{name}
+// NewBuilder creates a new builder owned by given user with a token of all scopes,
+// and returns the plain token. Builders registered by non-admin users start as
+// unapproved and do not take tasks until approved.
+func NewBuilder(owner *User, name string) (_ *Builder, _ string, err error) {
+	if !IsErrRecordNotFound(x.Where("name = ? AND deleted = 0", name).First(new(Builder)).Error) {
+		return nil, "", ErrBuilderExists{name}
 	}
 
+	tx := x.Begin()
+	defer releaseTransaction(tx)
+
 	builder := &Builder{
+		OwnerID:    owner.ID,
 		Name:       name,
-		Token:      tool.NewSecretToekn(),
-		TrustLevel: 1,
+		TrustLevel: TRUST_LEVEL_UNAPPROVED,
+	}
+	if owner.IsAdmin() {
+		builder.TrustLevel = TRUST_LEVEL_APPROVED
+	}
+	if err = tx.Create(builder).Error; err != nil {
+		return nil, "", fmt.Errorf("create builder: %v", err)
+	}
+
+	plain := tool.NewSecretToekn()
+	if _, err = createBuilderToken(tx, builder.ID, plain, BuilderScopes); err != nil {
+		return nil, "", fmt.Errorf("create builder token: %v", err)
 	}
-	return builder, x.Create(builder).Error
+
+	return builder, plain, tx.Commit().Error
 }
 
 func GetBuilderByID(id int64) (*Builder, error) {
@@ -116,48 +430,136 @@ func GetBuilderByID(id int64) (*Builder, error) {
 	return builder, x.First(builder, id).Error
 }
 
-func GetBuilderByToken(token string) (*Builder, error) {
+// NormalizeCertFingerprint returns fingerprint in lower case hex without colons and spaces.
+func NormalizeCertFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(fingerprint))
+}
+
+// GetBuilderByCertificate returns builder that verified client certificate belongs to.
+// Builders with fingerprint set are not matched by subject common name, and common
+// name matches more than one builder (saved before subjects were unique) is rejected.
+func GetBuilderByCertificate(cert *x509.Certificate) (*Builder, error) {
 	builder := new(Builder)
-	return builder, x.Where("token = ?", token).First(builder).Error
+	err := x.Where("cert_fingerprint = ? AND deleted = 0", tool.CertFingerprint(cert.Raw)).First(builder).Error
+	if err == nil || !IsErrRecordNotFound(err) || len(cert.Subject.CommonName) == 0 {
+		return builder, err
+	}
+
+	builders := make([]*Builder, 0, 2)
+	if err = x.Where("cert_subject = ? AND cert_fingerprint = '' AND deleted = 0", cert.Subject.CommonName).
+		Limit(2).Find(&builders).Error; err != nil {
+		return nil, err
+	} else if len(builders) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	} else if len(builders) > 1 {
+		return nil, ErrBuilderCertSubjectExists{cert.Subject.CommonName}
+	}
+	return builders[0], nil
 }
 
 func ListBuilders() ([]*Builder, error) {
 	builders := make([]*Builder, 0, 10)
-	return builders, x.Find(&builders).Error
+	return builders, x.Where("deleted = 0").Find(&builders).Error
+}
+
+// ListOwnedBuilders returns builders owned by given user.
+func ListOwnedBuilders(ownerID int64) ([]*Builder, error) {
+	builders := make([]*Builder, 0, 5)
+	return builders, x.Where("owner_id = ? AND deleted = 0", ownerID).Find(&builders).Error
+}
+
+// ListPendingBuilders returns builders waiting for approval.
+func ListPendingBuilders() ([]*Builder, error) {
+	builders := make([]*Builder, 0, 5)
+	return builders, x.Where("trust_level = ? AND deleted = 0", TRUST_LEVEL_UNAPPROVED).Order("id").Find(&builders).Error
+}
+
+func CountPendingBuilders() int64 {
+	var count int64
+	x.Model(new(Builder)).Where("trust_level = ? AND deleted = 0", TRUST_LEVEL_UNAPPROVED).Count(&count)
+	return count
+}
+
+func GetBuildersByIDs(ids []int64) ([]*Builder, error) {
+	builders := make([]*Builder, 0, len(ids))
+	if len(ids) == 0 {
+		return builders, nil
+	}
+	return builders, x.Where("id IN (?)", tool.Int64sToStrings(ids)).Order("id").Find(&builders).Error
 }
 
 func CountBuilders() int64 {
-	return Count(new(Builder))
+	var count int64
+	x.Model(new(Builder)).Where("deleted = 0").Count(&count)
+	return count
 }
 
-func RegenerateBuilderToken(id int64) error {
-	return x.First(new(Builder), id).Update("token", tool.NewSecretToekn()).Error
+// DeleteBuilderByID soft deletes the builder so tasks built by it are still attributed.
+// Its matrices are deleted, current task is requeued and tokens are revoked.
+func DeleteBuilderByID(id int64) (err error) {
+	builder, err := GetBuilderByID(id)
+	if err != nil {
+		return fmt.Errorf("GetBuilderByID: %v", err)
+	} else if builder.IsDeleted() {
+		return nil
+	}
+
+	tx := x.Begin()
+	defer releaseTransaction(tx)
+
+	if err = deleteBuilderMatrices(tx, id); err != nil {
+		return fmt.Errorf("deleteBuilderMatrices: %v", err)
+	} else if err = builder.requeueTask(tx); err != nil {
+		return fmt.Errorf("requeueTask: %v", err)
+	}
+
+	if err = tx.Delete(new(BuilderToken), "builder_id = ?", id).Error; err != nil {
+		return fmt.Errorf("delete tokens: %v", err)
+	}
+
+	builder.Deleted = time.Now().Unix()
+	if err = tx.Save(builder).Error; err != nil {
+		return fmt.Errorf("save builder: %v", err)
+	}
+
+	return tx.Commit().Error
 }
 
-// TODO: delete building history and matrices
-func DeleteBuilderByID(id int64) error {
-	return x.Delete(new(Builder), id).Error
+// ParseTagConstraint returns tag expression that requires all given tags
+// and satisfies the extra expression.
+func ParseTagConstraint(tags []string, extra string) (*tagexpr.Expr, error) {
+	expr, err := tagexpr.Parse(extra)
+	if err != nil {
+		return nil, ErrInvalidTagExpr{err}
+	}
+	return tagexpr.All(tagexpr.And(tags), expr), nil
 }
 
-func MatchBuilders(os, arch string, tags []string) ([]int64, error) {
-	matrices, err := FindMatrices(os, arch)
+// MatchBuilders returns IDs of builders have a matrix for given OS and architecture,
+// with supported tags satisfy the tag expression and toolchain satisfies requirement.
+func MatchBuilders(os, arch string, tags *tagexpr.Expr, tc Toolchain) ([]int64, error) {
+	matrices, err := findCandidateMatrices(os, arch, tags.Required(), tc)
 	if err != nil {
-		return nil, fmt.Errorf("FindBuilders: %v", err)
+		return nil, fmt.Errorf("findCandidateMatrices: %v", err)
 	}
 	if len(matrices) == 0 {
-		return nil, ErrNoSuitableMatrix{os, arch, tags}
+		return nil, ErrNoSuitableMatrix{os, arch, tags.String(), tc}
+	}
+
+	// Candidates already have all required tags, only expressions with "||" or "!"
+	// need to be evaluated against supported tags.
+	isConjunction := tags.IsConjunction()
+	if !isConjunction {
+		if err = loadMatrixTags(matrices); err != nil {
+			return nil, fmt.Errorf("loadMatrixTags: %v", err)
+		}
 	}
 
 	marked := make(map[int64]bool)
 	builderIDs := make([]int64, 0, 5)
-CHECK_TAG:
 	for _, m := range matrices {
-		supportTags := strings.Split(m.Tags, ",")
-
-		for _, tag := range tags {
-			if !com.IsSliceContainsStr(supportTags, tag) {
-				continue CHECK_TAG
-			}
+		if !m.Toolchain.Satisfy(tc) || (!isConjunction && !tags.Eval(m.TagSet())) {
+			continue
 		}
 
 		if !marked[m.BuilderID] {
@@ -0,0 +1,244 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package models
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Unknwon/com"
+	"github.com/jinzhu/gorm"
+
+	"github.com/lubanstudio/luban/pkg/tool"
+)
+
+// Scopes of builder tokens.
+const (
+	BUILDER_SCOPE_HEARTBEAT = "heartbeat" // Send heartbeats and update matrices
+	BUILDER_SCOPE_UPLOAD    = "upload"    // Upload artifacts and build logs
+)
+
+var BuilderScopes = []string{BUILDER_SCOPE_HEARTBEAT, BUILDER_SCOPE_UPLOAD}
+
+// tokenPrefixLength is the length of plain token prefix stored for lookup,
+// which is shared by builder tokens and access tokens.
+const tokenPrefixLength = 8
+
+// BuilderToken is a secret token used by a builder to call builder APIs.
+// Only a salted hash of the token is stored, the plain token is shown once.
+type BuilderToken struct {
+	ID         int64
+	BuilderID  int64  `gorm:"INDEX"`
+	Prefix     string `gorm:"INDEX"`
+	Salt       string `json:"-"`
+	Hash       string `json:"-"`
+	Scopes     string // Comma-separated
+	Expires    int64  // Set when the token is rotated, 0 means never expires
+	LastUsed   int64
+	LastUsedIP string `gorm:"column:last_used_ip"`
+	Created    int64
+}
+
+func (t *BuilderToken) BeforeCreate() {
+	t.Created = time.Now().Unix()
+}
+
+func (t *BuilderToken) CreatedTime() time.Time {
+	return time.Unix(t.Created, 0)
+}
+
+func (t *BuilderToken) ExpiresTime() time.Time {
+	return time.Unix(t.Expires, 0)
+}
+
+func (t *BuilderToken) LastUsedTime() time.Time {
+	return time.Unix(t.LastUsed, 0)
+}
+
+func (t *BuilderToken) IsExpired() bool {
+	return t.Expires > 0 && t.Expires <= time.Now().Unix()
+}
+
+func (t *BuilderToken) ScopeList() []string {
+	return splitList(t.Scopes)
+}
+
+func (t *BuilderToken) HasScope(scope string) bool {
+	return com.IsSliceContainsStr(t.ScopeList(), scope)
+}
+
+func hashToken(salt, token string) string {
+	return tool.EncodeSHA256(salt + token)
+}
+
+// validateBuilderScopes returns error if any of scopes is unknown or none is given.
+func validateBuilderScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return ErrInvalidBuilderScope{""}
+	}
+	for _, scope := range scopes {
+		if !com.IsSliceContainsStr(BuilderScopes, scope) {
+			return ErrInvalidBuilderScope{scope}
+		}
+	}
+	return nil
+}
+
+func createBuilderToken(e *gorm.DB, builderID int64, plain string, scopes []string) (*BuilderToken, error) {
+	salt := tool.NewSecretToekn()[:10]
+	t := &BuilderToken{
+		BuilderID: builderID,
+		Prefix:    plain[:tokenPrefixLength],
+		Salt:      salt,
+		Hash:      hashToken(salt, plain),
+		Scopes:    strings.Join(scopes, ","),
+	}
+	return t, e.Create(t).Error
+}
+
+// NewBuilderToken creates a new token with given scopes for the builder,
+// and returns the plain token which is not stored anywhere.
+func NewBuilderToken(builderID int64, scopes []string) (*BuilderToken, string, error) {
+	if err := validateBuilderScopes(scopes); err != nil {
+		return nil, "", err
+	}
+
+	plain := tool.NewSecretToekn()
+	t, err := createBuilderToken(x, builderID, plain, scopes)
+	if err != nil {
+		return nil, "", err
+	}
+	return t, plain, nil
+}
+
+// GetBuilderTokenByToken returns the token matches given plain token,
+// expired tokens are treated as not exist.
+func GetBuilderTokenByToken(plain string) (*BuilderToken, error) {
+	if len(plain) < tokenPrefixLength {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	candidates := make([]*BuilderToken, 0, 1)
+	if err := x.Where("prefix = ?", plain[:tokenPrefixLength]).Find(&candidates).Error; err != nil {
+		return nil, err
+	}
+	for _, t := range candidates {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hashToken(t.Salt, plain))) == 1 {
+			if t.IsExpired() {
+				return nil, gorm.ErrRecordNotFound
+			}
+			return t, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+// GetBuilderTokenByID returns token of the builder by given ID.
+func GetBuilderTokenByID(builderID, id int64) (*BuilderToken, error) {
+	t := new(BuilderToken)
+	return t, x.Where("id = ? AND builder_id = ?", id, builderID).First(t).Error
+}
+
+// UpdateLastUsed records when and where the token is used.
+func (t *BuilderToken) UpdateLastUsed(ip string) error {
+	t.LastUsed = time.Now().Unix()
+	t.LastUsedIP = ip
+	return x.Model(t).Updates(map[string]interface{}{
+		"last_used":    t.LastUsed,
+		"last_used_ip": t.LastUsedIP,
+	}).Error
+}
+
+// ListBuilderTokens returns tokens of the builder that are not expired.
+func ListBuilderTokens(builderID int64) ([]*BuilderToken, error) {
+	tokens := make([]*BuilderToken, 0, 2)
+	return tokens, x.Where("builder_id = ? AND (expires = 0 OR expires > ?)", builderID, time.Now().Unix()).
+		Order("id").Find(&tokens).Error
+}
+
+// Rotate creates a new token with same scopes, and keeps the old token valid
+// for given grace period so that running agent is able to switch to the new one.
+// The old token is deleted immediately when grace is 0.
+func (t *BuilderToken) Rotate(grace time.Duration) (_ *BuilderToken, _ string, err error) {
+	tx := x.Begin()
+	defer releaseTransaction(tx)
+
+	if grace > 0 {
+		err = tx.Model(t).Update("expires", time.Now().Add(grace).Unix()).Error
+	} else {
+		err = tx.Delete(t).Error
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("expire old token: %v", err)
+	}
+
+	plain := tool.NewSecretToekn()
+	nt, err := createBuilderToken(tx, t.BuilderID, plain, t.ScopeList())
+	if err != nil {
+		return nil, "", fmt.Errorf("create new token: %v", err)
+	}
+	return nt, plain, tx.Commit().Error
+}
+
+func DeleteBuilderToken(builderID, id int64) error {
+	return x.Where("id = ? AND builder_id = ?", id, builderID).Delete(new(BuilderToken)).Error
+}
+
+// migrateBuilderTokens moves legacy plain tokens of builders to builder token table.
+func migrateBuilderTokens() (err error) {
+	if !x.Dialect().HasColumn("builders", "token") {
+		return nil
+	}
+
+	var legacy []struct {
+		ID      int64
+		Token   string
+		Deleted int64
+	}
+	if err = x.Table("builders").Select("id, token, deleted").Scan(&legacy).Error; err != nil {
+		return fmt.Errorf("select legacy tokens: %v", err)
+	}
+
+	tx := x.Begin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// MySQL commits implicitly before dropping the column, tokens that have been
+	// copied are skipped in case the column failed to be dropped last time.
+	for _, b := range legacy {
+		if b.Deleted > 0 || len(b.Token) < tokenPrefixLength {
+			continue
+		}
+
+		var count int64
+		if err = tx.Model(new(BuilderToken)).Where("builder_id = ? AND prefix = ?", b.ID, b.Token[:tokenPrefixLength]).Count(&count).Error; err != nil {
+			return fmt.Errorf("count builder tokens: %v", err)
+		} else if count > 0 {
+			continue
+		}
+		if _, err = createBuilderToken(tx, b.ID, b.Token, BuilderScopes); err != nil {
+			return fmt.Errorf("create builder token: %v", err)
+		}
+	}
+	if err = tx.Model(new(Builder)).DropColumn("token").Error; err != nil {
+		return fmt.Errorf("drop column: %v", err)
+	}
+	return tx.Commit().Error
+}
@@ -16,9 +16,48 @@ package models
 
 import (
 	"fmt"
-	"strings"
+	"time"
 )
 
+type ErrUserExists struct {
+	Username string
+}
+
+func IsErrUserExists(err error) bool {
+	_, ok := err.(ErrUserExists)
+	return ok
+}
+
+func (err ErrUserExists) Error() string {
+	return fmt.Sprintf("User already exists [username: %s]", err.Username)
+}
+
+type ErrUserNameAmbiguous struct {
+	Name string
+}
+
+func IsErrUserNameAmbiguous(err error) bool {
+	_, ok := err.(ErrUserNameAmbiguous)
+	return ok
+}
+
+func (err ErrUserNameAmbiguous) Error() string {
+	return fmt.Sprintf("More than one user has the name, use \"<source>:<username>\" instead [name: %s]", err.Name)
+}
+
+type ErrAccessTokenExists struct {
+	Name string
+}
+
+func IsErrAccessTokenExists(err error) bool {
+	_, ok := err.(ErrAccessTokenExists)
+	return ok
+}
+
+func (err ErrAccessTokenExists) Error() string {
+	return fmt.Sprintf("Access token already exists [name: %s]", err.Name)
+}
+
 type ErrBuilderExists struct {
 	Name string
 }
@@ -32,10 +71,37 @@ func (err ErrBuilderExists) Error() string {
 	return fmt.Sprintf("Builder already exists [name: %s]", err.Name)
 }
 
+type ErrBuilderCertExists struct {
+	Fingerprint string
+}
+
+func IsErrBuilderCertExists(err error) bool {
+	_, ok := err.(ErrBuilderCertExists)
+	return ok
+}
+
+func (err ErrBuilderCertExists) Error() string {
+	return fmt.Sprintf("Builder with same certificate fingerprint already exists [fingerprint: %s]", err.Fingerprint)
+}
+
+type ErrBuilderCertSubjectExists struct {
+	Subject string
+}
+
+func IsErrBuilderCertSubjectExists(err error) bool {
+	_, ok := err.(ErrBuilderCertSubjectExists)
+	return ok
+}
+
+func (err ErrBuilderCertSubjectExists) Error() string {
+	return fmt.Sprintf("Builder with same certificate subject already exists [subject: %s]", err.Subject)
+}
+
 type ErrNoSuitableMatrix struct {
-	OS   string
-	Arch string
-	Tags []string
+	OS        string
+	Arch      string
+	Tags      string // Tag expression
+	Toolchain Toolchain
 }
 
 func IsErrNoSuitableMatrix(err error) bool {
@@ -44,5 +110,277 @@ func IsErrNoSuitableMatrix(err error) bool {
 }
 
 func (err ErrNoSuitableMatrix) Error() string {
-	return fmt.Sprintf("no suitable matrix for the task [os: %s, arch: %s, tags: %s]", err.OS, err.Arch, strings.Join(err.Tags, ","))
+	return fmt.Sprintf("no suitable matrix for the task [os: %s, arch: %s, tags: %s, toolchain: %s]",
+		err.OS, err.Arch, err.Tags, err.Toolchain.String())
+}
+
+type ErrInvalidMaintenanceWindow struct {
+	Start time.Time
+	End   time.Time
+}
+
+func IsErrInvalidMaintenanceWindow(err error) bool {
+	_, ok := err.(ErrInvalidMaintenanceWindow)
+	return ok
+}
+
+func (err ErrInvalidMaintenanceWindow) Error() string {
+	return fmt.Sprintf("maintenance window must end after it starts [start: %s, end: %s]", err.Start, err.End)
+}
+
+type ErrInvalidBuilderScope struct {
+	Scope string
+}
+
+func IsErrInvalidBuilderScope(err error) bool {
+	_, ok := err.(ErrInvalidBuilderScope)
+	return ok
+}
+
+func (err ErrInvalidBuilderScope) Error() string {
+	return fmt.Sprintf("invalid builder token scope [scope: %s]", err.Scope)
+}
+
+type ErrMatrixNotAllowed struct {
+	Field string
+	Value string
+}
+
+func IsErrMatrixNotAllowed(err error) bool {
+	_, ok := err.(ErrMatrixNotAllowed)
+	return ok
+}
+
+func (err ErrMatrixNotAllowed) Error() string {
+	return fmt.Sprintf("matrix is not allowed [field: %s, value: %s]", err.Field, err.Value)
+}
+
+type ErrInvalidGoVersion struct {
+	Constraint string
+}
+
+func IsErrInvalidGoVersion(err error) bool {
+	_, ok := err.(ErrInvalidGoVersion)
+	return ok
+}
+
+func (err ErrInvalidGoVersion) Error() string {
+	return fmt.Sprintf("invalid Go version constraint [constraint: %s]", err.Constraint)
+}
+
+type ErrInvalidToolchain struct {
+	Name  string
+	Value string
+}
+
+func IsErrInvalidToolchain(err error) bool {
+	_, ok := err.(ErrInvalidToolchain)
+	return ok
+}
+
+func (err ErrInvalidToolchain) Error() string {
+	return fmt.Sprintf("invalid toolchain, path separators and \"..\" are not allowed [%s: %s]", err.Name, err.Value)
+}
+
+type ErrInvalidProjectSetting struct {
+	Field  string // "clone_url", "pack_root" or "pack_formats"
+	Value  string
+	Reason string
+}
+
+func IsErrInvalidProjectSetting(err error) bool {
+	_, ok := err.(ErrInvalidProjectSetting)
+	return ok
+}
+
+func (err ErrInvalidProjectSetting) Error() string {
+	return fmt.Sprintf("invalid project setting, %s [%s: %s]", err.Reason, err.Field, err.Value)
+}
+
+type ErrInvalidTag struct {
+	Tag    string
+	Reason string
+}
+
+func IsErrInvalidTag(err error) bool {
+	_, ok := err.(ErrInvalidTag)
+	return ok
+}
+
+func (err ErrInvalidTag) Error() string {
+	return fmt.Sprintf("invalid tag, %s [tag: %s]", err.Reason, err.Tag)
+}
+
+type ErrInvalidTagExpr struct {
+	Err error
+}
+
+func IsErrInvalidTagExpr(err error) bool {
+	_, ok := err.(ErrInvalidTagExpr)
+	return ok
+}
+
+func (err ErrInvalidTagExpr) Error() string {
+	return err.Err.Error()
+}
+
+type ErrRefNotExist struct {
+	Ref string
+}
+
+func IsErrRefNotExist(err error) bool {
+	_, ok := err.(ErrRefNotExist)
+	return ok
+}
+
+func (err ErrRefNotExist) Error() string {
+	return fmt.Sprintf("reference does not exist [ref: %s]", err.Ref)
+}
+
+type ErrInvalidTaskStatus struct {
+	ID     int64
+	Status TaskStatus
+	Op     string
+}
+
+func IsErrInvalidTaskStatus(err error) bool {
+	_, ok := err.(ErrInvalidTaskStatus)
+	return ok
+}
+
+func (err ErrInvalidTaskStatus) Error() string {
+	return fmt.Sprintf("task cannot be %s in current status [id: %d, status: %s]", err.Op, err.ID, err.Status.ToString())
+}
+
+type ErrScheduleExists struct {
+	Name string
+}
+
+func IsErrScheduleExists(err error) bool {
+	_, ok := err.(ErrScheduleExists)
+	return ok
+}
+
+func (err ErrScheduleExists) Error() string {
+	return fmt.Sprintf("Schedule already exists [name: %s]", err.Name)
+}
+
+type ErrInvalidCronSpec struct {
+	Spec string
+	Err  error
+}
+
+func IsErrInvalidCronSpec(err error) bool {
+	_, ok := err.(ErrInvalidCronSpec)
+	return ok
+}
+
+func (err ErrInvalidCronSpec) Error() string {
+	return fmt.Sprintf("invalid cron spec [spec: %s]: %v", err.Spec, err.Err)
+}
+
+type ErrBatchProfileExists struct {
+	Name string
+}
+
+func IsErrBatchProfileExists(err error) bool {
+	_, ok := err.(ErrBatchProfileExists)
+	return ok
+}
+
+func (err ErrBatchProfileExists) Error() string {
+	return fmt.Sprintf("Batch profile already exists [name: %s]", err.Name)
+}
+
+type ErrBatchProfileInUse struct {
+	ID int64
+}
+
+func IsErrBatchProfileInUse(err error) bool {
+	_, ok := err.(ErrBatchProfileInUse)
+	return ok
+}
+
+func (err ErrBatchProfileInUse) Error() string {
+	return fmt.Sprintf("batch profile is still used by schedules [id: %d]", err.ID)
+}
+
+type ErrInvalidBatchEntry struct {
+	Line    int
+	Content string
+}
+
+func IsErrInvalidBatchEntry(err error) bool {
+	_, ok := err.(ErrInvalidBatchEntry)
+	return ok
+}
+
+func (err ErrInvalidBatchEntry) Error() string {
+	return fmt.Sprintf("invalid batch entry [line: %d, content: %s]", err.Line, err.Content)
+}
+
+type ErrProjectExists struct {
+	Name string
+}
+
+func IsErrProjectExists(err error) bool {
+	_, ok := err.(ErrProjectExists)
+	return ok
+}
+
+func (err ErrProjectExists) Error() string {
+	return fmt.Sprintf("Project already exists [name: %s]", err.Name)
+}
+
+type ErrInvalidBuildEnv struct {
+	Line    int
+	Content string
+}
+
+func IsErrInvalidBuildEnv(err error) bool {
+	_, ok := err.(ErrInvalidBuildEnv)
+	return ok
+}
+
+func (err ErrInvalidBuildEnv) Error() string {
+	return fmt.Sprintf("invalid environment variable, expect \"KEY=VALUE\" [line: %d, content: %s]", err.Line, err.Content)
+}
+
+type ErrProfileOnlyOption struct {
+	Option string
+}
+
+func IsErrProfileOnlyOption(err error) bool {
+	_, ok := err.(ErrProfileOnlyOption)
+	return ok
+}
+
+func (err ErrProfileOnlyOption) Error() string {
+	return fmt.Sprintf("option can only be set in batch profile [option: %s]", err.Option)
+}
+
+type ErrSecretNotExist struct {
+	Name string
+}
+
+func IsErrSecretNotExist(err error) bool {
+	_, ok := err.(ErrSecretNotExist)
+	return ok
+}
+
+func (err ErrSecretNotExist) Error() string {
+	return fmt.Sprintf("secret does not exist [name: %s]", err.Name)
+}
+
+type ErrInvalidSecretName struct {
+	Name string
+}
+
+func IsErrInvalidSecretName(err error) bool {
+	_, ok := err.(ErrInvalidSecretName)
+	return ok
+}
+
+func (err ErrInvalidSecretName) Error() string {
+	return fmt.Sprintf("invalid secret name, expect upper case letters, digits and underscores [name: %s]", err.Name)
 }
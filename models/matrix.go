@@ -16,39 +16,428 @@ package models
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Unknwon/com"
+	"github.com/jinzhu/gorm"
+
+	"github.com/lubanstudio/luban/pkg/setting"
+	"github.com/lubanstudio/luban/pkg/tagexpr"
+	"github.com/lubanstudio/luban/pkg/tool"
+	"github.com/lubanstudio/luban/pkg/version"
 )
 
+// Toolchain describes the compilers and C library used to build.
+// Matrices have exact Go version (e.g. "1.21.5"), while tasks and batch entries
+// have version constraint (e.g. ">=1.21"). Empty values of task match any toolchain.
+type Toolchain struct {
+	GoVersion string
+	CC        string // C compiler, e.g. "gcc" or "clang"
+	Libc      string // C library flavour, e.g. "glibc" or "musl"
+}
+
+func (tc Toolchain) IsEmpty() bool {
+	return len(tc.GoVersion) == 0 && len(tc.CC) == 0 && len(tc.Libc) == 0
+}
+
+// String returns toolchain in format of "go=<version> cc=<cc> libc=<libc>"
+// with empty values omitted, which is also accepted by ParseBatchEntries.
+func (tc Toolchain) String() string {
+	fields := make([]string, 0, 3)
+	if len(tc.GoVersion) > 0 {
+		fields = append(fields, "go="+tc.GoVersion)
+	}
+	if len(tc.CC) > 0 {
+		fields = append(fields, "cc="+tc.CC)
+	}
+	if len(tc.Libc) > 0 {
+		fields = append(fields, "libc="+tc.Libc)
+	}
+	return strings.Join(fields, " ")
+}
+
+// isSafeName returns true if s can be part of a file name, i.e. it has no path
+// separator or "..".
+func isSafeName(s string) bool {
+	return !strings.ContainsAny(s, `/\`) && !strings.Contains(s, "..")
+}
+
+// Validate returns error if Go version constraint is malformed, or C compiler
+// or C library is not safe to be part of artifact names.
+func (tc Toolchain) Validate() error {
+	if version.ValidateConstraint(tc.GoVersion) != nil {
+		return ErrInvalidGoVersion{tc.GoVersion}
+	} else if !isSafeName(tc.CC) {
+		return ErrInvalidToolchain{"cc", tc.CC}
+	} else if !isSafeName(tc.Libc) {
+		return ErrInvalidToolchain{"libc", tc.Libc}
+	}
+	return nil
+}
+
+// Satisfy returns true if the toolchain of matrix satisfies requirement of given one.
+func (tc Toolchain) Satisfy(required Toolchain) bool {
+	if len(required.CC) > 0 && required.CC != tc.CC {
+		return false
+	} else if len(required.Libc) > 0 && required.Libc != tc.Libc {
+		return false
+	} else if len(required.GoVersion) == 0 {
+		return true
+	} else if len(tc.GoVersion) == 0 {
+		return false
+	}
+
+	matched, err := version.Match(required.GoVersion, tc.GoVersion)
+	return err == nil && matched
+}
+
 type Matrix struct {
 	ID        int64
-	BuilderID int64
-	OS        string
-	Arch      string
-	Tags      string
+	BuilderID int64  `gorm:"INDEX"`
+	OS        string `gorm:"INDEX:matrix_os_arch"`
+	Arch      string `gorm:"INDEX:matrix_os_arch"`
+	Toolchain
+
+	Tags []string `gorm:"-"` // Supported tags stored in matrix tag table, "*" means any tag
+}
+
+func (m *Matrix) TagSet() tagexpr.Set {
+	return tagexpr.NewSet(m.Tags)
+}
+
+// String returns matrix in format of "<os>/<arch> tags=<tags> <toolchain>".
+func (m *Matrix) String() string {
+	s := m.OS + "/" + m.Arch
+	if len(m.Tags) > 0 {
+		tags := append([]string{}, m.Tags...)
+		sort.Strings(tags)
+		s += " tags=" + strings.Join(tags, ",")
+	}
+	if !m.Toolchain.IsEmpty() {
+		s += " " + m.Toolchain.String()
+	}
+	return s
+}
+
+// goPlatforms is the set of valid "GOOS/GOARCH" pairs, see "go tool dist list".
+var goPlatforms = map[string]bool{
+	"aix/ppc64":       true,
+	"android/386":     true,
+	"android/amd64":   true,
+	"android/arm":     true,
+	"android/arm64":   true,
+	"darwin/386":      true,
+	"darwin/amd64":    true,
+	"darwin/arm64":    true,
+	"dragonfly/amd64": true,
+	"freebsd/386":     true,
+	"freebsd/amd64":   true,
+	"freebsd/arm":     true,
+	"freebsd/arm64":   true,
+	"illumos/amd64":   true,
+	"ios/amd64":       true,
+	"ios/arm64":       true,
+	"js/wasm":         true,
+	"linux/386":       true,
+	"linux/amd64":     true,
+	"linux/arm":       true,
+	"linux/arm64":     true,
+	"linux/loong64":   true,
+	"linux/mips":      true,
+	"linux/mips64":    true,
+	"linux/mips64le":  true,
+	"linux/mipsle":    true,
+	"linux/ppc64":     true,
+	"linux/ppc64le":   true,
+	"linux/riscv64":   true,
+	"linux/s390x":     true,
+	"netbsd/386":      true,
+	"netbsd/amd64":    true,
+	"netbsd/arm":      true,
+	"netbsd/arm64":    true,
+	"openbsd/386":     true,
+	"openbsd/amd64":   true,
+	"openbsd/arm":     true,
+	"openbsd/arm64":   true,
+	"openbsd/ppc64":   true,
+	"openbsd/riscv64": true,
+	"plan9/386":       true,
+	"plan9/amd64":     true,
+	"plan9/arm":       true,
+	"solaris/amd64":   true,
+	"wasip1/wasm":     true,
+	"windows/386":     true,
+	"windows/amd64":   true,
+	"windows/arm":     true,
+	"windows/arm64":   true,
+}
+
+func isAllowed(list []string, value string) bool {
+	return len(list) == 0 || com.IsSliceContainsStr(list, value)
+}
+
+// ValidateMatrices returns error if any of matrices is not a valid Go platform,
+// or not allowed by global settings or allowlist of the builder. Wildcard tag
+// must be explicitly allowed by allowlist of the builder.
+func (b *Builder) ValidateMatrices(matrices []*Matrix) error {
+	for _, m := range matrices {
+		if !goPlatforms[m.OS+"/"+m.Arch] {
+			return ErrMatrixNotAllowed{"platform", m.OS + "/" + m.Arch}
+		} else if !isAllowed(setting.AllowedOSs, m.OS) || !isAllowed(b.AllowedOSList(), m.OS) {
+			return ErrMatrixNotAllowed{"os", m.OS}
+		} else if !isAllowed(setting.AllowedArchs, m.Arch) || !isAllowed(b.AllowedArchList(), m.Arch) {
+			return ErrMatrixNotAllowed{"arch", m.Arch}
+		} else if err := m.Toolchain.Validate(); err != nil {
+			if IsErrInvalidToolchain(err) {
+				e := err.(ErrInvalidToolchain)
+				return ErrMatrixNotAllowed{e.Name, e.Value}
+			}
+			return ErrMatrixNotAllowed{"go_version", m.GoVersion}
+		}
+
+		for _, tag := range m.Tags {
+			if tag == tagexpr.Wildcard {
+				if !com.IsSliceContainsStr(b.AllowedTagList(), tag) {
+					return ErrMatrixNotAllowed{"tags", tag}
+				}
+			} else if !isAllowed(setting.AllowedTags, tag) || !isAllowed(b.AllowedTagList(), tag) {
+				return ErrMatrixNotAllowed{"tags", tag}
+			}
+		}
+	}
+	return nil
+}
+
+// MatrixHistory is a record of matrices submitted by a builder.
+type MatrixHistory struct {
+	ID        int64
+	BuilderID int64  `gorm:"INDEX"`
+	Matrices  string `gorm:"TYPE:TEXT"` // One matrix per line
+	Error     string // Reason of rejection, empty means accepted
+	Created   int64
+}
+
+func (h *MatrixHistory) BeforeCreate() {
+	h.Created = time.Now().Unix()
+}
+
+func (h *MatrixHistory) CreatedTime() time.Time {
+	return time.Unix(h.Created, 0)
+}
+
+func (h *MatrixHistory) IsRejected() bool {
+	return len(h.Error) > 0
+}
+
+func (h *MatrixHistory) MatrixList() []string {
+	return splitLines(h.Matrices)
+}
+
+func describeMatrices(matrices []*Matrix) string {
+	lines := make([]string, len(matrices))
+	for i := range matrices {
+		lines[i] = matrices[i].String()
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// ListMatrixHistories returns latest matrix histories of the builder.
+func ListMatrixHistories(builderID int64, limit int) ([]*MatrixHistory, error) {
+	histories := make([]*MatrixHistory, 0, limit)
+	return histories, x.Where("builder_id = ?", builderID).Order("id DESC").Limit(limit).Find(&histories).Error
+}
+
+// MatrixTag is a tag supported by a matrix.
+type MatrixTag struct {
+	ID       int64
+	MatrixID int64  `gorm:"UNIQUE_INDEX:matrix_tag_matrix_tag"`
+	Tag      string `gorm:"UNIQUE_INDEX:matrix_tag_matrix_tag;INDEX"`
+}
+
+// loadMatrixTags fills supported tags of given matrices within one query.
+func loadMatrixTags(matrices []*Matrix) error {
+	if len(matrices) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, len(matrices))
+	for i := range matrices {
+		ids[i] = matrices[i].ID
+	}
+	matrixTags := make([]*MatrixTag, 0, len(matrices))
+	if err := x.Where("matrix_id IN (?)", tool.Int64sToStrings(ids)).Order("tag").Find(&matrixTags).Error; err != nil {
+		return err
+	}
+
+	tags := make(map[int64][]string, len(matrices))
+	for _, mt := range matrixTags {
+		tags[mt.MatrixID] = append(tags[mt.MatrixID], mt.Tag)
+	}
+	for _, m := range matrices {
+		m.Tags = tags[m.ID]
+	}
+	return nil
+}
+
+// deleteBuilderMatrices deletes all matrices of the builder with their tags.
+func deleteBuilderMatrices(tx *gorm.DB, builderID int64) error {
+	if err := tx.Where("matrix_id IN (SELECT id FROM matrices WHERE builder_id = ?)", builderID).Delete(new(MatrixTag)).Error; err != nil {
+		return fmt.Errorf("delete matrix tags: %v", err)
+	} else if err = tx.Delete(new(Matrix), "builder_id = ?", builderID).Error; err != nil {
+		return fmt.Errorf("delete matrices: %v", err)
+	}
+	return nil
 }
 
+// UpdateBuilderMatrices replaces all matrices of the builder within a transaction,
+// and records a history when matrices are changed.
 func UpdateBuilderMatrices(builderID int64, matrices []*Matrix) error {
-	if err := x.Delete(new(Matrix), "builder_id = ?", builderID).Error; err != nil {
-		return fmt.Errorf("delete old matrices: %v", err)
+	desc := describeMatrices(matrices)
+	last := new(MatrixHistory)
+	err := x.Where("builder_id = ? AND error = ?", builderID, "").Order("id DESC").First(last).Error
+	if err != nil && !IsErrRecordNotFound(err) {
+		return fmt.Errorf("get last matrix history: %v", err)
 	}
 
 	tx := x.Begin()
 	defer releaseTransaction(tx)
 
+	if last.Matrices != desc || IsErrRecordNotFound(err) {
+		if err = tx.Create(&MatrixHistory{BuilderID: builderID, Matrices: desc}).Error; err != nil {
+			return fmt.Errorf("create matrix history: %v", err)
+		}
+	}
+
+	if err = deleteBuilderMatrices(tx, builderID); err != nil {
+		return fmt.Errorf("deleteBuilderMatrices: %v", err)
+	}
+
 	for _, matrix := range matrices {
 		matrix.BuilderID = builderID
 		if err := tx.Create(matrix).Error; err != nil {
 			return fmt.Errorf("create matrix: %v", err)
 		}
+		for tag := range matrix.TagSet() {
+			if err := tx.Create(&MatrixTag{MatrixID: matrix.ID, Tag: tag}).Error; err != nil {
+				return fmt.Errorf("create matrix tag: %v", err)
+			}
+		}
 	}
 
 	return tx.Commit().Error
 }
 
+// UpdateMatrices validates and replaces matrices of the builder.
+// Rejected matrices are recorded in history and existing ones are kept.
 func (b *Builder) UpdateMatrices(matrices []*Matrix) error {
+	if err := b.ValidateMatrices(matrices); err != nil {
+		if IsErrMatrixNotAllowed(err) {
+			history := &MatrixHistory{
+				BuilderID: b.ID,
+				Matrices:  describeMatrices(matrices),
+				Error:     err.Error(),
+			}
+			if err := x.Create(history).Error; err != nil {
+				return fmt.Errorf("create matrix history: %v", err)
+			}
+		}
+		return err
+	}
 	return UpdateBuilderMatrices(b.ID, matrices)
 }
 
 func FindMatrices(os, arch string) ([]*Matrix, error) {
 	matrices := make([]*Matrix, 0, 10)
-	return matrices, x.Where("os = ? AND arch= ?", os, arch).Find(&matrices).Error
+	if err := x.Where("os = ? AND arch = ?", os, arch).Find(&matrices).Error; err != nil {
+		return nil, err
+	}
+	return matrices, loadMatrixTags(matrices)
+}
+
+// ListBuilderMatrices returns matrices of the builder with supported tags.
+func ListBuilderMatrices(builderID int64) ([]*Matrix, error) {
+	matrices := make([]*Matrix, 0, 5)
+	if err := x.Where("builder_id = ?", builderID).Order("os, arch").Find(&matrices).Error; err != nil {
+		return nil, err
+	}
+	return matrices, loadMatrixTags(matrices)
+}
+
+// findCandidateMatrices returns matrices for given OS and architecture that support
+// all required tags and have required C toolchain. Filters are done by database
+// with indexes so that only candidates are loaded, Go version is left to the caller.
+func findCandidateMatrices(os, arch string, required []string, tc Toolchain) ([]*Matrix, error) {
+	sess := x.Table("matrices").Select("matrices.*").
+		Where("matrices.os = ? AND matrices.arch = ?", os, arch)
+	if len(tc.CC) > 0 {
+		sess = sess.Where("matrices.cc = ?", tc.CC)
+	}
+	if len(tc.Libc) > 0 {
+		sess = sess.Where("matrices.libc = ?", tc.Libc)
+	}
+	if len(required) > 0 {
+		// A matrix qualifies when it has every required tag or the wildcard.
+		tags := make([]string, 0, len(required)+1)
+		tags = append(tags, required...)
+		tags = append(tags, tagexpr.Wildcard)
+		sess = sess.Joins("JOIN matrix_tags ON matrix_tags.matrix_id = matrices.id").
+			Where("matrix_tags.tag IN (?)", tags).
+			Group("matrices.id").
+			Having("COUNT(DISTINCT matrix_tags.tag) >= ? OR SUM(matrix_tags.tag = ?) > 0", len(required), tagexpr.Wildcard)
+	}
+
+	matrices := make([]*Matrix, 0, 10)
+	return matrices, sess.Find(&matrices).Error
+}
+
+// migrateMatrixTags moves legacy comma-separated tags of matrices to matrix tag table.
+func migrateMatrixTags() (err error) {
+	if !x.Dialect().HasColumn("matrices", "tags") {
+		return nil
+	}
+
+	var legacy []struct {
+		ID   int64
+		Tags string
+	}
+	if err = x.Table("matrices").Select("id, tags").Scan(&legacy).Error; err != nil {
+		return fmt.Errorf("select legacy tags: %v", err)
+	}
+
+	tx := x.Begin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// MySQL commits implicitly before dropping the column, tags are copied again
+	// from scratch in case the column fails to be dropped.
+	for _, m := range legacy {
+		if err = tx.Where("matrix_id = ?", m.ID).Delete(new(MatrixTag)).Error; err != nil {
+			return fmt.Errorf("delete matrix tags: %v", err)
+		}
+		for tag := range tagexpr.NewSet(strings.Split(m.Tags, ",")) {
+			if err = tx.Create(&MatrixTag{MatrixID: m.ID, Tag: tag}).Error; err != nil {
+				return fmt.Errorf("create matrix tag: %v", err)
+			}
+		}
+	}
+	if err = tx.Model(new(Matrix)).DropColumn("tags").Error; err != nil {
+		return fmt.Errorf("drop column: %v", err)
+	}
+	return tx.Commit().Error
+}
+
+// migrateOrphanedMatrices deletes matrices of builders that used to be deleted
+// without cleaning up their matrices.
+func migrateOrphanedMatrices() error {
+	if err := x.Where("matrix_id IN (SELECT id FROM matrices WHERE builder_id NOT IN (SELECT id FROM builders))").
+		Delete(new(MatrixTag)).Error; err != nil {
+		return fmt.Errorf("delete orphaned matrix tags: %v", err)
+	}
+	return x.Where("builder_id NOT IN (SELECT id FROM builders)").Delete(new(Matrix)).Error
 }
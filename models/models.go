@@ -26,7 +26,13 @@ import (
 
 var x *gorm.DB
 
-func init() {
+// Init connects to database and migrates tables, settings must have been loaded.
+func Init() {
+	var ok bool
+	if defaultRole, ok = ParseRoleName(setting.Auth.DefaultRole); !ok {
+		log.Fatal(4, "Invalid default role: %s", setting.Auth.DefaultRole)
+	}
+
 	var err error
 	x, err = gorm.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s)/%s?charset=utf8&parseTime=true",
 		setting.Database.User, setting.Database.Password, setting.Database.Host, setting.Database.Name))
@@ -35,9 +41,28 @@ func init() {
 	}
 
 	if err = x.Set("gorm:table_options", "ENGINE=InnoDB").
-		AutoMigrate(new(User), new(Builder), new(Matrix), new(Task)).Error; err != nil {
+		AutoMigrate(new(User), new(AccessToken), new(Builder), new(BuilderToken), new(Matrix), new(MatrixTag), new(MatrixHistory), new(HeartBeatHistory), new(Task), new(Schedule),
+			new(BatchProfile), new(BatchEntry), new(Project), new(Collaboration), new(Secret), new(AuditLog)).Error; err != nil {
 		log.Fatal(4, "Fail to auto migrate database: %s", err)
 	}
+
+	if err = migrateBatchProfiles(); err != nil {
+		log.Fatal(4, "Fail to migrate batch profiles: %s", err)
+	} else if err = migrateProjects(); err != nil {
+		log.Fatal(4, "Fail to migrate projects: %s", err)
+	} else if err = migrateWebhookSecrets(); err != nil {
+		log.Fatal(4, "Fail to migrate webhook secrets: %s", err)
+	} else if err = migrateMatrixTags(); err != nil {
+		log.Fatal(4, "Fail to migrate matrix tags: %s", err)
+	} else if err = migrateOrphanedMatrices(); err != nil {
+		log.Fatal(4, "Fail to migrate orphaned matrices: %s", err)
+	} else if err = migrateBuilderTokens(); err != nil {
+		log.Fatal(4, "Fail to migrate builder tokens: %s", err)
+	} else if err = migrateUserLogins(); err != nil {
+		log.Fatal(4, "Fail to migrate user logins: %s", err)
+	} else if err = migrateUserRoles(); err != nil {
+		log.Fatal(4, "Fail to migrate user roles: %s", err)
+	}
 }
 
 func releaseTransaction(tx *gorm.DB) {
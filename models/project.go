@@ -0,0 +1,433 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package models
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Unknwon/com"
+
+	"github.com/lubanstudio/luban/pkg/setting"
+	"github.com/lubanstudio/luban/pkg/tagexpr"
+	"github.com/lubanstudio/luban/pkg/tool"
+)
+
+type AccessMode int
+
+const (
+	ACCESS_MODE_NONE AccessMode = iota
+	ACCESS_MODE_READ
+	ACCESS_MODE_WRITE
+	ACCESS_MODE_ADMIN
+)
+
+func (m AccessMode) ToString() string {
+	switch m {
+	case ACCESS_MODE_READ:
+		return "Read"
+	case ACCESS_MODE_WRITE:
+		return "Write"
+	case ACCESS_MODE_ADMIN:
+		return "Admin"
+	}
+	return "None"
+}
+
+func ParseAccessMode(n int) AccessMode {
+	switch n {
+	case 1:
+		return ACCESS_MODE_READ
+	case 2:
+		return ACCESS_MODE_WRITE
+	case 3:
+		return ACCESS_MODE_ADMIN
+	default:
+		return ACCESS_MODE_NONE
+	}
+}
+
+// Project is a Go repository to build artifacts for.
+type Project struct {
+	ID          int64
+	Name        string `gorm:"UNIQUE"`
+	CloneURL    string
+	CommitURL   string
+	ImportPath  string
+	Branches    string
+	PackRoot    string
+	PackEntries string
+	PackFormats string
+
+	// Allowed values on new task page, empty means to use global ones.
+	AllowedOSs   string `gorm:"column:allowed_oss"`
+	AllowedArchs string
+	AllowedTags  string
+
+	// Access mode of signed in users who are not collaborators.
+	DefaultAccess AccessMode
+	// Lowest trust level of builders that take tasks with environment variables,
+	// pre-build commands or other options that run arbitrary commands.
+	MinScriptTrustLevel TrustLevel `gorm:"NOT NULL;DEFAULT:99"`
+	// Verifies signatures of webhook payloads sent to the project.
+	WebhookSecret string `json:"-"`
+	Created       int64
+}
+
+func (p *Project) BeforeCreate() {
+	p.Created = time.Now().Unix()
+}
+
+func (p *Project) CreatedTime() time.Time {
+	return time.Unix(p.Created, 0)
+}
+
+func splitList(s string) []string {
+	list := make([]string, 0, 5)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func (p *Project) BranchList() []string {
+	return splitList(p.Branches)
+}
+
+func (p *Project) PackEntryList() []string {
+	return splitList(p.PackEntries)
+}
+
+func (p *Project) PackFormatList() []string {
+	return splitList(p.PackFormats)
+}
+
+func (p *Project) AllowedOSList() []string {
+	if len(p.AllowedOSs) == 0 {
+		return setting.AllowedOSs
+	}
+	return splitList(p.AllowedOSs)
+}
+
+func (p *Project) AllowedArchList() []string {
+	if len(p.AllowedArchs) == 0 {
+		return setting.AllowedArchs
+	}
+	return splitList(p.AllowedArchs)
+}
+
+func (p *Project) AllowedTagList() []string {
+	if len(p.AllowedTags) == 0 {
+		return setting.AllowedTags
+	}
+	return splitList(p.AllowedTags)
+}
+
+// ValidateTags returns error if any of tags is malformed or not allowed by the project.
+func (p *Project) ValidateTags(tags []string) error {
+	allowedTags := p.AllowedTagList()
+	for _, tag := range tags {
+		if !tagexpr.IsValidTag(tag) || !isSafeName(tag) {
+			return ErrInvalidTag{tag, "contains invalid characters"}
+		} else if !isAllowed(allowedTags, tag) {
+			return ErrInvalidTag{tag, "not allowed by the project"}
+		}
+	}
+	return nil
+}
+
+func (p *Project) Link() string {
+	return "/projects/" + p.Name
+}
+
+// ArtifactsPath returns the directory to store artifacts of the project.
+func (p *Project) ArtifactsPath() string {
+	return path.Join(setting.ArtifactsPath, p.Name)
+}
+
+// MirrorPath returns the path of local mirror of the project repository.
+func (p *Project) MirrorPath() string {
+	return path.Join(setting.MirrorsPath, p.Name+".git")
+}
+
+var projectNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// SupportedPackFormats are archive formats that builders are able to pack artifacts in.
+var SupportedPackFormats = []string{"zip", "tar.gz"}
+
+var (
+	cloneURLSchemes = map[string]bool{"https": true, "ssh": true, "git": true}
+	// scpURLPattern matches scp-like syntax of SSH, e.g. "git@github.com:owner/repo.git",
+	// path cannot start with ":" which is used by "<transport>::<address>".
+	scpURLPattern = regexp.MustCompile(`^(?:[a-zA-Z0-9._-]+@)?[a-zA-Z0-9][a-zA-Z0-9.-]*:[^:]`)
+)
+
+// isValidCloneURL returns true if the URL is HTTPS, SSH, Git or scp-like syntax
+// of SSH. Values that git treats as options or other transports (e.g. "ext::")
+// are rejected because they run commands on the server.
+func isValidCloneURL(cloneURL string) bool {
+	if len(cloneURL) == 0 || strings.HasPrefix(cloneURL, "-") ||
+		strings.IndexFunc(cloneURL, func(r rune) bool { return r <= ' ' || r == 0x7f }) > -1 {
+		return false
+	}
+
+	if strings.Contains(cloneURL, "://") {
+		u, err := url.Parse(cloneURL)
+		return err == nil && cloneURLSchemes[u.Scheme] && len(u.Host) > 0 && !strings.HasPrefix(u.Host, "-")
+	}
+	return scpURLPattern.MatchString(cloneURL)
+}
+
+// Validate returns error if clone URL is not supported, pack root is not a single
+// path element or any pack format is not supported, because they are used in
+// git commands and paths of artifacts.
+func (p *Project) Validate() error {
+	if !isValidCloneURL(p.CloneURL) {
+		return ErrInvalidProjectSetting{"clone_url", p.CloneURL, "only HTTPS, SSH and Git URLs are supported"}
+	} else if len(p.PackRoot) == 0 || p.PackRoot == "." || !isSafeName(p.PackRoot) {
+		return ErrInvalidProjectSetting{"pack_root", p.PackRoot, "must be a directory name without path separators"}
+	}
+
+	formats := p.PackFormatList()
+	if len(formats) == 0 {
+		return ErrInvalidProjectSetting{"pack_formats", p.PackFormats, "at least one format is required"}
+	}
+	for _, format := range formats {
+		if !com.IsSliceContainsStr(SupportedPackFormats, format) {
+			return ErrInvalidProjectSetting{"pack_formats", format, "supported formats are " + strings.Join(SupportedPackFormats, ", ")}
+		}
+	}
+	return nil
+}
+
+func (p *Project) Save() error {
+	if err := p.Validate(); err != nil {
+		return err
+	} else if !IsErrRecordNotFound(x.Where("name = ? AND id != ?", p.Name, p.ID).First(new(Project)).Error) {
+		return ErrProjectExists{p.Name}
+	}
+	return x.Save(p).Error
+}
+
+func NewProject(project *Project) error {
+	if err := project.Validate(); err != nil {
+		return err
+	} else if !IsErrRecordNotFound(x.Where("name = ?", project.Name).First(new(Project)).Error) {
+		return ErrProjectExists{project.Name}
+	}
+	if len(project.WebhookSecret) == 0 {
+		project.WebhookSecret = tool.NewSecretToekn()
+	}
+	return x.Create(project).Error
+}
+
+// RegenerateWebhookSecret replaces webhook secret of the project with a new random one.
+func (p *Project) RegenerateWebhookSecret() error {
+	p.WebhookSecret = tool.NewSecretToekn()
+	return x.Model(p).Update("webhook_secret", p.WebhookSecret).Error
+}
+
+func GetProjectByID(id int64) (*Project, error) {
+	project := new(Project)
+	return project, x.First(project, id).Error
+}
+
+func GetProjectByName(name string) (*Project, error) {
+	project := new(Project)
+	return project, x.Where("name = ?", name).First(project).Error
+}
+
+func ListProjects() ([]*Project, error) {
+	projects := make([]*Project, 0, 5)
+	return projects, x.Order("name").Find(&projects).Error
+}
+
+// ListAccessibleProjects returns projects that given user has at least given access mode to.
+func ListAccessibleProjects(u *User, mode AccessMode) ([]*Project, error) {
+	projects, err := ListProjects()
+	if err != nil {
+		return nil, err
+	}
+
+	accessibles := make([]*Project, 0, len(projects))
+	for _, p := range projects {
+		m, err := p.UserAccessMode(u)
+		if err != nil {
+			return nil, fmt.Errorf("UserAccessMode [%d]: %v", p.ID, err)
+		} else if m >= mode {
+			accessibles = append(accessibles, p)
+		}
+	}
+	return accessibles, nil
+}
+
+func CountProjects() int64 {
+	return Count(new(Project))
+}
+
+// Collaboration grants a user access to a project.
+type Collaboration struct {
+	ID        int64
+	ProjectID int64 `gorm:"UNIQUE_INDEX:collaboration_project_user"`
+	UserID    int64 `gorm:"UNIQUE_INDEX:collaboration_project_user"`
+	User      *User `gorm:"-"`
+	Mode      AccessMode
+}
+
+func (c *Collaboration) AfterFind() (err error) {
+	c.User, err = GetUserByID(c.UserID)
+	if err != nil {
+		return fmt.Errorf("GetUserByID [%d]: %v", c.UserID, err)
+	}
+	return nil
+}
+
+// UserAccessMode returns the access mode of given user to the project,
+// which is limited by role of the user.
+func (p *Project) UserAccessMode(u *User) (AccessMode, error) {
+	if u == nil {
+		return ACCESS_MODE_NONE, nil
+	} else if u.IsAdmin() {
+		return ACCESS_MODE_ADMIN, nil
+	}
+
+	mode := p.DefaultAccess
+	c := new(Collaboration)
+	if err := x.Where("project_id = ? AND user_id = ?", p.ID, u.ID).First(c).Error; err != nil {
+		if !IsErrRecordNotFound(err) {
+			return ACCESS_MODE_NONE, err
+		}
+	} else if c.Mode > mode {
+		mode = c.Mode
+	}
+
+	if max := u.Role.MaxAccessMode(); mode > max {
+		return max, nil
+	}
+	return mode, nil
+}
+
+// GetCollaboration returns the collaboration of given user to the project.
+func (p *Project) GetCollaboration(userID int64) (*Collaboration, error) {
+	c := new(Collaboration)
+	return c, x.Where("project_id = ? AND user_id = ?", p.ID, userID).First(c).Error
+}
+
+// SetCollaborator adds or updates access mode of given user to the project,
+// the user is removed from collaborators with ACCESS_MODE_NONE.
+func (p *Project) SetCollaborator(userID int64, mode AccessMode) error {
+	c := new(Collaboration)
+	err := x.Where("project_id = ? AND user_id = ?", p.ID, userID).First(c).Error
+	if err != nil && !IsErrRecordNotFound(err) {
+		return err
+	}
+
+	if mode == ACCESS_MODE_NONE {
+		if c.ID == 0 {
+			return nil
+		}
+		return x.Delete(c).Error
+	}
+
+	c.ProjectID = p.ID
+	c.UserID = userID
+	c.Mode = mode
+	return x.Save(c).Error
+}
+
+func (p *Project) Collaborators() ([]*Collaboration, error) {
+	collaborations := make([]*Collaboration, 0, 5)
+	return collaborations, x.Where("project_id = ?", p.ID).Find(&collaborations).Error
+}
+
+// migrateProjects imports legacy "[project]" section as the first project,
+// and moves existing tasks, batch profiles and artifacts into it.
+func migrateProjects() error {
+	if len(setting.Project.CloneURL) == 0 || Count(new(Project)) > 0 {
+		return nil
+	}
+
+	name := setting.Project.Name
+	if !projectNamePattern.MatchString(name) {
+		name = "default"
+	}
+	project := &Project{
+		Name:          name,
+		CloneURL:      setting.Project.CloneURL,
+		CommitURL:     setting.Project.CommitURL,
+		ImportPath:    setting.Project.ImportPath,
+		Branches:      strings.Join(setting.Project.Branches, ","),
+		PackRoot:      setting.Project.PackRoot,
+		PackEntries:   strings.Join(setting.Project.PackEntries, ","),
+		PackFormats:   strings.Join(setting.Project.PackFormats, ","),
+		DefaultAccess: ACCESS_MODE_READ,
+	}
+	if err := NewProject(project); err != nil {
+		return fmt.Errorf("NewProject: %v", err)
+	}
+
+	if err := x.Model(new(Task)).Where("project_id = 0").Update("project_id", project.ID).Error; err != nil {
+		return fmt.Errorf("update tasks: %v", err)
+	} else if err = x.Model(new(BatchProfile)).Where("project_id = 0").Update("project_id", project.ID).Error; err != nil {
+		return fmt.Errorf("update batch profiles: %v", err)
+	}
+
+	// Artifacts used to be stored directly under artifacts path.
+	fis, err := ioutil.ReadDir(setting.ArtifactsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("read artifacts directory: %v", err)
+	}
+	os.MkdirAll(project.ArtifactsPath(), os.ModePerm)
+	for _, fi := range fis {
+		if fi.IsDir() {
+			continue
+		}
+		if err = os.Rename(path.Join(setting.ArtifactsPath, fi.Name()), path.Join(project.ArtifactsPath(), fi.Name())); err != nil {
+			return fmt.Errorf("move artifact: %v", err)
+		}
+	}
+	return nil
+}
+
+// migrateWebhookSecrets sets webhook secrets of projects that do not have one,
+// to the legacy global secret so that existing webhooks keep working.
+func migrateWebhookSecrets() error {
+	projects := make([]*Project, 0, 5)
+	if err := x.Where("webhook_secret = ? OR webhook_secret IS NULL", "").Find(&projects).Error; err != nil {
+		return fmt.Errorf("find projects: %v", err)
+	}
+
+	for _, p := range projects {
+		secret := setting.Webhook.Secret
+		if len(secret) == 0 {
+			secret = tool.NewSecretToekn()
+		}
+		if err := x.Model(p).Update("webhook_secret", secret).Error; err != nil {
+			return fmt.Errorf("update project [%d]: %v", p.ID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package models
+
+import (
+	"testing"
+)
+
+func TestIsValidCloneURL(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"https://github.com/gogs/gogs.git", true},
+		{"ssh://git@github.com/gogs/gogs.git", true},
+		{"git://github.com/gogs/gogs.git", true},
+		{"git@github.com:gogs/gogs.git", true},
+		{"github.com:gogs/gogs.git", true},
+
+		{"", false},
+		{"--upload-pack=touch /tmp/marker;", false},
+		{"-uhttps://github.com/gogs/gogs.git", false},
+		{"ext::sh -c touch% /tmp/marker", false},
+		{"ext::sh", false},
+		{"http://github.com/gogs/gogs.git", false},
+		{"file:///etc", false},
+		{"/var/repos/gogs.git", false},
+		{"ssh://-oProxyCommand=touch/gogs.git", false},
+		{"https://github.com/gogs/gogs.git\n--upload-pack=x", false},
+		{"https:///gogs.git", false},
+	}
+	for _, test := range tests {
+		if valid := isValidCloneURL(test.url); valid != test.valid {
+			t.Errorf("isValidCloneURL(%q): got %v, want %v", test.url, valid, test.valid)
+		}
+	}
+}
+
+func TestProject_Validate(t *testing.T) {
+	valid := Project{CloneURL: "https://github.com/gogs/gogs.git", PackRoot: "gogs", PackFormats: "zip, tar.gz"}
+	if err := valid.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(p *Project)
+		field  string
+	}{
+		{"option as clone URL", func(p *Project) { p.CloneURL = "--upload-pack=id" }, "clone_url"},
+		{"empty pack root", func(p *Project) { p.PackRoot = "" }, "pack_root"},
+		{"dot pack root", func(p *Project) { p.PackRoot = "." }, "pack_root"},
+		{"parent pack root", func(p *Project) { p.PackRoot = ".." }, "pack_root"},
+		{"nested pack root", func(p *Project) { p.PackRoot = "a/b" }, "pack_root"},
+		{"absolute pack root", func(p *Project) { p.PackRoot = "/etc" }, "pack_root"},
+		{"no format", func(p *Project) { p.PackFormats = " , " }, "pack_formats"},
+		{"format with path", func(p *Project) { p.PackFormats = "zip, ../../../etc/passwd" }, "pack_formats"},
+		{"unsupported format", func(p *Project) { p.PackFormats = "rar" }, "pack_formats"},
+	}
+	for _, test := range tests {
+		p := valid
+		test.modify(&p)
+		err := p.Validate()
+		if !IsErrInvalidProjectSetting(err) {
+			t.Errorf("%s: got error %v", test.name, err)
+		} else if field := err.(ErrInvalidProjectSetting).Field; field != test.field {
+			t.Errorf("%s: got field %q, want %q", test.name, field, test.field)
+		}
+	}
+}
+
+func TestProject_ValidateTags(t *testing.T) {
+	p := &Project{AllowedTags: "sqlite, pam, cert"}
+	if err := p.ValidateTags([]string{"pam", "sqlite"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tag := range []string{"", "*", "..", "a/b", `a\b`, "sqlite,pam", "sqlite pam", "$(id)", "redis"} {
+		if err := p.ValidateTags([]string{"sqlite", tag}); !IsErrInvalidTag(err) {
+			t.Errorf("ValidateTags(%q): got error %v", tag, err)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/Unknwon/com"
+)
+
+type RefType int
+
+const (
+	REF_TYPE_BRANCH RefType = iota
+	REF_TYPE_TAG
+	REF_TYPE_PULL
+	REF_TYPE_COMMIT
+)
+
+func (t RefType) ToString() string {
+	switch t {
+	case REF_TYPE_TAG:
+		return "Tag"
+	case REF_TYPE_PULL:
+		return "Pull Request"
+	case REF_TYPE_COMMIT:
+		return "Commit"
+	}
+	return "Branch"
+}
+
+const (
+	BRANCH_PREFIX = "refs/heads/"
+	TAG_PREFIX    = "refs/tags/"
+	PULL_PREFIX   = "refs/pull/"
+)
+
+var (
+	commitPattern    = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+	shortPullPattern = regexp.MustCompile(`^(?:pull/|#)([0-9]+)$`)
+)
+
+// ParseRefType returns the type of given reference which is stored in the task.
+func ParseRefType(ref string) RefType {
+	switch {
+	case strings.HasPrefix(ref, TAG_PREFIX):
+		return REF_TYPE_TAG
+	case strings.HasPrefix(ref, PULL_PREFIX):
+		return REF_TYPE_PULL
+	case commitPattern.MatchString(ref):
+		return REF_TYPE_COMMIT
+	}
+	return REF_TYPE_BRANCH
+}
+
+// ShortRefName returns the human readable name of given reference.
+func ShortRefName(ref string) string {
+	switch ParseRefType(ref) {
+	case REF_TYPE_TAG:
+		return strings.TrimPrefix(ref, TAG_PREFIX)
+	case REF_TYPE_PULL:
+		return strings.TrimSuffix(strings.TrimPrefix(ref, "refs/"), "/head")
+	case REF_TYPE_COMMIT:
+		if len(ref) > 10 {
+			return ref[:10]
+		}
+		return ref
+	}
+	return strings.TrimPrefix(ref, BRANCH_PREFIX)
+}
+
+// gitRemoteArgs restricts transports of git commands that access the project
+// repository, so that a clone URL saved before validation cannot run commands
+// by transports like "ext::".
+var gitRemoteArgs = []string{
+	"-c", "protocol.allow=never",
+	"-c", "protocol.https.allow=always",
+	"-c", "protocol.ssh.allow=always",
+	"-c", "protocol.git.allow=always",
+}
+
+func gitRemoteCmd(args ...string) []string {
+	return append(append([]string{}, gitRemoteArgs...), args...)
+}
+
+// lsRemote returns reference names and their commit IDs in the remote repository
+// that match given patterns. Annotated tags are resolved to the commits they point to.
+func (p *Project) lsRemote(patterns ...string) (map[string]string, error) {
+	// "--" prevents the URL from being parsed as an option, e.g. "--upload-pack".
+	stdout, stderr, err := com.ExecCmd("git", gitRemoteCmd(append([]string{"ls-remote", "--", p.CloneURL}, patterns...)...)...)
+	if err != nil {
+		return nil, fmt.Errorf("list remote references: %v - %s", err, stderr)
+	}
+
+	refs := make(map[string]string)
+	for _, line := range strings.Split(stdout, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || len(fields[0]) != 40 {
+			continue
+		}
+
+		// Peeled entry of annotated tag always comes after the tag itself.
+		if strings.HasSuffix(fields[1], "^{}") {
+			refs[strings.TrimSuffix(fields[1], "^{}")] = fields[0]
+		} else if _, ok := refs[fields[1]]; !ok {
+			refs[fields[1]] = fields[0]
+		}
+	}
+	return refs, nil
+}
+
+var mirrorLockers = struct {
+	sync.Mutex
+	locks map[int64]*sync.Mutex
+}{locks: make(map[int64]*sync.Mutex)}
+
+// mirrorLocker returns the lock to sync local mirror of the project.
+func (p *Project) mirrorLocker() *sync.Mutex {
+	mirrorLockers.Lock()
+	defer mirrorLockers.Unlock()
+
+	if mirrorLockers.locks[p.ID] == nil {
+		mirrorLockers.locks[p.ID] = new(sync.Mutex)
+	}
+	return mirrorLockers.locks[p.ID]
+}
+
+// resolveCommit makes sure given commit exists in the remote repository by
+// syncing a local mirror, and returns the full commit ID.
+func (p *Project) resolveCommit(sha string) (string, error) {
+	locker := p.mirrorLocker()
+	locker.Lock()
+	defer locker.Unlock()
+
+	mirrorPath := p.MirrorPath()
+	if !com.IsDir(mirrorPath) {
+		if _, stderr, err := com.ExecCmd("git", gitRemoteCmd("clone", "--mirror", "--quiet", "--", p.CloneURL, mirrorPath)...); err != nil {
+			return "", fmt.Errorf("clone mirror: %v - %s", err, stderr)
+		}
+	} else if _, stderr, err := com.ExecCmdDir(mirrorPath, "git", gitRemoteCmd("remote", "update", "--prune")...); err != nil {
+		return "", fmt.Errorf("update mirror: %v - %s", err, stderr)
+	}
+
+	stdout, _, err := com.ExecCmdDir(mirrorPath, "git", "rev-parse", "--verify", "--quiet", sha+"^{commit}")
+	if err != nil {
+		return "", ErrRefNotExist{sha}
+	}
+	return strings.TrimSpace(stdout), nil
+}
+
+// ResolveRef validates given reference against the project repository and returns
+// its full name with the commit ID it points to. The reference can be a branch,
+// a tag, a pull request (e.g. "pull/12" or "refs/pull/12/head") or a commit SHA.
+// Full commit ID is used as reference name when a commit SHA is given.
+func (p *Project) ResolveRef(ref string) (fullRef, commit string, err error) {
+	ref = strings.TrimSpace(ref)
+	if len(ref) == 0 {
+		return "", "", ErrRefNotExist{ref}
+	}
+
+	if commitPattern.MatchString(ref) {
+		commit, err = p.resolveCommit(ref)
+		if err != nil {
+			return "", "", err
+		}
+		return commit, commit, nil
+	}
+
+	candidates := []string{ref}
+	if m := shortPullPattern.FindStringSubmatch(ref); m != nil {
+		candidates = []string{PULL_PREFIX + m[1] + "/head"}
+	} else if !strings.HasPrefix(ref, "refs/") {
+		candidates = []string{BRANCH_PREFIX + ref, TAG_PREFIX + ref}
+	}
+
+	refs, err := p.lsRemote(candidates...)
+	if err != nil {
+		return "", "", err
+	}
+	for _, name := range candidates {
+		if commit, ok := refs[name]; ok {
+			return name, commit, nil
+		}
+	}
+	return "", "", ErrRefNotExist{ref}
+}
@@ -0,0 +1,241 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron"
+	log "gopkg.in/clog.v1"
+
+	"github.com/lubanstudio/luban/pkg/setting"
+)
+
+// Schedule creates batch tasks for a reference periodically.
+type Schedule struct {
+	ID        int64
+	Name      string `gorm:"UNIQUE"`
+	Spec      string
+	ProfileID int64
+	Profile   *BatchProfile `gorm:"-" json:"-"`
+	Ref       string        // Empty means default reference of the profile
+	IsActive  bool          `gorm:"NOT NULL"`
+	// Schedules defined in configuration are overwritten by it on start.
+	IsConfigured bool `gorm:"NOT NULL"`
+
+	LastCommit string
+	LastRun    int64
+	NextRun    int64
+	Created    int64
+}
+
+func (s *Schedule) BeforeCreate() {
+	s.Created = time.Now().Unix()
+}
+
+func (s *Schedule) AfterFind() (err error) {
+	s.Profile, err = GetBatchProfileByID(s.ProfileID)
+	if err != nil && !IsErrRecordNotFound(err) {
+		return fmt.Errorf("GetBatchProfileByID [%d]: %v", s.ProfileID, err)
+	}
+	return nil
+}
+
+func (s *Schedule) LastRunTime() time.Time {
+	return time.Unix(s.LastRun, 0)
+}
+
+func (s *Schedule) NextRunTime() time.Time {
+	return time.Unix(s.NextRun, 0)
+}
+
+// updateNextRun calculates next time to run the schedule after given time.
+func (s *Schedule) updateNextRun(after time.Time) error {
+	sched, err := cron.ParseStandard(s.Spec)
+	if err != nil {
+		return ErrInvalidCronSpec{s.Spec, err}
+	}
+	s.NextRun = sched.Next(after).Unix()
+	return nil
+}
+
+func (s *Schedule) Save() error {
+	if !IsErrRecordNotFound(x.Where("name = ? AND id != ?", s.Name, s.ID).First(new(Schedule)).Error) {
+		return ErrScheduleExists{s.Name}
+	} else if err := s.updateNextRun(time.Now()); err != nil {
+		return err
+	}
+	return x.Save(s).Error
+}
+
+// Run creates batch tasks for the schedule unless the reference
+// still points to the same commit as last run.
+func (s *Schedule) Run() (err error) {
+	now := time.Now()
+	s.LastRun = now.Unix()
+	if err = s.updateNextRun(now); err != nil {
+		return err
+	}
+	// Always save run times, so a failed run won't be retried until next time.
+	defer func() {
+		if saveErr := x.Save(s).Error; err == nil && saveErr != nil {
+			err = fmt.Errorf("save schedule: %v", saveErr)
+		}
+	}()
+
+	profile, err := GetBatchProfileByID(s.ProfileID)
+	if err != nil {
+		return fmt.Errorf("GetBatchProfileByID [%d]: %v", s.ProfileID, err)
+	}
+
+	ref := s.Ref
+	if len(ref) == 0 {
+		ref = profile.DefaultRef
+	}
+	ref, commit, err := profile.Project.ResolveRef(ref)
+	if err != nil {
+		return fmt.Errorf("ResolveRef: %v", err)
+	}
+
+	if commit == s.LastCommit {
+		log.Trace("Schedule '%s' skipped: no new commit since last run", s.Name)
+		return nil
+	}
+
+	result, err := NewBatchTasksOfCommit(0, profile, ref, commit)
+	if err != nil {
+		return fmt.Errorf("NewBatchTasksOfCommit: %v", err)
+	}
+	log.Trace("Schedule '%s' created %d tasks (skipped: %d, rejected: %d)",
+		s.Name, len(result.Created), len(result.Skipped), len(result.Rejected))
+	s.LastCommit = commit
+	return nil
+}
+
+func NewSchedule(name, spec string, profileID int64, ref string, isActive bool) (*Schedule, error) {
+	if !IsErrRecordNotFound(x.Where("name = ?", name).First(new(Schedule)).Error) {
+		return nil, ErrScheduleExists{name}
+	}
+
+	schedule := &Schedule{
+		Name:      name,
+		Spec:      spec,
+		ProfileID: profileID,
+		Ref:       ref,
+		IsActive:  isActive,
+	}
+	if err := schedule.updateNextRun(time.Now()); err != nil {
+		return nil, err
+	}
+	return schedule, x.Create(schedule).Error
+}
+
+func GetScheduleByID(id int64) (*Schedule, error) {
+	schedule := new(Schedule)
+	return schedule, x.First(schedule, id).Error
+}
+
+func ListSchedules() ([]*Schedule, error) {
+	schedules := make([]*Schedule, 0, 5)
+	return schedules, x.Order("name").Find(&schedules).Error
+}
+
+func DeleteScheduleByID(id int64) error {
+	return x.Delete(new(Schedule), id).Error
+}
+
+// SyncSchedules makes schedules match the ones defined in configuration,
+// schedules that have been removed from configuration are deactivated.
+func SyncSchedules() error {
+	names := make(map[string]bool, len(setting.Schedules))
+	for _, s := range setting.Schedules {
+		names[s.Name] = true
+
+		project, err := GetProjectByName(s.Project)
+		if err != nil {
+			return fmt.Errorf("GetProjectByName [%s]: %v", s.Project, err)
+		}
+		profile, err := GetBatchProfileByName(project.ID, s.Profile)
+		if err != nil {
+			return fmt.Errorf("GetBatchProfileByName [%s]: %v", s.Profile, err)
+		}
+
+		schedule := new(Schedule)
+		err = x.Where("name = ?", s.Name).First(schedule).Error
+		if IsErrRecordNotFound(err) {
+			if schedule, err = NewSchedule(s.Name, s.Spec, profile.ID, s.Ref, s.IsActive); err != nil {
+				return fmt.Errorf("NewSchedule [%s]: %v", s.Name, err)
+			}
+		} else if err != nil {
+			return fmt.Errorf("get schedule [%s]: %v", s.Name, err)
+		}
+
+		// Keep next run time when spec is not changed, so a run missed during
+		// downtime is still due.
+		if schedule.Spec != s.Spec {
+			schedule.Spec = s.Spec
+			if err = schedule.updateNextRun(time.Now()); err != nil {
+				return fmt.Errorf("schedule [%s]: %v", s.Name, err)
+			}
+		}
+		schedule.ProfileID = profile.ID
+		schedule.Ref = s.Ref
+		schedule.IsActive = s.IsActive
+		schedule.IsConfigured = true
+		if err = x.Save(schedule).Error; err != nil {
+			return fmt.Errorf("save schedule [%s]: %v", s.Name, err)
+		}
+	}
+
+	configured := make([]*Schedule, 0, 5)
+	if err := x.Where("is_configured = ?", true).Find(&configured).Error; err != nil {
+		return fmt.Errorf("find configured schedules: %v", err)
+	}
+	for _, schedule := range configured {
+		if names[schedule.Name] {
+			continue
+		}
+
+		log.Info("Schedule '%s' has been removed from configuration, deactivating", schedule.Name)
+		if err := x.Model(schedule).Updates(map[string]interface{}{
+			"is_active":     false,
+			"is_configured": false,
+		}).Error; err != nil {
+			return fmt.Errorf("deactivate schedule [%s]: %v", schedule.Name, err)
+		}
+	}
+	return nil
+}
+
+func RunSchedules() {
+	if !startJob() {
+		return
+	}
+	defer endJob(time.Minute, RunSchedules)
+
+	schedules := make([]*Schedule, 0, 5)
+	if err := x.Where("is_active = ? AND next_run <= ?", true, time.Now().Unix()).Find(&schedules).Error; err != nil {
+		log.Error(4, "find due schedules: %v", err)
+		return
+	}
+
+	for _, s := range schedules {
+		log.Trace("Running schedule '%s'...", s.Name)
+		if err := s.Run(); err != nil {
+			log.Error(4, "Run schedule [%s]: %v", s.Name, err)
+		}
+	}
+}
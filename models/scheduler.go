@@ -0,0 +1,56 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package models
+
+import (
+	"sync"
+	"time"
+)
+
+// scheduler keeps track of periodic jobs, i.e. AssignTasks and RunSchedules,
+// so that they can be stopped cleanly.
+var scheduler struct {
+	sync.Mutex
+	stopped bool
+	running sync.WaitGroup
+}
+
+// startJob returns false if scheduler has been stopped, otherwise caller
+// must call endJob when the job is finished.
+func startJob() bool {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+
+	if scheduler.stopped {
+		return false
+	}
+	scheduler.running.Add(1)
+	return true
+}
+
+// endJob marks the job as finished and runs it again after given duration.
+func endJob(d time.Duration, job func()) {
+	scheduler.running.Done()
+	time.AfterFunc(d, job)
+}
+
+// StopScheduler prevents periodic jobs from running again and waits for running ones to finish.
+func StopScheduler() {
+	scheduler.Lock()
+	scheduler.stopped = true
+	scheduler.Unlock()
+
+	scheduler.running.Wait()
+}
@@ -0,0 +1,207 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package models
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/lubanstudio/luban/pkg/tagexpr"
+)
+
+// Scheduler benchmarks need a MySQL database whose tables are dropped, e.g.
+//
+//	LUBAN_TEST_DATABASE="root:@tcp(localhost:3306)/luban_test?charset=utf8&parseTime=true" \
+//		go test -run NONE -bench . ./models
+const (
+	benchNumBuilders = 2000
+	benchNumTasks    = 5000
+)
+
+var (
+	benchPlatforms = [][2]string{{"linux", "amd64"}, {"linux", "arm64"}, {"windows", "amd64"}, {"darwin", "arm64"}}
+	benchTags      = []string{"sqlite", "pam", "bindata", "cert", "miniwinsvc"}
+)
+
+// benchTagSubset returns tags of which bits are set in mask.
+func benchTagSubset(mask int) []string {
+	tags := make([]string, 0, len(benchTags))
+	for i, tag := range benchTags {
+		if mask&(1<<uint(i)) > 0 {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func setupBenchDatabase(b *testing.B) {
+	dsn := os.Getenv("LUBAN_TEST_DATABASE")
+	if len(dsn) == 0 {
+		b.Skip("LUBAN_TEST_DATABASE is not set")
+	}
+
+	var err error
+	x, err = gorm.Open("mysql", dsn)
+	if err != nil {
+		b.Fatalf("open database: %v", err)
+	}
+	tables := []interface{}{new(User), new(Project), new(Builder), new(Matrix), new(MatrixTag), new(Task), new(Secret)}
+	if err = x.DropTableIfExists(tables...).Error; err != nil {
+		b.Fatalf("drop tables: %v", err)
+	} else if err = x.Set("gorm:table_options", "ENGINE=InnoDB").AutoMigrate(tables...).Error; err != nil {
+		b.Fatalf("migrate tables: %v", err)
+	}
+
+	tx := x.Begin()
+	defer releaseTransaction(tx)
+
+	project := &Project{Name: "bench", PackFormats: "zip", MinScriptTrustLevel: TRUST_LEVEL_OFFICIAL}
+	if err = tx.Create(project).Error; err != nil {
+		b.Fatalf("create project: %v", err)
+	}
+
+	// Every builder has matrices of three platforms, with different combinations
+	// of tags and Go versions. Some of them support any tag.
+	for i := 0; i < benchNumBuilders; i++ {
+		builder := &Builder{
+			Name:       fmt.Sprintf("builder-%d", i),
+			TrustLevel: TRUST_LEVEL_APPROVED,
+			Mode:       BUILDER_MODE_ACTIVE,
+		}
+		if err = tx.Create(builder).Error; err != nil {
+			b.Fatalf("create builder: %v", err)
+		}
+
+		for j := 0; j < 3; j++ {
+			platform := benchPlatforms[(i+j)%len(benchPlatforms)]
+			m := &Matrix{
+				BuilderID: builder.ID,
+				OS:        platform[0],
+				Arch:      platform[1],
+				Toolchain: Toolchain{GoVersion: fmt.Sprintf("1.%d.%d", 20+i%4, i%10)},
+			}
+			if err = tx.Create(m).Error; err != nil {
+				b.Fatalf("create matrix: %v", err)
+			}
+
+			tags := benchTagSubset(i + j)
+			if i%50 == 0 {
+				tags = []string{tagexpr.Wildcard}
+			}
+			for _, tag := range tags {
+				if err = tx.Create(&MatrixTag{MatrixID: m.ID, Tag: tag}).Error; err != nil {
+					b.Fatalf("create matrix tag: %v", err)
+				}
+			}
+		}
+	}
+
+	for i := 0; i < benchNumTasks; i++ {
+		platform := benchPlatforms[i%len(benchPlatforms)]
+		t := &Task{
+			ProjectID: project.ID,
+			OS:        platform[0],
+			Arch:      platform[1],
+			Tags:      strings.Join(benchTagSubset(i%8), ","),
+			Ref:       "refs/heads/master",
+			Commit:    "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c",
+			Status:    TASK_STATUS_PENDING,
+		}
+		if i%10 == 0 {
+			t.TagExpr = "!miniwinsvc || cert"
+		}
+		if i%3 == 0 {
+			t.GoVersion = ">=1.21"
+		}
+		if err = tx.Create(t).Error; err != nil {
+			b.Fatalf("create task: %v", err)
+		}
+	}
+
+	if err = tx.Commit().Error; err != nil {
+		b.Fatalf("commit: %v", err)
+	}
+}
+
+// resetBenchDatabase makes all builders online and idle, and all tasks pending.
+func resetBenchDatabase(b *testing.B) {
+	if err := x.Exec("UPDATE builders SET is_idle = ?, task_id = 0, last_heart_beat = ?", true, time.Now().Unix()).Error; err != nil {
+		b.Fatalf("reset builders: %v", err)
+	} else if err = x.Exec("UPDATE tasks SET status = ?, builder_id = 0", TASK_STATUS_PENDING).Error; err != nil {
+		b.Fatalf("reset tasks: %v", err)
+	}
+}
+
+func BenchmarkAssignTasks(b *testing.B) {
+	setupBenchDatabase(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		resetBenchDatabase(b)
+		b.StartTimer()
+
+		assignTasks()
+	}
+	b.StopTimer()
+
+	var assigned int64
+	if err := x.Model(new(Task)).Where("status = ?", TASK_STATUS_BUILDING).Count(&assigned).Error; err != nil {
+		b.Fatalf("count assigned tasks: %v", err)
+	} else if assigned == 0 {
+		b.Fatal("no task has been assigned")
+	}
+	b.Logf("%d of %d tasks are assigned to %d builders", assigned, benchNumTasks, benchNumBuilders)
+}
+
+func BenchmarkMatchBuilders(b *testing.B) {
+	setupBenchDatabase(b)
+
+	constraints := []struct {
+		tags    []string
+		tagExpr string
+		tc      Toolchain
+	}{
+		{nil, "", Toolchain{}},
+		{[]string{"sqlite", "pam"}, "", Toolchain{}},
+		{[]string{"sqlite"}, "", Toolchain{GoVersion: ">=1.21, <1.23"}},
+		{nil, "(pam || bindata) && !miniwinsvc", Toolchain{}},
+	}
+	exprs := make([]struct {
+		tags *tagexpr.Expr
+		tc   Toolchain
+	}, len(constraints))
+	for i, c := range constraints {
+		expr, err := ParseTagConstraint(c.tags, c.tagExpr)
+		if err != nil {
+			b.Fatalf("ParseTagConstraint: %v", err)
+		}
+		exprs[i].tags = expr
+		exprs[i].tc = c.tc
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e := exprs[i%len(exprs)]
+		if _, err := MatchBuilders("linux", "amd64", e.tags, e.tc); err != nil {
+			b.Fatalf("MatchBuilders: %v", err)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lubanstudio/luban/pkg/setting"
+	"github.com/lubanstudio/luban/pkg/tool"
+)
+
+// Secret is an encrypted value of a project, which is delivered to builders
+// that are trusted enough when a task asks for it.
+type Secret struct {
+	ID            int64
+	ProjectID     int64  `gorm:"UNIQUE_INDEX:secret_project_name"`
+	Name          string `gorm:"UNIQUE_INDEX:secret_project_name"`
+	Value         string `gorm:"TYPE:TEXT" json:"-"` // Base64 encoded cipher text
+	MinTrustLevel TrustLevel
+	Updated       int64
+	Created       int64
+}
+
+func (s *Secret) BeforeCreate() {
+	s.Created = time.Now().Unix()
+}
+
+func (s *Secret) BeforeSave() {
+	s.Updated = time.Now().Unix()
+}
+
+func (s *Secret) UpdatedTime() time.Time {
+	return time.Unix(s.Updated, 0)
+}
+
+var errSecretKeyNotSet = errors.New("secret key is not set in section '[security]'")
+
+func secretKey() ([]byte, error) {
+	if len(setting.Security.SecretKey) == 0 {
+		return nil, errSecretKeyNotSet
+	}
+	key := sha256.Sum256([]byte(setting.Security.SecretKey))
+	return key[:], nil
+}
+
+// SetValue encrypts and sets given plain value to the secret.
+func (s *Secret) SetValue(value string) error {
+	key, err := secretKey()
+	if err != nil {
+		return err
+	}
+
+	data, err := tool.AESGCMEncrypt(key, []byte(value))
+	if err != nil {
+		return fmt.Errorf("AESGCMEncrypt: %v", err)
+	}
+	s.Value = base64.StdEncoding.EncodeToString(data)
+	return nil
+}
+
+// PlainValue returns decrypted value of the secret.
+func (s *Secret) PlainValue() (string, error) {
+	key, err := secretKey()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(s.Value)
+	if err != nil {
+		return "", fmt.Errorf("DecodeString: %v", err)
+	}
+	data, err = tool.AESGCMDecrypt(key, data)
+	if err != nil {
+		return "", fmt.Errorf("AESGCMDecrypt: %v", err)
+	}
+	return string(data), nil
+}
+
+var secretNamePattern = regexp.MustCompile(`^[A-Z_][A-Z0-9_]*$`)
+
+// SetSecret creates a new secret or updates value and trust level of existing one.
+func SetSecret(projectID int64, name, value string, minTrustLevel TrustLevel) (*Secret, error) {
+	if !secretNamePattern.MatchString(name) {
+		return nil, ErrInvalidSecretName{name}
+	}
+
+	secret := new(Secret)
+	err := x.Where("project_id = ? AND name = ?", projectID, name).First(secret).Error
+	if err != nil && !IsErrRecordNotFound(err) {
+		return nil, err
+	}
+
+	secret.ProjectID = projectID
+	secret.Name = name
+	secret.MinTrustLevel = minTrustLevel
+	if err = secret.SetValue(value); err != nil {
+		return nil, err
+	}
+	return secret, x.Save(secret).Error
+}
+
+func GetSecretByName(projectID int64, name string) (*Secret, error) {
+	secret := new(Secret)
+	return secret, x.Where("project_id = ? AND name = ?", projectID, name).First(secret).Error
+}
+
+func GetSecretByID(id int64) (*Secret, error) {
+	secret := new(Secret)
+	return secret, x.First(secret, id).Error
+}
+
+func ListSecrets(projectID int64) ([]*Secret, error) {
+	secrets := make([]*Secret, 0, 5)
+	return secrets, x.Where("project_id = ?", projectID).Order("name").Find(&secrets).Error
+}
+
+func DeleteSecretByID(id int64) error {
+	return x.Delete(new(Secret), id).Error
+}
+
+// checkSecrets returns error if any of given secret names does not exist in the project.
+func checkSecrets(projectID int64, names []string) error {
+	for _, name := range names {
+		if err := x.Where("project_id = ? AND name = ?", projectID, name).First(new(Secret)).Error; err != nil {
+			if IsErrRecordNotFound(err) {
+				return ErrSecretNotExist{name}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// DeliverableSecrets returns plain values of secrets the task asks for. Tasks are
+// only assigned to builders trusted enough for all of their secrets, but secrets
+// that have been deleted, or require higher trust level than the builder has
+// since it was assigned, are withheld.
+func (t *Task) DeliverableSecrets(builder *Builder) (secrets map[string]string, withheld []string, err error) {
+	secrets = make(map[string]string)
+	for _, name := range t.SecretList() {
+		secret := new(Secret)
+		if err = x.Where("project_id = ? AND name = ?", t.ProjectID, name).First(secret).Error; err != nil {
+			if IsErrRecordNotFound(err) {
+				withheld = append(withheld, name)
+				continue
+			}
+			return nil, nil, err
+		}
+
+		if builder.TrustLevel < secret.MinTrustLevel {
+			withheld = append(withheld, name)
+			continue
+		}
+
+		secrets[name], err = secret.PlainValue()
+		if err != nil {
+			return nil, nil, fmt.Errorf("PlainValue [%s]: %v", name, err)
+		}
+	}
+	return secrets, withheld, nil
+}
+
+// encodedForms returns the value and its common encoded forms that may appear
+// in build logs, i.e. base64 and URL-encoded.
+func encodedForms(value string) []string {
+	forms := []string{
+		value,
+		base64.StdEncoding.EncodeToString([]byte(value)),
+		base64.RawStdEncoding.EncodeToString([]byte(value)),
+		base64.URLEncoding.EncodeToString([]byte(value)),
+		base64.RawURLEncoding.EncodeToString([]byte(value)),
+		url.QueryEscape(value),
+		url.PathEscape(value),
+	}
+
+	// Remove duplicates in order, e.g. URL-encoded form of alphanumeric value is itself.
+	seen := make(map[string]bool, len(forms))
+	list := forms[:0]
+	for _, form := range forms {
+		if !seen[form] {
+			seen[form] = true
+			list = append(list, form)
+		}
+	}
+	return list
+}
+
+// RedactSecrets replaces values of all secrets of the project appear in given text,
+// as well as their base64 and URL-encoded forms. It is best effort: values that
+// are transformed otherwise, split across lines or encoded as part of a longer
+// string are not recognized, so builds must never print secrets on purpose.
+func (p *Project) RedactSecrets(text string) (string, error) {
+	secrets, err := ListSecrets(p.ID)
+	if err != nil {
+		return "", fmt.Errorf("ListSecrets: %v", err)
+	}
+
+	values := make(map[string]string, len(secrets))
+	for _, s := range secrets {
+		value, err := s.PlainValue()
+		if err != nil {
+			return "", fmt.Errorf("PlainValue [%s]: %v", s.Name, err)
+		} else if len(value) > 0 {
+			for _, form := range encodedForms(value) {
+				values[form] = s.Name
+			}
+		}
+	}
+	if len(values) == 0 {
+		return text, nil
+	}
+
+	// Longer values go first in case one value contains another.
+	olds := make([]string, 0, len(values))
+	for value := range values {
+		olds = append(olds, value)
+	}
+	sort.Slice(olds, func(i, j int) bool { return len(olds[i]) > len(olds[j]) })
+	pairs := make([]string, 0, len(olds)*2)
+	for _, value := range olds {
+		pairs = append(pairs, value, "***"+values[value]+"***")
+	}
+	return strings.NewReplacer(pairs...).Replace(text), nil
+}
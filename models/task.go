@@ -16,6 +16,7 @@ package models
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"sort"
@@ -23,10 +24,13 @@ import (
 	"time"
 
 	"github.com/Unknwon/com"
+	"github.com/jinzhu/gorm"
 	log "gopkg.in/clog.v1"
 
 	"github.com/lubanstudio/luban/pkg/setting"
+	"github.com/lubanstudio/luban/pkg/tagexpr"
 	"github.com/lubanstudio/luban/pkg/tool"
+	"github.com/lubanstudio/luban/pkg/version"
 )
 
 type TaskStatus int
@@ -37,6 +41,7 @@ const (
 	TASK_STATUS_UPLOADING
 	TASK_STATUS_FAILED
 	TASK_STATUS_SUCCEED
+	TASK_STATUS_CANCELED
 	TASK_STATUS_ARCHIVED TaskStatus = 99
 )
 
@@ -52,6 +57,8 @@ func (s TaskStatus) ToString() string {
 		return "Failed"
 	case TASK_STATUS_SUCCEED:
 		return "Succeed"
+	case TASK_STATUS_CANCELED:
+		return "Canceled"
 	case TASK_STATUS_ARCHIVED:
 		return "Archived"
 	}
@@ -59,17 +66,26 @@ func (s TaskStatus) ToString() string {
 }
 
 type Task struct {
-	ID     int64
-	OS     string
-	Arch   string
-	Tags   string
-	Commit string
-	Status TaskStatus
+	ID        int64
+	ProjectID int64    `gorm:"INDEX"`
+	Project   *Project `gorm:"-" json:"-"`
+	OS        string
+	Arch      string
+	Tags      string
+	TagExpr   string // Extra expression that supported tags of matrix must satisfy
+	Toolchain
+	Ref      string
+	Commit   string
+	Status   TaskStatus
+	Priority int
+	BuildOptions
 
 	PosterID  int64
-	Poster    *User `gorm:"-"`
+	Poster    *User `gorm:"-" json:"-"`
 	BuilderID int64
-	Builder   *Builder `gorm:"-"`
+	Builder   *Builder `gorm:"-" json:"-"`
+	Started   int64    // When the task was assigned to builder
+	Finished  int64
 	Updated   int64
 	Created   int64
 }
@@ -79,6 +95,11 @@ func (t *Task) BeforeCreate() {
 }
 
 func (t *Task) AfterFind() (err error) {
+	t.Project, err = GetProjectByID(t.ProjectID)
+	if err != nil {
+		return fmt.Errorf("GetProjectByID [%d]: %v", t.ProjectID, err)
+	}
+
 	if t.PosterID > 0 {
 		t.Poster, err = GetUserByID(t.PosterID)
 		if err != nil {
@@ -86,10 +107,14 @@ func (t *Task) AfterFind() (err error) {
 		}
 	}
 
+	// Builders used to be deleted permanently, tasks built by them have no builder.
 	if t.BuilderID > 0 {
 		t.Builder, err = GetBuilderByID(t.BuilderID)
 		if err != nil {
-			return fmt.Errorf("GetBuilderByID [%d]: %v", t.BuilderID, err)
+			if !IsErrRecordNotFound(err) {
+				return fmt.Errorf("GetBuilderByID [%d]: %v", t.BuilderID, err)
+			}
+			t.Builder = nil
 		}
 	}
 	return nil
@@ -103,18 +128,135 @@ func (t *Task) CreatedTime() time.Time {
 	return time.Unix(t.Created, 0)
 }
 
+func (t *Task) StartedTime() time.Time {
+	return time.Unix(t.Started, 0)
+}
+
+func (t *Task) FinishedTime() time.Time {
+	return time.Unix(t.Finished, 0)
+}
+
+// Duration returns time spent on building, or until now if the task is still building.
+// It returns 0 if the task has not been started.
+func (t *Task) Duration() time.Duration {
+	if t.Started == 0 {
+		return 0
+	}
+	end := t.Finished
+	if end == 0 {
+		end = time.Now().Unix()
+	}
+	return time.Duration(end-t.Started) * time.Second
+}
+
+func (t *Task) Link() string {
+	return fmt.Sprintf("%s/tasks/%d", t.Project.Link(), t.ID)
+}
+
 func (t *Task) CommitURL() string {
-	return com.Expand(setting.Project.CommitURL, map[string]string{"sha": t.Commit})
+	return com.Expand(t.Project.CommitURL, map[string]string{"sha": t.Commit})
+}
+
+func (t *Task) TagList() []string {
+	if len(t.Tags) == 0 {
+		return nil
+	}
+	return strings.Split(t.Tags, ",")
+}
+
+// TagConstraint returns tag expression that supported tags of matrix must satisfy.
+func (t *Task) TagConstraint() (*tagexpr.Expr, error) {
+	return ParseTagConstraint(t.TagList(), t.TagExpr)
+}
+
+func (t *Task) RefType() RefType {
+	return ParseRefType(t.Ref)
 }
 
+func (t *Task) RefName() string {
+	return ShortRefName(t.Ref)
+}
+
+// ArtifactName returns the file name of artifact in given format.
+// Tasks built from a tag use the tag name as version, others use the commit ID.
+// Toolchain requirements are appended when set, Go version constraint is
+// converted by version.Slug, e.g. ">=1.21" becomes "goge1.21".
 func (t *Task) ArtifactName(format string) string {
-	name := setting.Project.PackRoot + "_" + t.Commit[:10] + "_" + t.OS + "_" + t.Arch
+	ver := t.Commit[:10]
+	if t.RefType() == REF_TYPE_TAG {
+		ver = strings.Replace(t.RefName(), "/", "-", -1)
+	}
+	name := t.Project.PackRoot + "_" + ver + "_" + t.OS + "_" + t.Arch
 	if len(t.Tags) > 0 {
 		name += "_" + strings.Replace(t.Tags, ",", "_", -1)
 	}
+	if slug := version.Slug(t.GoVersion); len(slug) > 0 {
+		name += "_go" + slug
+	}
+	if len(t.CC) > 0 {
+		name += "_" + t.CC
+	}
+	if len(t.Libc) > 0 {
+		name += "_" + t.Libc
+	}
 	return name + "." + format
 }
 
+// ArtifactPath returns the local path of artifact in given format.
+func (t *Task) ArtifactPath(format string) string {
+	return path.Join(t.Project.ArtifactsPath(), t.ArtifactName(format))
+}
+
+// ArtifactURL returns the download URL of artifact in given format.
+func (t *Task) ArtifactURL(format string) string {
+	return "/artifacts/" + t.Project.Name + "/" + t.ArtifactName(format)
+}
+
+// BuildLogPath returns the local path of build log uploaded by the builder.
+func (t *Task) BuildLogPath() string {
+	return path.Join(setting.BuildLogsPath, t.Project.Name, com.ToStr(t.ID)+".log")
+}
+
+func (t *Task) HasBuildLog() bool {
+	return com.IsFile(t.BuildLogPath())
+}
+
+// SaveBuildLog saves build log of the task with values of project secrets redacted.
+func (t *Task) SaveBuildLog(data []byte) error {
+	content, err := t.Project.RedactSecrets(string(data))
+	if err != nil {
+		return fmt.Errorf("RedactSecrets: %v", err)
+	}
+
+	os.MkdirAll(path.Dir(t.BuildLogPath()), os.ModePerm)
+	return ioutil.WriteFile(t.BuildLogPath(), []byte(content), 0644)
+}
+
+// MinTrustLevel returns the lowest trust level of builders that may take the task,
+// tasks run commands other than "go build" require the level configured by the project,
+// and tasks ask for secrets require the highest level of those secrets.
+func (t *Task) MinTrustLevel() (TrustLevel, error) {
+	level := TRUST_LEVEL_APPROVED
+	if len(t.ScriptOption()) > 0 && t.Project.MinScriptTrustLevel > level {
+		level = t.Project.MinScriptTrustLevel
+	}
+
+	names := t.SecretList()
+	if len(names) == 0 {
+		return level, nil
+	}
+	secrets := make([]*Secret, 0, len(names))
+	if err := x.Where("project_id = ? AND name IN (?)", t.ProjectID, names).Find(&secrets).Error; err != nil {
+		return 0, err
+	}
+	for _, secret := range secrets {
+		if secret.MinTrustLevel > level {
+			level = secret.MinTrustLevel
+		}
+	}
+	return level, nil
+}
+
 func (t *Task) Save() error {
 	return x.Save(t).Error
 }
@@ -126,6 +268,8 @@ func (t *Task) AssignBuilder(builderID int64) (err error) {
 	t.BuilderID = builderID
 	t.Status = TASK_STATUS_BUILDING
 	t.Updated = time.Now().Unix()
+	t.Started = t.Updated
+	t.Finished = 0
 	if err = tx.Exec("UPDATE builders SET is_idle = ?,task_id = ? WHERE id = ?", false, t.ID, builderID).Error; err != nil {
 		return fmt.Errorf("set builder to busy: %v", err)
 	} else if err = tx.Save(t).Error; err != nil {
@@ -146,6 +290,7 @@ func (t *Task) buildFinish(status TaskStatus) error {
 
 	t.Status = status
 	t.Updated = time.Now().Unix()
+	t.Finished = t.Updated
 	if err = tx.Save(t).Error; err != nil {
 		return fmt.Errorf("Save.(task): %v", err)
 	}
@@ -167,36 +312,82 @@ func (t *Task) BuildSucceed() error {
 	return t.buildFinish(TASK_STATUS_SUCCEED)
 }
 
+// IsCancelable returns true if the task has not finished.
+func (t *Task) IsCancelable() bool {
+	return t.Status == TASK_STATUS_PENDING || t.Status == TASK_STATUS_BUILDING || t.Status == TASK_STATUS_UPLOADING
+}
+
+// Cancel stops the task, the builder is freed immediately and told to
+// cancel the build on its next heartbeat.
+func (t *Task) Cancel() (err error) {
+	if !t.IsCancelable() {
+		return ErrInvalidTaskStatus{t.ID, t.Status, "canceled"}
+	}
+
+	tx := x.Begin()
+	defer releaseTransaction(tx)
+
+	if t.BuilderID > 0 {
+		if err = tx.Exec("UPDATE builders SET is_idle = ?,task_id = ? WHERE id = ? AND task_id = ?",
+			true, 0, t.BuilderID, t.ID).Error; err != nil {
+			return fmt.Errorf("free builder: %v", err)
+		}
+	}
+
+	t.Status = TASK_STATUS_CANCELED
+	t.Updated = time.Now().Unix()
+	t.Finished = t.Updated
+	if err = tx.Save(t).Error; err != nil {
+		return fmt.Errorf("save task: %v", err)
+	}
+
+	return tx.Commit().Error
+}
+
+// Archive deletes artifacts of the succeeded task.
 func (t *Task) Archive() error {
+	if t.Status != TASK_STATUS_SUCCEED {
+		return ErrInvalidTaskStatus{t.ID, t.Status, "archived"}
+	}
+
 	t.Status = TASK_STATUS_ARCHIVED
 	if err := t.Save(); err != nil {
 		return err
 	}
 
-	for _, format := range setting.Project.PackFormats {
-		os.Remove(path.Join(setting.ArtifactsPath, t.ArtifactName(format)))
+	// Names of artifacts come from settings and options of the task, never delete
+	// files outside the artifacts directory of the project.
+	dir := t.Project.ArtifactsPath() + "/"
+	for _, format := range t.Project.PackFormatList() {
+		artifactPath := t.ArtifactPath(format)
+		if !strings.HasPrefix(artifactPath, dir) || strings.Contains(artifactPath[len(dir):], "/") {
+			log.Warn("Artifact of task [%d] is outside artifacts directory: %s", t.ID, artifactPath)
+			continue
+		}
+		os.Remove(artifactPath)
 	}
 	return nil
 }
 
-func GetCommitOfBranch(branch string) (string, error) {
-	fmt.Println("git", "ls-remote", setting.Project.CloneURL, branch)
-	// Get latest commit ID on given branch.
-	stdout, stderr, err := com.ExecCmd("git", "ls-remote", setting.Project.CloneURL, branch)
-	if err != nil {
-		return "", fmt.Errorf("get latest commit of branch '%s': %v - %s", branch, err, stderr)
+func NewTask(doerID int64, project *Project, os, arch string, tags []string, tagExpr string, tc Toolchain, ref string, opts BuildOptions) (*Task, error) {
+	sort.Strings(tags)
+
+	if err := project.ValidateTags(tags); err != nil {
+		return nil, err
 	}
-	if len(stdout) < 40 {
-		return "", fmt.Errorf("not enough length of commit ID: %s", stdout)
+	constraint, err := ParseTagConstraint(tags, tagExpr)
+	if err != nil {
+		return nil, err
+	} else if err = tc.Validate(); err != nil {
+		return nil, err
+	} else if err = opts.Validate(); err != nil {
+		return nil, err
+	} else if option := opts.ProfileOnlyOption(); len(option) > 0 {
+		return nil, ErrProfileOnlyOption{option}
 	}
-	return stdout[:40], nil
-}
-
-func NewTask(doerID int64, os, arch string, tags []string, branch string) (*Task, error) {
-	sort.Strings(tags)
 
 	// Make sure there is a matrix can take the job.
-	builderIDs, err := MatchBuilders(os, arch, tags)
+	builderIDs, err := MatchBuilders(os, arch, constraint, tc)
 	if err != nil {
 		if IsErrNoSuitableMatrix(err) {
 			return nil, err
@@ -204,62 +395,48 @@ func NewTask(doerID int64, os, arch string, tags []string, branch string) (*Task
 		return nil, fmt.Errorf("MatchBuilders: %v", err)
 	}
 	if len(builderIDs) == 0 {
-		return nil, ErrNoSuitableMatrix{os, arch, tags}
+		return nil, ErrNoSuitableMatrix{os, arch, constraint.String(), tc}
 	}
 
-	commit, err := GetCommitOfBranch(branch)
+	ref, commit, err := project.ResolveRef(ref)
 	if err != nil {
-		return nil, fmt.Errorf("GetCommitOfBranch: %v", err)
+		if IsErrRefNotExist(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("ResolveRef: %v", err)
 	}
 
 	// Check to prevent duplicated tasks
-	task := new(Task)
-	if err = x.Where("os=? AND arch=? AND tags=? AND commit=? AND status!=? AND status!=?",
-		os, arch, strings.Join(tags, ","), commit, TASK_STATUS_FAILED, TASK_STATUS_ARCHIVED).First(task).Error; err == nil {
-		return task, nil
+	task := &Task{
+		ProjectID:    project.ID,
+		Project:      project,
+		OS:           os,
+		Arch:         arch,
+		Tags:         strings.Join(tags, ","),
+		TagExpr:      strings.TrimSpace(tagExpr),
+		Toolchain:    tc,
+		Ref:          ref,
+		Commit:       commit,
+		BuildOptions: opts,
+		PosterID:     doerID,
+	}
+	if existing, err := findDuplicatedTask(x, task); err == nil {
+		return existing, nil
 	} else if !IsErrRecordNotFound(err) {
 		return nil, fmt.Errorf("check existing task: %v", err)
 	}
-
-	task = &Task{
-		OS:       os,
-		Arch:     arch,
-		Tags:     strings.Join(tags, ","),
-		Commit:   commit,
-		PosterID: doerID,
-	}
 	return task, x.Create(task).Error
 }
 
-func NewBatchTasks(doerID int64, branch string) error {
-	commit, err := GetCommitOfBranch(branch)
-	if err != nil {
-		return fmt.Errorf("GetCommitOfBranch: %v", err)
-	}
-
-	// Check to prevent duplicated tasks
-	for _, t := range setting.BatchTasks {
-		task := new(Task)
-		if err = x.Where("os=? AND arch=? AND tags=? AND commit=? AND status!=? AND status!=?",
-			t.OS, t.Arch, strings.Join(t.Tags, ","), commit, TASK_STATUS_FAILED, TASK_STATUS_ARCHIVED).First(task).Error; err != nil {
-			if !IsErrRecordNotFound(err) {
-				return fmt.Errorf("check existing task: %v", err)
-			}
-		}
-
-		task = &Task{
-			OS:       t.OS,
-			Arch:     t.Arch,
-			Tags:     strings.Join(t.Tags, ","),
-			Commit:   commit,
-			PosterID: doerID,
-		}
-		if err = x.Create(task).Error; err != nil {
-			return fmt.Errorf("create new task: %v", err)
-		}
-	}
-
-	return nil
+// findDuplicatedTask returns the task which builds the same thing as given one
+// and has not failed, been canceled or archived.
+func findDuplicatedTask(e *gorm.DB, t *Task) (*Task, error) {
+	task := new(Task)
+	return task, e.Where("project_id=? AND os=? AND arch=? AND tags=? AND tag_expr=? AND go_version=? AND cc=? AND libc=? AND ref=? AND commit=? "+
+		"AND build_flags=? AND ld_flags=? AND envs=? AND pre_build_cmds=? AND secrets=? AND status NOT IN (?)",
+		t.ProjectID, t.OS, t.Arch, t.Tags, t.TagExpr, t.GoVersion, t.CC, t.Libc, t.Ref, t.Commit,
+		t.BuildFlags, t.LDFlags, t.Envs, t.PreBuildCmds, t.Secrets,
+		[]TaskStatus{TASK_STATUS_FAILED, TASK_STATUS_CANCELED, TASK_STATUS_ARCHIVED}).First(task).Error
 }
 
 func GetTaskByID(id int64) (*Task, error) {
@@ -267,14 +444,81 @@ func GetTaskByID(id int64) (*Task, error) {
 	return task, x.First(task, id).Error
 }
 
-func ListTasks(page, pageSize int64) ([]*Task, error) {
+// ListTasks returns tasks of given project in reverse order, or of all projects when projectID is 0.
+func ListTasks(projectID, page, pageSize int64) ([]*Task, error) {
 	tasks := make([]*Task, 0, 10)
-	return tasks, x.Limit(pageSize).Offset((page - 1) * pageSize).Order("id DESC").Find(&tasks).Error
+	sess := x.Limit(pageSize).Offset((page - 1) * pageSize).Order("id DESC")
+	if projectID > 0 {
+		sess = sess.Where("project_id = ?", projectID)
+	}
+	return tasks, sess.Find(&tasks).Error
+}
+
+// TaskSearchOptions filters tasks, zero values are not used as filters.
+type TaskSearchOptions struct {
+	ProjectIDs []int64 // Required, tasks of other projects are never returned
+	BuilderID  int64
+	PosterID   int64
+	Status     *TaskStatus
+	OS         string
+	Arch       string
+	Ref        string
+	Commit     string
+	Page       int
+	PageSize   int
+}
+
+// SearchTasks returns tasks match given options in reverse order,
+// and total number of matched tasks.
+func SearchTasks(opts *TaskSearchOptions) ([]*Task, int64, error) {
+	tasks := make([]*Task, 0, opts.PageSize)
+	if len(opts.ProjectIDs) == 0 {
+		return tasks, 0, nil
+	}
+
+	sess := x.Model(new(Task)).Where("project_id IN (?)", tool.Int64sToStrings(opts.ProjectIDs))
+	if opts.BuilderID > 0 {
+		sess = sess.Where("builder_id = ?", opts.BuilderID)
+	}
+	if opts.PosterID > 0 {
+		sess = sess.Where("poster_id = ?", opts.PosterID)
+	}
+	if opts.Status != nil {
+		sess = sess.Where("status = ?", *opts.Status)
+	}
+	if len(opts.OS) > 0 {
+		sess = sess.Where("os = ?", opts.OS)
+	}
+	if len(opts.Arch) > 0 {
+		sess = sess.Where("arch = ?", opts.Arch)
+	}
+	if len(opts.Ref) > 0 {
+		sess = sess.Where("ref = ?", opts.Ref)
+	}
+	if len(opts.Commit) > 0 {
+		sess = sess.Where("commit = ?", opts.Commit)
+	}
+
+	var total int64
+	if err := sess.Count(&total).Error; err != nil {
+		return nil, 0, fmt.Errorf("count: %v", err)
+	}
+	return tasks, total, sess.Limit(opts.PageSize).Offset((opts.Page - 1) * opts.PageSize).Order("id DESC").Find(&tasks).Error
+}
+
+// ListBuilderTasks returns latest tasks assigned to the builder within given projects.
+func ListBuilderTasks(builderID int64, projectIDs []int64, limit int) ([]*Task, error) {
+	tasks := make([]*Task, 0, limit)
+	if len(projectIDs) == 0 {
+		return tasks, nil
+	}
+	return tasks, x.Where("builder_id = ? AND project_id IN (?)", builderID, tool.Int64sToStrings(projectIDs)).
+		Order("id DESC").Limit(limit).Find(&tasks).Error
 }
 
 func ListPendingTasks() ([]*Task, error) {
 	tasks := make([]*Task, 0, 10)
-	return tasks, x.Where("status = ?", TASK_STATUS_PENDING).Find(&tasks).Error
+	return tasks, x.Where("status = ?", TASK_STATUS_PENDING).Order("priority DESC, id ASC").Find(&tasks).Error
 }
 
 func CountTasks() int64 {
@@ -282,12 +526,29 @@ func CountTasks() int64 {
 }
 
 func AssignTasks() {
+	if !startJob() {
+		return
+	}
 	defer func() {
 		log.Trace("Finish assigning tasks.")
-		time.AfterFunc(30*time.Second, AssignTasks)
+		endJob(30*time.Second, AssignTasks)
 	}()
 
 	log.Trace("Start assigning tasks...")
+	assignTasks()
+}
+
+// assignTasks assigns pending tasks to idle builders in one pass.
+func assignTasks() {
+	// No need to match any task when no builder is able to take it.
+	var numIdle int64
+	if err := x.Model(new(Builder)).Scopes(idleBuilders).Count(&numIdle).Error; err != nil {
+		log.Error(4, "count idle builders: %v", err)
+		return
+	} else if numIdle == 0 {
+		return
+	}
+
 	tasks, err := ListPendingTasks()
 	if err != nil {
 		log.Error(4, "ListPendingTasks: %v", err)
@@ -295,11 +556,12 @@ func AssignTasks() {
 	}
 
 	for _, t := range tasks {
-		var tags []string
-		if len(t.Tags) > 0 {
-			tags = strings.Split(t.Tags, ",")
+		constraint, err := t.TagConstraint()
+		if err != nil {
+			log.Error(4, "TagConstraint [task_id: %d]: %v", t.ID, err)
+			continue
 		}
-		builderIDs, err := MatchBuilders(t.OS, t.Arch, tags)
+		builderIDs, err := MatchBuilders(t.OS, t.Arch, constraint, t.Toolchain)
 		if err != nil {
 			if !IsErrNoSuitableMatrix(err) {
 				log.Error(4, "MatchBuilders [task_id: %d]: %v", t.ID, err)
@@ -307,19 +569,30 @@ func AssignTasks() {
 			continue
 		}
 
+		minTrustLevel, err := t.MinTrustLevel()
+		if err != nil {
+			log.Error(4, "MinTrustLevel [task_id: %d]: %v", t.ID, err)
+			continue
+		}
+
 		builder := new(Builder)
-		if err = x.Where("is_idle = ? AND id IN (?)", true, tool.Int64sToStrings(builderIDs)).First(builder).Error; err != nil {
+		if err = x.Scopes(idleBuilders).Where("trust_level >= ? AND id IN (?)",
+			minTrustLevel, tool.Int64sToStrings(builderIDs)).First(builder).Error; err != nil {
 			if !IsErrRecordNotFound(err) {
-				log.Error(4, "find idle builder [task_id: %s]: %v", t.ID, err)
+				log.Error(4, "find idle builder [task_id: %d]: %v", t.ID, err)
 			}
 			continue
 		}
 
 		if err = t.AssignBuilder(builder.ID); err != nil {
-			log.Error(4, "AssignBuilder [task_id: %s, builder_id: %d]: %v", t.ID, builder.ID, err)
+			log.Error(4, "AssignBuilder [task_id: %d, builder_id: %d]: %v", t.ID, builder.ID, err)
 			continue
 		}
 
 		log.Trace("Assigned task '%d' to builder '%d'", t.ID, builder.ID)
+
+		if numIdle--; numIdle == 0 {
+			break
+		}
 	}
 }
@@ -15,113 +15,341 @@
 package models
 
 import (
-	"encoding/json"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"fmt"
+	"strings"
 	"time"
 
-	"github.com/Unknwon/com"
-	"github.com/parnurzeal/gorequest"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/pbkdf2"
+
+	"github.com/lubanstudio/luban/pkg/auth"
+	"github.com/lubanstudio/luban/pkg/setting"
+	"github.com/lubanstudio/luban/pkg/tool"
+)
+
+// Role is the site-wide role of a user, each role has permissions of lower roles.
+type Role int
+
+const (
+	ROLE_VIEWER          Role = iota // View projects, tasks and builders
+	ROLE_BUILDER_OWNER               // Register and manage own builders
+	ROLE_TASK_CREATOR                // Create tasks in projects with write access
+	ROLE_RELEASE_MANAGER             // Create batch tasks and manage projects with admin access
+	ROLE_ADMIN
 )
 
+var Roles = []Role{ROLE_VIEWER, ROLE_BUILDER_OWNER, ROLE_TASK_CREATOR, ROLE_RELEASE_MANAGER, ROLE_ADMIN}
+
+var roleNames = map[Role]string{
+	ROLE_VIEWER:          "viewer",
+	ROLE_BUILDER_OWNER:   "builder_owner",
+	ROLE_TASK_CREATOR:    "task_creator",
+	ROLE_RELEASE_MANAGER: "release_manager",
+	ROLE_ADMIN:           "admin",
+}
+
+// Name returns the name of role used in settings.
+func (r Role) Name() string {
+	return roleNames[r]
+}
+
+func (r Role) ToString() string {
+	switch r {
+	case ROLE_BUILDER_OWNER:
+		return "Builder Owner"
+	case ROLE_TASK_CREATOR:
+		return "Task Creator"
+	case ROLE_RELEASE_MANAGER:
+		return "Release Manager"
+	case ROLE_ADMIN:
+		return "Admin"
+	}
+	return "Viewer"
+}
+
+// MaxAccessMode returns the highest access mode to projects the role is able to have,
+// no matter what access mode is granted by projects.
+func (r Role) MaxAccessMode() AccessMode {
+	switch {
+	case r >= ROLE_RELEASE_MANAGER:
+		return ACCESS_MODE_ADMIN
+	case r >= ROLE_TASK_CREATOR:
+		return ACCESS_MODE_WRITE
+	}
+	return ACCESS_MODE_READ
+}
+
+func ParseRole(n int) Role {
+	if n < int(ROLE_VIEWER) || n > int(ROLE_ADMIN) {
+		return ROLE_VIEWER
+	}
+	return Role(n)
+}
+
+// ParseRoleName returns the role with given name, or false if it does not exist.
+func ParseRoleName(name string) (Role, bool) {
+	for r, n := range roleNames {
+		if n == name {
+			return r, true
+		}
+	}
+	return ROLE_VIEWER, false
+}
+
+// defaultRole is the role of new users signed in by external sources.
+var defaultRole Role
+
+// LOGIN_SOURCE_LOCAL is the login source of users signed in by username and password,
+// other login sources are names of authentication sources in settings.
+const LOGIN_SOURCE_LOCAL = "local"
+
 type User struct {
-	ID        int64
-	OAuthID   string `gorm:"column:oauth_id;UNIQUE"`
-	GitHubID  string `gorm:"column:github_id;UNIQUE"`
-	Username  string
-	AvatarURL string
-	IsAdmin   bool `gorm:"NOT NULL"`
-	Created   int64
+	ID          int64
+	LoginSource string `gorm:"NOT NULL"`
+	LoginID     string `gorm:"NOT NULL"` // Immutable user ID in login source
+	Username    string
+	Email       string
+	AvatarURL   string
+	Passwd      string `json:"-"` // Only for local users
+	Salt        string `json:"-"`
+	Role        Role   `gorm:"NOT NULL"`
+	// Prohibited users are not able to sign in, existing sessions are invalid.
+	ProhibitLogin bool `gorm:"NOT NULL"`
+	// Encrypted OAuth2 token of external login source, used to refresh user information.
+	OAuthToken string `gorm:"column:oauth_token;TYPE:TEXT" json:"-"`
+	Refreshed  int64
+	// Sessions signed in with an older version are invalid, it is increased
+	// when the user revokes authorization at the login source.
+	SessionVersion int64 `gorm:"NOT NULL"`
+	Created        int64
 }
 
 func (u *User) BeforeCreate() {
 	u.Created = time.Now().Unix()
 }
 
+func (u *User) CreatedTime() time.Time {
+	return time.Unix(u.Created, 0)
+}
+
+func (u *User) IsAdmin() bool {
+	return u.Role >= ROLE_ADMIN
+}
+
+// HasRole returns true if the user has given role or a higher one.
+func (u *User) HasRole(role Role) bool {
+	return u.Role >= role
+}
+
+func (u *User) IsLocal() bool {
+	return u.LoginSource == LOGIN_SOURCE_LOCAL
+}
+
+// LoginName returns the name in format of "<source>:<username>", which tells
+// apart users of different login sources that have same username.
+func (u *User) LoginName() string {
+	return u.LoginSource + ":" + u.Username
+}
+
+func encodePasswd(passwd, salt string) string {
+	return hex.EncodeToString(pbkdf2.Key([]byte(passwd), []byte(salt), 10000, 50, sha256.New))
+}
+
+// ValidatePasswd returns true if given password matches the one of local user.
+func (u *User) ValidatePasswd(passwd string) bool {
+	if !u.IsLocal() || len(u.Passwd) == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(u.Passwd), []byte(encodePasswd(passwd, u.Salt))) == 1
+}
+
 func GetUserByID(id int64) (*User, error) {
 	user := new(User)
 	return user, x.Where("id = ?", id).First(user).Error
 }
 
-func GetUserByGitHubID(githubID string) (*User, error) {
-	user := new(User)
-	return user, x.Where("github_id = ?", githubID).First(user).Error
+// GetUserByName returns the user with given name in format of "<source>:<username>".
+// Username without source is only accepted when no other user has the same one.
+func GetUserByName(name string) (*User, error) {
+	sess := x.Where("username = ?", name)
+	if idx := strings.Index(name, ":"); idx > -1 {
+		sess = x.Where("login_source = ? AND username = ?", name[:idx], name[idx+1:])
+	}
+
+	users := make([]*User, 0, 2)
+	if err := sess.Limit(2).Find(&users).Error; err != nil {
+		return nil, err
+	} else if len(users) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	} else if len(users) > 1 {
+		return nil, ErrUserNameAmbiguous{name}
+	}
+	return users[0], nil
 }
 
-func GetUserByOAuthID(oauthID string) (*User, error) {
+func GetUserByLogin(source, loginID string) (*User, error) {
 	user := new(User)
-	return user, x.Where("oauth_id = ?", oauthID).First(user).Error
+	return user, x.Where("login_source = ? AND login_id = ?", source, loginID).First(user).Error
+}
+
+// isConfiguredAdmin returns true if the user is listed as admin in settings
+// by immutable ID in login source.
+func isConfiguredAdmin(source, loginID string) bool {
+	for _, admin := range setting.Auth.Admins {
+		if admin == source+":id:"+loginID {
+			return true
+		}
+	}
+	return false
 }
 
-// GetOrCreateUserByGitHubID retrieves a user based on GitHub ID,
-// and creates a new user if does not exists.
+// GetOrCreateUserByIdentity retrieves a user based on identity returned by
+// given login source, and creates a new user if does not exists.
+// Username, email, avatar and token are updated on every sign in,
+// and users listed as admins in settings are granted admin role.
 // It returns true if a new user created.
-func GetOrCreateUserByGitHubID(oauthID, githubID, username, avatarURL string) (*User, bool, error) {
-	user, err := GetUserByGitHubID(githubID)
+func GetOrCreateUserByIdentity(source string, identity *auth.Identity) (*User, bool, error) {
+	user, err := GetUserByLogin(source, identity.ID)
 	if err != nil && !IsErrRecordNotFound(err) {
-		return nil, false, fmt.Errorf("GetUserByGitHubID: %v", err)
+		return nil, false, fmt.Errorf("GetUserByLogin: %v", err)
 	}
 
-	isNew := false
-	if IsErrRecordNotFound(err) {
-		user.OAuthID = oauthID
-		user.GitHubID = githubID
-		user.Username = username
-		user.AvatarURL = avatarURL
-		if err = x.Create(user).Error; err != nil {
-			return nil, false, fmt.Errorf("create new user: %v", err)
+	isNew := IsErrRecordNotFound(err)
+	if isNew {
+		user.LoginSource = source
+		user.LoginID = identity.ID
+		user.Role = defaultRole
+	}
+	user.Username = identity.Username
+	user.Email = identity.Email
+	user.AvatarURL = identity.AvatarURL
+	if identity.Token != nil {
+		if err = user.setOAuthToken(identity.Token); err != nil {
+			return nil, false, fmt.Errorf("setOAuthToken: %v", err)
 		}
-		isNew = true
+		user.Refreshed = time.Now().Unix()
 	}
 
-	// Update OAuthID as needed
-	if len(oauthID) > 0 && user.OAuthID != oauthID {
-		user.OAuthID = oauthID
-		user.AvatarURL = avatarURL
-		if err = x.Save(user).Error; err != nil {
-			return nil, false, fmt.Errorf("update user OAuthID: %v", err)
+	if isNew {
+		if err = x.Create(user).Error; err != nil {
+			return nil, false, fmt.Errorf("create new user: %v", err)
 		}
+	} else if err = x.Save(user).Error; err != nil {
+		return nil, false, fmt.Errorf("update user: %v", err)
 	}
 
-	// Make the first user be admin
-	if Count(new(User)) == 1 {
-		user.IsAdmin = true
+	if !user.IsAdmin() && isConfiguredAdmin(source, user.LoginID) {
+		user.Role = ROLE_ADMIN
 		if err = x.Save(user).Error; err != nil {
 			return nil, false, fmt.Errorf("set user as admin: %v", err)
 		}
 	}
-
 	return user, isNew, nil
 }
 
-// GetOrCreateUserByOAuthID retrieves a user based on OAuth ID,
-// and creates a new user if does not exists.
-// It returns true if a new user created.
-func GetOrCreateUserByOAuthID(oauthID string) (*User, bool, error) {
-	user, err := GetUserByOAuthID(oauthID)
-	if err != nil && !IsErrRecordNotFound(err) {
-		return nil, false, fmt.Errorf("GetUserByOAuthID: %v", err)
+// CreateLocalUser creates a new user who signs in by username and password.
+func CreateLocalUser(username, email, passwd string, role Role) (*User, error) {
+	_, err := GetUserByLogin(LOGIN_SOURCE_LOCAL, username)
+	if err == nil {
+		return nil, ErrUserExists{username}
+	} else if !IsErrRecordNotFound(err) {
+		return nil, fmt.Errorf("GetUserByLogin: %v", err)
 	}
 
-	isNew := false
-	if IsErrRecordNotFound(err) {
-		// Fetch user info
-		_, data, errs := gorequest.New().Get("https://api.github.com/user").Query("access_token=" + oauthID).EndBytes()
-		if len(errs) > 0 {
-			return nil, false, fmt.Errorf("request GitHub user info: %v", errs[0])
-		}
-		infos := make(map[string]interface{})
-		if err = json.Unmarshal(data, &infos); err != nil {
-			return nil, false, fmt.Errorf("decoding GitHub user info: %v", err)
+	user := &User{
+		LoginSource: LOGIN_SOURCE_LOCAL,
+		LoginID:     username,
+		Username:    username,
+		Email:       email,
+		AvatarURL:   "/img/luban.png",
+		Salt:        tool.NewSecretToekn(),
+		Role:        role,
+	}
+	user.Passwd = encodePasswd(passwd, user.Salt)
+	return user, x.Create(user).Error
+}
+
+// LocalProvider authenticates local users by username and password.
+type LocalProvider struct{}
+
+func (LocalProvider) Name() string {
+	return LOGIN_SOURCE_LOCAL
+}
+
+func (LocalProvider) Authenticate(username, passwd string) (*auth.Identity, error) {
+	user, err := GetUserByLogin(LOGIN_SOURCE_LOCAL, username)
+	if err != nil {
+		if IsErrRecordNotFound(err) {
+			return nil, auth.ErrInvalidCredentials
 		}
-		if infos["id"] == nil || infos["login"] == nil {
-			return nil, false, fmt.Errorf("'id' or 'login' not found in returned GitHub user info: %v", err)
+		return nil, fmt.Errorf("GetUserByLogin: %v", err)
+	} else if !user.ValidatePasswd(passwd) || user.ProhibitLogin {
+		return nil, auth.ErrInvalidCredentials
+	}
+
+	return &auth.Identity{
+		ID:        user.LoginID,
+		Username:  user.Username,
+		Email:     user.Email,
+		AvatarURL: user.AvatarURL,
+	}, nil
+}
+
+// migrateUserLogins moves GitHub IDs of users to login source "github",
+// and adds unique index of login sources and IDs.
+func migrateUserLogins() error {
+	if x.Dialect().HasColumn("users", "github_id") {
+		if err := x.Exec("UPDATE users SET login_source = ?, login_id = github_id WHERE login_id = ''", "github").Error; err != nil {
+			return fmt.Errorf("move GitHub IDs: %v", err)
+		} else if err = x.Model(new(User)).DropColumn("github_id").Error; err != nil {
+			return fmt.Errorf("drop column 'github_id': %v", err)
 		}
-		user, isNew, err = GetOrCreateUserByGitHubID(oauthID,
-			com.ToStr(infos["id"]), com.ToStr(infos["login"]), com.ToStr(infos["avatar_url"]))
-		if err != nil {
-			return nil, false, fmt.Errorf("GetOrCreateUserByGitHubID: %v", err)
+	}
+	if x.Dialect().HasColumn("users", "oauth_id") {
+		if err := x.Model(new(User)).DropColumn("oauth_id").Error; err != nil {
+			return fmt.Errorf("drop column 'oauth_id': %v", err)
 		}
 	}
 
-	return user, isNew, nil
+	if !x.Dialect().HasIndex("users", "uix_users_login") {
+		return x.Model(new(User)).AddUniqueIndex("uix_users_login", "login_source", "login_id").Error
+	}
+	return nil
+}
+
+// migrateUserRoles converts admin flags of users to roles, other users get the default role.
+func migrateUserRoles() error {
+	if !x.Dialect().HasColumn("users", "is_admin") {
+		return nil
+	}
+
+	if err := x.Exec("UPDATE users SET role = ? WHERE is_admin = ?", ROLE_ADMIN, true).Error; err != nil {
+		return fmt.Errorf("set admins: %v", err)
+	} else if err = x.Exec("UPDATE users SET role = ? WHERE is_admin = ?", defaultRole, false).Error; err != nil {
+		return fmt.Errorf("set default role: %v", err)
+	}
+	return x.Model(new(User)).DropColumn("is_admin").Error
+}
+
+// ListUsers returns users in pages ordered by ID.
+func ListUsers(page, pageSize int) ([]*User, error) {
+	users := make([]*User, 0, pageSize)
+	return users, x.Limit(pageSize).Offset((page - 1) * pageSize).Order("id ASC").Find(&users).Error
+}
+
+func CountUsers() int64 {
+	return Count(new(User))
+}
+
+// UpdateUserRole changes role and whether the user is prohibited to sign in.
+func UpdateUserRole(u *User, role Role, prohibitLogin bool) error {
+	u.Role = role
+	u.ProhibitLogin = prohibitLogin
+	return x.Model(u).Updates(map[string]interface{}{
+		"role":           role,
+		"prohibit_login": prohibitLogin,
+	}).Error
 }
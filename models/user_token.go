@@ -0,0 +1,209 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package models
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"golang.org/x/oauth2"
+	log "gopkg.in/clog.v1"
+
+	"github.com/lubanstudio/luban/pkg/auth"
+	"github.com/lubanstudio/luban/pkg/setting"
+	"github.com/lubanstudio/luban/pkg/tool"
+)
+
+// setOAuthToken encrypts and sets the token of login source,
+// it is not kept when secret key is not set.
+func (u *User) setOAuthToken(token *oauth2.Token) error {
+	key, err := secretKey()
+	if err != nil {
+		if err == errSecretKeyNotSet {
+			u.OAuthToken = ""
+			return nil
+		}
+		return err
+	}
+
+	data, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("encode token: %v", err)
+	}
+	data, err = tool.AESGCMEncrypt(key, data)
+	if err != nil {
+		return fmt.Errorf("AESGCMEncrypt: %v", err)
+	}
+	u.OAuthToken = base64.StdEncoding.EncodeToString(data)
+	return nil
+}
+
+// oauthToken returns decrypted token of login source.
+func (u *User) oauthToken() (*oauth2.Token, error) {
+	key, err := secretKey()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(u.OAuthToken)
+	if err != nil {
+		return nil, fmt.Errorf("DecodeString: %v", err)
+	}
+	data, err = tool.AESGCMDecrypt(key, data)
+	if err != nil {
+		return nil, fmt.Errorf("AESGCMDecrypt: %v", err)
+	}
+
+	token := new(oauth2.Token)
+	if err = json.Unmarshal(data, token); err != nil {
+		return nil, fmt.Errorf("decode token: %v", err)
+	}
+	return token, nil
+}
+
+// clearOAuthToken deletes the token of login source, and invalidates
+// all sessions and deletes all personal access tokens of the user when
+// signOut is true.
+func (u *User) clearOAuthToken(signOut bool) (err error) {
+	u.OAuthToken = ""
+	u.Refreshed = time.Now().Unix()
+	updates := map[string]interface{}{
+		"oauth_token": "",
+		"refreshed":   u.Refreshed,
+	}
+	if !signOut {
+		return x.Model(u).Updates(updates).Error
+	}
+
+	u.SessionVersion++
+	updates["session_version"] = u.SessionVersion
+	tx := x.Begin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	if err = tx.Model(u).Updates(updates).Error; err != nil {
+		return fmt.Errorf("update user: %v", err)
+	} else if err = tx.Where("user_id = ?", u.ID).Delete(new(AccessToken)).Error; err != nil {
+		return fmt.Errorf("delete access tokens: %v", err)
+	}
+	return tx.Commit().Error
+}
+
+// refresh updates username, email and avatar of the user from login source.
+func (u *User) refresh() error {
+	provider := auth.GetProvider(u.LoginSource)
+	if provider == nil {
+		// Login source has been removed from settings.
+		return u.clearOAuthToken(false)
+	}
+
+	token, err := u.oauthToken()
+	if err != nil {
+		log.Warn("Token of user '%s' is dropped: %v", u.Username, err)
+		return u.clearOAuthToken(false)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	identity, err := provider.Refresh(ctx, token)
+	switch err {
+	case nil:
+	case auth.ErrTokenExpired:
+		// Information will be refreshed on next sign in.
+		return u.clearOAuthToken(false)
+	case auth.ErrTokenRevoked, auth.ErrNotAllowed:
+		reason := err.Error()
+		log.Info("User '%s' is signed out and access tokens are deleted: %s", u.Username, reason)
+		if err = u.clearOAuthToken(true); err != nil {
+			return err
+		}
+		if err = NewAuditLog(nil, "", AUDIT_USER_SIGN_OUT, u.AuditTarget(), nil,
+			map[string]string{"reason": reason, "access_tokens": "deleted"}); err != nil {
+			log.Error(2, "NewAuditLog [%s]: %v", AUDIT_USER_SIGN_OUT, err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("Refresh: %v", err)
+	}
+	if identity.ID != u.LoginID {
+		return fmt.Errorf("login source returned another user: %s", identity.ID)
+	}
+
+	u.Username = identity.Username
+	u.Email = identity.Email
+	u.AvatarURL = identity.AvatarURL
+	if err = u.setOAuthToken(identity.Token); err != nil {
+		return fmt.Errorf("setOAuthToken: %v", err)
+	}
+	u.Refreshed = time.Now().Unix()
+	return x.Model(u).Updates(map[string]interface{}{
+		"username":    u.Username,
+		"email":       u.Email,
+		"avatar_url":  u.AvatarURL,
+		"oauth_token": u.OAuthToken,
+		"refreshed":   u.Refreshed,
+	}).Error
+}
+
+// RefreshUsers periodically refreshes information of users signed in by external
+// login sources with their stored tokens, so that requests never need to call
+// login sources. Users who have revoked authorization or are no longer allowed
+// to sign in are signed out from all sessions and lose their access tokens.
+func RefreshUsers() {
+	if !startJob() {
+		return
+	}
+	defer endJob(time.Hour, RefreshUsers)
+
+	users := make([]*User, 0, 10)
+	if err := x.Where("oauth_token != '' AND refreshed < ?", time.Now().Add(-setting.Auth.RefreshInterval).Unix()).
+		Find(&users).Error; err != nil {
+		log.Error(4, "find users to refresh: %v", err)
+		return
+	}
+
+	for _, u := range users {
+		if err := u.refresh(); err != nil {
+			log.Error(4, "Refresh user [%d]: %v", u.ID, err)
+		}
+	}
+}
+
+// RevokeOAuthToken revokes token of the user at login source and deletes it.
+// Revocation is best effort so that signing out never fails because of
+// an unavailable login source.
+func (u *User) RevokeOAuthToken() error {
+	if len(u.OAuthToken) == 0 {
+		return nil
+	}
+
+	if provider := auth.GetProvider(u.LoginSource); provider != nil {
+		token, err := u.oauthToken()
+		if err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			err = provider.Revoke(ctx, token)
+			cancel()
+		}
+		if err != nil {
+			log.Warn("Fail to revoke token of user '%s': %v", u.Username, err)
+		}
+	}
+	return u.clearOAuthToken(false)
+}
@@ -0,0 +1,154 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package auth signs in users with external OAuth2 and OIDC providers,
+// or with username and password.
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"golang.org/x/oauth2"
+
+	"github.com/lubanstudio/luban/pkg/setting"
+)
+
+const (
+	TYPE_GITHUB            = "github"
+	TYPE_GITHUB_ENTERPRISE = "github_enterprise"
+	TYPE_GITEA             = "gitea"
+	TYPE_GITLAB            = "gitlab"
+	TYPE_OIDC              = "oidc"
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrInvalidIdentity    = errors.New("provider returned no user ID or username")
+	ErrNotAllowed         = errors.New("user is not allowed to sign in")
+	ErrTokenExpired       = errors.New("token has expired and cannot be refreshed")
+	ErrTokenRevoked       = errors.New("token has been revoked")
+)
+
+// Identity is the user information returned by a provider.
+type Identity struct {
+	ID        string // Immutable ID of the user in the provider
+	Username  string
+	Email     string
+	AvatarURL string
+	Groups    []string // Organizations and teams, only set when used by allowlist
+	// Token is used to refresh user information later, it is nil for password providers.
+	Token *oauth2.Token
+}
+
+// Provider signs in users by redirecting them to an external service.
+type Provider interface {
+	Name() string
+	DisplayName() string
+	// AuthCodeURL returns the URL to redirect users to for authorization,
+	// the nonce is bound to ID token by OIDC providers and ignored by others.
+	AuthCodeURL(ctx context.Context, state, nonce string) (string, error)
+	// Exchange exchanges the authorization code returned to callback URL
+	// for identity of the user, it returns ErrNotAllowed when the user is
+	// not in allowlists. The nonce must be the same as given to AuthCodeURL.
+	Exchange(ctx context.Context, code, nonce string) (*Identity, error)
+	// Refresh returns current identity of the user with token returned by Exchange,
+	// the token is refreshed when expired. It returns ErrTokenExpired when the token
+	// cannot be refreshed, ErrTokenRevoked when the user has revoked authorization
+	// (i.e. refresh token is rejected as invalid grant or access token is rejected),
+	// and ErrNotAllowed when the user is no longer in allowlists. Other errors are
+	// temporary and should be retried later.
+	Refresh(ctx context.Context, token *oauth2.Token) (*Identity, error)
+	// Revoke revokes the token at the provider if it supports revocation.
+	Revoke(ctx context.Context, token *oauth2.Token) error
+}
+
+// PasswordProvider signs in users by username and password,
+// it returns ErrInvalidCredentials when they do not match.
+type PasswordProvider interface {
+	Name() string
+	Authenticate(username, password string) (*Identity, error)
+}
+
+var (
+	providers        []Provider
+	passwordProvider PasswordProvider
+)
+
+// NewProvider returns a new provider for given authentication source.
+func NewProvider(source *setting.AuthSource) (Provider, error) {
+	// GitHub falls back to callback URL registered with the OAuth App when it is not set.
+	var redirectURL string
+	if len(setting.Server.ExternalURL) > 0 {
+		redirectURL = setting.Server.ExternalURL + "login/" + source.Name + "/callback"
+	} else if source.Type != TYPE_GITHUB {
+		return nil, errors.New("EXTERNAL_URL in section 'server' is required to build callback URL")
+	}
+
+	switch source.Type {
+	case TYPE_GITHUB:
+		return newGitHubProvider(source, "https://github.com", "https://api.github.com", redirectURL), nil
+	case TYPE_GITHUB_ENTERPRISE:
+		return newGitHubProvider(source, source.BaseURL, source.BaseURL+"/api/v3", redirectURL), nil
+	case TYPE_GITEA:
+		return newGiteaProvider(source, redirectURL), nil
+	case TYPE_GITLAB:
+		return newGitLabProvider(source, redirectURL), nil
+	case TYPE_OIDC:
+		return newOIDCProvider(source, redirectURL), nil
+	}
+	return nil, fmt.Errorf("unsupported type: %s", source.Type)
+}
+
+// Init creates providers of all authentication sources in settings.
+func Init() error {
+	providers = make([]Provider, 0, len(setting.AuthSources))
+	for _, source := range setting.AuthSources {
+		p, err := NewProvider(source)
+		if err != nil {
+			return fmt.Errorf("new provider '%s': %v", source.Name, err)
+		}
+		providers = append(providers, p)
+	}
+	return nil
+}
+
+// Providers returns all external providers in the order of settings.
+func Providers() []Provider {
+	return providers
+}
+
+// GetProvider returns the external provider with given name,
+// or nil if it does not exist.
+func GetProvider(name string) Provider {
+	for _, p := range providers {
+		if p.Name() == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// SetPasswordProvider sets the provider to sign in with username and password,
+// which is disabled when it is nil.
+func SetPasswordProvider(p PasswordProvider) {
+	passwordProvider = p
+}
+
+// GetPasswordProvider returns the provider to sign in with username and password,
+// or nil if it is disabled.
+func GetPasswordProvider() PasswordProvider {
+	return passwordProvider
+}
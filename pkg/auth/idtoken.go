@@ -0,0 +1,282 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidIDToken = errors.New("invalid ID token")
+
+// idTokenClaims contains claims of ID token that are verified.
+type idTokenClaims struct {
+	Issuer   string   `json:"iss"`
+	Subject  string   `json:"sub"`
+	Audience audience `json:"aud"`
+	Expiry   int64    `json:"exp"`
+	Nonce    string   `json:"nonce"`
+}
+
+// audience is the "aud" claim, which is either a string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		*a = audience{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func (a audience) contains(aud string) bool {
+	for i := range a {
+		if a[i] == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// signingAlgs maps supported asymmetric algorithms to their hash functions,
+// "none" and HMAC algorithms are never accepted.
+var signingAlgs = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// keySet caches signing keys of the provider fetched from its JWKS endpoint,
+// keys are fetched again once when a token is signed by an unknown key.
+type keySet struct {
+	url string
+
+	lock sync.Mutex
+	keys map[string]crypto.PublicKey
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// publicKey returns the public key of the JWK, or nil if the key type
+// is not supported.
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, nil
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, nil
+}
+
+func (s *keySet) fetch(ctx context.Context) error {
+	data, err := getJSON(ctx, http.DefaultClient, s.url)
+	if err != nil {
+		return fmt.Errorf("get JWKS: %v", err)
+	}
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err = json.Unmarshal(data, &jwks); err != nil {
+		return fmt.Errorf("decode JWKS: %v", err)
+	}
+
+	s.keys = make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for i := range jwks.Keys {
+		if jwks.Keys[i].Use != "" && jwks.Keys[i].Use != "sig" {
+			continue
+		}
+		key, err := jwks.Keys[i].publicKey()
+		if err != nil {
+			return fmt.Errorf("decode key '%s': %v", jwks.Keys[i].Kid, err)
+		} else if key != nil {
+			s.keys[jwks.Keys[i].Kid] = key
+		}
+	}
+	return nil
+}
+
+// get returns the key with given ID, the key is the only one of the set
+// when ID is empty.
+func (s *keySet) get(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	lookup := func() crypto.PublicKey {
+		if len(kid) == 0 && len(s.keys) == 1 {
+			for _, key := range s.keys {
+				return key
+			}
+		}
+		return s.keys[kid]
+	}
+
+	if key := lookup(); key != nil {
+		return key, nil
+	}
+	if err := s.fetch(ctx); err != nil {
+		return nil, err
+	}
+	if key := lookup(); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%v: unknown signing key '%s'", ErrInvalidIDToken, kid)
+}
+
+// verifySignature verifies the signature of signing input with given key.
+func verifySignature(alg string, key crypto.PublicKey, input, sig []byte) bool {
+	hash := signingAlgs[alg]
+	h := hash.New()
+	h.Write(input)
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(key, hash, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+// verifyIDToken verifies signature of the ID token with keys of the provider,
+// and checks its issuer, audience, expiry and nonce.
+func verifyIDToken(ctx context.Context, keys *keySet, raw, issuer, clientID, nonce string) (*idTokenClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%v: malformed", ErrInvalidIDToken)
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%v: decode header: %v", ErrInvalidIDToken, err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err = json.Unmarshal(data, &header); err != nil {
+		return nil, fmt.Errorf("%v: decode header: %v", ErrInvalidIDToken, err)
+	} else if _, ok := signingAlgs[header.Alg]; !ok {
+		return nil, fmt.Errorf("%v: unsupported algorithm '%s'", ErrInvalidIDToken, header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%v: decode signature: %v", ErrInvalidIDToken, err)
+	}
+	key, err := keys.get(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	} else if !verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, fmt.Errorf("%v: signature mismatch", ErrInvalidIDToken)
+	}
+
+	data, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%v: decode claims: %v", ErrInvalidIDToken, err)
+	}
+	claims := new(idTokenClaims)
+	if err = json.Unmarshal(data, claims); err != nil {
+		return nil, fmt.Errorf("%v: decode claims: %v", ErrInvalidIDToken, err)
+	}
+
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != issuer:
+		return nil, fmt.Errorf("%v: issuer mismatch '%s'", ErrInvalidIDToken, claims.Issuer)
+	case !claims.Audience.contains(clientID):
+		return nil, fmt.Errorf("%v: audience mismatch %v", ErrInvalidIDToken, []string(claims.Audience))
+	case time.Now().Unix() >= claims.Expiry:
+		return nil, fmt.Errorf("%v: expired", ErrInvalidIDToken)
+	case len(nonce) == 0 || claims.Nonce != nonce:
+		return nil, fmt.Errorf("%v: nonce mismatch", ErrInvalidIDToken)
+	case len(claims.Subject) == 0:
+		return nil, fmt.Errorf("%v: no subject", ErrInvalidIDToken)
+	}
+	return claims, nil
+}
@@ -0,0 +1,411 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/oauth2"
+
+	"github.com/lubanstudio/luban/pkg/setting"
+)
+
+// oauth2Provider signs in users with OAuth2 authorization code flow,
+// then identifies them by user info API of the service.
+type oauth2Provider struct {
+	source      *setting.AuthSource
+	config      *oauth2.Config
+	userInfoURL string
+	// parse decodes response of user info API.
+	parse func(data []byte) (*Identity, error)
+	// groups returns organizations of the user, it is only called
+	// when the source has organizations in allowlist.
+	groups func(ctx context.Context, client *http.Client) ([]string, error)
+	// revoke revokes the token, it is nil when the service does not support revocation.
+	revoke func(ctx context.Context, token *oauth2.Token) error
+}
+
+func (p *oauth2Provider) Name() string {
+	return p.source.Name
+}
+
+func (p *oauth2Provider) DisplayName() string {
+	return p.source.DisplayName
+}
+
+func (p *oauth2Provider) AuthCodeURL(ctx context.Context, state, nonce string) (string, error) {
+	return p.config.AuthCodeURL(state), nil
+}
+
+func (p *oauth2Provider) Exchange(ctx context.Context, code, nonce string) (*Identity, error) {
+	token, err := p.config.Exchange(ctx, code)
+	if err != nil {
+		return nil, fmt.Errorf("exchange token: %v", err)
+	}
+	return p.identify(ctx, p.config.TokenSource(ctx, token))
+}
+
+func (p *oauth2Provider) Refresh(ctx context.Context, token *oauth2.Token) (*Identity, error) {
+	if !token.Valid() && len(token.RefreshToken) == 0 {
+		return nil, ErrTokenExpired
+	}
+	return p.identify(ctx, p.config.TokenSource(ctx, token))
+}
+
+func (p *oauth2Provider) Revoke(ctx context.Context, token *oauth2.Token) error {
+	if p.revoke == nil {
+		return nil
+	}
+	return p.revoke(ctx, token)
+}
+
+// identify returns identity of the user authorized by given token source,
+// and checks allowlists of the source.
+func (p *oauth2Provider) identify(ctx context.Context, ts oauth2.TokenSource) (*Identity, error) {
+	// Token is refreshed here when it has expired.
+	token, err := ts.Token()
+	if err != nil {
+		if rerr, ok := err.(*oauth2.RetrieveError); ok && isInvalidGrant(rerr) {
+			return nil, ErrTokenRevoked
+		}
+		return nil, fmt.Errorf("get token: %v", err)
+	}
+
+	client := oauth2.NewClient(ctx, ts)
+	data, err := getJSON(ctx, client, p.userInfoURL)
+	if err != nil {
+		return nil, err
+	}
+	identity, err := p.parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("decode user info: %v", err)
+	} else if len(identity.ID) == 0 || len(identity.Username) == 0 {
+		return nil, ErrInvalidIdentity
+	}
+
+	if len(p.source.AllowedOrgs) > 0 && p.groups != nil {
+		identity.Groups, err = p.groups(ctx, client)
+		if err != nil {
+			return nil, fmt.Errorf("get organizations: %v", err)
+		}
+	}
+	if !isAllowed(p.source, identity) {
+		return nil, ErrNotAllowed
+	}
+	identity.Token = token
+	return identity, nil
+}
+
+// isInvalidGrant returns true if the token endpoint rejected the refresh token
+// with error "invalid_grant" defined by RFC 6749, which means authorization
+// has been revoked or has expired. Other errors (e.g. server errors or invalid
+// client credentials) may be temporary.
+func isInvalidGrant(err *oauth2.RetrieveError) bool {
+	if err.Response == nil ||
+		(err.Response.StatusCode != http.StatusBadRequest && err.Response.StatusCode != http.StatusUnauthorized) {
+		return false
+	}
+
+	var resp struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(err.Body, &resp) != nil {
+		// Some services respond in form encoding.
+		values, _ := url.ParseQuery(string(err.Body))
+		resp.Error = values.Get("error")
+	}
+	return resp.Error == "invalid_grant"
+}
+
+// isAllowed returns true if the user is in allowlists of the source,
+// or the source has no allowlist.
+func isAllowed(source *setting.AuthSource, identity *Identity) bool {
+	if len(source.AllowedUsers) == 0 && len(source.AllowedOrgs) == 0 {
+		return true
+	}
+
+	for _, user := range source.AllowedUsers {
+		if user == "id:"+identity.ID {
+			return true
+		}
+	}
+	for _, org := range source.AllowedOrgs {
+		for _, group := range identity.Groups {
+			if strings.EqualFold(org, group) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getJSON requests given URL and returns the response body, the access token
+// is sent in header when the client is created by OAuth2 config.
+// It returns ErrTokenRevoked when the token is rejected.
+func getJSON(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("request %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response: %v", err)
+	} else if resp.StatusCode == http.StatusUnauthorized {
+		return nil, ErrTokenRevoked
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("request %s: status %d: %s", url, resp.StatusCode, data)
+	}
+	return data, nil
+}
+
+// revokeRequest sends the request to revoke a token, tokens that are
+// already invalid are treated as revoked.
+func revokeRequest(ctx context.Context, req *http.Request) error {
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("request %s: %v", req.URL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("request %s: status %d: %s", req.URL, resp.StatusCode, data)
+	}
+	return nil
+}
+
+// revokeToken revokes the token by revocation endpoint defined by RFC 7009.
+func revokeToken(ctx context.Context, source *setting.AuthSource, endpoint string, token *oauth2.Token) error {
+	form := url.Values{
+		"token":           {token.AccessToken},
+		"token_type_hint": {"access_token"},
+	}
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(source.ClientID, source.ClientSecret)
+	return revokeRequest(ctx, req)
+}
+
+// revokeGitHubToken revokes the token by API of GitHub, which requires
+// credentials of the OAuth App.
+func revokeGitHubToken(ctx context.Context, source *setting.AuthSource, apiURL string, token *oauth2.Token) error {
+	body, err := json.Marshal(map[string]string{"access_token": token.AccessToken})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("DELETE", apiURL+"/applications/"+source.ClientID+"/token", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(source.ClientID, source.ClientSecret)
+	return revokeRequest(ctx, req)
+}
+
+func scopesOrDefault(source *setting.AuthSource, scopes ...string) []string {
+	if len(source.Scopes) > 0 {
+		return source.Scopes
+	}
+	return scopes
+}
+
+// orgScopes returns given scopes if the source has organizations in allowlist,
+// which are required to list organizations of the user.
+func orgScopes(source *setting.AuthSource, scopes ...string) []string {
+	if len(source.AllowedOrgs) == 0 {
+		return nil
+	}
+	return scopes
+}
+
+// getNames requests given URL which responses a list of objects,
+// and returns values of given field.
+func getNames(ctx context.Context, client *http.Client, url, field string) ([]string, error) {
+	data, err := getJSON(ctx, client, url)
+	if err != nil {
+		return nil, err
+	}
+	var objects []map[string]interface{}
+	if err = json.Unmarshal(data, &objects); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(objects))
+	for _, obj := range objects {
+		if name, ok := obj[field].(string); ok {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// getGitHubOrgs returns organizations of the user, teams are only requested
+// when there are teams in allowlist.
+func getGitHubOrgs(ctx context.Context, client *http.Client, apiURL string, allowed []string) ([]string, error) {
+	orgs, err := getNames(ctx, client, apiURL+"/user/orgs?per_page=100", "login")
+	if err != nil {
+		return nil, err
+	}
+
+	hasTeam := false
+	for _, org := range allowed {
+		if strings.Contains(org, "/") {
+			hasTeam = true
+			break
+		}
+	}
+	if !hasTeam {
+		return orgs, nil
+	}
+
+	data, err := getJSON(ctx, client, apiURL+"/user/teams?per_page=100")
+	if err != nil {
+		return nil, err
+	}
+	var teams []struct {
+		Slug         string `json:"slug"`
+		Organization struct {
+			Login string `json:"login"`
+		} `json:"organization"`
+	}
+	if err = json.Unmarshal(data, &teams); err != nil {
+		return nil, err
+	}
+	for _, t := range teams {
+		orgs = append(orgs, t.Organization.Login+"/"+t.Slug)
+	}
+	return orgs, nil
+}
+
+// userInfo contains fields of user info API that are common between
+// GitHub, Gitea and GitLab.
+type userInfo struct {
+	ID        int64  `json:"id"`
+	Login     string `json:"login"`
+	Username  string `json:"username"`
+	Email     string `json:"email"`
+	AvatarURL string `json:"avatar_url"`
+}
+
+func parseUserInfo(data []byte) (*Identity, error) {
+	var info userInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+
+	identity := &Identity{
+		Username:  info.Login,
+		Email:     info.Email,
+		AvatarURL: info.AvatarURL,
+	}
+	if info.ID > 0 {
+		identity.ID = strconv.FormatInt(info.ID, 10)
+	}
+	// GitLab only has "username", and Gitea has both.
+	if len(identity.Username) == 0 {
+		identity.Username = info.Username
+	}
+	return identity, nil
+}
+
+// newGitHubProvider returns a provider of GitHub or GitHub Enterprise with
+// given base URLs of web and API.
+func newGitHubProvider(source *setting.AuthSource, baseURL, apiURL, redirectURL string) Provider {
+	return &oauth2Provider{
+		source: source,
+		config: &oauth2.Config{
+			ClientID:     source.ClientID,
+			ClientSecret: source.ClientSecret,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  baseURL + "/login/oauth/authorize",
+				TokenURL: baseURL + "/login/oauth/access_token",
+			},
+			RedirectURL: redirectURL,
+			Scopes:      scopesOrDefault(source, orgScopes(source, "read:org")...),
+		},
+		userInfoURL: apiURL + "/user",
+		parse:       parseUserInfo,
+		groups: func(ctx context.Context, client *http.Client) ([]string, error) {
+			return getGitHubOrgs(ctx, client, apiURL, source.AllowedOrgs)
+		},
+		revoke: func(ctx context.Context, token *oauth2.Token) error {
+			return revokeGitHubToken(ctx, source, apiURL, token)
+		},
+	}
+}
+
+func newGiteaProvider(source *setting.AuthSource, redirectURL string) Provider {
+	return &oauth2Provider{
+		source: source,
+		config: &oauth2.Config{
+			ClientID:     source.ClientID,
+			ClientSecret: source.ClientSecret,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  source.BaseURL + "/login/oauth/authorize",
+				TokenURL: source.BaseURL + "/login/oauth/access_token",
+			},
+			RedirectURL: redirectURL,
+			Scopes:      scopesOrDefault(source),
+		},
+		userInfoURL: source.BaseURL + "/api/v1/user",
+		parse:       parseUserInfo,
+		groups: func(ctx context.Context, client *http.Client) ([]string, error) {
+			return getNames(ctx, client, source.BaseURL+"/api/v1/user/orgs?limit=50", "username")
+		},
+	}
+}
+
+func newGitLabProvider(source *setting.AuthSource, redirectURL string) Provider {
+	return &oauth2Provider{
+		source: source,
+		config: &oauth2.Config{
+			ClientID:     source.ClientID,
+			ClientSecret: source.ClientSecret,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  source.BaseURL + "/oauth/authorize",
+				TokenURL: source.BaseURL + "/oauth/token",
+			},
+			RedirectURL: redirectURL,
+			Scopes:      scopesOrDefault(source, append([]string{"read_user"}, orgScopes(source, "read_api")...)...),
+		},
+		userInfoURL: source.BaseURL + "/api/v4/user",
+		parse:       parseUserInfo,
+		groups: func(ctx context.Context, client *http.Client) ([]string, error) {
+			return getNames(ctx, client, source.BaseURL+"/api/v4/groups?min_access_level=10&per_page=100", "full_path")
+		},
+		revoke: func(ctx context.Context, token *oauth2.Token) error {
+			return revokeToken(ctx, source, source.BaseURL+"/oauth/revoke", token)
+		},
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/lubanstudio/luban/pkg/setting"
+)
+
+func TestIsAllowed(t *testing.T) {
+	source := &setting.AuthSource{
+		AllowedUsers: []string{"id:1234"},
+		AllowedOrgs:  []string{"luban/core"},
+	}
+	tests := []struct {
+		name     string
+		identity *Identity
+		allowed  bool
+	}{
+		{"listed ID", &Identity{ID: "1234", Username: "alice"}, true},
+		{"username matches listed ID", &Identity{ID: "5678", Username: "1234"}, false},
+		{"listed organization", &Identity{ID: "5678", Username: "bob", Groups: []string{"Luban/Core"}}, true},
+		{"not listed", &Identity{ID: "5678", Username: "bob", Groups: []string{"luban"}}, false},
+	}
+	for _, test := range tests {
+		if allowed := isAllowed(source, test.identity); allowed != test.allowed {
+			t.Errorf("%s: got %v, want %v", test.name, allowed, test.allowed)
+		}
+	}
+
+	if !isAllowed(&setting.AuthSource{}, &Identity{ID: "5678"}) {
+		t.Error("source without allowlist should allow everyone")
+	}
+}
+
+// stubGitLabServer serves token, user and revocation endpoints of GitLab,
+// the token endpoint responds with given status and body when status is set.
+type stubGitLabServer struct {
+	*httptest.Server
+	tokenStatus int
+	tokenBody   string
+	userStatus  int
+	revoked     []string
+	revokeAuth  string
+}
+
+func newStubGitLabServer() *stubGitLabServer {
+	s := new(stubGitLabServer)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		if s.tokenStatus > 0 {
+			w.WriteHeader(s.tokenStatus)
+			w.Write([]byte(s.tokenBody))
+			return
+		}
+		if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != "refresh" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  "new-access",
+			"refresh_token": "new-refresh",
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+		})
+	})
+	mux.HandleFunc("/api/v4/user", func(w http.ResponseWriter, r *http.Request) {
+		if s.userStatus > 0 {
+			w.WriteHeader(s.userStatus)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if auth != "Bearer access" && auth != "Bearer new-access" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": 1234, "username": "alice"})
+	})
+	mux.HandleFunc("/oauth/revoke", func(w http.ResponseWriter, r *http.Request) {
+		user, passwd, _ := r.BasicAuth()
+		s.revokeAuth = user + ":" + passwd
+		if r.FormValue("token") == "unknown" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if r.FormValue("token") == "error" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		s.revoked = append(s.revoked, r.FormValue("token"))
+	})
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+func (s *stubGitLabServer) provider(allowedUsers ...string) Provider {
+	return newGitLabProvider(&setting.AuthSource{
+		Name:         "gitlab",
+		Type:         TYPE_GITLAB,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		BaseURL:      s.URL,
+		AllowedUsers: allowedUsers,
+	}, "http://luban.local/login/gitlab/callback")
+}
+
+func TestOAuth2Provider_Refresh(t *testing.T) {
+	valid := &oauth2.Token{AccessToken: "access", Expiry: time.Now().Add(time.Hour)}
+	expired := &oauth2.Token{AccessToken: "access", RefreshToken: "refresh", Expiry: time.Now().Add(-time.Hour)}
+
+	tests := []struct {
+		name         string
+		token        *oauth2.Token
+		tokenStatus  int
+		tokenBody    string
+		userStatus   int
+		allowedUsers []string
+		wantErr      error
+		wantToken    string
+	}{
+		{name: "valid token", token: valid, wantToken: "access"},
+		{name: "refreshed token", token: expired, wantToken: "new-access"},
+		{
+			name:    "expired without refresh token",
+			token:   &oauth2.Token{AccessToken: "access", Expiry: time.Now().Add(-time.Hour)},
+			wantErr: ErrTokenExpired,
+		},
+		{
+			name:        "invalid grant",
+			token:       expired,
+			tokenStatus: http.StatusBadRequest,
+			tokenBody:   `{"error":"invalid_grant","error_description":"revoked"}`,
+			wantErr:     ErrTokenRevoked,
+		},
+		{
+			name:        "invalid grant in form encoding",
+			token:       expired,
+			tokenStatus: http.StatusUnauthorized,
+			tokenBody:   "error=invalid_grant",
+			wantErr:     ErrTokenRevoked,
+		},
+		{name: "access token rejected", token: valid, userStatus: http.StatusUnauthorized, wantErr: ErrTokenRevoked},
+		{name: "not allowed", token: valid, allowedUsers: []string{"id:5678"}, wantErr: ErrNotAllowed},
+		{name: "allowed", token: valid, allowedUsers: []string{"id:1234"}, wantToken: "access"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStubGitLabServer()
+			defer s.Close()
+			s.tokenStatus = test.tokenStatus
+			s.tokenBody = test.tokenBody
+			s.userStatus = test.userStatus
+
+			identity, err := s.provider(test.allowedUsers...).Refresh(context.Background(), test.token)
+			if err != test.wantErr {
+				t.Fatalf("got error %v, want %v", err, test.wantErr)
+			} else if err != nil {
+				return
+			}
+			if identity.ID != "1234" || identity.Username != "alice" {
+				t.Errorf("got identity %+v", identity)
+			}
+			if identity.Token.AccessToken != test.wantToken {
+				t.Errorf("got access token %q, want %q", identity.Token.AccessToken, test.wantToken)
+			}
+		})
+	}
+}
+
+// Errors other than invalid grant may be temporary, so that users must not
+// be signed out and refresh is retried later.
+func TestOAuth2Provider_RefreshTemporaryError(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{"server error", http.StatusInternalServerError, `{"error":"server_error"}`},
+		{"unavailable", http.StatusServiceUnavailable, "Service Unavailable"},
+		{"invalid client", http.StatusUnauthorized, `{"error":"invalid_client"}`},
+		{"invalid grant with unexpected status", http.StatusInternalServerError, `{"error":"invalid_grant"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStubGitLabServer()
+			defer s.Close()
+			s.tokenStatus = test.status
+			s.tokenBody = test.body
+
+			token := &oauth2.Token{AccessToken: "access", RefreshToken: "refresh", Expiry: time.Now().Add(-time.Hour)}
+			_, err := s.provider().Refresh(context.Background(), token)
+			if err == nil {
+				t.Fatal("expected error")
+			} else if err == ErrTokenRevoked || err == ErrTokenExpired || err == ErrNotAllowed {
+				t.Fatalf("got error %v, want temporary error", err)
+			}
+		})
+	}
+
+	s := newStubGitLabServer()
+	defer s.Close()
+	s.userStatus = http.StatusBadGateway
+	_, err := s.provider().Refresh(context.Background(), &oauth2.Token{AccessToken: "access", Expiry: time.Now().Add(time.Hour)})
+	if err == nil || err == ErrTokenRevoked {
+		t.Fatalf("got error %v for unavailable user API, want temporary error", err)
+	}
+}
+
+func TestOAuth2Provider_Revoke(t *testing.T) {
+	s := newStubGitLabServer()
+	defer s.Close()
+	p := s.provider()
+
+	if err := p.Revoke(context.Background(), &oauth2.Token{AccessToken: "access"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.revoked) != 1 || s.revoked[0] != "access" {
+		t.Errorf("got revoked tokens %v", s.revoked)
+	}
+	if s.revokeAuth != "client:secret" {
+		t.Errorf("got client credentials %q", s.revokeAuth)
+	}
+
+	// Tokens already invalid are treated as revoked.
+	if err := p.Revoke(context.Background(), &oauth2.Token{AccessToken: "unknown"}); err != nil {
+		t.Errorf("got error %v for unknown token", err)
+	}
+	if err := p.Revoke(context.Background(), &oauth2.Token{AccessToken: "error"}); err == nil {
+		t.Error("expected error when revocation endpoint fails")
+	}
+
+	// Services without revocation endpoint do nothing.
+	gitea := newGiteaProvider(&setting.AuthSource{Name: "gitea", BaseURL: s.URL}, "")
+	if err := gitea.Revoke(context.Background(), &oauth2.Token{AccessToken: "access"}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+
+	"github.com/lubanstudio/luban/pkg/setting"
+)
+
+// oidcProvider signs in users with an OpenID Connect provider, endpoints are
+// discovered from the issuer on first use so that an unavailable provider
+// does not prevent start up.
+//
+// Organizations in allowlist are matched with "groups" claim of userinfo.
+// On sign in, the ID token is verified with keys of the provider and must be
+// issued for the nonce of the request, then users are identified by the
+// userinfo endpoint which must return the same subject.
+type oidcProvider struct {
+	source      *setting.AuthSource
+	redirectURL string
+
+	lock     sync.Mutex
+	provider *oauth2Provider
+	keys     *keySet
+}
+
+func newOIDCProvider(source *setting.AuthSource, redirectURL string) Provider {
+	return &oidcProvider{
+		source:      source,
+		redirectURL: redirectURL,
+	}
+}
+
+func (p *oidcProvider) Name() string {
+	return p.source.Name
+}
+
+func (p *oidcProvider) DisplayName() string {
+	return p.source.DisplayName
+}
+
+// discovery contains fields of OpenID provider metadata that are used.
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	RevocationEndpoint    string `json:"revocation_endpoint"` // Optional
+}
+
+// discover returns the underlying OAuth2 provider, it requests metadata
+// of the issuer if not yet.
+func (p *oidcProvider) discover(ctx context.Context) (*oauth2Provider, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.provider != nil {
+		return p.provider, nil
+	}
+
+	data, err := getJSON(ctx, http.DefaultClient, p.source.Issuer+"/.well-known/openid-configuration")
+	if err != nil {
+		return nil, fmt.Errorf("discover: %v", err)
+	}
+	var meta discovery
+	if err = json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("decode discovery: %v", err)
+	} else if strings.TrimSuffix(meta.Issuer, "/") != p.source.Issuer {
+		return nil, fmt.Errorf("issuer mismatch: %s", meta.Issuer)
+	} else if len(meta.AuthorizationEndpoint) == 0 || len(meta.TokenEndpoint) == 0 ||
+		len(meta.UserinfoEndpoint) == 0 || len(meta.JWKSURI) == 0 {
+		return nil, fmt.Errorf("discovery does not have authorization, token, userinfo endpoint or JWKS URI")
+	}
+
+	p.provider = &oauth2Provider{
+		source: p.source,
+		config: &oauth2.Config{
+			ClientID:     p.source.ClientID,
+			ClientSecret: p.source.ClientSecret,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  meta.AuthorizationEndpoint,
+				TokenURL: meta.TokenEndpoint,
+			},
+			RedirectURL: p.redirectURL,
+			Scopes:      scopesOrDefault(p.source, "openid", "profile", "email"),
+		},
+		userInfoURL: meta.UserinfoEndpoint,
+		parse:       parseOIDCUserInfo,
+	}
+	if len(meta.RevocationEndpoint) > 0 {
+		p.provider.revoke = func(ctx context.Context, token *oauth2.Token) error {
+			return revokeToken(ctx, p.source, meta.RevocationEndpoint, token)
+		}
+	}
+	p.keys = &keySet{url: meta.JWKSURI}
+	return p.provider, nil
+}
+
+func (p *oidcProvider) AuthCodeURL(ctx context.Context, state, nonce string) (string, error) {
+	provider, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	return provider.config.AuthCodeURL(state, oauth2.SetAuthURLParam("nonce", nonce)), nil
+}
+
+func (p *oidcProvider) Exchange(ctx context.Context, code, nonce string) (*Identity, error) {
+	provider, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := provider.config.Exchange(ctx, code)
+	if err != nil {
+		return nil, fmt.Errorf("exchange token: %v", err)
+	}
+	rawIDToken, _ := token.Extra("id_token").(string)
+	if len(rawIDToken) == 0 {
+		return nil, fmt.Errorf("%v: not returned by token endpoint", ErrInvalidIDToken)
+	}
+	claims, err := verifyIDToken(ctx, p.keys, rawIDToken, p.source.Issuer, p.source.ClientID, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	identity, err := provider.identify(ctx, provider.config.TokenSource(ctx, token))
+	if err != nil {
+		return nil, err
+	} else if identity.ID != claims.Subject {
+		return nil, fmt.Errorf("%v: subject mismatch with userinfo", ErrInvalidIDToken)
+	}
+	return identity, nil
+}
+
+func (p *oidcProvider) Refresh(ctx context.Context, token *oauth2.Token) (*Identity, error) {
+	provider, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return provider.Refresh(ctx, token)
+}
+
+func (p *oidcProvider) Revoke(ctx context.Context, token *oauth2.Token) error {
+	provider, err := p.discover(ctx)
+	if err != nil {
+		return err
+	}
+	return provider.Revoke(ctx, token)
+}
+
+func parseOIDCUserInfo(data []byte) (*Identity, error) {
+	var info struct {
+		Sub               string   `json:"sub"`
+		PreferredUsername string   `json:"preferred_username"`
+		Nickname          string   `json:"nickname"`
+		Email             string   `json:"email"`
+		Picture           string   `json:"picture"`
+		Groups            []string `json:"groups"`
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+
+	identity := &Identity{
+		ID:        info.Sub,
+		Username:  info.PreferredUsername,
+		Email:     info.Email,
+		AvatarURL: info.Picture,
+		Groups:    info.Groups,
+	}
+	if len(identity.Username) == 0 {
+		identity.Username = info.Nickname
+	}
+	if len(identity.Username) == 0 {
+		identity.Username = strings.Split(info.Email, "@")[0]
+	}
+	return identity, nil
+}
@@ -0,0 +1,261 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lubanstudio/luban/pkg/setting"
+)
+
+// stubOIDCServer is an OpenID provider that issues an ID token with given
+// claims for every authorization code.
+type stubOIDCServer struct {
+	*httptest.Server
+	key     *rsa.PrivateKey
+	signKey *rsa.PrivateKey // Signs ID token, it is the key in JWKS by default
+	kid     string
+	header  map[string]interface{} // Overrides header of ID token
+	claims  map[string]interface{}
+	sub     string // Subject returned by userinfo endpoint
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (s *stubOIDCServer) sign(key *rsa.PrivateKey) string {
+	header := map[string]interface{}{"alg": "RS256", "kid": s.kid}
+	for k, v := range s.header {
+		header[k] = v
+	}
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(s.claims)
+	input := b64(h) + "." + b64(c)
+	if header["alg"] == "none" {
+		return input + "."
+	}
+	digest := sha256.Sum256([]byte(input))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	return input + "." + b64(sig)
+}
+
+func newStubOIDCServer(t *testing.T) *stubOIDCServer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stubOIDCServer{key: key, signKey: key, kid: "key1", sub: "1234"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 s.URL,
+			"authorization_endpoint": s.URL + "/authorize",
+			"token_endpoint":         s.URL + "/token",
+			"userinfo_endpoint":      s.URL + "/userinfo",
+			"jwks_uri":               s.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kid": s.kid,
+				"kty": "RSA",
+				"use": "sig",
+				"n":   b64(key.N.Bytes()),
+				"e":   b64(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     s.sign(s.signKey),
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"sub":                s.sub,
+			"preferred_username": "alice",
+		})
+	})
+	s.Server = httptest.NewServer(mux)
+
+	s.claims = map[string]interface{}{
+		"iss":   s.URL,
+		"sub":   "1234",
+		"aud":   "client",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": "nonce",
+	}
+	return s
+}
+
+func (s *stubOIDCServer) provider() Provider {
+	return newOIDCProvider(&setting.AuthSource{
+		Name:         "oidc",
+		Type:         TYPE_OIDC,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Issuer:       s.URL,
+	}, "http://luban.local/login/oidc/callback")
+}
+
+func TestOIDCProvider_AuthCodeURL(t *testing.T) {
+	s := newStubOIDCServer(t)
+	defer s.Close()
+
+	authURL, err := s.provider().AuthCodeURL(context.Background(), "state", "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authURL, s.URL+"/authorize?") {
+		t.Errorf("got URL %q", authURL)
+	}
+	if u.Query().Get("state") != "state" || u.Query().Get("nonce") != "nonce" {
+		t.Errorf("got query %q", u.RawQuery)
+	}
+}
+
+func TestOIDCProvider_Exchange(t *testing.T) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		code    string
+		nonce   string
+		header  map[string]interface{}
+		claims  map[string]interface{}
+		signKey *rsa.PrivateKey
+		sub     string
+		ok      bool
+	}{
+		{name: "valid", ok: true},
+		{name: "audience in array", claims: map[string]interface{}{"aud": []string{"other", "client"}}, ok: true},
+		{name: "bad code", code: "bad"},
+		{name: "wrong nonce", nonce: "other"},
+		{name: "empty nonce", nonce: "-", claims: map[string]interface{}{"nonce": ""}},
+		{name: "wrong audience", claims: map[string]interface{}{"aud": "other"}},
+		{name: "wrong issuer", claims: map[string]interface{}{"iss": "https://evil.example.com"}},
+		{name: "expired", claims: map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()}},
+		{name: "wrong key", signKey: otherKey},
+		{name: "unknown key ID", header: map[string]interface{}{"kid": "key2"}},
+		{name: "alg none", header: map[string]interface{}{"alg": "none"}},
+		{name: "alg HMAC", header: map[string]interface{}{"alg": "HS256"}},
+		{name: "subject mismatch", sub: "5678"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStubOIDCServer(t)
+			defer s.Close()
+			s.header = test.header
+			for k, v := range test.claims {
+				s.claims[k] = v
+			}
+			if test.signKey != nil {
+				s.signKey = test.signKey
+			}
+			if len(test.sub) > 0 {
+				s.sub = test.sub
+			}
+			code, nonce := "good", "nonce"
+			if len(test.code) > 0 {
+				code = test.code
+			}
+			if test.nonce == "-" {
+				nonce = ""
+			} else if len(test.nonce) > 0 {
+				nonce = test.nonce
+			}
+
+			identity, err := s.provider().Exchange(context.Background(), code, nonce)
+			if !test.ok {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if identity.ID != "1234" || identity.Username != "alice" {
+				t.Errorf("got identity %+v", identity)
+			}
+			if identity.Token == nil || identity.Token.AccessToken != "access" {
+				t.Errorf("got token %+v", identity.Token)
+			}
+		})
+	}
+}
+
+func TestVerifySignature_ECDSA(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := []byte("header.claims")
+	digest := sha256.Sum256(input)
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	if !verifySignature("ES256", &key.PublicKey, input, sig) {
+		t.Error("valid signature is rejected")
+	}
+	if verifySignature("RS256", &key.PublicKey, input, sig) {
+		t.Error("signature is accepted with mismatched algorithm")
+	}
+	if verifySignature("ES256", &key.PublicKey, []byte("header.other"), sig) {
+		t.Error("signature is accepted for other input")
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package client implements a client of REST API of Luban server.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var ErrTimeout = errors.New("timed out waiting for task to finish")
+
+// Error is the error responded by server, type and details mirror
+// error types of server, e.g. "ErrNoSuitableMatrix".
+type Error struct {
+	StatusCode int             `json:"-"`
+	Type       string          `json:"type"`
+	Message    string          `json:"message"`
+	Details    json.RawMessage `json:"details"`
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("%s: %s", err.Type, err.Message)
+}
+
+type Task struct {
+	ID        int64      `json:"id"`
+	Project   string     `json:"project"`
+	OS        string     `json:"os"`
+	Arch      string     `json:"arch"`
+	Tags      []string   `json:"tags"`
+	TagExpr   string     `json:"tag_expr"`
+	GoVersion string     `json:"go_version"`
+	CC        string     `json:"cc"`
+	Libc      string     `json:"libc"`
+	Ref       string     `json:"ref"`
+	Commit    string     `json:"commit"`
+	Status    string     `json:"status"`
+	Priority  int        `json:"priority"`
+	Poster    string     `json:"poster"`
+	BuilderID int64      `json:"builder_id"`
+	Created   time.Time  `json:"created"`
+	Started   *time.Time `json:"started"`
+	Finished  *time.Time `json:"finished"`
+	URL       string     `json:"html_url"`
+}
+
+const (
+	TASK_STATUS_SUCCEED  = "succeed"
+	TASK_STATUS_FAILED   = "failed"
+	TASK_STATUS_CANCELED = "canceled"
+	TASK_STATUS_ARCHIVED = "archived"
+)
+
+// IsFinished returns true if the task will not change status anymore
+// except being archived.
+func (t *Task) IsFinished() bool {
+	switch t.Status {
+	case TASK_STATUS_SUCCEED, TASK_STATUS_FAILED, TASK_STATUS_CANCELED, TASK_STATUS_ARCHIVED:
+		return true
+	}
+	return false
+}
+
+type Artifact struct {
+	TaskID int64  `json:"task_id"`
+	Format string `json:"format"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	URL    string `json:"download_url"`
+}
+
+// CreateTaskOption describes the task to create, build options have the same
+// format as the form of web UI.
+type CreateTaskOption struct {
+	OS      string   `json:"os"`
+	Arch    string   `json:"arch"`
+	Tags    []string `json:"tags"`
+	TagExpr string   `json:"tag_expr"`
+	Ref     string   `json:"ref"`
+
+	GoVersion string `json:"go_version"`
+	CC        string `json:"cc"`
+	Libc      string `json:"libc"`
+
+	BuildFlags string `json:"build_flags"`
+	LDFlags    string `json:"ldflags"`
+}
+
+type BatchResult struct {
+	Profile  string   `json:"profile"`
+	Ref      string   `json:"ref"`
+	Commit   string   `json:"commit"`
+	Created  []*Task  `json:"created"`
+	Skipped  []*Task  `json:"skipped"`
+	Rejected []string `json:"rejected"`
+}
+
+// Client calls REST API of the server with a personal access token.
+type Client struct {
+	url   string
+	token string
+	http  *http.Client
+}
+
+// New returns a new client of the server at given URL.
+func New(serverURL, token string) *Client {
+	return &Client{
+		url:   strings.TrimSuffix(serverURL, "/"),
+		token: token,
+		http:  new(http.Client),
+	}
+}
+
+// resolveURL returns absolute URL of given link, which is responded as
+// relative when the server does not have external URL set.
+func (c *Client) resolveURL(link string) string {
+	if strings.HasPrefix(link, "http://") || strings.HasPrefix(link, "https://") {
+		return link
+	}
+	return c.url + "/" + strings.TrimPrefix(link, "/")
+}
+
+// do sends the request to the server, error responses are returned as *Error.
+func (c *Client) do(method, link string, body interface{}) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.resolveURL(link), r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "token "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode < 400 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	data, _ := ioutil.ReadAll(resp.Body)
+	apiErr := &Error{StatusCode: resp.StatusCode}
+	if err = json.Unmarshal(data, apiErr); err != nil || len(apiErr.Type) == 0 {
+		apiErr.Type = "ErrUnexpectedResponse"
+		apiErr.Message = fmt.Sprintf("status %d: %s", resp.StatusCode, bytes.TrimSpace(data))
+	}
+	return nil, apiErr
+}
+
+// getJSON sends the request and decodes JSON response into v.
+func (c *Client) getJSON(method, link string, body, v interface{}) error {
+	resp, err := c.do(method, link, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decode response: %v", err)
+	}
+	return nil
+}
+
+// CreateTask creates a task in given project, an existing task that builds
+// the same thing is returned if it has not failed.
+func (c *Client) CreateTask(project string, opt *CreateTaskOption) (*Task, error) {
+	task := new(Task)
+	return task, c.getJSON("POST", "/api/v1/projects/"+url.PathEscape(project)+"/tasks", opt, task)
+}
+
+func (c *Client) GetTask(id int64) (*Task, error) {
+	task := new(Task)
+	return task, c.getJSON("GET", fmt.Sprintf("/api/v1/tasks/%d", id), nil, task)
+}
+
+func (c *Client) CancelTask(id int64) (*Task, error) {
+	task := new(Task)
+	return task, c.getJSON("POST", fmt.Sprintf("/api/v1/tasks/%d/cancel", id), nil, task)
+}
+
+// WaitTask polls the task in given interval until it finishes or timeout,
+// 0 means no timeout. The last retrieved task is returned on timeout.
+func (c *Client) WaitTask(id int64, interval, timeout time.Duration) (*Task, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for {
+		task, err := c.GetTask(id)
+		if err != nil {
+			return nil, err
+		} else if task.IsFinished() {
+			return task, nil
+		} else if !deadline.IsZero() && time.Now().Add(interval).After(deadline) {
+			return task, ErrTimeout
+		}
+		time.Sleep(interval)
+	}
+}
+
+// TaskBuildLog returns build log of the task.
+func (c *Client) TaskBuildLog(id int64) ([]byte, error) {
+	resp, err := c.do("GET", fmt.Sprintf("/api/v1/tasks/%d/log", id), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// TaskArtifacts returns uploaded artifacts of the task, which only
+// succeeded tasks have.
+func (c *Client) TaskArtifacts(id int64) ([]*Artifact, error) {
+	artifacts := make([]*Artifact, 0, 2)
+	return artifacts, c.getJSON("GET", fmt.Sprintf("/api/v1/tasks/%d/artifacts", id), nil, &artifacts)
+}
+
+// Download writes content of the artifact to w.
+func (c *Client) Download(artifact *Artifact, w io.Writer) error {
+	resp, err := c.do("GET", artifact.URL, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// CreateBatchTasks creates tasks of the batch profile in given project,
+// default reference of the profile is used when ref is empty.
+func (c *Client) CreateBatchTasks(project, profile, ref string) (*BatchResult, error) {
+	result := new(BatchResult)
+	return result, c.getJSON("POST", "/api/v1/projects/"+url.PathEscape(project)+"/batches/"+url.PathEscape(profile)+"/tasks",
+		map[string]string{"ref": ref}, result)
+}
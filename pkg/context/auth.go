@@ -16,11 +16,48 @@ package context
 
 import (
 	"gopkg.in/macaron.v1"
+
+	"github.com/lubanstudio/luban/models"
 )
 
-func ReqAdmin() macaron.Handler {
+// ReqSignIn requires user to be signed in, and redirects to sign in page
+// which comes back to current page after signed in.
+func ReqSignIn() macaron.Handler {
+	return func(ctx *Context) {
+		if ctx.User == nil {
+			ctx.Session.Set(SESSION_KEY_REDIRECT_TO, ctx.Req.RequestURI)
+			ctx.Redirect("/login")
+			return
+		}
+	}
+}
+
+// ReqRole requires signed in user to have given role or a higher one.
+func ReqRole(role models.Role) macaron.Handler {
+	return func(ctx *Context) {
+		if !ctx.User.HasRole(role) {
+			ctx.NotFound()
+			return
+		}
+	}
+}
+
+// ReqBuilderOwner requires signed in user to be the owner of current builder or an admin,
+// deleted builders cannot be managed by anyone.
+func ReqBuilderOwner() macaron.Handler {
+	return func(ctx *Context) {
+		if !ctx.Builder.IsOwnedBy(ctx.User) {
+			ctx.NotFound()
+			return
+		}
+	}
+}
+
+// ReqProjectAccess requires signed in user to have at least given access mode
+// to current project.
+func ReqProjectAccess(mode models.AccessMode) macaron.Handler {
 	return func(ctx *Context) {
-		if !ctx.User.IsAdmin {
+		if ctx.ProjectAccess < mode {
 			ctx.NotFound()
 			return
 		}
@@ -0,0 +1,41 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package context
+
+import (
+	"gopkg.in/macaron.v1"
+
+	"github.com/lubanstudio/luban/models"
+)
+
+// BuilderAssignment assigns builder by ID in URL and whether current user
+// is able to manage it, which are the owner and admins.
+func BuilderAssignment() macaron.Handler {
+	return func(ctx *Context) {
+		builder, err := models.GetBuilderByID(ctx.ParamsInt64(":id"))
+		if err != nil {
+			if models.IsErrRecordNotFound(err) {
+				ctx.NotFound()
+			} else {
+				ctx.Handle(500, "GetBuilderByID", err)
+			}
+			return
+		}
+
+		ctx.Builder = builder
+		ctx.Data["Builder"] = builder
+		ctx.Data["IsBuilderOwner"] = builder.IsOwnedBy(ctx.User)
+	}
+}
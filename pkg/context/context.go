@@ -16,15 +16,22 @@ package context
 
 import (
 	"fmt"
+	"net"
 	"strings"
 
-	"github.com/go-macaron/oauth2"
 	"github.com/go-macaron/session"
 	log "gopkg.in/clog.v1"
 	"gopkg.in/macaron.v1"
 
 	"github.com/lubanstudio/luban/models"
 	"github.com/lubanstudio/luban/pkg/form"
+	"github.com/lubanstudio/luban/pkg/setting"
+)
+
+const (
+	SESSION_KEY_UID             = "uid"
+	SESSION_KEY_SESSION_VERSION = "session_version"
+	SESSION_KEY_REDIRECT_TO     = "redirect_to"
 )
 
 type Context struct {
@@ -32,9 +39,13 @@ type Context struct {
 	Flash   *session.Flash
 	Session session.Store
 
-	User    *models.User
-	Builder *models.Builder
-	Task    *models.Task
+	User         *models.User
+	Builder      *models.Builder
+	BuilderToken *models.BuilderToken
+	Task         *models.Task
+
+	Project       *models.Project
+	ProjectAccess models.AccessMode
 }
 
 // HasError returns true if error occurs in form validation.
@@ -90,8 +101,50 @@ func (ctx *Context) Handle(status int, title string, err error) {
 	ctx.HTML(status, fmt.Sprintf("status/%d", status))
 }
 
+// RemoteIP returns IP of the client. Headers "X-Forwarded-For" and "X-Real-IP"
+// are only used when the request comes from one of trusted proxies, otherwise
+// anyone is able to forge them.
+func (ctx *Context) RemoteIP() string {
+	ip, _, err := net.SplitHostPort(ctx.Req.RemoteAddr)
+	if err != nil {
+		ip = ctx.Req.RemoteAddr
+	}
+	if !setting.IsTrustedProxy(ip) {
+		return ip
+	}
+
+	// Proxies append IP of the previous hop, the client is the rightmost one
+	// that is not a trusted proxy.
+	if fwd := ctx.Req.Header.Get("X-Forwarded-For"); len(fwd) > 0 {
+		addrs := strings.Split(fwd, ",")
+		for i := len(addrs) - 1; i >= 0; i-- {
+			addr := strings.TrimSpace(addrs[i])
+			if net.ParseIP(addr) == nil {
+				break
+			}
+			ip = addr
+			if !setting.IsTrustedProxy(addr) {
+				break
+			}
+		}
+		return ip
+	}
+	if realIP := strings.TrimSpace(ctx.Req.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return ip
+}
+
+// Audit records an action of current user in audit log, failure to record
+// is logged and does not fail the request.
+func (ctx *Context) Audit(action string, target models.AuditTarget, before, after interface{}) {
+	if err := models.NewAuditLog(ctx.User, ctx.RemoteIP(), action, target, before, after); err != nil {
+		log.Error(2, "NewAuditLog [%s]: %v", action, err)
+	}
+}
+
 func Contexter() macaron.Handler {
-	return func(c *macaron.Context, sess session.Store, f *session.Flash, tokens oauth2.Tokens) {
+	return func(c *macaron.Context, sess session.Store, f *session.Flash) {
 		ctx := &Context{
 			Context: c,
 			Flash:   f,
@@ -100,22 +153,24 @@ func Contexter() macaron.Handler {
 		c.Map(ctx)
 
 		ctx.Data["Link"] = strings.TrimSuffix(ctx.Req.URL.Path, "/")
+		ctx.Data["CSRFToken"] = ctx.CSRFToken()
 
-		if ctx.Session.Get(oauth2.KEY_TOKEN) != nil {
-			user, isNew, err := models.GetOrCreateUserByOAuthID(tokens.Access())
-			if err != nil {
-				ctx.Handle(500, "GetOrCreateUserByOAuthID", err)
+		if uid, ok := ctx.Session.Get(SESSION_KEY_UID).(int64); ok {
+			user, err := models.GetUserByID(uid)
+			if err != nil && !models.IsErrRecordNotFound(err) {
+				ctx.Handle(500, "GetUserByID", err)
+				return
+			}
+			// Sessions signed in before the session version was introduced have version 0.
+			version, _ := ctx.Session.Get(SESSION_KEY_SESSION_VERSION).(int64)
+			if err != nil || user.ProhibitLogin || version != user.SessionVersion {
+				ctx.Session.Delete(SESSION_KEY_UID)
 				return
 			}
 			ctx.User = user
 			ctx.Data["IsSigned"] = true
 			ctx.Data["User"] = user
-
-			if isNew {
-				log.Info("New user authenticated: %s", user.Username)
-			} else {
-				log.Trace("Authenticated user: %s", user.Username)
-			}
+			ctx.Data["CanOwnBuilders"] = user.HasRole(models.ROLE_BUILDER_OWNER)
 		}
 	}
 }
@@ -0,0 +1,57 @@
+// Copyright 2016 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package context
+
+import (
+	"crypto/subtle"
+
+	"gopkg.in/macaron.v1"
+
+	"github.com/lubanstudio/luban/pkg/tool"
+)
+
+const SESSION_KEY_CSRF_TOKEN = "csrf_token"
+
+// CSRFToken returns the token of current session to be sent back by forms,
+// a new token is generated when the session does not have one.
+func (ctx *Context) CSRFToken() string {
+	token, _ := ctx.Session.Get(SESSION_KEY_CSRF_TOKEN).(string)
+	if len(token) == 0 {
+		token = tool.NewSecretToekn()
+		ctx.Session.Set(SESSION_KEY_CSRF_TOKEN, token)
+	}
+	return token
+}
+
+// ReqCSRFToken requires requests other than GET and HEAD to have the token
+// of current session in form field "_csrf" or header "X-CSRF-Token", so that
+// other sites cannot send requests on behalf of signed in users.
+func ReqCSRFToken() macaron.Handler {
+	return func(ctx *Context) {
+		if ctx.Req.Method == "GET" || ctx.Req.Method == "HEAD" {
+			return
+		}
+
+		token := ctx.Req.FormValue("_csrf")
+		if len(token) == 0 {
+			token = ctx.Req.Header.Get("X-CSRF-Token")
+		}
+		expected, _ := ctx.Session.Get(SESSION_KEY_CSRF_TOKEN).(string)
+		if len(expected) == 0 || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			ctx.PlainText(403, []byte("Invalid CSRF token, please go back, reload the page and try again."))
+			return
+		}
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package context
+
+import (
+	"gopkg.in/macaron.v1"
+
+	"github.com/lubanstudio/luban/models"
+)
+
+// ProjectAssignment assigns project by name in URL and access mode of current user,
+// users without read access get a 404 as if the project does not exist.
+func ProjectAssignment() macaron.Handler {
+	return func(ctx *Context) {
+		project, err := models.GetProjectByName(ctx.Params(":project"))
+		if err != nil {
+			if models.IsErrRecordNotFound(err) {
+				ctx.NotFound()
+			} else {
+				ctx.Handle(500, "GetProjectByName", err)
+			}
+			return
+		}
+
+		ctx.ProjectAccess, err = project.UserAccessMode(ctx.User)
+		if err != nil {
+			ctx.Handle(500, "UserAccessMode", err)
+			return
+		} else if ctx.ProjectAccess < models.ACCESS_MODE_READ {
+			ctx.NotFound()
+			return
+		}
+
+		ctx.Project = project
+		ctx.Data["Project"] = project
+		ctx.Data["IsProjectWriter"] = ctx.ProjectAccess >= models.ACCESS_MODE_WRITE
+		ctx.Data["IsProjectAdmin"] = ctx.ProjectAccess >= models.ACCESS_MODE_ADMIN
+		ctx.Data["AllowedOSs"] = project.AllowedOSList()
+		ctx.Data["AllowedArchs"] = project.AllowedArchList()
+		ctx.Data["AllowedTags"] = project.AllowedTagList()
+		ctx.Data["AllowedBranches"] = project.BranchList()
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package form
+
+import (
+	"github.com/go-macaron/binding"
+	"gopkg.in/macaron.v1"
+)
+
+type BatchProfile struct {
+	Name        string `binding:"Required;AlphaDashDot"`
+	DefaultRef  string `binding:"Required"`
+	Priority    int
+	WebhookRefs string
+	Entries     string `binding:"Required"`
+
+	BuildFlags   string
+	LDFlags      string `form:"ldflags"`
+	Envs         string
+	PreBuildCmds string
+	Secrets      string
+}
+
+func (f *BatchProfile) Validate(ctx *macaron.Context, errs binding.Errors) binding.Errors {
+	return Validate(errs, ctx.Data, f)
+}
+
+type NewBatchTasks struct {
+	ProfileID int64 `binding:"Required"`
+	Ref       string
+}
+
+func (f *NewBatchTasks) Validate(ctx *macaron.Context, errs binding.Errors) binding.Errors {
+	return Validate(errs, ctx.Data, f)
+}
@@ -20,10 +20,44 @@ import (
 )
 
 type NewBuilder struct {
-	Name       string `binding:"Required"`
-	TrustLevel int
+	Name         string `binding:"Required"`
+	TrustLevel   int
+	AllowedOSs   string `form:"allowed_oss"`
+	AllowedArchs string
+	AllowedTags  string
+
+	CertSubject     string
+	CertFingerprint string
 }
 
 func (f *NewBuilder) Validate(ctx *macaron.Context, errs binding.Errors) binding.Errors {
 	return Validate(errs, ctx.Data, f)
 }
+
+type BuilderToken struct {
+	Scopes []string
+}
+
+func (f *BuilderToken) Validate(ctx *macaron.Context, errs binding.Errors) binding.Errors {
+	return Validate(errs, ctx.Data, f)
+}
+
+type RotateBuilderToken struct {
+	Grace int // Hours that old token stays valid
+}
+
+func (f *RotateBuilderToken) Validate(ctx *macaron.Context, errs binding.Errors) binding.Errors {
+	return Validate(errs, ctx.Data, f)
+}
+
+// BuilderMaintenance sets mode and scheduled maintenance window of a builder,
+// times are in format of "2006-01-02T15:04" in server time zone.
+type BuilderMaintenance struct {
+	Mode             int
+	MaintenanceStart string
+	MaintenanceEnd   string
+}
+
+func (f *BuilderMaintenance) Validate(ctx *macaron.Context, errs binding.Errors) binding.Errors {
+	return Validate(errs, ctx.Data, f)
+}
@@ -0,0 +1,59 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package form
+
+import (
+	"github.com/go-macaron/binding"
+	"gopkg.in/macaron.v1"
+)
+
+type Project struct {
+	Name                string `binding:"Required;AlphaDashDot;MaxSize(50)"`
+	CloneURL            string `form:"clone_url" binding:"Required"`
+	CommitURL           string `form:"commit_url"`
+	ImportPath          string `binding:"Required"`
+	Branches            string
+	PackRoot            string `binding:"Required"`
+	PackEntries         string
+	PackFormats         string `binding:"Required"`
+	AllowedOSs          string `form:"allowed_oss"`
+	AllowedArchs        string
+	AllowedTags         string
+	DefaultAccess       int
+	MinScriptTrustLevel int
+}
+
+func (f *Project) Validate(ctx *macaron.Context, errs binding.Errors) binding.Errors {
+	return Validate(errs, ctx.Data, f)
+}
+
+type Secret struct {
+	Name          string `binding:"Required;MaxSize(100)"`
+	Value         string `binding:"Required"`
+	MinTrustLevel int
+}
+
+func (f *Secret) Validate(ctx *macaron.Context, errs binding.Errors) binding.Errors {
+	return Validate(errs, ctx.Data, f)
+}
+
+type Collaborator struct {
+	Username string `binding:"Required"`
+	Mode     int
+}
+
+func (f *Collaborator) Validate(ctx *macaron.Context, errs binding.Errors) binding.Errors {
+	return Validate(errs, ctx.Data, f)
+}
@@ -0,0 +1,32 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package form
+
+import (
+	"github.com/go-macaron/binding"
+	"gopkg.in/macaron.v1"
+)
+
+type Schedule struct {
+	Name      string `binding:"Required;AlphaDashDot"`
+	Spec      string `binding:"Required"`
+	ProfileID int64  `binding:"Required"`
+	Ref       string
+	IsActive  bool
+}
+
+func (f *Schedule) Validate(ctx *macaron.Context, errs binding.Errors) binding.Errors {
+	return Validate(errs, ctx.Data, f)
+}
@@ -20,10 +20,18 @@ import (
 )
 
 type NewTask struct {
-	OS     string `form:"os" binding:"Required"`
-	Arch   string `binding:"Required"`
-	Tags   []string
-	Branch string `binding:"Required"`
+	OS      string `form:"os" binding:"Required"`
+	Arch    string `binding:"Required"`
+	Tags    []string
+	TagExpr string
+	Ref     string `binding:"Required"`
+
+	GoVersion string
+	CC        string `form:"cc"`
+	Libc      string
+
+	BuildFlags string
+	LDFlags    string `form:"ldflags"`
 }
 
 func (f *NewTask) Validate(ctx *macaron.Context, errs binding.Errors) binding.Errors {
@@ -0,0 +1,57 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package form
+
+import (
+	"github.com/go-macaron/binding"
+	"gopkg.in/macaron.v1"
+)
+
+type SignIn struct {
+	Username string `binding:"Required;AlphaDashDot;MaxSize(50)"`
+	Password string `binding:"Required;MaxSize(255)"`
+}
+
+func (f *SignIn) Validate(ctx *macaron.Context, errs binding.Errors) binding.Errors {
+	return Validate(errs, ctx.Data, f)
+}
+
+type UserRole struct {
+	Role          int
+	ProhibitLogin bool
+}
+
+func (f *UserRole) Validate(ctx *macaron.Context, errs binding.Errors) binding.Errors {
+	return Validate(errs, ctx.Data, f)
+}
+
+type NewLocalUser struct {
+	Username string `binding:"Required;AlphaDashDot;MaxSize(50)"`
+	Email    string `binding:"MaxSize(255)"`
+	Password string `binding:"Required;MinSize(8);MaxSize(255)"`
+	Role     int
+}
+
+func (f *NewLocalUser) Validate(ctx *macaron.Context, errs binding.Errors) binding.Errors {
+	return Validate(errs, ctx.Data, f)
+}
+
+type AccessToken struct {
+	Name string `binding:"Required;MaxSize(50)"`
+}
+
+func (f *AccessToken) Validate(ctx *macaron.Context, errs binding.Errors) binding.Errors {
+	return Validate(errs, ctx.Data, f)
+}
@@ -0,0 +1,130 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package setting
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	Auth struct {
+		EnableLocal bool
+		DefaultRole string
+		Admins      []string // Users granted admin role on sign in, as "<source>:id:<user ID>"
+		// How often information of users signed in by external sources is refreshed.
+		RefreshInterval time.Duration
+	}
+
+	AuthSources []*AuthSource
+)
+
+// AuthSource is an external authentication provider defined in section "[auth.<name>]".
+type AuthSource struct {
+	Name         string
+	Type         string // "github", "github_enterprise", "gitea", "gitlab" or "oidc"
+	DisplayName  string
+	ClientID     string
+	ClientSecret string
+	BaseURL      string // Base URL of self-hosted instances
+	Issuer       string // Issuer URL of OIDC provider
+	Scopes       []string
+	// Only listed users and members of listed organizations are allowed to sign in
+	// when not empty. Users are "id:<user ID>" with immutable ID in the provider,
+	// organizations are teams as "<org>/<team>" for GitHub, group paths for
+	// GitLab and values of "groups" claim for OIDC.
+	AllowedUsers []string
+	AllowedOrgs  []string
+}
+
+func loadAuthSources() error {
+	if err := Cfg.Section("auth").MapTo(&Auth); err != nil {
+		return fmt.Errorf("map section 'auth': %v", err)
+	}
+	if len(Auth.DefaultRole) == 0 {
+		Auth.DefaultRole = "viewer"
+	}
+	// Usernames can be changed or reused in providers, only IDs are accepted.
+	for _, admin := range Auth.Admins {
+		if fields := strings.SplitN(admin, ":", 3); len(fields) != 3 || fields[1] != "id" || len(fields[2]) == 0 {
+			return fmt.Errorf("ADMINS in section 'auth' has invalid user '%s', must be \"<source>:id:<user ID>\"", admin)
+		}
+	}
+	if Auth.RefreshInterval <= 0 {
+		Auth.RefreshInterval = 24 * time.Hour
+	}
+
+	for _, sec := range Cfg.Sections() {
+		if !strings.HasPrefix(sec.Name(), "auth.") {
+			continue
+		}
+
+		source := &AuthSource{
+			Name:         strings.TrimPrefix(sec.Name(), "auth."),
+			Type:         sec.Key("TYPE").String(),
+			DisplayName:  sec.Key("DISPLAY_NAME").String(),
+			ClientID:     sec.Key("CLIENT_ID").String(),
+			ClientSecret: sec.Key("CLIENT_SECRET").String(),
+			BaseURL:      strings.TrimSuffix(sec.Key("BASE_URL").String(), "/"),
+			Issuer:       strings.TrimSuffix(sec.Key("ISSUER").String(), "/"),
+			Scopes:       sec.Key("SCOPES").Strings(","),
+			AllowedUsers: sec.Key("ALLOWED_USERS").Strings(","),
+			AllowedOrgs:  sec.Key("ALLOWED_ORGS").Strings(","),
+		}
+		if source.Name == "local" {
+			return fmt.Errorf("auth source name 'local' is reserved")
+		}
+		for _, user := range source.AllowedUsers {
+			if !strings.HasPrefix(user, "id:") || len(user) == 3 {
+				return fmt.Errorf("ALLOWED_USERS of auth source '%s' has invalid user '%s', must be \"id:<user ID>\"", source.Name, user)
+			}
+		}
+		switch source.Type {
+		case "github":
+		case "github_enterprise", "gitea", "gitlab":
+			if len(source.BaseURL) == 0 {
+				return fmt.Errorf("auth source '%s' requires BASE_URL", source.Name)
+			}
+		case "oidc":
+			if len(source.Issuer) == 0 {
+				return fmt.Errorf("auth source '%s' requires ISSUER", source.Name)
+			}
+		default:
+			return fmt.Errorf("auth source '%s' has unsupported type: %s", source.Name, source.Type)
+		}
+		if len(source.DisplayName) == 0 {
+			source.DisplayName = source.Name
+		}
+		AuthSources = append(AuthSources, source)
+	}
+
+	// Keep GitHub login working for installs that only have section "[oauth2]".
+	if len(OAuth2.ClientID) > 0 && len(OAuth2.ClientSecret) > 0 {
+		for _, source := range AuthSources {
+			if source.Name == "github" {
+				return nil
+			}
+		}
+		AuthSources = append(AuthSources, &AuthSource{
+			Name:         "github",
+			Type:         "github",
+			DisplayName:  "GitHub",
+			ClientID:     OAuth2.ClientID,
+			ClientSecret: OAuth2.ClientSecret,
+		})
+	}
+	return nil
+}
@@ -19,8 +19,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"sort"
+
+	"github.com/Unknwon/com"
 )
 
+// BatchTasks is loaded from legacy "custom/batch.json" if exists,
+// which is imported as the default batch profile.
 var BatchTasks []*BatchTask
 
 type BatchTask struct {
@@ -30,6 +34,10 @@ type BatchTask struct {
 }
 
 func loadBatchJobs() error {
+	if !com.IsFile("custom/batch.json") {
+		return nil
+	}
+
 	data, err := ioutil.ReadFile("custom/batch.json")
 	if err != nil {
 		return fmt.Errorf("ReadFile: %v", err)
@@ -30,9 +30,12 @@ var (
 )
 
 type Matrix struct {
-	OS    string   `json:"os"`
-	Archs []string `json:"archs"`
-	Tags  []string `json:"tags"`
+	OS        string   `json:"os"`
+	Archs     []string `json:"archs"`
+	Tags      []string `json:"tags"`
+	GoVersion string   `json:"go_version"`
+	CC        string   `json:"cc"`
+	Libc      string   `json:"libc"`
 }
 
 func loadMatrices() error {
@@ -57,7 +60,8 @@ func loadMatrices() error {
 		}
 
 		for _, tag := range m.Tags {
-			if !com.IsSliceContainsStr(AllowedTags, tag) {
+			// Wildcard means the matrix supports any tag, but it is not a tag itself.
+			if tag != "*" && !com.IsSliceContainsStr(AllowedTags, tag) {
 				AllowedTags = append(AllowedTags, tag)
 			}
 		}
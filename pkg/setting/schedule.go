@@ -0,0 +1,48 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package setting
+
+import (
+	"strings"
+)
+
+var Schedules []*Schedule
+
+// Schedule is a cron-style schedule defined in section "[schedule.<name>]".
+type Schedule struct {
+	Name     string
+	Spec     string
+	Project  string
+	Profile  string
+	Ref      string
+	IsActive bool
+}
+
+func loadSchedules() {
+	for _, sec := range Cfg.Sections() {
+		if !strings.HasPrefix(sec.Name(), "schedule.") {
+			continue
+		}
+
+		Schedules = append(Schedules, &Schedule{
+			Name:     strings.TrimPrefix(sec.Name(), "schedule."),
+			Spec:     sec.Key("SPEC").String(),
+			Project:  sec.Key("PROJECT").MustString(Project.Name),
+			Profile:  sec.Key("PROFILE").MustString("default"),
+			Ref:      sec.Key("REF").String(),
+			IsActive: sec.Key("ACTIVE").MustBool(true),
+		})
+	}
+}
@@ -16,7 +16,10 @@ package setting
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/Unknwon/com"
 	log "gopkg.in/clog.v1"
@@ -29,6 +32,28 @@ var (
 
 	HTTPPort      int
 	ArtifactsPath string
+	MirrorsPath   string
+	BuildLogsPath string
+
+	Server struct {
+		Protocol          string // "http" or "https"
+		ListenAddr        string
+		CertFile          string
+		KeyFile           string
+		ReadHeaderTimeout time.Duration
+		ReadTimeout       time.Duration
+		WriteTimeout      time.Duration
+		IdleTimeout       time.Duration
+		ShutdownTimeout   time.Duration
+		MaxBodySize       int64  // In MB, limit of matrix and heartbeat requests from builders
+		MaxUploadSize     int64  // In MB, limit of artifacts uploaded by builders
+		MaxBuildLogSize   int64  // In MB, limit of build logs uploaded by builders
+		ExternalURL       string `ini:"EXTERNAL_URL"`
+		// IPs or CIDRs of reverse proxies whose "X-Forwarded-For" and "X-Real-IP"
+		// headers are trusted to get IP of clients.
+		TrustedProxies []string
+	}
+	trustedProxies []*net.IPNet
 
 	Database struct {
 		Host     string
@@ -53,10 +78,45 @@ var (
 		PackFormats []string
 	}
 
+	Webhook struct {
+		Enabled bool
+		Secret  string   // Legacy shared secret, only used for existing projects on upgrade
+		Refs    []string // Legacy references, only used for the default batch profile on upgrade
+	}
+
+	Security struct {
+		SecretKey string
+	}
+
+	// Builder API served over TLS with client certificate verification.
+	BuilderTLS struct {
+		Enabled      bool
+		ListenAddr   string
+		CertFile     string
+		KeyFile      string
+		ClientCAFile string `ini:"CLIENT_CA_FILE"`
+	}
+
 	Cfg *ini.File
 )
 
-func init() {
+// IsTrustedProxy returns true if given IP is one of TRUSTED_PROXIES in section "[server]".
+func IsTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Init loads configuration from "conf/app.ini" and "custom/app.ini",
+// it must be called before any other package is used by the server.
+func Init() {
 	err := log.New(log.CONSOLE, log.ConsoleConfig{})
 	if err != nil {
 		fmt.Printf("Fail to create new logger: %v\n", err)
@@ -92,18 +152,69 @@ func init() {
 
 	HTTPPort = Cfg.Section("").Key("HTTP_PORT").MustInt(8086)
 	ArtifactsPath = Cfg.Section("").Key("ARTIFACTS_PATH").MustString("data/artifacts")
+	MirrorsPath = Cfg.Section("").Key("MIRRORS_PATH").MustString("data/mirrors")
+	BuildLogsPath = Cfg.Section("").Key("BUILD_LOGS_PATH").MustString("data/build_logs")
 
-	if err = Cfg.Section("database").MapTo(&Database); err != nil {
+	if err = Cfg.Section("server").MapTo(&Server); err != nil {
+		log.Fatal(4, "Fail to map section 'server': %v", err)
+	} else if err = Cfg.Section("database").MapTo(&Database); err != nil {
 		log.Fatal(4, "Fail to map section 'database': %v", err)
 	} else if err = Cfg.Section("oauth2").MapTo(&OAuth2); err != nil {
 		log.Fatal(4, "Fail to map section 'oauth2': %v", err)
 	} else if err = Cfg.Section("project").MapTo(&Project); err != nil {
 		log.Fatal(4, "Fail to map section 'project': %v", err)
+	} else if err = Cfg.Section("webhook").MapTo(&Webhook); err != nil {
+		log.Fatal(4, "Fail to map section 'webhook': %v", err)
+	} else if err = Cfg.Section("security").MapTo(&Security); err != nil {
+		log.Fatal(4, "Fail to map section 'security': %v", err)
+	} else if err = Cfg.Section("builder_tls").MapTo(&BuilderTLS); err != nil {
+		log.Fatal(4, "Fail to map section 'builder_tls': %v", err)
+	}
+	if len(Server.ExternalURL) > 0 && !strings.HasSuffix(Server.ExternalURL, "/") {
+		Server.ExternalURL += "/"
+	}
+	// Build logs are held in memory to redact secrets, they always have a limit.
+	if Server.MaxBuildLogSize <= 0 {
+		Server.MaxBuildLogSize = 10
+	}
+	if Server.ShutdownTimeout <= 0 {
+		Server.ShutdownTimeout = 30 * time.Second
+	}
+	for _, proxy := range Server.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			log.Fatal(4, "Invalid trusted proxy '%s': %v", proxy, err)
+		}
+		trustedProxies = append(trustedProxies, ipNet)
+	}
+	switch Server.Protocol {
+	case "", "http":
+		Server.Protocol = "http"
+	case "https":
+		// Self-signed certificate is generated when files are not set, which is only for development.
+		if ProdMode && (len(Server.CertFile) == 0 || len(Server.KeyFile) == 0) {
+			log.Fatal(4, "Certificate and key files must be set to serve HTTPS in production")
+		}
+	default:
+		log.Fatal(4, "Unsupported server protocol: %s", Server.Protocol)
+	}
+	if BuilderTLS.Enabled && (len(BuilderTLS.CertFile) == 0 || len(BuilderTLS.KeyFile) == 0 || len(BuilderTLS.ClientCAFile) == 0) {
+		log.Fatal(4, "Builder TLS is enabled but certificate, key or client CA file is not set")
 	}
 
 	if err = loadMatrices(); err != nil {
 		log.Fatal(4, "loadMatrices: %v", err)
 	} else if err = loadBatchJobs(); err != nil {
 		log.Fatal(4, "loadBatchJobs: %v", err)
+	} else if err = loadAuthSources(); err != nil {
+		log.Fatal(4, "loadAuthSources: %v", err)
 	}
+	loadSchedules()
 }
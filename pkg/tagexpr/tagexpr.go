@@ -0,0 +1,352 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package tagexpr implements boolean expressions of build tags, e.g. "sqlite && !cgo_off"
+// or "(pam || bindata) && sqlite". Comma is accepted as an alias of "&&" so that
+// plain tag lists like "sqlite,pam" are valid expressions as well.
+package tagexpr
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Wildcard in a tag set means all tags are supported.
+const Wildcard = "*"
+
+// Set is a set of supported tags.
+type Set map[string]bool
+
+// NewSet returns a set of given tags, empty tags are ignored.
+func NewSet(tags []string) Set {
+	set := make(Set, len(tags))
+	for _, tag := range tags {
+		if tag = strings.TrimSpace(tag); len(tag) > 0 {
+			set[tag] = true
+		}
+	}
+	return set
+}
+
+// Has returns true if the set contains given tag explicitly,
+// the wildcard is not taken into account.
+func (s Set) Has(tag string) bool {
+	return s[tag]
+}
+
+// IsWildcard returns true if the set contains the wildcard.
+func (s Set) IsWildcard() bool {
+	return s[Wildcard]
+}
+
+type kind int
+
+const (
+	kindTag kind = iota
+	kindNot
+	kindAnd
+	kindOr
+)
+
+// Expr is a parsed tag expression.
+type Expr struct {
+	kind  kind
+	tag   string
+	left  *Expr
+	right *Expr // Only used by "&&" and "||"
+}
+
+// Eval returns true if the expression holds for given tag set. A wildcard set
+// is able to build with or without any tag, so a tag holds where it is required
+// and a negated tag holds unless the expression requires it, e.g. both "sqlite"
+// and "!sqlite" hold but "sqlite && !sqlite" does not. Nil expression always holds.
+func (e *Expr) Eval(set Set) bool {
+	var required Set
+	if set.IsWildcard() {
+		required = NewSet(e.Required())
+	}
+	return e.eval(set, required, false)
+}
+
+// eval evaluates the expression, negated is true when it is inside odd number of "!".
+// Required tags are only used for wildcard set.
+func (e *Expr) eval(set, required Set, negated bool) bool {
+	if e == nil {
+		return true
+	}
+
+	switch e.kind {
+	case kindNot:
+		return !e.left.eval(set, required, !negated)
+	case kindAnd:
+		return e.left.eval(set, required, negated) && e.right.eval(set, required, negated)
+	case kindOr:
+		return e.left.eval(set, required, negated) || e.right.eval(set, required, negated)
+	}
+	if set.IsWildcard() {
+		return !negated || required.Has(e.tag)
+	}
+	return set.Has(e.tag)
+}
+
+func (e *Expr) String() string {
+	if e == nil {
+		return ""
+	}
+
+	switch e.kind {
+	case kindNot:
+		if e.left.kind == kindTag || e.left.kind == kindNot {
+			return "!" + e.left.String()
+		}
+		return "!(" + e.left.String() + ")"
+	case kindAnd:
+		return e.left.group(kindOr) + " && " + e.right.group(kindOr)
+	case kindOr:
+		return e.left.String() + " || " + e.right.String()
+	}
+	return e.tag
+}
+
+// group returns string of the expression with parentheses if it is of given kind.
+func (e *Expr) group(k kind) string {
+	if e.kind == k {
+		return "(" + e.String() + ")"
+	}
+	return e.String()
+}
+
+// Tags returns sorted tags that appear in the expression.
+func (e *Expr) Tags() []string {
+	seen := make(map[string]bool)
+	var walk func(*Expr)
+	walk = func(e *Expr) {
+		if e == nil {
+			return
+		} else if e.kind == kindTag {
+			seen[e.tag] = true
+			return
+		}
+		walk(e.left)
+		walk(e.right)
+	}
+	walk(e)
+
+	tags := make([]string, 0, len(seen))
+	for tag := range seen {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// Required returns sorted tags that every set satisfying the expression must have,
+// which are tags joined by "&&" at top level.
+func (e *Expr) Required() []string {
+	seen := make(map[string]bool)
+	var walk func(*Expr)
+	walk = func(e *Expr) {
+		if e == nil {
+			return
+		} else if e.kind == kindAnd {
+			walk(e.left)
+			walk(e.right)
+		} else if e.kind == kindTag {
+			seen[e.tag] = true
+		}
+	}
+	walk(e)
+
+	tags := make([]string, 0, len(seen))
+	for tag := range seen {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// IsConjunction returns true if the expression only consists of tags joined by "&&",
+// in which case it is satisfied by any set that has all required tags.
+func (e *Expr) IsConjunction() bool {
+	if e == nil || e.kind == kindTag {
+		return true
+	} else if e.kind == kindAnd {
+		return e.left.IsConjunction() && e.right.IsConjunction()
+	}
+	return false
+}
+
+// All returns an expression that requires all given expressions, nil ones are ignored.
+func All(exprs ...*Expr) *Expr {
+	var all *Expr
+	for _, expr := range exprs {
+		if expr == nil {
+			continue
+		} else if all == nil {
+			all = expr
+		} else {
+			all = &Expr{kind: kindAnd, left: all, right: expr}
+		}
+	}
+	return all
+}
+
+// And returns an expression that requires all given tags.
+func And(tags []string) *Expr {
+	exprs := make([]*Expr, 0, len(tags))
+	for _, tag := range tags {
+		if tag = strings.TrimSpace(tag); len(tag) > 0 {
+			exprs = append(exprs, &Expr{kind: kindTag, tag: tag})
+		}
+	}
+	return All(exprs...)
+}
+
+// SyntaxError describes where the expression is malformed.
+type SyntaxError struct {
+	Expr   string
+	Offset int
+	Msg    string
+}
+
+func (err *SyntaxError) Error() string {
+	return fmt.Sprintf("invalid tag expression at offset %d: %s [expr: %s]", err.Offset, err.Msg, err.Expr)
+}
+
+type parser struct {
+	input string
+	pos   int
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &SyntaxError{p.input, p.pos, fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) skipSpaces() {
+	for p.pos < len(p.input) && (p.input[p.pos] == ' ' || p.input[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// consume skips spaces and consumes given token if it is next.
+func (p *parser) consume(token string) bool {
+	p.skipSpaces()
+	if strings.HasPrefix(p.input[p.pos:], token) {
+		p.pos += len(token)
+		return true
+	}
+	return false
+}
+
+func isTagChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.' || c == '-'
+}
+
+// IsValidTag returns true if the tag is not empty and can be used in expressions.
+func IsValidTag(tag string) bool {
+	if len(tag) == 0 {
+		return false
+	}
+	for i := 0; i < len(tag); i++ {
+		if !isTagChar(tag[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// or := and ( "||" and )*
+func (p *parser) parseOr() (*Expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.consume("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &Expr{kind: kindOr, left: left, right: right}
+	}
+	return left, nil
+}
+
+// and := unary ( ( "&&" | "," ) unary )*
+func (p *parser) parseAnd() (*Expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.consume("&&") || p.consume(",") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &Expr{kind: kindAnd, left: left, right: right}
+	}
+	return left, nil
+}
+
+// unary := "!" unary | "(" or ")" | tag
+func (p *parser) parseUnary() (*Expr, error) {
+	if p.consume("!") {
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &Expr{kind: kindNot, left: expr}, nil
+	}
+
+	if p.consume("(") {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		} else if !p.consume(")") {
+			return nil, p.errorf("missing closing parenthesis")
+		}
+		return expr, nil
+	}
+
+	p.skipSpaces()
+	start := p.pos
+	for p.pos < len(p.input) && isTagChar(p.input[p.pos]) {
+		p.pos++
+	}
+	if start == p.pos {
+		if p.pos == len(p.input) {
+			return nil, p.errorf("unexpected end of expression")
+		}
+		return nil, p.errorf("unexpected character %q", p.input[p.pos])
+	}
+	return &Expr{kind: kindTag, tag: p.input[start:p.pos]}, nil
+}
+
+// Parse parses given tag expression, it returns nil for empty expression.
+func Parse(input string) (*Expr, error) {
+	if len(strings.TrimSpace(input)) == 0 {
+		return nil, nil
+	}
+
+	p := &parser{input: input}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.pos < len(p.input) {
+		return nil, p.errorf("unexpected character %q", p.input[p.pos])
+	}
+	return expr, nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package tagexpr
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"", ""},
+		{"  ", ""},
+		{"sqlite", "sqlite"},
+		{"sqlite,pam", "sqlite && pam"},
+		{"sqlite && !cgo_off", "sqlite && !cgo_off"},
+		{"(pam || bindata) && sqlite", "(pam || bindata) && sqlite"},
+		{"pam || bindata && sqlite", "pam || bindata && sqlite"},
+		{"!!sqlite", "!!sqlite"},
+		{"!(pam || bindata)", "!(pam || bindata)"},
+		{"go1.21 && linux-only", "go1.21 && linux-only"},
+	}
+	for _, test := range tests {
+		expr, err := Parse(test.input)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.input, err)
+		} else if got := expr.String(); got != test.want {
+			t.Errorf("Parse(%q).String() = %q, want %q", test.input, got, test.want)
+		}
+	}
+
+	for _, input := range []string{"&&", "sqlite &&", "(sqlite", "sqlite)", "sqlite pam", "!", "sqlite | pam", "$tag"} {
+		if _, err := Parse(input); err == nil {
+			t.Errorf("Parse(%q) expects error", input)
+		} else if _, ok := err.(*SyntaxError); !ok {
+			t.Errorf("Parse(%q) returns %T, want *SyntaxError", input, err)
+		}
+	}
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		input string
+		tags  []string
+		want  bool
+	}{
+		{"", nil, true},
+		{"sqlite", []string{"sqlite", "pam"}, true},
+		{"sqlite", []string{"pam"}, false},
+		{"sqlite,pam", []string{"sqlite"}, false},
+		{"!cgo_off", []string{"sqlite"}, true},
+		{"!cgo_off", []string{"cgo_off"}, false},
+		{"(pam || bindata) && sqlite", []string{"bindata", "sqlite"}, true},
+		{"(pam || bindata) && sqlite", []string{"pam"}, false},
+
+		// Wildcard sets are able to build with or without any tag.
+		{"sqlite", []string{Wildcard}, true},
+		{"!sqlite", []string{Wildcard}, true},
+		{"!!sqlite", []string{Wildcard}, true},
+		{"sqlite && !cgo_off", []string{Wildcard}, true},
+		{"!(pam || bindata)", []string{Wildcard}, true},
+		{"!(pam && bindata)", []string{Wildcard, "pam"}, true},
+		{"pam && !sqlite", []string{Wildcard}, true},
+
+		// Negated tags do not hold where they are also required.
+		{"sqlite && !sqlite", []string{Wildcard}, false},
+		{"sqlite && !(pam || sqlite)", []string{Wildcard}, false},
+		{"sqlite, pam && !!sqlite", []string{Wildcard}, true},
+	}
+	for _, test := range tests {
+		expr, err := Parse(test.input)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.input, err)
+			continue
+		}
+		if got := expr.Eval(NewSet(test.tags)); got != test.want {
+			t.Errorf("Parse(%q).Eval(%v) = %v, want %v", test.input, test.tags, got, test.want)
+		}
+	}
+}
+
+func TestSet(t *testing.T) {
+	set := NewSet([]string{" sqlite ", "", Wildcard})
+	if !set.Has("sqlite") {
+		t.Error("Has(\"sqlite\") = false, want true")
+	}
+	if set.Has("pam") {
+		t.Error("Has(\"pam\") = true, want false")
+	}
+	if !set.IsWildcard() {
+		t.Error("IsWildcard() = false, want true")
+	}
+	if NewSet([]string{"sqlite"}).IsWildcard() {
+		t.Error("IsWildcard() of set without wildcard = true, want false")
+	}
+}
+
+func TestExprTags(t *testing.T) {
+	expr, err := Parse("(pam || bindata) && sqlite && !cgo_off, sqlite")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	if got, want := expr.Tags(), []string{"bindata", "cgo_off", "pam", "sqlite"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Tags() = %v, want %v", got, want)
+	}
+	if got, want := expr.Required(), []string{"sqlite"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Required() = %v, want %v", got, want)
+	}
+	if expr.IsConjunction() {
+		t.Error("IsConjunction() = true, want false")
+	}
+	if !All(And([]string{"sqlite", " pam "}), nil).IsConjunction() {
+		t.Error("IsConjunction() of tags = false, want true")
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package tool
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority that issues client certificates in tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse CA certificate: %v", err)
+	}
+	return &testCA{cert, key}
+}
+
+func (ca *testCA) PEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
+
+// Issue returns a client certificate with given common name signed by the CA.
+func (ca *testCA) Issue(t *testing.T, commonName string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("create client certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// newClientCertServer starts a TLS server that requires client certificates
+// signed by given CA, and responds common name and fingerprint of verified one.
+func newClientCertServer(t *testing.T, ca *testCA) *httptest.Server {
+	config, err := NewClientCertConfig(ca.PEM())
+	if err != nil {
+		t.Fatalf("NewClientCertConfig: %v", err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "no verified chain", http.StatusForbidden)
+			return
+		}
+		cert := r.TLS.VerifiedChains[0][0]
+		w.Write([]byte(cert.Subject.CommonName + " " + CertFingerprint(cert.Raw)))
+	}))
+	server.TLS = config
+	server.StartTLS()
+	return server
+}
+
+// newClient returns a client trusts the server and presents given certificates,
+// connections are not shared with other clients.
+func newClient(server *httptest.Server, certs ...tls.Certificate) *http.Client {
+	config := server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	config.Certificates = certs
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+}
+
+func TestNewClientCertConfig(t *testing.T) {
+	ca := newTestCA(t, "Luban Builders")
+	server := newClientCertServer(t, ca)
+	defer server.Close()
+
+	t.Run("trusted certificate", func(t *testing.T) {
+		cert := ca.Issue(t, "builder-1")
+		resp, err := newClient(server, cert).Get(server.URL)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("read body: %v", err)
+		}
+		if want := "builder-1 " + CertFingerprint(cert.Certificate[0]); string(body) != want {
+			t.Errorf("got %q, want %q", body, want)
+		}
+	})
+
+	t.Run("certificate of another CA", func(t *testing.T) {
+		cert := newTestCA(t, "Luban Builders").Issue(t, "builder-1")
+		if resp, err := newClient(server, cert).Get(server.URL); err == nil {
+			resp.Body.Close()
+			t.Fatalf("expect handshake error, got status %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("no certificate", func(t *testing.T) {
+		if resp, err := newClient(server).Get(server.URL); err == nil {
+			resp.Body.Close()
+			t.Fatalf("expect handshake error, got status %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("invalid CA file", func(t *testing.T) {
+		if _, err := NewClientCertConfig([]byte("not a certificate")); err == nil {
+			t.Fatal("expect error for PEM without certificate")
+		}
+	})
+}
+
+func TestCertFingerprint(t *testing.T) {
+	cert, err := NewSelfSignedCert([]string{"localhost", "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("NewSelfSignedCert: %v", err)
+	}
+
+	fingerprint := CertFingerprint(cert.Certificate[0])
+	if len(fingerprint) != 64 {
+		t.Errorf("fingerprint %q has %d characters, want 64", fingerprint, len(fingerprint))
+	}
+	if CertFingerprint(cert.Certificate[0]) != fingerprint {
+		t.Error("fingerprint of same certificate changed")
+	}
+
+	other, err := NewSelfSignedCert([]string{"localhost"})
+	if err != nil {
+		t.Fatalf("NewSelfSignedCert: %v", err)
+	}
+	if CertFingerprint(other.Certificate[0]) == fingerprint {
+		t.Error("different certificates have same fingerprint")
+	}
+}
@@ -15,8 +15,13 @@
 package tool
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 
 	"github.com/Unknwon/com"
 	"github.com/satori/go.uuid"
@@ -29,6 +34,19 @@ func EncodeSHA1(str string) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
+// EncodeSHA256 encodes string to SHA256 hex value.
+func EncodeSHA256(str string) string {
+	h := sha256.New()
+	h.Write([]byte(str))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// CertFingerprint returns SHA256 fingerprint of DER encoded certificate in lower case hex.
+func CertFingerprint(der []byte) string {
+	h := sha256.Sum256(der)
+	return hex.EncodeToString(h[:])
+}
+
 // NewSecretToekn generates and returns a random secret token based on SHA1.
 func NewSecretToekn() string {
 	return EncodeSHA1(uuid.NewV4().String())
@@ -42,3 +60,40 @@ func Int64sToStrings(ints []int64) []string {
 	}
 	return strs
 }
+
+// AESGCMEncrypt encrypts data with given key (16, 24 or 32 bytes) using AES-GCM,
+// the random nonce is prepended to the returned cipher text.
+func AESGCMEncrypt(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+// AESGCMDecrypt decrypts data which is encrypted by AESGCMEncrypt with the same key.
+func AESGCMDecrypt(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	size := gcm.NonceSize()
+	if len(data) < size {
+		return nil, errors.New("cipher text is too short")
+	}
+	return gcm.Open(nil, data[:size], data[size:], nil)
+}
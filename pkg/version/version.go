@@ -0,0 +1,267 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package version implements comparison of Go toolchain versions
+// and matching them against simple range constraints.
+package version
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidConstraint = errors.New("invalid version constraint")
+
+// Version is a parsed Go toolchain version, e.g. "1.21.5" or "go1.22rc1".
+type Version struct {
+	Parts [3]int
+	// Number of parts given explicitly, "1.21" has 2 parts.
+	NumParts int
+	// Pre-release kind ("beta" or "rc") and its number, e.g. "1.22rc1"
+	// has "rc" and 1. Pre-release versions are lower than the release.
+	PreRelease    string
+	PreReleaseNum int
+}
+
+var (
+	partPattern     = regexp.MustCompile(`^[0-9]+$`)
+	lastPartPattern = regexp.MustCompile(`^([0-9]+)(?:(beta|rc)([0-9]+))?$`)
+)
+
+// preReleaseRanks orders pre-release kinds, release has the highest rank.
+var preReleaseRanks = map[string]int{
+	"beta": 0,
+	"rc":   1,
+	"":     2,
+}
+
+// IsPreRelease returns true if v is a beta or release candidate.
+func (v *Version) IsPreRelease() bool {
+	return len(v.PreRelease) > 0
+}
+
+// trimPrefix removes surrounding spaces and optional "go" or "v" prefix of version string.
+func trimPrefix(s string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(s), "go"), "v")
+}
+
+// Parse parses version string with optional "go" or "v" prefix.
+func Parse(s string) (*Version, error) {
+	s = trimPrefix(s)
+	if len(s) == 0 {
+		return nil, errors.New("empty version")
+	}
+
+	v := new(Version)
+	fields := strings.Split(s, ".")
+	if len(fields) > 3 {
+		return nil, errors.New("too many parts in version")
+	}
+	for i, field := range fields {
+		num := field
+		if i == len(fields)-1 {
+			// Only last part may have pre-release suffix such as "rc1" or "beta2".
+			m := lastPartPattern.FindStringSubmatch(field)
+			if m == nil {
+				return nil, errors.New("invalid part in version: " + field)
+			}
+			num = m[1]
+			if len(m[2]) > 0 {
+				n, err := strconv.Atoi(m[3])
+				if err != nil {
+					return nil, err
+				}
+				v.PreRelease = m[2]
+				v.PreReleaseNum = n
+			}
+		} else if !partPattern.MatchString(field) {
+			return nil, errors.New("invalid part in version: " + field)
+		}
+
+		n, err := strconv.Atoi(num)
+		if err != nil {
+			return nil, err
+		}
+		v.Parts[i] = n
+	}
+	v.NumParts = len(fields)
+	return v, nil
+}
+
+// Compare returns -1, 0 or 1 if v is lower than, equal to or higher than target.
+func (v *Version) Compare(target *Version) int {
+	for i := 0; i < 3; i++ {
+		if v.Parts[i] < target.Parts[i] {
+			return -1
+		} else if v.Parts[i] > target.Parts[i] {
+			return 1
+		}
+	}
+	if rank, targetRank := preReleaseRanks[v.PreRelease], preReleaseRanks[target.PreRelease]; rank != targetRank {
+		if rank < targetRank {
+			return -1
+		}
+		return 1
+	}
+	if v.PreReleaseNum < target.PreReleaseNum {
+		return -1
+	} else if v.PreReleaseNum > target.PreReleaseNum {
+		return 1
+	}
+	return 0
+}
+
+// hasPrefix returns true if v has all parts explicitly given in prefix,
+// e.g. "1.21.5" has prefix "1.21". A pre-release prefix only matches the
+// exact same pre-release, e.g. "1.22rc1" does not match "1.22rc2".
+func (v *Version) hasPrefix(prefix *Version) bool {
+	for i := 0; i < prefix.NumParts; i++ {
+		if v.Parts[i] != prefix.Parts[i] {
+			return false
+		}
+	}
+	if prefix.IsPreRelease() {
+		return v.NumParts == prefix.NumParts &&
+			v.PreRelease == prefix.PreRelease && v.PreReleaseNum == prefix.PreReleaseNum
+	}
+	return !v.IsPreRelease() || prefix.NumParts < v.NumParts
+}
+
+type clause struct {
+	op      string
+	raw     string // Version string as given, without prefix
+	version *Version
+}
+
+func (c *clause) match(v *Version) bool {
+	switch c.op {
+	case "", "=":
+		return v.hasPrefix(c.version)
+	case "!=":
+		return !v.hasPrefix(c.version)
+	case ">":
+		return v.Compare(c.version) > 0
+	case ">=":
+		return v.Compare(c.version) >= 0
+	case "<":
+		return v.Compare(c.version) < 0
+	case "<=":
+		return v.Compare(c.version) <= 0
+	case "~":
+		// Same minor version, e.g. "~1.21" and "~1.21.3" both only match 1.21.x.
+		return v.Parts[0] == c.version.Parts[0] && v.Parts[1] == c.version.Parts[1] && v.Compare(c.version) >= 0
+	case "^":
+		// Same major version.
+		return v.Parts[0] == c.version.Parts[0] && v.Compare(c.version) >= 0
+	}
+	return false
+}
+
+var operators = []string{">=", "<=", "!=", ">", "<", "=", "~", "^"}
+
+func parseConstraint(constraint string) ([]*clause, error) {
+	clauses := make([]*clause, 0, 2)
+	for _, part := range strings.Split(constraint, ",") {
+		fields := strings.Fields(part)
+		for i := 0; i < len(fields); i++ {
+			c := new(clause)
+			for _, op := range operators {
+				if strings.HasPrefix(fields[i], op) {
+					c.op = op
+					break
+				}
+			}
+
+			// Operator may be separated from its version by spaces, e.g. ">= 1.21".
+			raw := fields[i][len(c.op):]
+			if len(raw) == 0 && len(c.op) > 0 && i+1 < len(fields) {
+				i++
+				raw = fields[i]
+			}
+
+			var err error
+			c.version, err = Parse(raw)
+			if err != nil {
+				return nil, ErrInvalidConstraint
+			}
+			c.raw = trimPrefix(raw)
+			clauses = append(clauses, c)
+		}
+	}
+	return clauses, nil
+}
+
+// ValidateConstraint returns error if given constraint cannot be parsed.
+func ValidateConstraint(constraint string) error {
+	_, err := parseConstraint(constraint)
+	return err
+}
+
+// Match returns true if version satisfies all clauses of the constraint.
+// Clauses are separated by comma or space, each of them is a version with
+// optional operator (=, !=, >, >=, <, <=, ~, ^), e.g. ">=1.21, <1.23".
+// A version without operator, or with "=" and "!=", matches all versions
+// it is prefix of, e.g. "1.21" matches "1.21.5". Other operators compare
+// versions with missing parts being zero, e.g. ">1.21" matches "1.21.5" but
+// "<=1.21" does not. Empty constraint matches any version.
+func Match(constraint, version string) (bool, error) {
+	clauses, err := parseConstraint(constraint)
+	if err != nil {
+		return false, err
+	} else if len(clauses) == 0 {
+		return true, nil
+	}
+
+	v, err := Parse(version)
+	if err != nil {
+		return false, err
+	}
+	for _, c := range clauses {
+		if !c.match(v) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+var opNames = map[string]string{
+	"":   "",
+	"=":  "",
+	"!=": "ne",
+	">":  "gt",
+	">=": "ge",
+	"<":  "lt",
+	"<=": "le",
+	"~":  "tilde",
+	"^":  "caret",
+}
+
+// Slug returns the constraint in a form that is safe in file names, operators
+// are replaced by words so constraints match different versions have different
+// slugs, e.g. ">= 1.21, <1.23" becomes "ge1.21-lt1.23". Empty string is returned
+// for empty or invalid constraint.
+func Slug(constraint string) string {
+	clauses, err := parseConstraint(constraint)
+	if err != nil {
+		return ""
+	}
+
+	parts := make([]string, len(clauses))
+	for i, c := range clauses {
+		parts[i] = opNames[c.op] + c.raw
+	}
+	return strings.Join(parts, "-")
+}
@@ -0,0 +1,160 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package version
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		s             string
+		parts         [3]int
+		numParts      int
+		preRelease    string
+		preReleaseNum int
+	}{
+		{"1.21", [3]int{1, 21, 0}, 2, "", 0},
+		{"1.21.5", [3]int{1, 21, 5}, 3, "", 0},
+		{"go1.22rc1", [3]int{1, 22, 0}, 2, "rc", 1},
+		{"1.22beta2", [3]int{1, 22, 0}, 2, "beta", 2},
+		{"v1", [3]int{1, 0, 0}, 1, "", 0},
+		{" go1.20.3 ", [3]int{1, 20, 3}, 3, "", 0},
+	}
+	for _, test := range tests {
+		v, err := Parse(test.s)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.s, err)
+			continue
+		}
+		if v.Parts != test.parts || v.NumParts != test.numParts ||
+			v.PreRelease != test.preRelease || v.PreReleaseNum != test.preReleaseNum {
+			t.Errorf("Parse(%q) = %+v, want parts %v, %d parts, pre-release %q%d",
+				test.s, *v, test.parts, test.numParts, test.preRelease, test.preReleaseNum)
+		}
+	}
+
+	for _, s := range []string{
+		"", "go", "1.2.3.4", "1.x", "1rc1.2", "a1",
+		"1.2/x", "1.21$(id)", "1.22alpha1", "1.22rc", "1.22rc1x", "1.+2", "1.22 rc1",
+	} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("Parse(%q) expects error", s)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		constraint string
+		version    string
+		want       bool
+	}{
+		{"", "1.21.5", true},
+
+		{"1.21", "1.21.5", true},
+		{"1.21", "1.21", true},
+		{"1.21", "1.22", false},
+		{"=1.21.5", "1.21.5", true},
+		{"=1.21.5", "1.21.6", false},
+		{"!=1.21", "1.21.5", false},
+		{"!=1.21", "1.22.0", true},
+
+		{">1.21", "1.21.5", true},
+		{">1.21", "1.21.0", false},
+		{">1.21", "1.21", false},
+		{">1.21", "1.22rc1", true},
+		{">=1.21", "1.21", true},
+		{">=1.21", "1.21rc1", false},
+		{">=1.21", "1.20.14", false},
+		{"<1.21", "1.20.14", true},
+		{"<1.21", "1.21rc2", true},
+		{"<1.21", "1.21.0", false},
+		{"<=1.21", "1.21.0", true},
+		{"<=1.21", "1.21.5", false},
+
+		{"1.22rc1", "1.22rc1", true},
+		{"1.22rc1", "1.22rc2", false},
+		{"1.22rc1", "1.22.1", false},
+		{"!=1.22rc1", "1.22rc2", true},
+		{">1.22rc1", "1.22rc2", true},
+		{">1.22rc2", "1.22rc1", false},
+		{">1.22beta2", "1.22rc1", true},
+		{"<1.22rc1", "1.22beta3", true},
+		{">=1.22rc2", "1.22", true},
+		{"<1.22rc10", "1.22rc9", true},
+
+		{"~1.21", "1.21.9", true},
+		{"~1.21.3", "1.21.2", false},
+		{"~1.21", "1.22.0", false},
+		{"^1.21", "1.30", true},
+		{"^1.21", "1.20", false},
+
+		{">= 1.21", "1.21.5", true},
+		{">= 1.21", "1.20", false},
+		{">=1.21, <1.23", "1.22.7", true},
+		{">=1.21, <1.23", "1.23.0", false},
+		{">= 1.21 < 1.23", "1.22", true},
+		{">= 1.21 < 1.23", "1.23", false},
+		{">=go1.21,<go1.23", "go1.22.1", true},
+	}
+	for _, test := range tests {
+		got, err := Match(test.constraint, test.version)
+		if err != nil {
+			t.Errorf("Match(%q, %q): %v", test.constraint, test.version, err)
+		} else if got != test.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", test.constraint, test.version, got, test.want)
+		}
+	}
+}
+
+func TestValidateConstraint(t *testing.T) {
+	for _, constraint := range []string{"", "1.21", ">= 1.21", ">=1.21, <1.23", "~1.21 ^1"} {
+		if err := ValidateConstraint(constraint); err != nil {
+			t.Errorf("ValidateConstraint(%q): %v", constraint, err)
+		}
+	}
+
+	for _, constraint := range []string{">=", ">=, 1.21", "1.21,>=", "=>1.21", "1.x", "latest"} {
+		if err := ValidateConstraint(constraint); err != ErrInvalidConstraint {
+			t.Errorf("ValidateConstraint(%q) = %v, want %v", constraint, err, ErrInvalidConstraint)
+		}
+	}
+}
+
+func TestSlug(t *testing.T) {
+	tests := []struct {
+		constraint string
+		want       string
+	}{
+		{"", ""},
+		{"1.21", "1.21"},
+		{"=1.21", "1.21"},
+		{"go1.21", "1.21"},
+		{">=1.21", "ge1.21"},
+		{">= 1.21", "ge1.21"},
+		{">1.21", "gt1.21"},
+		{">=1.21, <1.23", "ge1.21-lt1.23"},
+		{"<=1.21 !=1.20.3", "le1.21-ne1.20.3"},
+		{"~1.21rc1", "tilde1.21rc1"},
+		{"^1", "caret1"},
+		{">=1.x", ""},
+	}
+	for _, test := range tests {
+		if got := Slug(test.constraint); got != test.want {
+			t.Errorf("Slug(%q) = %q, want %q", test.constraint, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package webhook parses and verifies push and tag events sent by code hosting services.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+type Kind string
+
+const (
+	KIND_GITHUB  Kind = "github"
+	KIND_GITEA   Kind = "gitea"
+	KIND_GENERIC Kind = "generic"
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrUnsupportedKind  = errors.New("unsupported webhook kind")
+)
+
+// Event represents a push of a branch or tag.
+type Event struct {
+	Ref     string
+	Commit  string
+	Deleted bool
+}
+
+// pushPayload contains fields of push event that are common between
+// GitHub, Gitea (Gogs) and generic payloads.
+type pushPayload struct {
+	Ref     string `json:"ref"`
+	After   string `json:"after"`
+	Commit  string `json:"commit"`
+	Deleted bool   `json:"deleted"`
+}
+
+var (
+	commitPattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+	emptyCommit   = strings.Repeat("0", 40)
+)
+
+// verifySignature checks hex encoded HMAC signature of payload with given hash function.
+func verifySignature(newHash func() hash.Hash, secret string, payload []byte, signature string) error {
+	expected, err := hex.DecodeString(signature)
+	if err != nil || len(signature) == 0 {
+		return ErrInvalidSignature
+	}
+
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write(payload)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func verifyGitHub(header http.Header, payload []byte, secret string) error {
+	if sig := header.Get("X-Hub-Signature-256"); len(sig) > 0 {
+		return verifySignature(sha256.New, secret, payload, strings.TrimPrefix(sig, "sha256="))
+	}
+	return verifySignature(sha1.New, secret, payload, strings.TrimPrefix(header.Get("X-Hub-Signature"), "sha1="))
+}
+
+func verifyGitea(header http.Header, payload []byte, secret string) error {
+	sig := header.Get("X-Gitea-Signature")
+	if len(sig) == 0 {
+		sig = header.Get("X-Gogs-Signature")
+	}
+	return verifySignature(sha256.New, secret, payload, sig)
+}
+
+func verifyGeneric(header http.Header, payload []byte, secret string) error {
+	return verifySignature(sha256.New, secret, payload, strings.TrimPrefix(header.Get("X-LUBAN-SIGNATURE"), "sha256="))
+}
+
+// eventType returns the name of event sent by the service, generic webhook only sends push events.
+func eventType(kind Kind, header http.Header) string {
+	switch kind {
+	case KIND_GITHUB:
+		return header.Get("X-GitHub-Event")
+	case KIND_GITEA:
+		if event := header.Get("X-Gitea-Event"); len(event) > 0 {
+			return event
+		}
+		return header.Get("X-Gogs-Event")
+	}
+	return "push"
+}
+
+// Parse verifies signature of the payload with given secret and parses it to a push event.
+// It returns nil event without error for events other than push (e.g. ping).
+func Parse(kind Kind, header http.Header, payload []byte, secret string) (*Event, error) {
+	var err error
+	switch kind {
+	case KIND_GITHUB:
+		err = verifyGitHub(header, payload, secret)
+	case KIND_GITEA:
+		err = verifyGitea(header, payload, secret)
+	case KIND_GENERIC:
+		err = verifyGeneric(header, payload, secret)
+	default:
+		return nil, ErrUnsupportedKind
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if eventType(kind, header) != "push" {
+		return nil, nil
+	}
+
+	var push pushPayload
+	if err = json.Unmarshal(payload, &push); err != nil {
+		return nil, fmt.Errorf("decode payload: %v", err)
+	}
+
+	event := &Event{
+		Ref:     push.Ref,
+		Commit:  push.After,
+		Deleted: push.Deleted,
+	}
+	if kind == KIND_GENERIC {
+		event.Commit = push.Commit
+	}
+	if event.Commit == emptyCommit {
+		event.Deleted = true
+	}
+
+	if !strings.HasPrefix(event.Ref, "refs/") {
+		return nil, fmt.Errorf("invalid reference: %q", event.Ref)
+	} else if !event.Deleted && !commitPattern.MatchString(event.Commit) {
+		return nil, fmt.Errorf("invalid commit: %q", event.Commit)
+	}
+	return event, nil
+}
+
+// MatchRef returns true if the reference matches any of given glob patterns.
+func MatchRef(patterns []string, ref string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(strings.TrimSpace(pattern), ref); matched {
+			return true
+		}
+	}
+	return false
+}
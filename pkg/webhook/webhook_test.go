@@ -0,0 +1,261 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+const testSecret = "s3cr3t"
+
+func signWith(newHash func() hash.Hash, secret string, payload []byte) string {
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func sign(newHash func() hash.Hash, payload []byte) string {
+	return signWith(newHash, testSecret, payload)
+}
+
+func loadFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("read fixture %q: %v", name, err)
+	}
+	return data
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		kind    Kind
+		fixture string
+		header  func(payload []byte) http.Header
+		event   *Event
+	}{
+		{
+			name:    "GitHub push",
+			kind:    KIND_GITHUB,
+			fixture: "github_push.json",
+			header: func(payload []byte) http.Header {
+				return http.Header{
+					"X-Github-Event":      {"push"},
+					"X-Hub-Signature-256": {"sha256=" + sign(sha256.New, payload)},
+				}
+			},
+			event: &Event{Ref: "refs/heads/master", Commit: "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c"},
+		},
+		{
+			name:    "GitHub tag with legacy SHA1 signature",
+			kind:    KIND_GITHUB,
+			fixture: "github_tag.json",
+			header: func(payload []byte) http.Header {
+				return http.Header{
+					"X-Github-Event":  {"push"},
+					"X-Hub-Signature": {"sha1=" + sign(sha1.New, payload)},
+				}
+			},
+			event: &Event{Ref: "refs/tags/v0.11.0", Commit: "3f2a1b7c4e5d6f708192a3b4c5d6e7f8091a2b3c"},
+		},
+		{
+			name:    "GitHub branch deletion",
+			kind:    KIND_GITHUB,
+			fixture: "github_delete.json",
+			header: func(payload []byte) http.Header {
+				return http.Header{
+					"X-Github-Event":      {"push"},
+					"X-Hub-Signature-256": {"sha256=" + sign(sha256.New, payload)},
+				}
+			},
+			event: &Event{Ref: "refs/heads/feature", Commit: emptyCommit, Deleted: true},
+		},
+		{
+			name:    "GitHub ping",
+			kind:    KIND_GITHUB,
+			fixture: "github_ping.json",
+			header: func(payload []byte) http.Header {
+				return http.Header{
+					"X-Github-Event":      {"ping"},
+					"X-Hub-Signature-256": {"sha256=" + sign(sha256.New, payload)},
+				}
+			},
+			event: nil,
+		},
+		{
+			name:    "Gitea push",
+			kind:    KIND_GITEA,
+			fixture: "gitea_push.json",
+			header: func(payload []byte) http.Header {
+				return http.Header{
+					"X-Gitea-Event":     {"push"},
+					"X-Gitea-Signature": {sign(sha256.New, payload)},
+				}
+			},
+			event: &Event{Ref: "refs/heads/develop", Commit: "bffeb74224043ba2feb48d137756c8a9331c449a"},
+		},
+		{
+			name:    "Gogs push",
+			kind:    KIND_GITEA,
+			fixture: "gitea_push.json",
+			header: func(payload []byte) http.Header {
+				return http.Header{
+					"X-Gogs-Event":     {"push"},
+					"X-Gogs-Signature": {sign(sha256.New, payload)},
+				}
+			},
+			event: &Event{Ref: "refs/heads/develop", Commit: "bffeb74224043ba2feb48d137756c8a9331c449a"},
+		},
+		{
+			name:    "generic push",
+			kind:    KIND_GENERIC,
+			fixture: "generic_push.json",
+			header: func(payload []byte) http.Header {
+				return http.Header{
+					"X-Luban-Signature": {"sha256=" + sign(sha256.New, payload)},
+				}
+			},
+			event: &Event{Ref: "refs/tags/v1.0.0", Commit: "4b825dc642cb6eb9a060e54bf8d69288fbee4904"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payload := loadFixture(t, test.fixture)
+			event, err := Parse(test.kind, test.header(payload), payload, testSecret)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+
+			if test.event == nil {
+				if event != nil {
+					t.Fatalf("expect no event but got %+v", event)
+				}
+				return
+			}
+			if event == nil || *event != *test.event {
+				t.Fatalf("expect event %+v but got %+v", test.event, event)
+			}
+		})
+	}
+}
+
+func TestParse_InvalidSignature(t *testing.T) {
+	payload := loadFixture(t, "github_push.json")
+	tests := []struct {
+		name   string
+		kind   Kind
+		header http.Header
+	}{
+		{
+			name:   "GitHub missing signature",
+			kind:   KIND_GITHUB,
+			header: http.Header{"X-Github-Event": {"push"}},
+		},
+		{
+			name: "GitHub signed with another secret",
+			kind: KIND_GITHUB,
+			header: http.Header{
+				"X-Github-Event":      {"push"},
+				"X-Hub-Signature-256": {"sha256=" + signWith(sha256.New, "other", payload)},
+			},
+		},
+		{
+			name: "GitHub malformed signature",
+			kind: KIND_GITHUB,
+			header: http.Header{
+				"X-Github-Event":      {"push"},
+				"X-Hub-Signature-256": {"sha256=not-hex"},
+			},
+		},
+		{
+			name: "Gitea signed with SHA1",
+			kind: KIND_GITEA,
+			header: http.Header{
+				"X-Gitea-Event":     {"push"},
+				"X-Gitea-Signature": {sign(sha1.New, payload)},
+			},
+		},
+		{
+			name:   "generic missing signature",
+			kind:   KIND_GENERIC,
+			header: http.Header{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Parse(test.kind, test.header, payload, testSecret); err != ErrInvalidSignature {
+				t.Fatalf("expect ErrInvalidSignature but got %v", err)
+			}
+		})
+	}
+}
+
+func TestParse_TamperedPayload(t *testing.T) {
+	payload := loadFixture(t, "github_push.json")
+	header := http.Header{
+		"X-Github-Event":      {"push"},
+		"X-Hub-Signature-256": {"sha256=" + sign(sha256.New, payload)},
+	}
+	tampered := append([]byte{}, payload...)
+	tampered[len(tampered)-2] = ' '
+	if _, err := Parse(KIND_GITHUB, header, tampered, testSecret); err != ErrInvalidSignature {
+		t.Fatalf("expect ErrInvalidSignature but got %v", err)
+	}
+}
+
+func TestParse_UnsupportedKind(t *testing.T) {
+	if _, err := Parse("bitbucket", http.Header{}, []byte("{}"), testSecret); err != ErrUnsupportedKind {
+		t.Fatalf("expect ErrUnsupportedKind but got %v", err)
+	}
+}
+
+func TestParse_InvalidPayload(t *testing.T) {
+	for _, payload := range []string{
+		`not json`,
+		`{"ref": "master", "commit": "4b825dc642cb6eb9a060e54bf8d69288fbee4904"}`,
+		`{"ref": "refs/heads/master", "commit": "HEAD"}`,
+	} {
+		header := http.Header{"X-Luban-Signature": {sign(sha256.New, []byte(payload))}}
+		if _, err := Parse(KIND_GENERIC, header, []byte(payload), testSecret); err == nil || err == ErrInvalidSignature {
+			t.Fatalf("expect payload error for %q but got %v", payload, err)
+		}
+	}
+}
+
+func TestMatchRef(t *testing.T) {
+	patterns := []string{"refs/heads/master", " refs/tags/v* "}
+	tests := []struct {
+		ref   string
+		match bool
+	}{
+		{"refs/heads/master", true},
+		{"refs/tags/v1.0.0", true},
+		{"refs/heads/develop", false},
+		{"refs/tags/release-1", false},
+	}
+	for _, test := range tests {
+		if got := MatchRef(patterns, test.ref); got != test.match {
+			t.Errorf("MatchRef(%q) = %v, expect %v", test.ref, got, test.match)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+// Preview builders that are able to take the task on new task page.
+$('#preview-builders').click(function () {
+  var $form = $(this).closest('form');
+  var $result = $('#preview-result');
+  $.getJSON($(this).data('url'), $form.serialize(), function (data) {
+    $result.removeClass('hidden').empty();
+    if (data.error) {
+      $result.append($('<p class="text-danger">').text(data.error));
+      return;
+    }
+
+    if (data.constraint) {
+      $result.append($('<p>').append('Tag constraint: ', $('<code>').text(data.constraint)));
+    }
+    if (data.builders.length == 0) {
+      $result.append($('<p class="text-warning">').text('No builder is able to take this task.'));
+      return;
+    }
+    var $list = $('<ul>');
+    $.each(data.builders, function (i, b) {
+      $list.append($('<li>').text(b.name + ' (' + b.status + ', ' + b.trust_level + ')'));
+    });
+    $result.append($list);
+  });
+});
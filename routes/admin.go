@@ -0,0 +1,133 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package routes
+
+import (
+	"fmt"
+
+	log "gopkg.in/clog.v1"
+
+	"github.com/lubanstudio/luban/models"
+	"github.com/lubanstudio/luban/pkg/auth"
+	"github.com/lubanstudio/luban/pkg/context"
+	"github.com/lubanstudio/luban/pkg/form"
+)
+
+const usersPageSize = 50
+
+func AdminUsers(c *context.Context) {
+	c.Data["Title"] = "Users"
+
+	page := c.QueryInt("page")
+	if page < 1 {
+		page = 1
+	}
+	users, err := models.ListUsers(page, usersPageSize)
+	if err != nil {
+		c.Handle(500, "ListUsers", err)
+		return
+	}
+	c.Data["Users"] = users
+	c.Data["Roles"] = models.Roles
+	c.Data["EnableLocal"] = auth.GetPasswordProvider() != nil
+	c.Data["Page"] = page
+	c.Data["PreviousPage"] = page - 1
+	c.Data["NextPage"] = page + 1
+	c.Data["HasNextPage"] = int64(page*usersPageSize) < models.CountUsers()
+
+	c.HTML(200, "admin/users")
+}
+
+// roleAuditValue returns role of the user to be recorded in audit log.
+func roleAuditValue(u *models.User) map[string]interface{} {
+	return map[string]interface{}{
+		"role":           u.Role.Name(),
+		"prohibit_login": u.ProhibitLogin,
+	}
+}
+
+func UpdateUserRole(c *context.Context, f form.UserRole) {
+	user, err := models.GetUserByID(c.ParamsInt64(":id"))
+	if err != nil {
+		if models.IsErrRecordNotFound(err) {
+			c.NotFound()
+		} else {
+			c.Handle(500, "GetUserByID", err)
+		}
+		return
+	}
+
+	// Admins cannot lock themselves out.
+	if user.ID == c.User.ID {
+		c.Flash.Error("You cannot change role of yourself.")
+		c.Redirect("/admin/users")
+		return
+	}
+
+	before := roleAuditValue(user)
+	role := models.ParseRole(f.Role)
+	if err = models.UpdateUserRole(user, role, f.ProhibitLogin); err != nil {
+		c.Handle(500, "UpdateUserRole", err)
+		return
+	}
+	log.Info("Role of user '%s' has been changed to '%s' by %s [prohibit_login: %v]",
+		user.Username, role.Name(), c.User.Username, f.ProhibitLogin)
+	c.Audit(models.AUDIT_USER_UPDATE_ROLE, user.AuditTarget(), before, roleAuditValue(user))
+
+	c.Flash.Success(fmt.Sprintf("User '%s' has been updated.", user.Username))
+	c.Redirect("/admin/users")
+}
+
+func NewLocalUser(c *context.Context) {
+	if auth.GetPasswordProvider() == nil {
+		c.NotFound()
+		return
+	}
+
+	c.Data["Title"] = "New User"
+	c.Data["Roles"] = models.Roles
+	c.HTML(200, "admin/user_new")
+}
+
+func NewLocalUserPost(c *context.Context, f form.NewLocalUser) {
+	if auth.GetPasswordProvider() == nil {
+		c.NotFound()
+		return
+	}
+
+	c.Data["Title"] = "New User"
+	c.Data["Roles"] = models.Roles
+
+	if c.HasError() {
+		c.HTML(200, "admin/user_new")
+		return
+	}
+
+	user, err := models.CreateLocalUser(f.Username, f.Email, f.Password, models.ParseRole(f.Role))
+	if err != nil {
+		if models.IsErrUserExists(err) {
+			c.Data["Err_Username"] = true
+			c.RenderWithErr("Username has been used.", "admin/user_new", f)
+		} else {
+			c.Handle(500, "CreateLocalUser", err)
+		}
+		return
+	}
+	log.Info("Local user '%s' has been created by %s", user.Username, c.User.Username)
+	c.Audit(models.AUDIT_USER_CREATE, user.AuditTarget(), nil, user)
+
+	c.Flash.Success(fmt.Sprintf("User '%s' has been created.", user.Username))
+	c.Redirect("/admin/users")
+}
@@ -0,0 +1,299 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package routes
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	log "gopkg.in/clog.v1"
+
+	"github.com/lubanstudio/luban/models"
+	"github.com/lubanstudio/luban/pkg/context"
+	"github.com/lubanstudio/luban/pkg/setting"
+)
+
+const (
+	API_DEFAULT_PAGE_SIZE = 20
+	API_MAX_PAGE_SIZE     = 100
+)
+
+// APIError is the body of all error responses of REST API. Type and details
+// are the name and fields of the models.Err* type when the error is one of them.
+type APIError struct {
+	Type    string      `json:"type"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// APIPage is the body of responses that list resources.
+type APIPage struct {
+	Data  interface{} `json:"data"`
+	Page  int         `json:"page"`
+	Limit int         `json:"limit"`
+	Total int64       `json:"total"`
+}
+
+func apiError(c *context.Context, status int, typ, msg string) {
+	c.JSON(status, &APIError{
+		Type:    typ,
+		Message: msg,
+	})
+}
+
+// apiHandleErr responses errors of models with their types and status codes,
+// other errors are logged and responded as internal errors without details.
+func apiHandleErr(c *context.Context, title string, err error) {
+	var status int
+	switch {
+	case models.IsErrRecordNotFound(err):
+		apiError(c, 404, "ErrNotFound", "resource does not exist")
+		return
+	case models.IsErrNoSuitableMatrix(err),
+		models.IsErrRefNotExist(err),
+		models.IsErrInvalidTag(err),
+		models.IsErrInvalidTagExpr(err),
+		models.IsErrInvalidGoVersion(err),
+		models.IsErrInvalidToolchain(err),
+		models.IsErrUserNameAmbiguous(err),
+		models.IsErrInvalidBuildEnv(err),
+		models.IsErrProfileOnlyOption(err),
+		models.IsErrSecretNotExist(err):
+		status = 422
+	case models.IsErrInvalidTaskStatus(err):
+		status = 409
+	default:
+		log.Error(3, "%s: %v", title, err)
+		apiError(c, 500, "ErrInternal", "internal server error")
+		return
+	}
+
+	c.JSON(status, &APIError{
+		Type:    reflect.TypeOf(err).Name(),
+		Message: err.Error(),
+		Details: err,
+	})
+}
+
+// apiPaging returns page and page size from query parameters "page" and "limit".
+func apiPaging(c *context.Context) (page, limit int) {
+	page = c.QueryInt("page")
+	if page < 1 {
+		page = 1
+	}
+	limit = c.QueryInt("limit")
+	if limit < 1 {
+		limit = API_DEFAULT_PAGE_SIZE
+	} else if limit > API_MAX_PAGE_SIZE {
+		limit = API_MAX_PAGE_SIZE
+	}
+	return page, limit
+}
+
+// apiURL returns absolute URL of given link when external URL is set.
+func apiURL(link string) string {
+	if len(setting.Server.ExternalURL) == 0 {
+		return link
+	}
+	return setting.Server.ExternalURL + strings.TrimPrefix(link, "/")
+}
+
+// apiTime returns nil for zero unix time so that it is omitted in responses.
+func apiTime(unix int64) *time.Time {
+	if unix == 0 {
+		return nil
+	}
+	t := time.Unix(unix, 0)
+	return &t
+}
+
+// RequireAccessToken authenticates user by personal access token in header
+// "Authorization: token <token>" or "Authorization: Bearer <token>".
+// Session cookies are not accepted by REST API.
+func RequireAccessToken(c *context.Context) {
+	c.User = nil
+
+	fields := strings.Fields(c.Req.Header.Get("Authorization"))
+	if len(fields) != 2 || (!strings.EqualFold(fields[0], "token") && !strings.EqualFold(fields[0], "bearer")) {
+		apiError(c, 401, "ErrUnauthorized", "access token is required")
+		return
+	}
+
+	// Access tokens of users signed out by refresh of login source are deleted.
+	token, err := models.GetAccessTokenByToken(fields[1])
+	if err != nil {
+		if models.IsErrRecordNotFound(err) {
+			apiError(c, 401, "ErrUnauthorized", "invalid access token")
+		} else {
+			apiHandleErr(c, "GetAccessTokenByToken", err)
+		}
+		return
+	}
+
+	user, err := models.GetUserByID(token.UserID)
+	if err != nil {
+		if models.IsErrRecordNotFound(err) {
+			apiError(c, 401, "ErrUnauthorized", "invalid access token")
+		} else {
+			apiHandleErr(c, "GetUserByID", err)
+		}
+		return
+	} else if user.ProhibitLogin {
+		apiError(c, 401, "ErrUnauthorized", "user is prohibited to sign in")
+		return
+	}
+
+	if err = token.UpdateLastUsed(c.RemoteIP()); err != nil {
+		apiHandleErr(c, "UpdateLastUsed", err)
+		return
+	}
+
+	c.User = user
+}
+
+// ReqSignInOrAccessToken authenticates user by personal access token when header
+// "Authorization" is present, otherwise requires user to be signed in, so that
+// resources like artifacts can be downloaded by both browsers and API clients.
+func ReqSignInOrAccessToken(c *context.Context) {
+	if len(c.Req.Header.Get("Authorization")) > 0 {
+		RequireAccessToken(c)
+		return
+	}
+
+	if c.User == nil {
+		c.Session.Set(context.SESSION_KEY_REDIRECT_TO, c.Req.RequestURI)
+		c.Redirect("/login")
+	}
+}
+
+// apiReqRole responses 403 and returns false if current user does not have given role.
+func apiReqRole(c *context.Context, role models.Role) bool {
+	if !c.User.HasRole(role) {
+		apiError(c, 403, "ErrForbidden", "role '"+role.Name()+"' is required")
+		return false
+	}
+	return true
+}
+
+// apiReqProjectAccess responses 403 and returns false if current user does not have
+// given access mode to current project.
+func apiReqProjectAccess(c *context.Context, mode models.AccessMode) bool {
+	if c.ProjectAccess < mode {
+		apiError(c, 403, "ErrForbidden", "project access '"+mode.ToString()+"' is required")
+		return false
+	}
+	return true
+}
+
+// APIProjectAssignment assigns project in path to context,
+// projects without read access are treated as not exist.
+func APIProjectAssignment(c *context.Context) {
+	project, err := models.GetProjectByName(c.Params(":project"))
+	if err != nil {
+		apiHandleErr(c, "GetProjectByName", err)
+		return
+	}
+
+	c.ProjectAccess, err = project.UserAccessMode(c.User)
+	if err != nil {
+		apiHandleErr(c, "UserAccessMode", err)
+		return
+	} else if c.ProjectAccess < models.ACCESS_MODE_READ {
+		apiError(c, 404, "ErrNotFound", "resource does not exist")
+		return
+	}
+	c.Project = project
+}
+
+type APIBuilder struct {
+	ID            int64      `json:"id"`
+	Name          string     `json:"name"`
+	Owner         string     `json:"owner"`
+	Status        string     `json:"status"`
+	TrustLevel    string     `json:"trust_level"`
+	Mode          string     `json:"mode"`
+	Version       string     `json:"version"`
+	TaskID        int64      `json:"task_id"`
+	LastHeartBeat *time.Time `json:"last_heartbeat,omitempty"`
+	Created       time.Time  `json:"created"`
+	URL           string     `json:"html_url"`
+}
+
+func toAPIBuilder(b *models.Builder) *APIBuilder {
+	ab := &APIBuilder{
+		ID:            b.ID,
+		Name:          b.Name,
+		Status:        strings.ToLower(b.Status()),
+		TrustLevel:    strings.ToLower(b.TrustLevel.ToString()),
+		Mode:          strings.ToLower(b.Mode.ToString()),
+		Version:       b.Version,
+		TaskID:        b.TaskID,
+		LastHeartBeat: apiTime(b.LastHeartBeat),
+		Created:       b.CreatedTime(),
+		URL:           apiURL(fmt.Sprintf("/builders/%d", b.ID)),
+	}
+	if b.Owner != nil {
+		ab.Owner = b.Owner.Username
+	}
+	return ab
+}
+
+func APIListBuilders(c *context.Context) {
+	builders, err := models.ListBuilders()
+	if err != nil {
+		apiHandleErr(c, "ListBuilders", err)
+		return
+	}
+
+	page, limit := apiPaging(c)
+	total := len(builders)
+	start := (page - 1) * limit
+	if start > total {
+		start = total
+	}
+	end := start + limit
+	if end > total {
+		end = total
+	}
+
+	results := make([]*APIBuilder, 0, end-start)
+	for _, b := range builders[start:end] {
+		if err = b.GetOwner(); err != nil {
+			apiHandleErr(c, "GetOwner", err)
+			return
+		}
+		results = append(results, toAPIBuilder(b))
+	}
+	c.JSON(200, &APIPage{
+		Data:  results,
+		Page:  page,
+		Limit: limit,
+		Total: int64(total),
+	})
+}
+
+func APIGetBuilder(c *context.Context) {
+	builder, err := models.GetBuilderByID(c.ParamsInt64(":id"))
+	if err != nil {
+		apiHandleErr(c, "GetBuilderByID", err)
+		return
+	} else if err = builder.GetOwner(); err != nil {
+		apiHandleErr(c, "GetOwner", err)
+		return
+	}
+	c.JSON(200, toAPIBuilder(builder))
+}
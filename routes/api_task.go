@@ -0,0 +1,428 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package routes
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lubanstudio/luban/models"
+	"github.com/lubanstudio/luban/pkg/context"
+)
+
+var apiTaskStatuses = []models.TaskStatus{
+	models.TASK_STATUS_PENDING,
+	models.TASK_STATUS_BUILDING,
+	models.TASK_STATUS_UPLOADING,
+	models.TASK_STATUS_FAILED,
+	models.TASK_STATUS_SUCCEED,
+	models.TASK_STATUS_CANCELED,
+	models.TASK_STATUS_ARCHIVED,
+}
+
+type APITask struct {
+	ID        int64      `json:"id"`
+	Project   string     `json:"project"`
+	OS        string     `json:"os"`
+	Arch      string     `json:"arch"`
+	Tags      []string   `json:"tags"`
+	TagExpr   string     `json:"tag_expr"`
+	GoVersion string     `json:"go_version"`
+	CC        string     `json:"cc"`
+	Libc      string     `json:"libc"`
+	Ref       string     `json:"ref"`
+	Commit    string     `json:"commit"`
+	Status    string     `json:"status"`
+	Priority  int        `json:"priority"`
+	Poster    string     `json:"poster"`
+	BuilderID int64      `json:"builder_id"`
+	Created   time.Time  `json:"created"`
+	Started   *time.Time `json:"started,omitempty"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	URL       string     `json:"html_url"`
+}
+
+func toAPITask(t *models.Task) *APITask {
+	at := &APITask{
+		ID:        t.ID,
+		Project:   t.Project.Name,
+		OS:        t.OS,
+		Arch:      t.Arch,
+		Tags:      t.TagList(),
+		TagExpr:   t.TagExpr,
+		GoVersion: t.GoVersion,
+		CC:        t.CC,
+		Libc:      t.Libc,
+		Ref:       t.Ref,
+		Commit:    t.Commit,
+		Status:    strings.ToLower(t.Status.ToString()),
+		Priority:  t.Priority,
+		BuilderID: t.BuilderID,
+		Created:   t.CreatedTime(),
+		Started:   apiTime(t.Started),
+		Finished:  apiTime(t.Finished),
+		URL:       apiURL(t.Link()),
+	}
+	if t.Poster != nil {
+		at.Poster = t.Poster.Username
+	}
+	return at
+}
+
+func toAPITasks(tasks []*models.Task) []*APITask {
+	results := make([]*APITask, len(tasks))
+	for i := range tasks {
+		results[i] = toAPITask(tasks[i])
+	}
+	return results
+}
+
+type APIArtifact struct {
+	TaskID int64  `json:"task_id"`
+	Format string `json:"format"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	URL    string `json:"download_url"`
+}
+
+// taskArtifacts returns artifacts of the task in formats of its project
+// that have been uploaded.
+func taskArtifacts(t *models.Task) []*APIArtifact {
+	artifacts := make([]*APIArtifact, 0, 2)
+	if t.Status != models.TASK_STATUS_SUCCEED {
+		return artifacts
+	}
+
+	for _, format := range t.Project.PackFormatList() {
+		fi, err := os.Stat(t.ArtifactPath(format))
+		if err != nil {
+			continue
+		}
+		artifacts = append(artifacts, &APIArtifact{
+			TaskID: t.ID,
+			Format: format,
+			Name:   t.ArtifactName(format),
+			Size:   fi.Size(),
+			URL:    apiURL(t.ArtifactURL(format)),
+		})
+	}
+	return artifacts
+}
+
+// apiTaskSearchOptions builds search options from query parameters, which are
+// "project" (name), "status", "os", "arch", "ref" (full reference name),
+// "commit", "builder" (ID) and "poster" ("<source>:<username>"). Tasks are limited to
+// projects current user has read access to.
+func apiTaskSearchOptions(c *context.Context) (*models.TaskSearchOptions, bool) {
+	projects, err := models.ListAccessibleProjects(c.User, models.ACCESS_MODE_READ)
+	if err != nil {
+		apiHandleErr(c, "ListAccessibleProjects", err)
+		return nil, false
+	}
+
+	opts := &models.TaskSearchOptions{
+		BuilderID: c.QueryInt64("builder"),
+		OS:        c.Query("os"),
+		Arch:      c.Query("arch"),
+		Ref:       c.Query("ref"),
+		Commit:    c.Query("commit"),
+	}
+	opts.Page, opts.PageSize = apiPaging(c)
+
+	name := c.Query("project")
+	for _, p := range projects {
+		if len(name) == 0 || p.Name == name {
+			opts.ProjectIDs = append(opts.ProjectIDs, p.ID)
+		}
+	}
+	if len(name) > 0 && len(opts.ProjectIDs) == 0 {
+		apiError(c, 404, "ErrNotFound", "project does not exist")
+		return nil, false
+	}
+
+	if status := c.Query("status"); len(status) > 0 {
+		for i := range apiTaskStatuses {
+			if strings.ToLower(apiTaskStatuses[i].ToString()) == status {
+				opts.Status = &apiTaskStatuses[i]
+				break
+			}
+		}
+		if opts.Status == nil {
+			apiError(c, 422, "ErrInvalidQuery", "unknown task status: "+status)
+			return nil, false
+		}
+	}
+
+	if poster := c.Query("poster"); len(poster) > 0 {
+		u, err := models.GetUserByName(poster)
+		if err != nil {
+			if models.IsErrRecordNotFound(err) {
+				apiError(c, 404, "ErrNotFound", "poster does not exist")
+			} else {
+				apiHandleErr(c, "GetUserByName", err)
+			}
+			return nil, false
+		}
+		opts.PosterID = u.ID
+	}
+	return opts, true
+}
+
+func APIListTasks(c *context.Context) {
+	opts, ok := apiTaskSearchOptions(c)
+	if !ok {
+		return
+	}
+
+	tasks, total, err := models.SearchTasks(opts)
+	if err != nil {
+		apiHandleErr(c, "SearchTasks", err)
+		return
+	}
+	c.JSON(200, &APIPage{
+		Data:  toAPITasks(tasks),
+		Page:  opts.Page,
+		Limit: opts.PageSize,
+		Total: total,
+	})
+}
+
+// apiDecodeJSON decodes request body into v, an empty body is allowed
+// when optional is true.
+func apiDecodeJSON(c *context.Context, v interface{}, optional bool) bool {
+	err := json.NewDecoder(c.Req.Request.Body).Decode(v)
+	if err == nil || (err == io.EOF && optional) {
+		return true
+	}
+	apiError(c, 400, "ErrInvalidBody", "decode request body: "+err.Error())
+	return false
+}
+
+// APICreateTaskOption is the request body to create a task,
+// build options have the same format as the form of web UI.
+type APICreateTaskOption struct {
+	OS      string   `json:"os"`
+	Arch    string   `json:"arch"`
+	Tags    []string `json:"tags"`
+	TagExpr string   `json:"tag_expr"`
+	Ref     string   `json:"ref"`
+
+	GoVersion string `json:"go_version"`
+	CC        string `json:"cc"`
+	Libc      string `json:"libc"`
+
+	BuildFlags string `json:"build_flags"`
+	LDFlags    string `json:"ldflags"`
+}
+
+// APICreateTask creates a task in current project, an existing task that builds
+// the same thing is responded instead if it has not failed.
+func APICreateTask(c *context.Context) {
+	if !apiReqRole(c, models.ROLE_TASK_CREATOR) || !apiReqProjectAccess(c, models.ACCESS_MODE_WRITE) {
+		return
+	}
+
+	var opt APICreateTaskOption
+	if !apiDecodeJSON(c, &opt, false) {
+		return
+	} else if len(opt.OS) == 0 || len(opt.Arch) == 0 || len(opt.Ref) == 0 {
+		apiError(c, 422, "ErrInvalidBody", "os, arch and ref are required")
+		return
+	}
+
+	tc := models.Toolchain{
+		GoVersion: opt.GoVersion,
+		CC:        opt.CC,
+		Libc:      opt.Libc,
+	}
+	task, err := models.NewTask(c.User.ID, c.Project, opt.OS, opt.Arch, opt.Tags, opt.TagExpr, tc, opt.Ref, models.BuildOptions{
+		BuildFlags: opt.BuildFlags,
+		LDFlags:    opt.LDFlags,
+	})
+	if err != nil {
+		apiHandleErr(c, "NewTask", err)
+		return
+	}
+
+	if task.Poster == nil {
+		task.Poster = c.User
+	}
+	c.Audit(models.AUDIT_TASK_CREATE, task.AuditTarget(), nil, task)
+	c.JSON(201, toAPITask(task))
+}
+
+type APIBatchResult struct {
+	Profile  string     `json:"profile"`
+	Ref      string     `json:"ref"`
+	Commit   string     `json:"commit"`
+	Created  []*APITask `json:"created"`
+	Skipped  []*APITask `json:"skipped"`
+	Rejected []string   `json:"rejected"` // Entries that no builder matrix can take
+}
+
+// APICreateBatchTasks creates tasks of the batch profile in current project,
+// request body {"ref": "..."} is optional and defaults to default reference
+// of the profile.
+func APICreateBatchTasks(c *context.Context) {
+	if !apiReqRole(c, models.ROLE_RELEASE_MANAGER) || !apiReqProjectAccess(c, models.ACCESS_MODE_ADMIN) {
+		return
+	}
+
+	var opt struct {
+		Ref string `json:"ref"`
+	}
+	if !apiDecodeJSON(c, &opt, true) {
+		return
+	}
+
+	profile, err := models.GetBatchProfileByName(c.Project.ID, c.Params(":name"))
+	if err != nil {
+		apiHandleErr(c, "GetBatchProfileByName", err)
+		return
+	}
+
+	result, err := models.NewBatchTasks(c.User.ID, profile, opt.Ref)
+	if err != nil {
+		apiHandleErr(c, "NewBatchTasks", err)
+		return
+	}
+	c.Audit(models.AUDIT_BATCH_PROFILE_RUN, profile.AuditTarget(), nil, batchAuditValue(result))
+
+	rejected := make([]string, len(result.Rejected))
+	for i := range result.Rejected {
+		rejected[i] = result.Rejected[i].String()
+	}
+	c.JSON(201, &APIBatchResult{
+		Profile:  profile.Name,
+		Ref:      result.Ref,
+		Commit:   result.Commit,
+		Created:  toAPITasks(result.Created),
+		Skipped:  toAPITasks(result.Skipped),
+		Rejected: rejected,
+	})
+}
+
+// APITaskAssignment assigns task in path and its project to context,
+// tasks of projects without read access are treated as not exist.
+func APITaskAssignment(c *context.Context) {
+	task, err := models.GetTaskByID(c.ParamsInt64(":id"))
+	if err != nil {
+		apiHandleErr(c, "GetTaskByID", err)
+		return
+	}
+
+	c.ProjectAccess, err = task.Project.UserAccessMode(c.User)
+	if err != nil {
+		apiHandleErr(c, "UserAccessMode", err)
+		return
+	} else if c.ProjectAccess < models.ACCESS_MODE_READ {
+		apiError(c, 404, "ErrNotFound", "resource does not exist")
+		return
+	}
+	c.Project = task.Project
+	c.Task = task
+}
+
+func APIGetTask(c *context.Context) {
+	c.JSON(200, toAPITask(c.Task))
+}
+
+func APICancelTask(c *context.Context) {
+	if !apiReqRole(c, models.ROLE_TASK_CREATOR) || !apiReqProjectAccess(c, models.ACCESS_MODE_WRITE) {
+		return
+	}
+
+	before := taskStatusAuditValue(c.Task)
+	if err := c.Task.Cancel(); err != nil {
+		apiHandleErr(c, "Cancel", err)
+		return
+	}
+	c.Audit(models.AUDIT_TASK_CANCEL, c.Task.AuditTarget(), before, taskStatusAuditValue(c.Task))
+	c.JSON(200, toAPITask(c.Task))
+}
+
+func APIArchiveTask(c *context.Context) {
+	if !apiReqRole(c, models.ROLE_RELEASE_MANAGER) || !apiReqProjectAccess(c, models.ACCESS_MODE_ADMIN) {
+		return
+	}
+
+	before := taskStatusAuditValue(c.Task)
+	if err := c.Task.Archive(); err != nil {
+		apiHandleErr(c, "Archive", err)
+		return
+	}
+	c.Audit(models.AUDIT_TASK_ARCHIVE, c.Task.AuditTarget(), before, taskStatusAuditValue(c.Task))
+	c.JSON(200, toAPITask(c.Task))
+}
+
+func APITaskArtifacts(c *context.Context) {
+	c.JSON(200, taskArtifacts(c.Task))
+}
+
+// APITaskBuildLog responses build log of the task as plain text.
+func APITaskBuildLog(c *context.Context) {
+	data, err := ioutil.ReadFile(c.Task.BuildLogPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			apiError(c, 404, "ErrNotFound", "build log does not exist")
+		} else {
+			apiHandleErr(c, "ReadFile", err)
+		}
+		return
+	}
+
+	c.Resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	c.Resp.WriteHeader(200)
+	c.Resp.Write(data)
+}
+
+// APIListArtifacts lists artifacts of succeeded tasks, it accepts the same filters
+// as listing tasks except status, and pagination applies to tasks.
+func APIListArtifacts(c *context.Context) {
+	opts, ok := apiTaskSearchOptions(c)
+	if !ok {
+		return
+	}
+	status := models.TASK_STATUS_SUCCEED
+	opts.Status = &status
+
+	tasks, total, err := models.SearchTasks(opts)
+	if err != nil {
+		apiHandleErr(c, "SearchTasks", err)
+		return
+	}
+
+	type taskArtifact struct {
+		Task      *APITask       `json:"task"`
+		Artifacts []*APIArtifact `json:"artifacts"`
+	}
+	results := make([]*taskArtifact, len(tasks))
+	for i, t := range tasks {
+		results[i] = &taskArtifact{
+			Task:      toAPITask(t),
+			Artifacts: taskArtifacts(t),
+		}
+	}
+	c.JSON(200, &APIPage{
+		Data:  results,
+		Page:  opts.Page,
+		Limit: opts.PageSize,
+		Total: total,
+	})
+}
@@ -0,0 +1,238 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package routes
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"strconv"
+	"strings"
+	"time"
+
+	log "gopkg.in/clog.v1"
+
+	"github.com/lubanstudio/luban/models"
+	"github.com/lubanstudio/luban/pkg/context"
+)
+
+const (
+	auditLogsPageSize   = 50
+	auditLogsExportSize = 500
+	auditDateLayout     = "2006-01-02"
+)
+
+var auditTargetTypes = []string{
+	"user", "access_token", "project", "task", "batch_profile", "secret", "builder", "builder_token", "schedule",
+}
+
+// auditLogSearchOptions parses filters of audit logs from query parameters,
+// "since" and "until" are inclusive dates in the form of "YYYY-MM-DD".
+func auditLogSearchOptions(c *context.Context) (*models.AuditLogSearchOptions, error) {
+	opts := &models.AuditLogSearchOptions{
+		ActorName:  c.Query("actor"),
+		Action:     c.Query("action"),
+		TargetType: c.Query("target_type"),
+		TargetID:   c.QueryInt64("target_id"),
+	}
+	if since := c.Query("since"); len(since) > 0 {
+		t, err := time.ParseInLocation(auditDateLayout, since, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("invalid since date: %s", since)
+		}
+		opts.Since = t.Unix()
+	}
+	if until := c.Query("until"); len(until) > 0 {
+		t, err := time.ParseInLocation(auditDateLayout, until, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("invalid until date: %s", until)
+		}
+		opts.Until = t.AddDate(0, 0, 1).Unix()
+	}
+	return opts, nil
+}
+
+func AdminAuditLogs(c *context.Context) {
+	c.Data["Title"] = "Audit Log"
+	c.Data["AuditActions"] = models.AuditActions
+	c.Data["AuditTargetTypes"] = auditTargetTypes
+	c.Data["Query"] = c.Req.URL.Query()
+
+	opts, err := auditLogSearchOptions(c)
+	if err != nil {
+		c.Flash.Error(err.Error())
+		c.Redirect("/admin/audit")
+		return
+	}
+
+	// One more log is requested to know whether there is another page.
+	opts.BeforeID = c.QueryInt64("before")
+	opts.AfterID = c.QueryInt64("after")
+	opts.PageSize = auditLogsPageSize + 1
+	logs, total, err := models.SearchAuditLogs(opts)
+	if err != nil {
+		c.Handle(500, "SearchAuditLogs", err)
+		return
+	}
+	hasMore := len(logs) > auditLogsPageSize
+	isNewerPage := opts.BeforeID <= 0 && opts.AfterID > 0
+	if hasMore {
+		if isNewerPage {
+			logs = logs[1:]
+		} else {
+			logs = logs[:auditLogsPageSize]
+		}
+	}
+	c.Data["AuditLogs"] = logs
+	c.Data["Total"] = total
+
+	query := c.Req.URL.Query()
+	query.Del("before")
+	query.Del("after")
+	c.Data["FilterQuery"] = template.URL(query.Encode())
+	if len(logs) > 0 {
+		c.Data["HasNewerPage"] = opts.BeforeID > 0 || (isNewerPage && hasMore)
+		c.Data["HasOlderPage"] = isNewerPage || hasMore
+		c.Data["NewestID"] = logs[0].ID
+		c.Data["OldestID"] = logs[len(logs)-1].ID
+	}
+
+	c.HTML(200, "admin/audit")
+}
+
+// AuditLogExport is the exported form of an audit log.
+type AuditLogExport struct {
+	ID         int64           `json:"id"`
+	ActorID    int64           `json:"actor_id"`
+	ActorName  string          `json:"actor_name"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type"`
+	TargetID   int64           `json:"target_id"`
+	TargetName string          `json:"target_name"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	IP         string          `json:"ip"`
+	Created    time.Time       `json:"created"`
+}
+
+func toAuditLogExport(l *models.AuditLog) *AuditLogExport {
+	e := &AuditLogExport{
+		ID:         l.ID,
+		ActorID:    l.ActorID,
+		ActorName:  l.ActorName,
+		Action:     l.Action,
+		TargetType: l.TargetType,
+		TargetID:   l.TargetID,
+		TargetName: l.TargetName,
+		IP:         l.IP,
+		Created:    l.CreatedTime(),
+	}
+	if len(l.Before) > 0 {
+		e.Before = json.RawMessage(l.Before)
+	}
+	if len(l.After) > 0 {
+		e.After = json.RawMessage(l.After)
+	}
+	return e
+}
+
+// csvCell returns the value to be written to a CSV cell, values that start with
+// characters treated as formulas by spreadsheet applications are prefixed by "'",
+// because names and values of targets are given by users.
+func csvCell(value string) string {
+	if len(value) > 0 && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// ExportAuditLogs writes audit logs matched filters of the page as JSON or CSV
+// depends on query parameter "format", logs are read in batches so that the
+// whole log is never loaded into memory.
+func ExportAuditLogs(c *context.Context) {
+	opts, err := auditLogSearchOptions(c)
+	if err != nil {
+		c.PlainText(422, []byte(err.Error()))
+		return
+	}
+
+	format := c.QueryTrim("format")
+	switch format {
+	case "json":
+		c.Resp.Header().Set("Content-Type", "application/json; charset=utf-8")
+	case "csv":
+		c.Resp.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	default:
+		c.PlainText(422, []byte("format must be 'json' or 'csv'"))
+		return
+	}
+	c.Resp.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="audit-%s.%s"`, time.Now().Format("20060102150405"), format))
+
+	var (
+		enc   = json.NewEncoder(c.Resp)
+		w     = csv.NewWriter(c.Resp)
+		count int
+	)
+	if format == "json" {
+		c.Resp.Write([]byte("["))
+	} else {
+		w.Write([]string{"id", "created", "actor_id", "actor_name", "action", "target_type", "target_id", "target_name", "before", "after", "ip"})
+	}
+
+	opts.PageSize = auditLogsExportSize
+	for {
+		logs, _, err := models.SearchAuditLogs(opts)
+		if err != nil {
+			// Response has been partly written, the best we can do is to stop.
+			log.Error(2, "SearchAuditLogs: %v", err)
+			break
+		}
+
+		for _, l := range logs {
+			if format == "json" {
+				if count > 0 {
+					c.Resp.Write([]byte(","))
+				}
+				enc.Encode(toAuditLogExport(l))
+			} else {
+				w.Write([]string{
+					strconv.FormatInt(l.ID, 10),
+					l.CreatedTime().Format(time.RFC3339),
+					strconv.FormatInt(l.ActorID, 10),
+					csvCell(l.ActorName),
+					csvCell(l.Action),
+					csvCell(l.TargetType),
+					strconv.FormatInt(l.TargetID, 10),
+					csvCell(l.TargetName),
+					csvCell(l.Before),
+					csvCell(l.After),
+					csvCell(l.IP),
+				})
+			}
+			count++
+		}
+		if len(logs) < opts.PageSize {
+			break
+		}
+		opts.BeforeID = logs[len(logs)-1].ID
+	}
+
+	if format == "json" {
+		c.Resp.Write([]byte("]"))
+	} else {
+		w.Flush()
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package routes
+
+import (
+	"fmt"
+
+	"github.com/lubanstudio/luban/models"
+	"github.com/lubanstudio/luban/pkg/context"
+	"github.com/lubanstudio/luban/pkg/form"
+)
+
+func BatchProfiles(c *context.Context) {
+	c.Data["Title"] = "Batch Profiles"
+
+	profiles, err := models.ListBatchProfiles(c.Project.ID)
+	if err != nil {
+		c.Handle(500, "ListBatchProfiles", err)
+		return
+	}
+	c.Data["Profiles"] = profiles
+
+	c.HTML(200, "batch/list")
+}
+
+func NewBatchProfile(c *context.Context) {
+	c.Data["Title"] = "New Batch Profile"
+	c.Data["default_ref"] = "master"
+	c.HTML(200, "batch/new")
+}
+
+func NewBatchProfilePost(c *context.Context, f form.BatchProfile) {
+	c.Data["Title"] = "New Batch Profile"
+
+	if c.HasError() {
+		c.HTML(200, "batch/new")
+		return
+	}
+
+	entries, err := models.ParseBatchEntries(f.Entries)
+	if err != nil {
+		c.Data["Err_Entries"] = true
+		c.RenderWithErr(err.Error(), "batch/new", f)
+		return
+	}
+
+	profile := &models.BatchProfile{
+		ProjectID:   c.Project.ID,
+		Project:     c.Project,
+		Name:        f.Name,
+		DefaultRef:  f.DefaultRef,
+		Priority:    f.Priority,
+		WebhookRefs: f.WebhookRefs,
+		BuildOptions: models.BuildOptions{
+			BuildFlags:   f.BuildFlags,
+			LDFlags:      f.LDFlags,
+			Envs:         f.Envs,
+			PreBuildCmds: f.PreBuildCmds,
+			Secrets:      f.Secrets,
+		},
+		Entries: entries,
+	}
+	if err = models.NewBatchProfile(profile); err != nil {
+		if models.IsErrBatchProfileExists(err) {
+			c.Data["Err_Name"] = true
+			c.RenderWithErr("Batch profile name has been used.", "batch/new", f)
+		} else if models.IsErrInvalidBuildEnv(err) {
+			c.Data["Err_Envs"] = true
+			c.RenderWithErr(err.Error(), "batch/new", f)
+		} else if models.IsErrSecretNotExist(err) {
+			c.Data["Err_Secrets"] = true
+			c.RenderWithErr(err.Error(), "batch/new", f)
+		} else {
+			c.Handle(500, "NewBatchProfile", err)
+		}
+		return
+	}
+	c.Audit(models.AUDIT_BATCH_PROFILE_CREATE, profile.AuditTarget(), nil, profile)
+
+	c.Redirect(fmt.Sprintf("%s/batches/%d/edit", c.Project.Link(), profile.ID))
+}
+
+// batchAuditValue returns summary of batch tasks to be recorded in audit log.
+func batchAuditValue(result *models.BatchResult) map[string]interface{} {
+	created := make([]int64, len(result.Created))
+	for i := range result.Created {
+		created[i] = result.Created[i].ID
+	}
+	return map[string]interface{}{
+		"ref":      result.Ref,
+		"commit":   result.Commit,
+		"created":  created,
+		"skipped":  len(result.Skipped),
+		"rejected": len(result.Rejected),
+	}
+}
+
+func parseBatchProfileParams(c *context.Context) *models.BatchProfile {
+	profile, err := models.GetBatchProfileByID(c.ParamsInt64(":id"))
+	if err != nil {
+		if models.IsErrRecordNotFound(err) {
+			c.NotFound()
+		} else {
+			c.Handle(500, "GetBatchProfileByID", err)
+		}
+		return nil
+	} else if profile.ProjectID != c.Project.ID {
+		c.NotFound()
+		return nil
+	}
+	return profile
+}
+
+func EditBatchProfile(c *context.Context) {
+	profile := parseBatchProfileParams(c)
+	if c.Written() {
+		return
+	}
+	c.Data["Profile"] = profile
+
+	c.Data["Title"] = profile.Name + " - Batch Profile"
+	c.HTML(200, "batch/edit")
+}
+
+func EditBatchProfilePost(c *context.Context, f form.BatchProfile) {
+	profile := parseBatchProfileParams(c)
+	if c.Written() {
+		return
+	}
+	c.Data["Profile"] = profile
+
+	if c.HasError() {
+		c.HTML(200, "batch/edit")
+		return
+	}
+
+	entries, err := models.ParseBatchEntries(f.Entries)
+	if err != nil {
+		c.Data["Err_Entries"] = true
+		c.RenderWithErr(err.Error(), "batch/edit", f)
+		return
+	}
+
+	before := *profile
+	profile.Name = f.Name
+	profile.DefaultRef = f.DefaultRef
+	profile.Priority = f.Priority
+	profile.WebhookRefs = f.WebhookRefs
+	profile.BuildFlags = f.BuildFlags
+	profile.LDFlags = f.LDFlags
+	profile.Envs = f.Envs
+	profile.PreBuildCmds = f.PreBuildCmds
+	profile.Secrets = f.Secrets
+	profile.Entries = entries
+	if err = profile.Save(); err != nil {
+		if models.IsErrBatchProfileExists(err) {
+			c.Data["Err_Name"] = true
+			c.RenderWithErr("Batch profile name has been used.", "batch/edit", f)
+		} else if models.IsErrInvalidBuildEnv(err) {
+			c.Data["Err_Envs"] = true
+			c.RenderWithErr(err.Error(), "batch/edit", f)
+		} else if models.IsErrSecretNotExist(err) {
+			c.Data["Err_Secrets"] = true
+			c.RenderWithErr(err.Error(), "batch/edit", f)
+		} else {
+			c.Handle(500, "profile.Save", err)
+		}
+		return
+	}
+	c.Audit(models.AUDIT_BATCH_PROFILE_UPDATE, profile.AuditTarget(), before, profile)
+
+	c.Redirect(fmt.Sprintf("%s/batches/%d/edit", c.Project.Link(), profile.ID))
+}
+
+func DeleteBatchProfile(c *context.Context) {
+	profile := parseBatchProfileParams(c)
+	if c.Written() {
+		return
+	}
+
+	if err := models.DeleteBatchProfileByID(profile.ID); err != nil {
+		if models.IsErrBatchProfileInUse(err) {
+			c.Flash.Error("Batch profile is still used by schedules.")
+			c.Redirect(fmt.Sprintf("%s/batches/%d/edit", c.Project.Link(), profile.ID))
+		} else {
+			c.Handle(500, "DeleteBatchProfileByID", err)
+		}
+		return
+	}
+	c.Audit(models.AUDIT_BATCH_PROFILE_DELETE, profile.AuditTarget(), profile, nil)
+
+	c.Redirect(c.Project.Link() + "/batches")
+}
@@ -16,6 +16,7 @@ package routes
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/lubanstudio/luban/models"
 	"github.com/lubanstudio/luban/pkg/context"
@@ -25,16 +26,52 @@ import (
 func Builders(ctx *context.Context) {
 	ctx.Data["Title"] = "Builders"
 
-	builders, err := models.ListBuilders()
+	var builders []*models.Builder
+	var err error
+	if ctx.Query("type") == "mine" {
+		ctx.Data["PageIsMine"] = true
+		builders, err = models.ListOwnedBuilders(ctx.User.ID)
+	} else {
+		builders, err = models.ListBuilders()
+	}
 	if err != nil {
 		ctx.Handle(500, "ListBuilders", err)
 		return
 	}
+	for _, b := range builders {
+		if err = b.GetOwner(); err != nil {
+			ctx.Handle(500, "GetOwner", err)
+			return
+		}
+	}
 	ctx.Data["Builders"] = builders
 
+	if ctx.User.IsAdmin() {
+		ctx.Data["NumPendingBuilders"] = models.CountPendingBuilders()
+	}
+
 	ctx.HTML(200, "builder/list")
 }
 
+func PendingBuilders(ctx *context.Context) {
+	ctx.Data["Title"] = "Pending Builders"
+
+	builders, err := models.ListPendingBuilders()
+	if err != nil {
+		ctx.Handle(500, "ListPendingBuilders", err)
+		return
+	}
+	for _, b := range builders {
+		if err = b.GetOwner(); err != nil {
+			ctx.Handle(500, "GetOwner", err)
+			return
+		}
+	}
+	ctx.Data["Builders"] = builders
+
+	ctx.HTML(200, "builder/pending")
+}
+
 func NewBuilder(ctx *context.Context) {
 	ctx.Data["Title"] = "New Builder"
 	ctx.HTML(200, "builder/new")
@@ -48,7 +85,7 @@ func NewBuilderPost(ctx *context.Context, form form.NewBuilder) {
 		return
 	}
 
-	builder, err := models.NewBuilder(form.Name)
+	builder, token, err := models.NewBuilder(ctx.User, form.Name)
 	if err != nil {
 		if models.IsErrBuilderExists(err) {
 			ctx.Data["Err_Name"] = true
@@ -58,75 +95,307 @@ func NewBuilderPost(ctx *context.Context, form form.NewBuilder) {
 		}
 		return
 	}
+	ctx.Audit(models.AUDIT_BUILDER_CREATE, builder.AuditTarget(), nil, builder)
 
+	if !builder.IsApproved() {
+		ctx.Flash.Success("Builder has been registered, it will not take any task until approved by admins.")
+	}
+	setNewBuilderToken(ctx, builder.ID, token)
 	ctx.Redirect(fmt.Sprintf("/builders/%d/edit", builder.ID))
 }
 
-func parseBuilderParams(ctx *context.Context) *models.Builder {
-	builder, err := models.GetBuilderByID(ctx.ParamsInt64(":id"))
+func ViewBuilder(ctx *context.Context) {
+	builder := ctx.Builder
+	if err := builder.GetOwner(); err != nil {
+		ctx.Handle(500, "GetOwner", err)
+		return
+	}
+
+	// Builders take tasks of all projects, only tasks of projects the user
+	// has access to are shown.
+	projects, err := models.ListAccessibleProjects(ctx.User, models.ACCESS_MODE_READ)
 	if err != nil {
-		if models.IsErrRecordNotFound(err) {
-			ctx.NotFound()
-		} else {
-			ctx.Handle(500, "GetBuilderByID", err)
+		ctx.Handle(500, "ListAccessibleProjects", err)
+		return
+	}
+	projectIDs := make([]int64, len(projects))
+	accessible := make(map[int64]bool, len(projects))
+	for i, p := range projects {
+		projectIDs[i] = p.ID
+		accessible[p.ID] = true
+	}
+
+	if builder.TaskID > 0 {
+		task, err := models.GetTaskByID(builder.TaskID)
+		if err == nil {
+			if accessible[task.ProjectID] {
+				ctx.Data["CurrentTask"] = task
+			} else {
+				ctx.Data["HasHiddenTask"] = true
+			}
+		} else if !models.IsErrRecordNotFound(err) {
+			ctx.Handle(500, "GetTaskByID", err)
+			return
 		}
-		return nil
 	}
-	return builder
+
+	matrices, err := models.ListBuilderMatrices(builder.ID)
+	if err != nil {
+		ctx.Handle(500, "ListBuilderMatrices", err)
+		return
+	}
+	ctx.Data["Matrices"] = matrices
+
+	tasks, err := models.ListBuilderTasks(builder.ID, projectIDs, 20)
+	if err != nil {
+		ctx.Handle(500, "ListBuilderTasks", err)
+		return
+	}
+	ctx.Data["Tasks"] = tasks
+
+	stats, err := models.GetBuilderStats(builder.ID)
+	if err != nil {
+		ctx.Handle(500, "GetBuilderStats", err)
+		return
+	}
+	ctx.Data["Stats"] = stats
+
+	histories, err := models.ListHeartBeatHistories(builder.ID, 20)
+	if err != nil {
+		ctx.Handle(500, "ListHeartBeatHistories", err)
+		return
+	}
+	ctx.Data["HeartBeatHistories"] = histories
+
+	ctx.Data["Title"] = builder.Name + " - Builder"
+	ctx.HTML(200, "builder/view")
+}
+
+func newBuilderTokenSessionKey(builderID int64) string {
+	return fmt.Sprintf("new_builder_token_%d", builderID)
+}
+
+// setNewBuilderToken saves plain token in session to be shown once on edit page.
+func setNewBuilderToken(ctx *context.Context, builderID int64, token string) {
+	ctx.Session.Set(newBuilderTokenSessionKey(builderID), token)
+}
+
+func prepareMatrixHistories(ctx *context.Context) bool {
+	histories, err := models.ListMatrixHistories(ctx.Builder.ID, 20)
+	if err != nil {
+		ctx.Handle(500, "ListMatrixHistories", err)
+		return false
+	}
+	ctx.Data["MatrixHistories"] = histories
+
+	tokens, err := models.ListBuilderTokens(ctx.Builder.ID)
+	if err != nil {
+		ctx.Handle(500, "ListBuilderTokens", err)
+		return false
+	}
+	ctx.Data["Tokens"] = tokens
+	ctx.Data["BuilderScopes"] = models.BuilderScopes
+	return true
 }
 
 func EditBuilder(ctx *context.Context) {
-	builder := parseBuilderParams(ctx)
-	if ctx.Written() {
+	if !prepareMatrixHistories(ctx) {
 		return
 	}
-	ctx.Data["Builder"] = builder
 
-	ctx.Data["Title"] = builder.Name + " - Builder"
+	key := newBuilderTokenSessionKey(ctx.Builder.ID)
+	if token, ok := ctx.Session.Get(key).(string); ok {
+		ctx.Data["NewToken"] = token
+		ctx.Session.Delete(key)
+	}
+
+	ctx.Data["Title"] = ctx.Builder.Name + " - Builder"
 	ctx.HTML(200, "builder/edit")
 }
 
 func EditBuilderPost(ctx *context.Context, form form.NewBuilder) {
-	builder := parseBuilderParams(ctx)
-	if ctx.Written() {
+	builder := ctx.Builder
+	ctx.Data["Title"] = builder.Name + " - Builder"
+
+	if !prepareMatrixHistories(ctx) {
 		return
 	}
-	ctx.Data["Builder"] = builder
 
 	if ctx.HasError() {
 		ctx.HTML(200, "builder/edit")
 		return
 	}
 
+	before := *builder
 	builder.Name = form.Name
-	builder.TrustLevel = models.ParseTrustLevel(form.TrustLevel)
+	// Trust level and allowlists are only managed by admins.
+	if ctx.User.IsAdmin() {
+		builder.TrustLevel = models.ParseTrustLevel(form.TrustLevel)
+		builder.AllowedOSs = form.AllowedOSs
+		builder.AllowedArchs = form.AllowedArchs
+		builder.AllowedTags = form.AllowedTags
+		builder.CertSubject = form.CertSubject
+		builder.CertFingerprint = models.NormalizeCertFingerprint(form.CertFingerprint)
+	}
 	if err := builder.Save(); err != nil {
 		if models.IsErrBuilderExists(err) {
 			ctx.Data["Err_Name"] = true
 			ctx.RenderWithErr("Builder name has been used.", "builder/edit", form)
+		} else if models.IsErrBuilderCertExists(err) {
+			ctx.Data["Err_CertFingerprint"] = true
+			ctx.RenderWithErr("Certificate fingerprint has been used by another builder.", "builder/edit", form)
+		} else if models.IsErrBuilderCertSubjectExists(err) {
+			ctx.Data["Err_CertSubject"] = true
+			ctx.RenderWithErr("Certificate subject has been used by another builder.", "builder/edit", form)
 		} else {
 			ctx.Handle(500, "builder.Save", err)
 		}
 		return
 	}
+	ctx.Audit(models.AUDIT_BUILDER_UPDATE, builder.AuditTarget(), before, builder)
 
 	ctx.Redirect(fmt.Sprintf("/builders/%d/edit", builder.ID))
 }
 
-func RegenerateBuilderToken(ctx *context.Context) {
-	if err := models.RegenerateBuilderToken(ctx.ParamsInt64(":id")); err != nil {
-		ctx.Handle(500, "RegenerateBuilderToken", err)
+const maintenanceTimeLayout = "2006-01-02T15:04"
+
+func parseMaintenanceTime(value string) (time.Time, error) {
+	if len(value) == 0 {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation(maintenanceTimeLayout, value, time.Local)
+}
+
+func UpdateBuilderMaintenance(ctx *context.Context, form form.BuilderMaintenance) {
+	builder := ctx.Builder
+	ctx.Data["Title"] = builder.Name + " - Builder"
+
+	if !prepareMatrixHistories(ctx) {
+		return
+	}
+
+	start, err := parseMaintenanceTime(form.MaintenanceStart)
+	if err != nil {
+		ctx.Data["Err_MaintenanceStart"] = true
+		ctx.RenderWithErr(fmt.Sprintf("Invalid maintenance start time: %v", err), "builder/edit", nil)
+		return
+	}
+	end, err := parseMaintenanceTime(form.MaintenanceEnd)
+	if err != nil {
+		ctx.Data["Err_MaintenanceEnd"] = true
+		ctx.RenderWithErr(fmt.Sprintf("Invalid maintenance end time: %v", err), "builder/edit", nil)
+		return
+	}
+
+	before := *builder
+	if err = builder.SetMaintenance(start, end); err != nil {
+		if models.IsErrInvalidMaintenanceWindow(err) {
+			ctx.Data["Err_MaintenanceEnd"] = true
+			ctx.RenderWithErr("Maintenance window must end after it starts.", "builder/edit", nil)
+		} else {
+			ctx.Handle(500, "SetMaintenance", err)
+		}
+		return
+	}
+
+	if err = builder.SetMode(models.ParseBuilderMode(form.Mode)); err != nil {
+		ctx.Handle(500, "SetMode", err)
+		return
+	}
+	ctx.Audit(models.AUDIT_BUILDER_UPDATE_MAINTENANCE, builder.AuditTarget(), before, builder)
+
+	ctx.Flash.Success("Builder maintenance settings have been updated.")
+	ctx.Redirect(fmt.Sprintf("/builders/%d/edit", builder.ID))
+}
+
+func ApproveBuilder(ctx *context.Context) {
+	if ctx.Builder.IsDeleted() {
+		ctx.NotFound()
+		return
+	}
+
+	if !ctx.Builder.IsApproved() {
+		before := *ctx.Builder
+		ctx.Builder.TrustLevel = models.TRUST_LEVEL_APPROVED
+		if err := ctx.Builder.Save(); err != nil {
+			ctx.Handle(500, "Save", err)
+			return
+		}
+		ctx.Audit(models.AUDIT_BUILDER_APPROVE, ctx.Builder.AuditTarget(), before, ctx.Builder)
+	}
+
+	ctx.Flash.Success(fmt.Sprintf("Builder '%s' has been approved.", ctx.Builder.Name))
+	ctx.Redirect("/builders/pending")
+}
+
+func NewBuilderTokenPost(ctx *context.Context, form form.BuilderToken) {
+	t, token, err := models.NewBuilderToken(ctx.Builder.ID, form.Scopes)
+	if err != nil {
+		if models.IsErrInvalidBuilderScope(err) {
+			ctx.Flash.Error("At least one valid scope must be selected.")
+		} else {
+			ctx.Handle(500, "NewBuilderToken", err)
+			return
+		}
+	} else {
+		ctx.Audit(models.AUDIT_BUILDER_TOKEN_CREATE, t.AuditTarget(), nil, t)
+		setNewBuilderToken(ctx, ctx.Builder.ID, token)
+	}
+
+	ctx.Redirect(fmt.Sprintf("/builders/%d/edit", ctx.Builder.ID))
+}
+
+func parseBuilderTokenParams(ctx *context.Context) *models.BuilderToken {
+	token, err := models.GetBuilderTokenByID(ctx.Builder.ID, ctx.ParamsInt64(":tid"))
+	if err != nil {
+		if models.IsErrRecordNotFound(err) {
+			ctx.NotFound()
+		} else {
+			ctx.Handle(500, "GetBuilderTokenByID", err)
+		}
+		return nil
+	}
+	return token
+}
+
+func RotateBuilderToken(ctx *context.Context, form form.RotateBuilderToken) {
+	token := parseBuilderTokenParams(ctx)
+	if ctx.Written() {
+		return
+	}
+
+	nt, plain, err := token.Rotate(time.Duration(form.Grace) * time.Hour)
+	if err != nil {
+		ctx.Handle(500, "Rotate", err)
+		return
+	}
+	ctx.Audit(models.AUDIT_BUILDER_TOKEN_ROTATE, token.AuditTarget(), token, nt)
+	setNewBuilderToken(ctx, ctx.Builder.ID, plain)
+
+	ctx.Redirect(fmt.Sprintf("/builders/%d/edit", ctx.Builder.ID))
+}
+
+func DeleteBuilderToken(ctx *context.Context) {
+	token := parseBuilderTokenParams(ctx)
+	if ctx.Written() {
+		return
+	}
+
+	if err := models.DeleteBuilderToken(ctx.Builder.ID, token.ID); err != nil {
+		ctx.Handle(500, "DeleteBuilderToken", err)
 		return
 	}
+	ctx.Audit(models.AUDIT_BUILDER_TOKEN_DELETE, token.AuditTarget(), token, nil)
 
-	ctx.Redirect(fmt.Sprintf("/builders/%d/edit", ctx.ParamsInt64(":id")))
+	ctx.Redirect(fmt.Sprintf("/builders/%d/edit", ctx.Builder.ID))
 }
 
 func DeleteBuilder(ctx *context.Context) {
-	if err := models.DeleteBuilderByID(ctx.ParamsInt64(":id")); err != nil {
+	if err := models.DeleteBuilderByID(ctx.Builder.ID); err != nil {
 		ctx.Handle(500, "DeleteBuilderByID", err)
 		return
 	}
+	ctx.Audit(models.AUDIT_BUILDER_DELETE, ctx.Builder.AuditTarget(), ctx.Builder, nil)
 
 	ctx.Redirect("/builders")
 }
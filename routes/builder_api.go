@@ -17,28 +17,96 @@ package routes
 import (
 	"encoding/json"
 	"io"
+	"net/http"
 	"os"
 	"path"
-	"sort"
 	"strings"
 
+	"github.com/Unknwon/com"
 	log "gopkg.in/clog.v1"
+	"gopkg.in/macaron.v1"
 
 	"github.com/lubanstudio/luban/models"
 	"github.com/lubanstudio/luban/pkg/context"
 	"github.com/lubanstudio/luban/pkg/setting"
 )
 
+// RequireBuilderToken authenticates builder by client certificate verified by builder
+// TLS listener, or by token in header "X-LUBAN-TOKEN".
 func RequireBuilderToken(ctx *context.Context) {
-	var err error
-	ctx.Builder, err = models.GetBuilderByToken(ctx.Req.Header.Get("X-LUBAN-TOKEN"))
+	if ctx.Req.TLS != nil && len(ctx.Req.TLS.VerifiedChains) > 0 {
+		builder, err := models.GetBuilderByCertificate(ctx.Req.TLS.VerifiedChains[0][0])
+		if err != nil {
+			if models.IsErrRecordNotFound(err) {
+				ctx.Status(403)
+			} else if models.IsErrBuilderCertSubjectExists(err) {
+				log.Warn("Client certificate is rejected: %v", err)
+				ctx.Status(403)
+			} else {
+				ctx.Error("GetBuilderByCertificate: %v", err)
+			}
+			return
+		}
+		ctx.Builder = builder
+		return
+	}
+
+	token, err := models.GetBuilderTokenByToken(ctx.Req.Header.Get("X-LUBAN-TOKEN"))
+	if err != nil {
+		if models.IsErrRecordNotFound(err) {
+			ctx.Status(403)
+		} else {
+			ctx.Error("GetBuilderTokenByToken: %v", err)
+		}
+		return
+	}
+
+	builder, err := models.GetBuilderByID(token.BuilderID)
 	if err != nil {
 		if models.IsErrRecordNotFound(err) {
 			ctx.Status(403)
 		} else {
-			ctx.Error("GetBuilderByToken: %v", err)
+			ctx.Error("GetBuilderByID: %v", err)
 		}
 		return
+	} else if builder.IsDeleted() {
+		ctx.Status(403)
+		return
+	}
+
+	if err = token.UpdateLastUsed(ctx.RemoteIP()); err != nil {
+		ctx.Error("UpdateLastUsed: %v", err)
+		return
+	}
+
+	ctx.Builder = builder
+	ctx.BuilderToken = token
+}
+
+// LimitBodySize limits size of request body to given megabytes, 0 means no limit.
+func LimitBodySize(mb int64) macaron.Handler {
+	return func(ctx *context.Context) {
+		if mb <= 0 {
+			return
+		}
+
+		limit := mb << 20
+		if ctx.Req.ContentLength > limit {
+			ctx.Status(413)
+			return
+		}
+		ctx.Req.Request.Body = http.MaxBytesReader(ctx.Resp, ctx.Req.Request.Body, limit)
+	}
+}
+
+// RequireBuilderScope requires token of current builder to have given scope,
+// builders authenticated by client certificates have all scopes.
+func RequireBuilderScope(scope string) macaron.Handler {
+	return func(ctx *context.Context) {
+		if ctx.BuilderToken != nil && !ctx.BuilderToken.HasScope(scope) {
+			ctx.Status(403)
+			return
+		}
 	}
 }
 
@@ -57,17 +125,25 @@ func UpdateMatrix(ctx *context.Context) {
 
 	matrices := make([]*models.Matrix, 0, 5)
 	for _, raw := range rawMatrices {
-		sort.Strings(raw.Tags)
 		for _, arch := range raw.Archs {
 			matrices = append(matrices, &models.Matrix{
 				OS:   raw.OS,
 				Arch: arch,
-				Tags: strings.Join(raw.Tags, ","),
+				Tags: raw.Tags,
+				Toolchain: models.Toolchain{
+					GoVersion: strings.TrimPrefix(raw.GoVersion, "go"),
+					CC:        raw.CC,
+					Libc:      raw.Libc,
+				},
 			})
 		}
 	}
 
 	if err = ctx.Builder.UpdateMatrices(matrices); err != nil {
+		if models.IsErrMatrixNotAllowed(err) {
+			ctx.Context.Error(422, err.Error())
+			return
+		}
 		ctx.Error("UpdateMatrices: %v", err)
 		return
 	}
@@ -80,7 +156,7 @@ func HeartBeat(ctx *context.Context) {
 	log.Trace("Hearrbeat from builder '%d': %s", ctx.Builder.ID, status)
 
 	isIdle := status == "IDLE"
-	if err := ctx.Builder.HeartBeat(isIdle && ctx.Builder.TaskID == 0); err != nil {
+	if err := ctx.Builder.HeartBeat(isIdle && ctx.Builder.TaskID == 0, status, ctx.Req.Header.Get("X-LUBAN-VERSION")); err != nil {
 		log.Error(4, "HeartBeat [%d]: %v", ctx.Builder.ID, err)
 		ctx.Error("HeartBeat: %v", err)
 		return
@@ -96,18 +172,39 @@ func HeartBeat(ctx *context.Context) {
 				return
 			}
 
+			secrets, withheld, err := task.DeliverableSecrets(ctx.Builder)
+			if err != nil {
+				ctx.Error("DeliverableSecrets [%d]: %v", task.ID, err)
+				return
+			} else if len(withheld) > 0 {
+				log.Warn("Secrets withheld from builder '%d' for task '%d': %s", ctx.Builder.ID, task.ID, strings.Join(withheld, ", "))
+			}
+
+			// Updated time is when the task was assigned, which is used as build time.
 			ctx.Resp.Header().Set("X-LUBAN-TASK", "ASSIGN")
 			ctx.JSON(200, map[string]interface{}{
-				"import_path":  setting.Project.ImportPath,
-				"pack_root":    setting.Project.PackRoot,
-				"pack_entries": setting.Project.PackEntries,
-				"pack_formats": setting.Project.PackFormats,
+				"project":      task.Project.Name,
+				"clone_url":    task.Project.CloneURL,
+				"import_path":  task.Project.ImportPath,
+				"pack_root":    task.Project.PackRoot,
+				"pack_entries": task.Project.PackEntryList(),
+				"pack_formats": task.Project.PackFormatList(),
 				"task": map[string]interface{}{
-					"id":     task.ID,
-					"os":     task.OS,
-					"arch":   task.Arch,
-					"tags":   task.Tags,
-					"commit": task.Commit,
+					"id":             task.ID,
+					"os":             task.OS,
+					"arch":           task.Arch,
+					"tags":           task.Tags,
+					"tag_expr":       task.TagExpr,
+					"go_version":     task.GoVersion,
+					"cc":             task.CC,
+					"libc":           task.Libc,
+					"ref":            task.Ref,
+					"commit":         task.Commit,
+					"build_flags":    task.BuildFlagList(),
+					"ldflags":        task.ExpandLDFlags(task.UpdatedTime()),
+					"envs":           task.EnvList(),
+					"pre_build_cmds": task.PreBuildCmdList(),
+					"secrets":        secrets,
 				},
 			})
 		} else {
@@ -116,6 +213,13 @@ func HeartBeat(ctx *context.Context) {
 		return
 	}
 
+	// Task has been requeued after the builder was disabled.
+	if ctx.Builder.TaskID == 0 {
+		ctx.Resp.Header().Set("X-LUBAN-TASK", "CANCEL")
+		ctx.Status(204)
+		return
+	}
+
 	task, err := models.GetTaskByID(ctx.Builder.TaskID)
 	if err != nil {
 		ctx.Error("GetTaskByID [%d]: %v", ctx.Builder.TaskID, err)
@@ -144,12 +248,52 @@ func HeartBeat(ctx *context.Context) {
 	ctx.Status(204)
 }
 
+// UploadBuildLog receives the full build log of current task, which replaces
+// previously uploaded one. Log must be uploaded as a whole so that secret values
+// would not be split across uploads and escape from redaction.
+func UploadBuildLog(ctx *context.Context) {
+	task, err := models.GetTaskByID(ctx.Builder.TaskID)
+	if err != nil {
+		if models.IsErrRecordNotFound(err) {
+			ctx.Status(404)
+		} else {
+			ctx.Error("GetTaskByID: %v", err)
+		}
+		return
+	}
+
+	// Body is limited by LimitBodySize, reading fails when the log is too large.
+	data, err := ctx.Req.Body().Bytes()
+	if err != nil {
+		ctx.PlainText(400, []byte(err.Error()))
+		return
+	}
+
+	if err = task.SaveBuildLog(data); err != nil {
+		ctx.Error("SaveBuildLog: %v", err)
+		return
+	}
+
+	ctx.Status(204)
+}
+
 func UploadArtifact(ctx *context.Context) {
 	log.Trace("Receiving artifact from builder '%d' for task '%d'", ctx.Builder.ID, ctx.Builder.TaskID)
 
 	task, err := models.GetTaskByID(ctx.Builder.TaskID)
 	if err != nil {
-		ctx.Error("GetTaskByID: %v", err)
+		if models.IsErrRecordNotFound(err) {
+			ctx.Status(404)
+		} else {
+			ctx.Error("GetTaskByID: %v", err)
+		}
+		return
+	}
+
+	// Format is part of the file name, only ones configured by the project are accepted.
+	format := ctx.Req.Header.Get("X-LUBAN-FORMAT")
+	if !com.IsSliceContainsStr(task.Project.PackFormatList(), format) {
+		ctx.PlainText(400, []byte("unsupported format: "+format))
 		return
 	}
 
@@ -158,7 +302,12 @@ func UploadArtifact(ctx *context.Context) {
 		return
 	}
 
-	savePath := path.Join("data/artifacts", task.ArtifactName(ctx.Req.Header.Get("X-LUBAN-FORMAT")))
+	// Tasks created before toolchain was validated may have unsafe artifact names.
+	savePath := task.ArtifactPath(format)
+	if path.Dir(savePath) != path.Clean(task.Project.ArtifactsPath()) {
+		ctx.PlainText(400, []byte("invalid artifact name: "+task.ArtifactName(format)))
+		return
+	}
 	os.MkdirAll(path.Dir(savePath), os.ModePerm)
 
 	fw, err := os.Create(savePath)
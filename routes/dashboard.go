@@ -23,6 +23,7 @@ func Dashboard(ctx *context.Context) {
 	ctx.Data["Title"] = "Dashboard"
 	ctx.Data["PageIsDashboard"] = true
 
+	ctx.Data["NumProjects"] = models.CountProjects()
 	ctx.Data["NumBuilders"] = models.CountBuilders()
 	ctx.Data["NumTasks"] = models.CountTasks()
 
@@ -0,0 +1,224 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package routes
+
+import (
+	"fmt"
+
+	"github.com/lubanstudio/luban/models"
+	"github.com/lubanstudio/luban/pkg/context"
+	"github.com/lubanstudio/luban/pkg/form"
+	"github.com/lubanstudio/luban/pkg/setting"
+)
+
+func Projects(c *context.Context) {
+	c.Data["Title"] = "Projects"
+
+	// Only list projects that current user has access to.
+	projects, err := models.ListAccessibleProjects(c.User, models.ACCESS_MODE_READ)
+	if err != nil {
+		c.Handle(500, "ListAccessibleProjects", err)
+		return
+	}
+	c.Data["Projects"] = projects
+
+	c.HTML(200, "project/list")
+}
+
+func NewProject(c *context.Context) {
+	c.Data["Title"] = "New Project"
+	form.AssignForm(form.Project{
+		DefaultAccess:       int(models.ACCESS_MODE_READ),
+		MinScriptTrustLevel: int(models.TRUST_LEVEL_OFFICIAL),
+	}, c.Data)
+	c.HTML(200, "project/new")
+}
+
+func NewProjectPost(c *context.Context, f form.Project) {
+	c.Data["Title"] = "New Project"
+
+	if c.HasError() {
+		c.HTML(200, "project/new")
+		return
+	}
+
+	project := &models.Project{Name: f.Name}
+	applyProjectForm(project, f)
+	if err := models.NewProject(project); err != nil {
+		if models.IsErrProjectExists(err) {
+			c.Data["Err_Name"] = true
+			c.RenderWithErr("Project name has been used.", "project/new", f)
+		} else if models.IsErrInvalidProjectSetting(err) {
+			renderInvalidProjectSetting(c, err.(models.ErrInvalidProjectSetting), "project/new", f)
+		} else {
+			c.Handle(500, "NewProject", err)
+		}
+		return
+	}
+	c.Audit(models.AUDIT_PROJECT_CREATE, project.AuditTarget(), nil, project)
+
+	c.Redirect(project.Link() + "/settings")
+}
+
+// renderInvalidProjectSetting renders the form with the invalid field highlighted.
+func renderInvalidProjectSetting(c *context.Context, err models.ErrInvalidProjectSetting, tpl string, f form.Project) {
+	switch err.Field {
+	case "clone_url":
+		c.Data["Err_CloneURL"] = true
+	case "pack_root":
+		c.Data["Err_PackRoot"] = true
+	case "pack_formats":
+		c.Data["Err_PackFormats"] = true
+	}
+	c.RenderWithErr(fmt.Sprintf("Fail to save project: %v", err), tpl, f)
+}
+
+func applyProjectForm(project *models.Project, f form.Project) {
+	project.CloneURL = f.CloneURL
+	project.CommitURL = f.CommitURL
+	project.ImportPath = f.ImportPath
+	project.Branches = f.Branches
+	project.PackRoot = f.PackRoot
+	project.PackEntries = f.PackEntries
+	project.PackFormats = f.PackFormats
+	project.AllowedOSs = f.AllowedOSs
+	project.AllowedArchs = f.AllowedArchs
+	project.AllowedTags = f.AllowedTags
+	project.DefaultAccess = models.ParseAccessMode(f.DefaultAccess)
+	if project.DefaultAccess > models.ACCESS_MODE_WRITE {
+		project.DefaultAccess = models.ACCESS_MODE_WRITE
+	}
+	project.MinScriptTrustLevel = models.ParseTrustLevel(f.MinScriptTrustLevel)
+	if project.MinScriptTrustLevel < models.TRUST_LEVEL_APPROVED {
+		project.MinScriptTrustLevel = models.TRUST_LEVEL_APPROVED
+	}
+}
+
+// prepareCollaborators assigns collaborators and webhook information of current project.
+func prepareCollaborators(c *context.Context) {
+	collaborators, err := c.Project.Collaborators()
+	if err != nil {
+		c.Handle(500, "Collaborators", err)
+		return
+	}
+	c.Data["Collaborators"] = collaborators
+
+	c.Data["WebhookEnabled"] = setting.Webhook.Enabled
+	c.Data["WebhookURL"] = setting.Server.ExternalURL + "projects/" + c.Project.Name + "/webhook/"
+}
+
+func ProjectSettings(c *context.Context) {
+	c.Data["Title"] = c.Project.Name + " - Settings"
+	prepareCollaborators(c)
+	if c.Written() {
+		return
+	}
+	c.HTML(200, "project/settings")
+}
+
+func ProjectSettingsPost(c *context.Context, f form.Project) {
+	c.Data["Title"] = c.Project.Name + " - Settings"
+	prepareCollaborators(c)
+	if c.Written() {
+		return
+	}
+
+	if c.HasError() {
+		c.HTML(200, "project/settings")
+		return
+	}
+
+	// Name is used in artifact paths and webhook URLs, so it cannot be changed.
+	if f.Name != c.Project.Name {
+		c.Data["Err_Name"] = true
+		c.RenderWithErr("Project name cannot be changed.", "project/settings", f)
+		return
+	}
+
+	before := *c.Project
+	applyProjectForm(c.Project, f)
+	if err := c.Project.Save(); err != nil {
+		if models.IsErrInvalidProjectSetting(err) {
+			renderInvalidProjectSetting(c, err.(models.ErrInvalidProjectSetting), "project/settings", f)
+		} else {
+			c.Handle(500, "Project.Save", err)
+		}
+		return
+	}
+	c.Audit(models.AUDIT_PROJECT_UPDATE, c.Project.AuditTarget(), before, c.Project)
+
+	c.Flash.Success("Project settings have been updated.")
+	c.Redirect(c.Project.Link() + "/settings")
+}
+
+func RegenerateWebhookSecret(c *context.Context) {
+	if err := c.Project.RegenerateWebhookSecret(); err != nil {
+		c.Handle(500, "RegenerateWebhookSecret", err)
+		return
+	}
+	c.Audit(models.AUDIT_PROJECT_REGENERATE_WEBHOOK_SECRET, c.Project.AuditTarget(), nil, nil)
+
+	c.Flash.Success("Webhook secret has been regenerated, please update it in webhooks of the repository.")
+	c.Redirect(c.Project.Link() + "/settings")
+}
+
+func ProjectCollaboratorPost(c *context.Context, f form.Collaborator) {
+	if c.HasError() {
+		c.Flash.Error(c.Data["ErrorMsg"].(string))
+		c.Redirect(c.Project.Link() + "/settings")
+		return
+	}
+
+	user, err := models.GetUserByName(f.Username)
+	if err != nil {
+		if models.IsErrRecordNotFound(err) {
+			c.Flash.Error(fmt.Sprintf("User '%s' does not exist.", f.Username))
+			c.Redirect(c.Project.Link() + "/settings")
+		} else if models.IsErrUserNameAmbiguous(err) {
+			c.Flash.Error(fmt.Sprintf("More than one user is named '%s', please use \"<source>:<username>\".", f.Username))
+			c.Redirect(c.Project.Link() + "/settings")
+		} else {
+			c.Handle(500, "GetUserByName", err)
+		}
+		return
+	}
+
+	// Values are nil when the user is not a collaborator before or after.
+	var before, after interface{}
+	if old, err := c.Project.GetCollaboration(user.ID); err == nil {
+		before = map[string]string{
+			"user": user.LoginName(),
+			"mode": old.Mode.ToString(),
+		}
+	} else if !models.IsErrRecordNotFound(err) {
+		c.Handle(500, "GetCollaboration", err)
+		return
+	}
+
+	mode := models.ParseAccessMode(f.Mode)
+	if err = c.Project.SetCollaborator(user.ID, mode); err != nil {
+		c.Handle(500, "SetCollaborator", err)
+		return
+	}
+	if mode != models.ACCESS_MODE_NONE {
+		after = map[string]string{
+			"user": user.LoginName(),
+			"mode": mode.ToString(),
+		}
+	}
+	c.Audit(models.AUDIT_PROJECT_SET_COLLABORATOR, c.Project.AuditTarget(), before, after)
+
+	c.Redirect(c.Project.Link() + "/settings")
+}
@@ -0,0 +1,184 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package routes
+
+import (
+	"fmt"
+
+	"github.com/lubanstudio/luban/models"
+	"github.com/lubanstudio/luban/pkg/context"
+	"github.com/lubanstudio/luban/pkg/form"
+)
+
+func Schedules(c *context.Context) {
+	c.Data["Title"] = "Schedules"
+
+	schedules, err := models.ListSchedules()
+	if err != nil {
+		c.Handle(500, "ListSchedules", err)
+		return
+	}
+	c.Data["Schedules"] = schedules
+
+	c.HTML(200, "schedule/list")
+}
+
+// prepareBatchProfiles assigns batch profiles to be selected by schedule.
+func prepareBatchProfiles(c *context.Context) {
+	profiles, err := models.ListBatchProfiles(0)
+	if err != nil {
+		c.Handle(500, "ListBatchProfiles", err)
+		return
+	}
+	c.Data["Profiles"] = profiles
+}
+
+func NewSchedule(c *context.Context) {
+	c.Data["Title"] = "New Schedule"
+	prepareBatchProfiles(c)
+	if c.Written() {
+		return
+	}
+	form.AssignForm(form.Schedule{IsActive: true}, c.Data)
+	c.HTML(200, "schedule/new")
+}
+
+func NewSchedulePost(c *context.Context, f form.Schedule) {
+	c.Data["Title"] = "New Schedule"
+	prepareBatchProfiles(c)
+	if c.Written() {
+		return
+	}
+
+	if c.HasError() {
+		c.HTML(200, "schedule/new")
+		return
+	}
+
+	schedule, err := models.NewSchedule(f.Name, f.Spec, f.ProfileID, f.Ref, f.IsActive)
+	if err != nil {
+		if models.IsErrScheduleExists(err) {
+			c.Data["Err_Name"] = true
+			c.RenderWithErr("Schedule name has been used.", "schedule/new", f)
+		} else if models.IsErrInvalidCronSpec(err) {
+			c.Data["Err_Spec"] = true
+			c.RenderWithErr(err.Error(), "schedule/new", f)
+		} else {
+			c.Handle(500, "NewSchedule", err)
+		}
+		return
+	}
+	c.Audit(models.AUDIT_SCHEDULE_CREATE, schedule.AuditTarget(), nil, schedule)
+
+	c.Redirect(fmt.Sprintf("/schedules/%d/edit", schedule.ID))
+}
+
+func parseScheduleParams(c *context.Context) *models.Schedule {
+	schedule, err := models.GetScheduleByID(c.ParamsInt64(":id"))
+	if err != nil {
+		if models.IsErrRecordNotFound(err) {
+			c.NotFound()
+		} else {
+			c.Handle(500, "GetScheduleByID", err)
+		}
+		return nil
+	}
+	return schedule
+}
+
+func EditSchedule(c *context.Context) {
+	schedule := parseScheduleParams(c)
+	if c.Written() {
+		return
+	}
+	c.Data["Schedule"] = schedule
+	prepareBatchProfiles(c)
+	if c.Written() {
+		return
+	}
+
+	c.Data["Title"] = schedule.Name + " - Schedule"
+	c.HTML(200, "schedule/edit")
+}
+
+func EditSchedulePost(c *context.Context, f form.Schedule) {
+	schedule := parseScheduleParams(c)
+	if c.Written() {
+		return
+	}
+	c.Data["Schedule"] = schedule
+	prepareBatchProfiles(c)
+	if c.Written() {
+		return
+	}
+
+	if c.HasError() {
+		c.HTML(200, "schedule/edit")
+		return
+	}
+
+	before := *schedule
+	schedule.Name = f.Name
+	schedule.Spec = f.Spec
+	schedule.ProfileID = f.ProfileID
+	schedule.Ref = f.Ref
+	schedule.IsActive = f.IsActive
+	if err := schedule.Save(); err != nil {
+		if models.IsErrScheduleExists(err) {
+			c.Data["Err_Name"] = true
+			c.RenderWithErr("Schedule name has been used.", "schedule/edit", f)
+		} else if models.IsErrInvalidCronSpec(err) {
+			c.Data["Err_Spec"] = true
+			c.RenderWithErr(err.Error(), "schedule/edit", f)
+		} else {
+			c.Handle(500, "schedule.Save", err)
+		}
+		return
+	}
+	c.Audit(models.AUDIT_SCHEDULE_UPDATE, schedule.AuditTarget(), before, schedule)
+
+	c.Redirect(fmt.Sprintf("/schedules/%d/edit", schedule.ID))
+}
+
+func RunSchedule(c *context.Context) {
+	schedule := parseScheduleParams(c)
+	if c.Written() {
+		return
+	}
+
+	err := schedule.Run()
+	if err != nil {
+		c.Flash.Error("Run: " + err.Error())
+		c.Audit(models.AUDIT_SCHEDULE_RUN, schedule.AuditTarget(), nil, map[string]string{"error": err.Error()})
+	} else {
+		c.Audit(models.AUDIT_SCHEDULE_RUN, schedule.AuditTarget(), nil, nil)
+	}
+	c.Redirect("/schedules")
+}
+
+func DeleteSchedule(c *context.Context) {
+	schedule := parseScheduleParams(c)
+	if c.Written() {
+		return
+	}
+
+	if err := models.DeleteScheduleByID(schedule.ID); err != nil {
+		c.Handle(500, "DeleteScheduleByID", err)
+		return
+	}
+	c.Audit(models.AUDIT_SCHEDULE_DELETE, schedule.AuditTarget(), schedule, nil)
+
+	c.Redirect("/schedules")
+}
@@ -0,0 +1,89 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package routes
+
+import (
+	"github.com/lubanstudio/luban/models"
+	"github.com/lubanstudio/luban/pkg/context"
+	"github.com/lubanstudio/luban/pkg/form"
+)
+
+func Secrets(c *context.Context) {
+	c.Data["Title"] = c.Project.Name + " - Secrets"
+
+	secrets, err := models.ListSecrets(c.Project.ID)
+	if err != nil {
+		c.Handle(500, "ListSecrets", err)
+		return
+	}
+	c.Data["Secrets"] = secrets
+
+	c.HTML(200, "project/secrets")
+}
+
+func SetSecretPost(c *context.Context, f form.Secret) {
+	if c.HasError() {
+		c.Flash.Error(c.Data["ErrorMsg"].(string))
+		c.Redirect(c.Project.Link() + "/secrets")
+		return
+	}
+
+	// Value of the secret is never recorded, only its trust level and times.
+	var before interface{}
+	if old, err := models.GetSecretByName(c.Project.ID, f.Name); err == nil {
+		before = old
+	} else if !models.IsErrRecordNotFound(err) {
+		c.Handle(500, "GetSecretByName", err)
+		return
+	}
+
+	secret, err := models.SetSecret(c.Project.ID, f.Name, f.Value, models.ParseTrustLevel(f.MinTrustLevel))
+	if err != nil {
+		if models.IsErrInvalidSecretName(err) {
+			c.Flash.Error("Secret name must only contain upper case letters, digits and underscores.")
+			c.Redirect(c.Project.Link() + "/secrets")
+		} else {
+			c.Handle(500, "SetSecret", err)
+		}
+		return
+	}
+	c.Audit(models.AUDIT_SECRET_SET, secret.AuditTarget(), before, secret)
+
+	c.Flash.Success("Secret has been saved.")
+	c.Redirect(c.Project.Link() + "/secrets")
+}
+
+func DeleteSecret(c *context.Context) {
+	secret, err := models.GetSecretByID(c.ParamsInt64(":id"))
+	if err != nil {
+		if models.IsErrRecordNotFound(err) {
+			c.NotFound()
+		} else {
+			c.Handle(500, "GetSecretByID", err)
+		}
+		return
+	} else if secret.ProjectID != c.Project.ID {
+		c.NotFound()
+		return
+	}
+
+	if err = models.DeleteSecretByID(secret.ID); err != nil {
+		c.Handle(500, "DeleteSecretByID", err)
+		return
+	}
+	c.Audit(models.AUDIT_SECRET_DELETE, secret.AuditTarget(), secret, nil)
+
+	c.Redirect(c.Project.Link() + "/secrets")
+}
@@ -16,17 +16,20 @@ package routes
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
 
 	"github.com/lubanstudio/luban/models"
 	"github.com/lubanstudio/luban/pkg/context"
 	"github.com/lubanstudio/luban/pkg/form"
-	"github.com/lubanstudio/luban/pkg/setting"
 )
 
 func Tasks(c *context.Context) {
 	c.Data["Title"] = "Tasks"
 
-	tasks, err := models.ListTasks(1, 30)
+	tasks, err := models.ListTasks(c.Project.ID, 1, 30)
 	if err != nil {
 		c.Handle(500, "ListTasks", err)
 		return
@@ -50,46 +53,244 @@ func NewTaskPost(c *context.Context, form form.NewTask) {
 		return
 	}
 
-	task, err := models.NewTask(c.User.ID, form.OS, form.Arch, form.Tags, form.Branch)
+	tc := models.Toolchain{
+		GoVersion: form.GoVersion,
+		CC:        form.CC,
+		Libc:      form.Libc,
+	}
+	task, err := models.NewTask(c.User.ID, c.Project, form.OS, form.Arch, form.Tags, form.TagExpr, tc, form.Ref, models.BuildOptions{
+		BuildFlags: form.BuildFlags,
+		LDFlags:    form.LDFlags,
+	})
 	if err != nil {
 		if models.IsErrNoSuitableMatrix(err) {
 			c.Data["Err_OS"] = true
 			c.Data["Err_Arch"] = true
 			c.Data["Err_Tags"] = true
 			c.RenderWithErr(fmt.Sprintf("Fail to create task: %v", err), "task/new", form)
+		} else if models.IsErrRefNotExist(err) {
+			c.Data["Err_Ref"] = true
+			c.RenderWithErr(fmt.Sprintf("Fail to create task: %v", err), "task/new", form)
+		} else if models.IsErrInvalidTag(err) {
+			c.Data["Err_Tags"] = true
+			c.RenderWithErr(fmt.Sprintf("Fail to create task: %v", err), "task/new", form)
+		} else if models.IsErrInvalidTagExpr(err) {
+			c.Data["Err_TagExpr"] = true
+			c.RenderWithErr(fmt.Sprintf("Fail to create task: %v", err), "task/new", form)
+		} else if models.IsErrInvalidGoVersion(err) {
+			c.Data["Err_GoVersion"] = true
+			c.RenderWithErr(fmt.Sprintf("Fail to create task: %v", err), "task/new", form)
+		} else if models.IsErrInvalidToolchain(err) {
+			if err.(models.ErrInvalidToolchain).Name == "cc" {
+				c.Data["Err_CC"] = true
+			} else {
+				c.Data["Err_Libc"] = true
+			}
+			c.RenderWithErr(fmt.Sprintf("Fail to create task: %v", err), "task/new", form)
+		} else if models.IsErrProfileOnlyOption(err) {
+			c.Data["Err_BuildFlags"] = true
+			c.Data["Err_LDFlags"] = true
+			c.RenderWithErr(fmt.Sprintf("Fail to create task: %v", err), "task/new", form)
 		} else {
 			c.Handle(500, "NewTask", err)
 		}
 		return
 	}
+	c.Audit(models.AUDIT_TASK_CREATE, task.AuditTarget(), nil, task)
 
-	c.Redirect(fmt.Sprintf("/tasks/%d", task.ID))
+	c.Redirect(task.Link())
+}
+
+// PreviewTaskBuilders responses builders that are able to take the task
+// described by query parameters, without creating it.
+func PreviewTaskBuilders(c *context.Context) {
+	tags := c.QueryStrings("tags")
+	constraint, err := models.ParseTagConstraint(tags, c.Query("tag_expr"))
+	if err != nil {
+		c.JSON(200, map[string]interface{}{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	tc := models.Toolchain{
+		GoVersion: c.Query("go_version"),
+		CC:        c.Query("cc"),
+		Libc:      c.Query("libc"),
+	}
+	if err = tc.Validate(); err != nil {
+		c.JSON(200, map[string]interface{}{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	builderIDs, err := models.MatchBuilders(c.Query("os"), c.Query("arch"), constraint, tc)
+	if err != nil && !models.IsErrNoSuitableMatrix(err) {
+		c.Error("MatchBuilders: %v", err)
+		return
+	}
+	builders, err := models.GetBuildersByIDs(builderIDs)
+	if err != nil {
+		c.Error("GetBuildersByIDs: %v", err)
+		return
+	}
+
+	results := make([]map[string]interface{}, len(builders))
+	for i, b := range builders {
+		results[i] = map[string]interface{}{
+			"id":          b.ID,
+			"name":        b.Name,
+			"status":      b.Status(),
+			"trust_level": b.TrustLevel.ToString(),
+		}
+	}
+	c.JSON(200, map[string]interface{}{
+		"constraint": constraint.String(),
+		"builders":   results,
+	})
 }
 
 func NewBatchTasks(c *context.Context) {
 	c.Data["Title"] = "New Batch Tasks"
-	c.Data["branch"] = "master"
+
+	profiles, err := models.ListBatchProfiles(c.Project.ID)
+	if err != nil {
+		c.Handle(500, "ListBatchProfiles", err)
+		return
+	}
+	c.Data["Profiles"] = profiles
+	form.AssignForm(form.NewBatchTasks{}, c.Data)
+
 	c.HTML(200, "task/new_batch")
 }
 
-func NewBatchTasksPost(c *context.Context) {
-	if err := models.NewBatchTasks(c.User.ID, c.Query("branch")); err != nil {
-		c.Flash.Error("NewBatchTasks: " + err.Error())
+func NewBatchTasksPost(c *context.Context, f form.NewBatchTasks) {
+	c.Data["Title"] = "New Batch Tasks"
+
+	profiles, err := models.ListBatchProfiles(c.Project.ID)
+	if err != nil {
+		c.Handle(500, "ListBatchProfiles", err)
+		return
+	}
+	c.Data["Profiles"] = profiles
+
+	if c.HasError() {
+		c.HTML(200, "task/new_batch")
+		return
+	}
+
+	profile, err := models.GetBatchProfileByID(f.ProfileID)
+	if err != nil && !models.IsErrRecordNotFound(err) {
+		c.Handle(500, "GetBatchProfileByID", err)
+		return
+	} else if err != nil || profile.ProjectID != c.Project.ID {
+		c.Data["Err_ProfileID"] = true
+		c.RenderWithErr("Batch profile does not exist.", "task/new_batch", f)
+		return
 	}
-	c.Redirect("/tasks")
+
+	result, err := models.NewBatchTasks(c.User.ID, profile, f.Ref)
+	if err != nil {
+		if models.IsErrRefNotExist(err) {
+			c.Data["Err_Ref"] = true
+			c.RenderWithErr(fmt.Sprintf("Fail to create batch tasks: %v", err), "task/new_batch", f)
+		} else {
+			c.Handle(500, "NewBatchTasks", err)
+		}
+		return
+	}
+	c.Audit(models.AUDIT_BATCH_PROFILE_RUN, profile.AuditTarget(), nil, batchAuditValue(result))
+	c.Data["Result"] = result
+
+	c.HTML(200, "task/batch_result")
 }
 
 func ViewTask(c *context.Context) {
 	c.Data["Title"] = c.Task.ID
-	c.Data["PackFormats"] = setting.Project.PackFormats
+	c.Data["PackFormats"] = c.Project.PackFormatList()
 	c.HTML(200, "task/view")
 }
 
+func ViewTaskBuildLog(c *context.Context) {
+	data, err := ioutil.ReadFile(c.Task.BuildLogPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			c.NotFound()
+		} else {
+			c.Handle(500, "ReadFile", err)
+		}
+		return
+	}
+	c.Data["BuildLog"] = string(data)
+
+	c.Data["Title"] = fmt.Sprintf("%d - Build Log", c.Task.ID)
+	c.HTML(200, "task/log")
+}
+
 func ArchiveTask(c *context.Context) {
+	before := taskStatusAuditValue(c.Task)
 	if err := c.Task.Archive(); err != nil {
 		c.RenderWithErr(fmt.Sprintf("Fail to archive task: %v", err), "task/view", nil)
 		return
 	}
+	c.Audit(models.AUDIT_TASK_ARCHIVE, c.Task.AuditTarget(), before, taskStatusAuditValue(c.Task))
+
+	c.Redirect(c.Task.Link())
+}
 
-	c.Redirect(fmt.Sprintf("/tasks/%d", c.Task.ID))
+func CancelTask(c *context.Context) {
+	before := taskStatusAuditValue(c.Task)
+	if err := c.Task.Cancel(); err != nil {
+		if models.IsErrInvalidTaskStatus(err) {
+			c.Flash.Error(err.Error())
+		} else {
+			c.Handle(500, "Cancel", err)
+			return
+		}
+	} else {
+		c.Audit(models.AUDIT_TASK_CANCEL, c.Task.AuditTarget(), before, taskStatusAuditValue(c.Task))
+		c.Flash.Success("Task has been canceled.")
+	}
+
+	c.Redirect(c.Task.Link())
+}
+
+// taskStatusAuditValue returns status of the task to be recorded in audit log.
+func taskStatusAuditValue(t *models.Task) map[string]string {
+	return map[string]string{"status": t.Status.ToString()}
+}
+
+// RedirectTask redirects links of tasks before projects were introduced.
+func RedirectTask(c *context.Context) {
+	task, err := models.GetTaskByID(c.ParamsInt64(":id"))
+	if err != nil {
+		if models.IsErrRecordNotFound(err) {
+			c.NotFound()
+		} else {
+			c.Handle(500, "GetTaskByID", err)
+		}
+		return
+	}
+
+	// Do not reveal existence of tasks in projects without read access.
+	mode, err := task.Project.UserAccessMode(c.User)
+	if err != nil {
+		c.Handle(500, "UserAccessMode", err)
+		return
+	} else if mode < models.ACCESS_MODE_READ {
+		c.NotFound()
+		return
+	}
+	c.Redirect(task.Link())
+}
+
+// DownloadArtifact serves an artifact of current project.
+func DownloadArtifact(c *context.Context) {
+	name := c.Params(":name")
+	if name != path.Base(name) || name == "." || name == ".." {
+		c.NotFound()
+		return
+	}
+	http.ServeFile(c.Resp, c.Req.Request, path.Join(c.Project.ArtifactsPath(), name))
 }
@@ -0,0 +1,276 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package routes
+
+import (
+	"fmt"
+	"strings"
+
+	log "gopkg.in/clog.v1"
+
+	"github.com/lubanstudio/luban/models"
+	"github.com/lubanstudio/luban/pkg/auth"
+	"github.com/lubanstudio/luban/pkg/context"
+	"github.com/lubanstudio/luban/pkg/form"
+	"github.com/lubanstudio/luban/pkg/tool"
+)
+
+const (
+	SESSION_KEY_OAUTH_STATE      = "oauth_state"
+	SESSION_KEY_OAUTH_NONCE      = "oauth_nonce"
+	SESSION_KEY_NEW_ACCESS_TOKEN = "new_access_token"
+)
+
+func prepareLogin(c *context.Context) {
+	c.Data["Title"] = "Sign In"
+	c.Data["Providers"] = auth.Providers()
+	c.Data["EnableLocal"] = auth.GetPasswordProvider() != nil
+	// The first local user is created on sign in page and becomes admin.
+	c.Data["NeedSetup"] = auth.GetPasswordProvider() != nil && models.Count(new(models.User)) == 0
+}
+
+func Login(c *context.Context) {
+	if c.User != nil {
+		c.Redirect("/")
+		return
+	}
+
+	prepareLogin(c)
+	c.HTML(200, "user/login")
+}
+
+// auditSignInFailed records a failed sign in, which is rate limited per user and IP.
+func auditSignInFailed(c *context.Context, target models.AuditTarget, reason string) {
+	if err := models.NewSignInFailedAuditLog(c.RemoteIP(), target, reason); err != nil {
+		log.Error(2, "NewSignInFailedAuditLog: %v", err)
+	}
+}
+
+// signIn saves signed in user to session and redirects to the page
+// before signing in.
+func signIn(c *context.Context, source string, identity *auth.Identity) {
+	user, isNew, err := models.GetOrCreateUserByIdentity(source, identity)
+	if err != nil {
+		c.Handle(500, "GetOrCreateUserByIdentity", err)
+		return
+	} else if user.ProhibitLogin {
+		auditSignInFailed(c, user.AuditTarget(), "prohibited")
+		prepareLogin(c)
+		c.RenderWithErr("Your account is prohibited to sign in, please contact the site admin.", "user/login", nil)
+		return
+	}
+	if isNew {
+		log.Info("New user authenticated: %s [source: %s]", user.Username, source)
+	} else {
+		log.Trace("Authenticated user: %s [source: %s]", user.Username, source)
+	}
+
+	// Issue a new session ID and CSRF token to prevent session fixation,
+	// other data of the old session (e.g. redirect to) is kept.
+	if _, err = c.Session.RegenerateId(c.Context); err != nil {
+		c.Handle(500, "RegenerateId", err)
+		return
+	}
+	c.Session.Delete(context.SESSION_KEY_CSRF_TOKEN)
+	c.Session.Set(context.SESSION_KEY_UID, user.ID)
+	c.Session.Set(context.SESSION_KEY_SESSION_VERSION, user.SessionVersion)
+	c.User = user
+	c.Audit(models.AUDIT_USER_SIGN_IN, user.AuditTarget(), nil, map[string]string{"source": source})
+
+	redirectTo, _ := c.Session.Get(context.SESSION_KEY_REDIRECT_TO).(string)
+	c.Session.Delete(context.SESSION_KEY_REDIRECT_TO)
+	// Only redirect within the site.
+	if !strings.HasPrefix(redirectTo, "/") || strings.HasPrefix(redirectTo, "//") {
+		redirectTo = "/"
+	}
+	c.Redirect(redirectTo)
+}
+
+func LoginPost(c *context.Context, f form.SignIn) {
+	prepareLogin(c)
+
+	provider := auth.GetPasswordProvider()
+	if provider == nil {
+		c.NotFound()
+		return
+	}
+
+	if c.HasError() {
+		c.HTML(200, "user/login")
+		return
+	}
+
+	if c.Data["NeedSetup"].(bool) {
+		if _, err := models.CreateLocalUser(f.Username, "", f.Password, models.ROLE_ADMIN); err != nil {
+			c.Handle(500, "CreateLocalUser", err)
+			return
+		}
+		log.Info("First local user created: %s", f.Username)
+	}
+
+	identity, err := provider.Authenticate(f.Username, f.Password)
+	if err != nil {
+		if err == auth.ErrInvalidCredentials {
+			auditSignInFailed(c, models.AuditTarget{Type: "user", Name: provider.Name() + ":" + f.Username}, "invalid credentials")
+			c.Data["Err_Username"] = true
+			c.Data["Err_Password"] = true
+			c.RenderWithErr("Username or password is not correct.", "user/login", f)
+		} else {
+			c.Handle(500, "Authenticate", err)
+		}
+		return
+	}
+	signIn(c, provider.Name(), identity)
+}
+
+func parseProviderParams(c *context.Context) auth.Provider {
+	provider := auth.GetProvider(c.Params(":provider"))
+	if provider == nil {
+		c.NotFound()
+	}
+	return provider
+}
+
+// OAuthLogin redirects user to authorization page of the provider.
+func OAuthLogin(c *context.Context) {
+	provider := parseProviderParams(c)
+	if c.Written() {
+		return
+	}
+
+	state := tool.NewSecretToekn()
+	nonce := tool.NewSecretToekn()
+	authURL, err := provider.AuthCodeURL(c.Req.Context(), state, nonce)
+	if err != nil {
+		c.Handle(500, "AuthCodeURL", err)
+		return
+	}
+	c.Session.Set(SESSION_KEY_OAUTH_STATE, state)
+	c.Session.Set(SESSION_KEY_OAUTH_NONCE, nonce)
+	c.Redirect(authURL)
+}
+
+// OAuthCallback signs in user with the authorization code returned by the provider.
+func OAuthCallback(c *context.Context) {
+	provider := parseProviderParams(c)
+	if c.Written() {
+		return
+	}
+
+	state, _ := c.Session.Get(SESSION_KEY_OAUTH_STATE).(string)
+	nonce, _ := c.Session.Get(SESSION_KEY_OAUTH_NONCE).(string)
+	c.Session.Delete(SESSION_KEY_OAUTH_STATE)
+	c.Session.Delete(SESSION_KEY_OAUTH_NONCE)
+	if len(state) == 0 || state != c.Query("state") {
+		prepareLogin(c)
+		c.RenderWithErr("Sign in request has expired, please try again.", "user/login", nil)
+		return
+	} else if len(c.Query("error")) > 0 {
+		prepareLogin(c)
+		c.RenderWithErr(fmt.Sprintf("%s denied the sign in: %s", provider.DisplayName(), c.Query("error")), "user/login", nil)
+		return
+	}
+
+	identity, err := provider.Exchange(c.Req.Context(), c.Query("code"), nonce)
+	if err == auth.ErrNotAllowed {
+		prepareLogin(c)
+		c.RenderWithErr(fmt.Sprintf("Your %s account is not allowed to sign in.", provider.DisplayName()), "user/login", nil)
+		return
+	} else if err != nil {
+		log.Error(2, "Fail to sign in with %s: %v", provider.Name(), err)
+		prepareLogin(c)
+		c.RenderWithErr(fmt.Sprintf("Fail to sign in with %s, please try again.", provider.DisplayName()), "user/login", nil)
+		return
+	}
+	signIn(c, provider.Name(), identity)
+}
+
+// Logout signs out current user and revokes token of login source.
+func Logout(c *context.Context) {
+	if c.User != nil {
+		if err := c.User.RevokeOAuthToken(); err != nil {
+			log.Error(2, "RevokeOAuthToken [%d]: %v", c.User.ID, err)
+		}
+		c.Audit(models.AUDIT_USER_SIGN_OUT, c.User.AuditTarget(), nil, nil)
+	}
+	c.Session.Delete(context.SESSION_KEY_UID)
+	c.Session.Delete(context.SESSION_KEY_SESSION_VERSION)
+	c.Session.Delete(context.SESSION_KEY_CSRF_TOKEN)
+	c.Redirect("/login")
+}
+
+// AccessTokens lists personal access tokens of current user, a newly created
+// token is shown once.
+func AccessTokens(c *context.Context) {
+	c.Data["Title"] = "Access Tokens"
+
+	tokens, err := models.ListAccessTokens(c.User.ID)
+	if err != nil {
+		c.Handle(500, "ListAccessTokens", err)
+		return
+	}
+	c.Data["Tokens"] = tokens
+
+	if token, ok := c.Session.Get(SESSION_KEY_NEW_ACCESS_TOKEN).(string); ok {
+		c.Data["NewToken"] = token
+		c.Session.Delete(SESSION_KEY_NEW_ACCESS_TOKEN)
+	}
+
+	c.HTML(200, "user/tokens")
+}
+
+func NewAccessTokenPost(c *context.Context, f form.AccessToken) {
+	if c.HasError() {
+		c.Flash.Error(c.Data["ErrorMsg"].(string))
+		c.Redirect("/user/settings/tokens")
+		return
+	}
+
+	t, token, err := models.NewAccessToken(c.User.ID, f.Name)
+	if err != nil {
+		if models.IsErrAccessTokenExists(err) {
+			c.Flash.Error("Token name has been used.")
+		} else {
+			c.Handle(500, "NewAccessToken", err)
+			return
+		}
+	} else {
+		c.Audit(models.AUDIT_ACCESS_TOKEN_CREATE, t.AuditTarget(), nil, t)
+		c.Session.Set(SESSION_KEY_NEW_ACCESS_TOKEN, token)
+	}
+
+	c.Redirect("/user/settings/tokens")
+}
+
+func DeleteAccessToken(c *context.Context) {
+	t, err := models.GetAccessTokenByID(c.User.ID, c.ParamsInt64(":id"))
+	if err != nil {
+		if models.IsErrRecordNotFound(err) {
+			c.NotFound()
+		} else {
+			c.Handle(500, "GetAccessTokenByID", err)
+		}
+		return
+	}
+
+	if err = models.DeleteAccessToken(c.User.ID, t.ID); err != nil {
+		c.Handle(500, "DeleteAccessToken", err)
+		return
+	}
+	c.Audit(models.AUDIT_ACCESS_TOKEN_DELETE, t.AuditTarget(), t, nil)
+
+	c.Flash.Success("Access token has been revoked.")
+	c.Redirect("/user/settings/tokens")
+}
@@ -0,0 +1,93 @@
+// Copyright 2017 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package routes
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	log "gopkg.in/clog.v1"
+
+	"github.com/lubanstudio/luban/models"
+	"github.com/lubanstudio/luban/pkg/context"
+	"github.com/lubanstudio/luban/pkg/webhook"
+)
+
+// WEBHOOK_MAX_PAYLOAD_SIZE is the maximum size of webhook payloads,
+// which is the same limit as GitHub.
+const WEBHOOK_MAX_PAYLOAD_SIZE = 25 << 20
+
+func Webhook(ctx *context.Context) {
+	project, err := models.GetProjectByName(ctx.Params(":project"))
+	if err != nil {
+		if models.IsErrRecordNotFound(err) {
+			ctx.Status(404)
+		} else {
+			ctx.Error("GetProjectByName: %v", err)
+		}
+		return
+	}
+
+	if ctx.Req.ContentLength > WEBHOOK_MAX_PAYLOAD_SIZE {
+		ctx.Status(413)
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(ctx.Resp, ctx.Req.Request.Body, WEBHOOK_MAX_PAYLOAD_SIZE))
+	if err != nil {
+		ctx.PlainText(400, []byte(err.Error()))
+		return
+	}
+
+	event, err := webhook.Parse(webhook.Kind(ctx.Params(":kind")), ctx.Req.Header, data, project.WebhookSecret)
+	if err != nil {
+		switch err {
+		case webhook.ErrUnsupportedKind:
+			ctx.Status(404)
+		case webhook.ErrInvalidSignature:
+			ctx.Status(403)
+		default:
+			ctx.PlainText(400, []byte(err.Error()))
+		}
+		return
+	}
+
+	if event == nil || event.Deleted {
+		ctx.Status(204)
+		return
+	}
+
+	profiles, err := models.ListBatchProfiles(project.ID)
+	if err != nil {
+		ctx.Error("ListBatchProfiles: %v", err)
+		return
+	}
+
+	for _, profile := range profiles {
+		if !profile.MatchWebhookRef(event.Ref) {
+			continue
+		}
+
+		result, err := models.NewBatchTasksOfCommit(0, profile, event.Ref, event.Commit)
+		if err != nil {
+			ctx.Error("NewBatchTasksOfCommit [%s]: %v", profile.Name, err)
+			return
+		}
+		ctx.Audit(models.AUDIT_BATCH_PROFILE_RUN, profile.AuditTarget(), nil, batchAuditValue(result))
+		log.Trace("Webhook for '%s' at %s created %d tasks of profile '%s/%s' (skipped: %d, rejected: %d)",
+			event.Ref, event.Commit, len(result.Created), project.Name, profile.Name, len(result.Skipped), len(result.Rejected))
+	}
+
+	ctx.Status(204)
+}